@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrInvalidAddress is returned when an address fails validation
+var ErrInvalidAddress = errors.New("invalid address")
+
+// errValidatorUnavailable marks provider failures that say nothing about the
+// address itself
+var errValidatorUnavailable = errors.New("address validator unavailable")
+
+// Address validation failure reasons
+const (
+	addressReasonMissing = "missing"
+	addressReasonFormat  = "format"
+	addressReasonUnknown = "unknown" // rejected by an external provider
+)
+
+// AddressValidationError reports the address field that failed validation
+type AddressValidationError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *AddressValidationError) Error() string {
+	return fmt.Sprintf("%s: %s is %s", ErrInvalidAddress, e.Field, e.Reason)
+}
+
+func (e *AddressValidationError) Unwrap() error { return ErrInvalidAddress }
+
+// addressField returns the failing field of an address validation error
+func addressField(err error) string {
+	var invalid *AddressValidationError
+	if errors.As(err, &invalid) {
+		return invalid.Field
+	}
+	return "address"
+}
+
+// AddressValidator checks an address and returns its normalized form
+type AddressValidator interface {
+	Name() string
+	Validate(ctx context.Context, address Address) (Address, error)
+}
+
+// postalRule describes the postal code format of a country
+type postalRule struct {
+	pattern *regexp.Regexp
+	format  func(code string) string // canonical spacing, applied after matching
+}
+
+// postalRules are the countries whose postal codes are checked. Codes are
+// upper-cased before matching; other countries accept any postal code.
+var postalRules = map[string]postalRule{
+	"US": {pattern: regexp.MustCompile(`^\d{5}(-\d{4})?$`)},
+	"CA": {pattern: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), format: spaceAt(3)},
+	"GB": {pattern: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), format: spaceBeforeLast(3)},
+	"NL": {pattern: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`), format: spaceAt(4)},
+	"JP": {pattern: regexp.MustCompile(`^\d{3}-?\d{4}$`), format: dashAt(3)},
+	"DE": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"ES": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"IT": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"AU": {pattern: regexp.MustCompile(`^\d{4}$`)},
+}
+
+// spaceAt inserts a space after the first n characters of a compact code
+func spaceAt(n int) func(string) string {
+	return func(code string) string {
+		code = strings.ReplaceAll(code, " ", "")
+		return code[:n] + " " + code[n:]
+	}
+}
+
+// spaceBeforeLast inserts a space before the last n characters
+func spaceBeforeLast(n int) func(string) string {
+	return func(code string) string {
+		code = strings.ReplaceAll(code, " ", "")
+		return code[:len(code)-n] + " " + code[len(code)-n:]
+	}
+}
+
+// dashAt inserts a dash after the first n characters of a compact code
+func dashAt(n int) func(string) string {
+	return func(code string) string {
+		code = strings.ReplaceAll(code, "-", "")
+		return code[:n] + "-" + code[n:]
+	}
+}
+
+// collapseSpace trims s and collapses internal runs of whitespace
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// rulesAddressValidator checks required fields and per-country postal code
+// formats locally
+type rulesAddressValidator struct{}
+
+func (rulesAddressValidator) Name() string { return "rules" }
+
+func (rulesAddressValidator) Validate(_ context.Context, address Address) (Address, error) {
+	address.Label = collapseSpace(address.Label)
+	address.Recipient = collapseSpace(address.Recipient)
+	address.Line1 = collapseSpace(address.Line1)
+	address.Line2 = collapseSpace(address.Line2)
+	address.City = collapseSpace(address.City)
+	address.PostalCode = strings.ToUpper(collapseSpace(address.PostalCode))
+	address.Country = strings.ToUpper(strings.TrimSpace(address.Country))
+
+	switch {
+	case address.Country == "":
+		return address, &AddressValidationError{Field: "country", Reason: addressReasonMissing}
+	case !validRegion(address.Country):
+		return address, &AddressValidationError{Field: "country", Reason: addressReasonFormat}
+	case address.Line1 == "":
+		return address, &AddressValidationError{Field: "line1", Reason: addressReasonMissing}
+	case address.City == "":
+		return address, &AddressValidationError{Field: "city", Reason: addressReasonMissing}
+	}
+
+	rule, checked := postalRules[address.Country]
+	if !checked {
+		return address, nil
+	}
+	if address.PostalCode == "" {
+		return address, &AddressValidationError{Field: "postal_code", Reason: addressReasonMissing}
+	}
+	if !rule.pattern.MatchString(address.PostalCode) {
+		return address, &AddressValidationError{Field: "postal_code", Reason: addressReasonFormat}
+	}
+	if rule.format != nil {
+		address.PostalCode = rule.format(address.PostalCode)
+	}
+	return address, nil
+}
+
+// httpAddressValidator delegates validation to an external provider. The
+// provider receives the address as JSON and answers with
+// {"valid": bool, "address": {...}, "field": "...", "reason": "..."}.
+type httpAddressValidator struct {
+	url    string
+	client *http.Client
+}
+
+func (hv *httpAddressValidator) Name() string { return "http" }
+
+func (hv *httpAddressValidator) Validate(ctx context.Context, address Address) (Address, error) {
+	body, err := json.Marshal(address)
+	if err != nil {
+		return address, fmt.Errorf("failed to encode address: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hv.url, bytes.NewReader(body))
+	if err != nil {
+		return address, fmt.Errorf("%w: %v", errValidatorUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := hv.client.Do(req)
+	if err != nil {
+		return address, fmt.Errorf("%w: %v", errValidatorUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return address, fmt.Errorf("%w: provider returned status %d", errValidatorUnavailable, resp.StatusCode)
+	}
+
+	var result struct {
+		Valid   bool     `json:"valid"`
+		Address *Address `json:"address"`
+		Field   string   `json:"field"`
+		Reason  string   `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return address, fmt.Errorf("%w: invalid provider response: %v", errValidatorUnavailable, err)
+	}
+
+	if !result.Valid {
+		if result.Field == "" {
+			result.Field = "address"
+		}
+		if result.Reason == "" {
+			result.Reason = addressReasonUnknown
+		}
+		return address, &AddressValidationError{Field: result.Field, Reason: result.Reason}
+	}
+	if result.Address != nil {
+		// The provider may not echo our identifiers
+		normalized := *result.Address
+		normalized.ID, normalized.Label = address.ID, address.Label
+		address = normalized
+	}
+	return address, nil
+}
+
+// AddressValidation runs the local rules and then, when configured, an
+// external provider, counting outcomes. Provider outages fall back to the
+// rules result so checkout keeps working.
+type AddressValidation struct {
+	validators []AddressValidator
+	tracer     trace.Tracer
+
+	// OpenTelemetry Metrics
+	validationCounter metric.Int64Counter // Counter: validations by validator and result
+	failureCounter    metric.Int64Counter // Counter: rejected addresses by country, field and reason
+}
+
+// NewAddressValidation creates the validation chain. providerURL, when set,
+// adds an external provider after the built-in country rules.
+func NewAddressValidation(providerURL string) (*AddressValidation, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	av := &AddressValidation{
+		validators: []AddressValidator{rulesAddressValidator{}},
+		tracer:     otel.Tracer("shopping-cart-service"),
+	}
+	if providerURL != "" {
+		av.validators = append(av.validators, &httpAddressValidator{
+			url: providerURL,
+			client: &http.Client{
+				Timeout:   3 * time.Second,
+				Transport: otelhttp.NewTransport(&requestIDTransport{next: outboundPools.transport("address_validation")}),
+			},
+		})
+	}
+
+	var err error
+	av.validationCounter, err = meter.Int64Counter(
+		"address_validations_total",
+		metric.WithDescription("Total number of address validations by validator and result (valid, invalid, unavailable)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create address validation counter: %w", err)
+	}
+
+	av.failureCounter, err = meter.Int64Counter(
+		"address_validation_failures_total",
+		metric.WithDescription("Total number of rejected addresses by country, field and reason"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create address validation failure counter: %w", err)
+	}
+
+	return av, nil
+}
+
+// Validate returns the normalized address, or an *AddressValidationError
+// naming the first field that failed
+func (av *AddressValidation) Validate(ctx context.Context, address Address) (normalized Address, err error) {
+	ctx, span := av.tracer.Start(ctx, "address.validate",
+		trace.WithAttributes(attribute.String("address.country", address.Country)),
+	)
+	defer func() { endSpan(span, err) }()
+
+	normalized = address
+	for _, validator := range av.validators {
+		result, err := validator.Validate(ctx, normalized)
+
+		var invalid *AddressValidationError
+		switch {
+		case errors.As(err, &invalid):
+			country := result.Country
+			if !validRegion(country) {
+				country = "unknown"
+			}
+			av.record(ctx, validator.Name(), "invalid")
+			av.failureCounter.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("country", country),
+				attribute.String("field", invalid.Field),
+				attribute.String("reason", invalid.Reason),
+			))
+			return result, err
+		case err != nil:
+			av.record(ctx, validator.Name(), "unavailable")
+			slog.WarnContext(ctx, "Address validator failed, keeping previous result", "validator", validator.Name(), "error", err)
+			continue
+		}
+
+		av.record(ctx, validator.Name(), "valid")
+		normalized = result
+	}
+	return normalized, nil
+}
+
+// record counts a validation outcome
+func (av *AddressValidation) record(ctx context.Context, validator, result string) {
+	av.validationCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("validator", validator),
+		attribute.String("result", result),
+	))
+}
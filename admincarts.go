@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes for /admin/carts
+const (
+	defaultCartPageSize = 50
+	maxCartPageSize     = 500
+)
+
+// CartOverview is a cart as operators see it, with its totals and the time
+// of its last item change
+type CartOverview struct {
+	UserID    string     `json:"user_id"`
+	Items     []CartItem `json:"items"`
+	ItemCount int        `json:"item_count"` // units across all lines
+	Value     float64    `json:"value"`      // list-price value of those units
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Locked    bool       `json:"locked"` // held read-only by a checkout
+}
+
+// newCartOverview summarizes cart at now
+func newCartOverview(cart *Cart, now time.Time) CartOverview {
+	overview := CartOverview{UserID: cart.UserID, Items: cart.Items, Locked: cart.lockedAt(now)}
+	for _, item := range cart.Items {
+		overview.ItemCount += item.Quantity
+		overview.Value += item.Price * float64(item.Quantity)
+	}
+	if !cart.updatedAt.IsZero() {
+		updatedAt := cart.updatedAt.UTC()
+		overview.UpdatedAt = &updatedAt
+	}
+	return overview
+}
+
+// cartFilter selects carts for /admin/carts
+type cartFilter struct {
+	userPrefix    string
+	minItems      int
+	updatedAfter  time.Time // zero for no bound
+	updatedBefore time.Time // zero for no bound
+}
+
+// matches reports whether the cart passes every filter. Carts with no
+// recorded change time only match when no time range is given.
+func (f cartFilter) matches(overview CartOverview) bool {
+	if !strings.HasPrefix(overview.UserID, f.userPrefix) || overview.ItemCount < f.minItems {
+		return false
+	}
+	if f.updatedAfter.IsZero() && f.updatedBefore.IsZero() {
+		return true
+	}
+	if overview.UpdatedAt == nil {
+		return false
+	}
+	if !f.updatedAfter.IsZero() && overview.UpdatedAt.Before(f.updatedAfter) {
+		return false
+	}
+	return f.updatedBefore.IsZero() || overview.UpdatedAt.Before(f.updatedBefore)
+}
+
+// handleAdmin registers an admin endpoint, which requires the admin token
+func (ms *MetricsServer) handleAdmin(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	ms.handle(mux, pattern, ms.requireAdminToken(handler))
+}
+
+// requireAdminToken rejects requests without the configured admin token,
+// sent as a bearer token or in X-Admin-Token. Without a configured token the
+// wrapped endpoints are disabled.
+func (ms *MetricsServer) requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ms.adminToken == "" {
+			writeError(w, r, http.StatusForbidden, msgAdminDisabled)
+			return
+		}
+
+		token := r.Header.Get("X-Admin-Token")
+		if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			token = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ms.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, r, http.StatusUnauthorized, msgUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleListCarts pages through carts in user ID order. Filters are
+// user_prefix, min_items (units), and updated_after/updated_before
+// (RFC 3339); limit sets the page size and cursor continues after the
+// previous page's next_cursor.
+func (ms *MetricsServer) handleListCarts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := cartFilter{userPrefix: query.Get("user_prefix")}
+	if value := query.Get("min_items"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "min_items")
+			return
+		}
+		filter.minItems = parsed
+	}
+	limit := defaultCartPageSize
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxCartPageSize {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "limit")
+			return
+		}
+		limit = parsed
+	}
+	for name, target := range map[string]*time.Time{"updated_after": &filter.updatedAfter, "updated_before": &filter.updatedBefore} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, msgInvalidParameter, name)
+				return
+			}
+			*target = parsed
+		}
+	}
+	cursor := query.Get("cursor")
+
+	carts, err := ms.service.store.List(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+	sort.Slice(carts, func(i, j int) bool { return carts[i].UserID < carts[j].UserID })
+
+	now := time.Now()
+	page := []CartOverview{}
+	matched := 0
+	nextCursor := ""
+	for _, cart := range carts {
+		overview := newCartOverview(cart, now)
+		if !filter.matches(overview) {
+			continue
+		}
+		matched++
+		if cart.UserID <= cursor {
+			continue
+		}
+		if len(page) == limit {
+			nextCursor = page[len(page)-1].UserID
+			continue
+		}
+		page = append(page, overview)
+	}
+
+	response := map[string]interface{}{
+		"carts":   page,
+		"matched": matched,
+	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleInspectCart returns one user's cart with its totals and lock state
+func (ms *MetricsServer) handleInspectCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	userID := strings.TrimPrefix(r.URL.Path, "/admin/carts/")
+	if userID == "" || strings.Contains(userID, "/") {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "userID")
+		return
+	}
+
+	cart, err := ms.service.store.Get(r.Context(), userID)
+	if err != nil {
+		ms.writeServiceError(w, r, err, userID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newCartOverview(cart, time.Now()))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// codeValidationError is the envelope code of every validation failure
+const codeValidationError = "VALIDATION_ERROR"
+
+// ErrorEnvelope is the body of every error response: a machine-readable
+// code clients can branch on, the localized message and the request ID
+// support can look the request up by
+type ErrorEnvelope struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"` // the offending field of a validation error
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// validationKeys are the message keys of malformed or invalid requests,
+// which share the VALIDATION_ERROR code; the message and field tell them
+// apart
+var validationKeys = map[string]bool{
+	msgInvalidJSON:       true,
+	msgMissingFields:     true,
+	msgMissingParameter:  true,
+	msgInvalidParameter:  true,
+	msgUnknownField:      true,
+	msgInvalidFieldType:  true,
+	msgInvalidFieldValue: true,
+	msgConflictingUser:   true,
+}
+
+// errorCode returns the envelope code of a message key: VALIDATION_ERROR
+// for validation failures, else the key upper-cased, e.g. CART_NOT_FOUND.
+// Codes are part of the API, so keys must not be renamed lightly.
+func errorCode(key string) string {
+	if validationKeys[key] {
+		return codeValidationError
+	}
+	return strings.ToUpper(key)
+}
+
+// serviceErrors maps the service layer's sentinel errors to their status
+// code and message, the first match winning. Their message argument, if
+// any, is the one the caller passes to writeServiceError.
+var serviceErrors = []struct {
+	err        error
+	statusCode int
+	key        string
+}{
+	{ErrCartNotFound, http.StatusNotFound, msgCartNotFound},
+	{ErrItemNotFound, http.StatusNotFound, msgItemNotFound},
+	{ErrProductNotFound, http.StatusNotFound, msgProductNotFound},
+	{ErrOrderNotFound, http.StatusNotFound, msgOrderNotFound},
+	{ErrReturnNotFound, http.StatusNotFound, msgReturnNotFound},
+	{ErrProfileNotFound, http.StatusNotFound, msgProfileNotFound},
+	{ErrAddressNotFound, http.StatusNotFound, msgAddressNotFound},
+	{ErrTemplateNotFound, http.StatusNotFound, msgTemplateNotFound},
+	{ErrNoStagedRestore, http.StatusNotFound, msgNoStagedRestore},
+	{ErrEmptyCart, http.StatusBadRequest, msgEmptyCart},
+	{ErrCheckoutRejected, http.StatusForbidden, msgCheckoutRejected},
+	{ErrInvalidQuote, http.StatusForbidden, msgInvalidQuote},
+	{ErrInvalidShareToken, http.StatusForbidden, msgInvalidShareToken},
+	{ErrInsufficientStock, http.StatusConflict, msgInsufficientStock},
+	{ErrQuoteMismatch, http.StatusConflict, msgQuoteMismatch},
+	{ErrInvalidTransition, http.StatusConflict, msgInvalidTransition},
+	{ErrTooManyAddresses, http.StatusConflict, msgAddressLimit},
+	{ErrRestoreUnavailable, http.StatusConflict, msgRestoreUnavailable},
+	{ErrCartConflict, http.StatusConflict, msgCartConflict},
+	{ErrQuoteExpired, http.StatusGone, msgQuoteExpired},
+	{ErrShareTokenExpired, http.StatusGone, msgShareTokenExpired},
+	{ErrRejectedByHook, http.StatusUnprocessableEntity, msgItemRejected},
+	{ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, msgIdempotencyKeyReused},
+	{ErrNoShippingTier, http.StatusUnprocessableEntity, msgNoShippingTier},
+	{ErrRestoreOutOfRange, http.StatusUnprocessableEntity, msgRestoreOutOfRange},
+	{ErrCartLocked, http.StatusLocked, msgCartLocked},
+}
+
+// serviceErrorKey returns the status code and message mapped to a service
+// error by serviceErrors
+func serviceErrorKey(err error) (statusCode int, key string, ok bool) {
+	for _, mapped := range serviceErrors {
+		if errors.Is(err, mapped.err) {
+			return mapped.statusCode, mapped.key, true
+		}
+	}
+	return 0, "", false
+}
+
+// writeServiceError writes the error response for an error returned by the
+// service layer, with the status code and message mapped to it. args fill
+// in the message, e.g. the user or item the request was about. Errors
+// mapped to nothing are logged and answered with a bare 500, so their
+// text never reaches clients.
+func (ms *MetricsServer) writeServiceError(w http.ResponseWriter, r *http.Request, err error, args ...interface{}) {
+	switch {
+	case errors.Is(err, ErrStoreUnavailable):
+		ms.writeStoreUnavailable(w, r)
+		return
+	case errors.Is(err, ErrDependencyUnavailable):
+		writeDependencyUnavailable(w, r, err)
+		return
+	}
+	if statusCode, key, ok := serviceErrorKey(err); ok {
+		writeError(w, r, statusCode, key, args...)
+		return
+	}
+
+	slog.ErrorContext(r.Context(), "Request failed", "endpoint", endpointOf(r), "error", err)
+	writeError(w, r, http.StatusInternalServerError, msgInternalError)
+}
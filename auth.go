@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeyHeader carries static API keys
+const apiKeyHeader = "X-API-Key"
+
+// maxUserPeek caps the request body read to find the user it is for
+const maxUserPeek = 1 << 20
+
+// Authentication failure reasons, the reason label of auth_failures_total
+const (
+	authMissingCredentials = "missing_credentials"
+	authInvalidAPIKey      = "invalid_api_key"
+	authInvalidToken       = "invalid_token"
+	authExpiredToken       = "expired_token"
+	authSubjectMismatch    = "subject_mismatch"
+)
+
+// authError is an authentication failure and its reason
+type authError struct {
+	reason string
+	detail string
+}
+
+func (e *authError) Error() string { return e.reason + ": " + e.detail }
+
+// Authenticator checks the API key or JWT bearer token of application
+// requests and that the user a request names is the authenticated one
+type Authenticator struct {
+	enabled bool
+	apiKeys map[[sha256.Size]byte]string // key hash -> subject
+	jwt     config.JWTConfig
+
+	// OpenTelemetry Metrics
+	failureCounter metric.Int64Counter // Counter: rejected requests by reason and endpoint
+}
+
+// NewAuthenticator creates an authenticator for cfg. When cfg is disabled
+// every request passes.
+func NewAuthenticator(cfg config.AuthConfig) (*Authenticator, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	// Keys are looked up by hash so lookups don't compare the key itself
+	auth := &Authenticator{
+		enabled: cfg.Enabled,
+		apiKeys: make(map[[sha256.Size]byte]string),
+		jwt:     cfg.JWT,
+	}
+	for _, key := range cfg.APIKeys {
+		auth.apiKeys[sha256.Sum256([]byte(key.Key))] = key.Subject
+	}
+
+	var err error
+	auth.failureCounter, err = meter.Int64Counter(
+		"auth_failures_total",
+		metric.WithDescription("Total number of requests rejected by authentication by reason and endpoint"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth failures counter: %w", err)
+	}
+
+	return auth, nil
+}
+
+// authRequired reports whether a route serves the application APIs rather
+// than probes, metrics, the API docs or the admin endpoints, which have
+// their own token
+func authRequired(pattern string) bool {
+	return pattern != "/health" && pattern != "/ready" && pattern != "/metrics" && !apiDocsRoute(pattern) && !strings.HasPrefix(pattern, "/admin/")
+}
+
+// wrap is the auth middleware: 401 with WWW-Authenticate for missing or
+// invalid credentials, 403 when the request names a user other than the
+// authenticated one
+func (a *Authenticator) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a == nil || !a.enabled || !authRequired(endpointOf(r)) {
+			handler(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		userID := requestUserID(r)
+		_, span := startPhaseSpan(ctx, phaseAuth, "authenticate", "auth.authenticate")
+		subject, method, err := a.authenticate(r.Header.Get(apiKeyHeader), r.Header.Get("Authorization"))
+		if err == nil {
+			err = a.authorize(subject, userID)
+		}
+		span.End()
+		var failure *authError
+		if errors.As(err, &failure) {
+			slog.DebugContext(ctx, "Rejected request credentials", "reason", failure.reason, "detail", failure.detail)
+			a.countFailure(ctx, failure.reason, endpointOf(r))
+			if failure.reason == authSubjectMismatch {
+				writeError(w, r, http.StatusForbidden, msgForbiddenUser, userID)
+				return
+			}
+			challenge := `Bearer realm="shopping-cart"`
+			if failure.reason == authInvalidToken || failure.reason == authExpiredToken {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeError(w, r, http.StatusUnauthorized, msgUnauthenticated)
+			return
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("enduser.id", subject),
+			attribute.String("auth.method", method),
+		)
+		// The body is only peeked at here; decodeJSONBody checks the user
+		// it names again once the handler has decoded it
+		handler(w, r.WithContext(withAuthSubject(ctx, subject)))
+	}
+}
+
+type authSubjectContextKey struct{}
+
+// withAuthSubject records the authenticated subject of a request in ctx
+func withAuthSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, authSubjectContextKey{}, subject)
+}
+
+// authSubjectFrom returns the authenticated subject of the request in ctx,
+// and false when the request wasn't authenticated
+func authSubjectFrom(ctx context.Context) (string, bool) {
+	subject, ok := ctx.Value(authSubjectContextKey{}).(string)
+	return subject, ok
+}
+
+// forbiddenUserError rejects a decoded body naming a user its credentials
+// can't act on
+type forbiddenUserError struct {
+	UserID string
+}
+
+func (e *forbiddenUserError) Error() string { return "credentials can't act on " + e.UserID }
+
+// checkBodyUser checks the user_id of a JSON body the handler decoded,
+// which is the user it acts on: the path and query string must not name
+// another user, and an authenticated subject must be allowed to act on
+// it. Bodies naming no user pass.
+func checkBodyUser(r *http.Request, body []byte) error {
+	var named struct {
+		UserID string `json:"user_id"`
+	}
+	if json.Unmarshal(body, &named) != nil || named.UserID == "" {
+		return nil
+	}
+	for _, userID := range []string{r.PathValue("userID"), r.URL.Query().Get("user_id")} {
+		if userID != "" && userID != named.UserID {
+			return constraintViolation("user_id", msgConflictingUser)
+		}
+	}
+	if subject, ok := authSubjectFrom(r.Context()); ok {
+		if subject != config.AnySubject && subject != named.UserID {
+			return &forbiddenUserError{UserID: named.UserID}
+		}
+	}
+	return nil
+}
+
+// unaryInterceptor applies the same checks to gRPC calls, reading the
+// credentials from the x-api-key and authorization metadata and the user
+// from the request message
+func (a *Authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if a == nil || !a.enabled {
+		return handler(ctx, req)
+	}
+
+	var apiKey, authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			apiKey = values[0]
+		}
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	subject, method, err := a.authenticate(apiKey, authorization)
+	if err == nil {
+		err = a.authorize(subject, grpcRequestUser(req))
+	}
+	var failure *authError
+	if errors.As(err, &failure) {
+		slog.DebugContext(ctx, "Rejected RPC credentials", "method", info.FullMethod, "reason", failure.reason, "detail", failure.detail)
+		a.countFailure(ctx, failure.reason, info.FullMethod)
+		if failure.reason == authSubjectMismatch {
+			return nil, status.Error(codes.PermissionDenied, "credentials can't act on this user")
+		}
+		return nil, status.Error(codes.Unauthenticated, "a valid API key or bearer token is required")
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("enduser.id", subject),
+		attribute.String("auth.method", method),
+	)
+	return handler(ctx, req)
+}
+
+// grpcRequestUser returns the user a gRPC request message names
+func grpcRequestUser(req interface{}) string {
+	switch m := req.(type) {
+	case *wireAddToCartRequest:
+		return m.UserID
+	case *wireGetCartRequest:
+		return m.UserID
+	case *wireRemoveFromCartRequest:
+		return m.UserID
+	}
+	return ""
+}
+
+// authenticate returns the subject of an API key or, without one, of a
+// bearer token, and which of them it was
+func (a *Authenticator) authenticate(apiKey, authorization string) (string, string, error) {
+	if apiKey != "" {
+		subject, ok := a.apiKeys[sha256.Sum256([]byte(apiKey))]
+		if !ok {
+			return "", "", &authError{authInvalidAPIKey, "unknown API key"}
+		}
+		return subject, "api_key", nil
+	}
+
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found || token == "" {
+		return "", "", &authError{authMissingCredentials, "no API key or bearer token"}
+	}
+	subject, err := a.verifyJWT(token, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	return subject, "jwt", nil
+}
+
+// authorize checks that subject may act on userID, which is empty for
+// requests not naming a user
+func (a *Authenticator) authorize(subject, userID string) error {
+	if userID == "" || subject == config.AnySubject || subject == userID {
+		return nil
+	}
+	return &authError{authSubjectMismatch, fmt.Sprintf("%s can't act on %s", subject, userID)}
+}
+
+func (a *Authenticator) countFailure(ctx context.Context, reason, endpoint string) {
+	a.failureCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("reason", reason),
+		attribute.String("endpoint", endpoint),
+	))
+}
+
+// jwtClaims are the registered claims checked on bearer tokens
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // a string or a list of them
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// verifyJWT checks an HS256 token's signature and claims as of now and
+// returns its subject. Other algorithms, "none" included, are rejected.
+func (a *Authenticator) verifyJWT(token string, now time.Time) (string, error) {
+	invalid := func(detail string) error { return &authError{authInvalidToken, detail} }
+	if a.jwt.Secret == "" {
+		return "", invalid("bearer tokens are not accepted")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", invalid("malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", invalid("malformed header")
+	}
+	if header.Algorithm != "HS256" {
+		return "", invalid("unsupported algorithm " + header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", invalid("malformed signature")
+	}
+	mac := hmac.New(sha256.New, []byte(a.jwt.Secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", invalid("bad signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", invalid("malformed claims")
+	}
+	if claims.Subject == "" {
+		return "", invalid("missing sub claim")
+	}
+	leeway := a.jwt.Leeway.Seconds()
+	unix := float64(now.Unix())
+	if claims.ExpiresAt != nil && unix > *claims.ExpiresAt+leeway {
+		return "", &authError{authExpiredToken, "token expired"}
+	}
+	if claims.NotBefore != nil && unix < *claims.NotBefore-leeway {
+		return "", invalid("token not valid yet")
+	}
+	if a.jwt.Issuer != "" && claims.Issuer != a.jwt.Issuer {
+		return "", invalid("unexpected issuer")
+	}
+	if a.jwt.Audience != "" && !jwtAudienceIncludes(claims.Audience, a.jwt.Audience) {
+		return "", invalid("unexpected audience")
+	}
+	return claims.Subject, nil
+}
+
+// decodeJWTPart decodes a base64url JSON segment of a token
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAudienceIncludes reports whether an aud claim, a string or a list,
+// names audience
+func jwtAudienceIncludes(claim json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(claim, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(claim, &list) == nil {
+		for _, entry := range list {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestUserID returns the user a request names in its route path, query
+// string or JSON body, leaving the body for the handler to read. The body
+// is read whatever its Content-Type, as handlers decode it regardless.
+func requestUserID(r *http.Request) string {
+	if userID := r.PathValue("userID"); userID != "" {
+		return userID
+	}
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		return userID
+	}
+
+	if r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxUserPeek))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		var identified struct {
+			UserID string `json:"user_id"`
+		}
+		if err == nil && json.Unmarshal(body, &identified) == nil {
+			return identified.UserID
+		}
+	}
+	return ""
+}
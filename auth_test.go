@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+)
+
+// newAuthTestHandler returns an add-to-cart style handler behind an
+// authenticator accepting "alice-key" for alice, and the user the handler
+// last acted on
+func newAuthTestHandler(t *testing.T) (http.Handler, *string) {
+	t.Helper()
+	auth, err := NewAuthenticator(config.AuthConfig{
+		Enabled: true,
+		APIKeys: []config.APIKeyConfig{{Key: "alice-key", Subject: "alice"}},
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	decodeFailures, err := otel.Meter("test").Int64Counter("decode_failures")
+	if err != nil {
+		t.Fatalf("Int64Counter: %v", err)
+	}
+	ms := &MetricsServer{service: &CartService{decodeFailureCounter: decodeFailures}, auth: auth}
+
+	var actedOn string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cart/add", auth.wrap(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			UserID string   `json:"user_id"`
+			Item   CartItem `json:"item"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		actedOn = req.UserID
+		w.WriteHeader(http.StatusOK)
+	}))
+	return mux, &actedOn
+}
+
+func TestAuthorizesTheDecodedUser(t *testing.T) {
+	bobBody := `{"user_id":"bob","item":{"id":"sku-1","quantity":1,"price":1}}`
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"own user", "/cart/add", "application/json", `{"user_id":"alice","item":{"id":"sku-1","quantity":1,"price":1}}`, http.StatusOK},
+		{"other user", "/cart/add", "application/json", bobBody, http.StatusForbidden},
+		{"other user without content type", "/cart/add", "", bobBody, http.StatusForbidden},
+		{"other user past the peek limit", "/cart/add", "application/json", "{" + strings.Repeat(" ", maxUserPeek) + bobBody[1:], http.StatusForbidden},
+		{"query and body naming different users", "/cart/add?user_id=alice", "application/json", bobBody, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, actedOn := newAuthTestHandler(t)
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			req.Header.Set(apiKeyHeader, "alice-key")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK && *actedOn != "" {
+				t.Fatalf("handler acted on %q", *actedOn)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"shopping-cart-service/config"
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrBatchRejected is returned when items of a batch add are rejected, so
+// none of the batch was added
+var ErrBatchRejected = errors.New("batch add rejected")
+
+// maxBatchItems bounds the items of one batch add
+const maxBatchItems = 100
+
+// Batch item results
+const (
+	batchItemAdded    = "added"
+	batchItemRejected = "rejected"
+	batchItemNotAdded = "not_added" // valid, but other items were rejected
+)
+
+// BatchItemResult is the outcome of one item of a batch add
+type BatchItemResult struct {
+	ItemID   string         `json:"item_id"`
+	Status   string         `json:"status"`             // added, rejected or not_added
+	Quantity int            `json:"quantity,omitempty"` // the item's quantity in the cart after the batch
+	Error    *ErrorEnvelope `json:"error,omitempty"`    // why the item was rejected
+
+	err error
+}
+
+// reject marks the item rejected for err
+func (r *BatchItemResult) reject(err error) {
+	r.Status = batchItemRejected
+	r.err = err
+}
+
+// newBatchResults starts every item of a batch out as added
+func newBatchResults(items []CartItem) []BatchItemResult {
+	results := make([]BatchItemResult, len(items))
+	for i, item := range items {
+		results[i] = BatchItemResult{ItemID: item.ID, Status: batchItemAdded}
+	}
+	return results
+}
+
+// rejectedItems counts the rejected items and marks the others not added,
+// if there are any
+func rejectedItems(results []BatchItemResult) int {
+	rejected := 0
+	for _, result := range results {
+		if result.Status == batchItemRejected {
+			rejected++
+		}
+	}
+	if rejected > 0 {
+		for i := range results {
+			if results[i].Status == batchItemAdded {
+				results[i].Status = batchItemNotAdded
+			}
+		}
+	}
+	return rejected
+}
+
+// AddItemsToCart adds items to a user's cart under one cart lock, either
+// all of them or, when any is rejected by a hook or for lack of stock, none,
+// returning ErrBatchRejected. The results say per item whether it was added
+// and, if not, why.
+func (cs *CartService) AddItemsToCart(ctx context.Context, userID string, items []CartItem) (_ []BatchItemResult, err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.AddItemsToCart", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+		attribute.Int("batch.items", len(items)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	results := newBatchResults(items)
+	defer func() { cs.recordBatchItems(ctx, results, err) }()
+
+	// Hooks and the inventory service may call out, so they run before
+	// the cart is locked; the inventory once for the whole batch
+	for i, item := range items {
+		if err := cs.hooks.runBeforeAddItem(ctx, userID, item); err != nil {
+			results[i].reject(err)
+		}
+	}
+	if err := cs.dependencies.call(ctx, config.DependencyInventory, "check_availability"); err != nil {
+		return nil, err
+	}
+
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if errors.Is(err, ErrCartNotFound) {
+		cart, err = &Cart{
+			UserID: userID,
+			Items:  []CartItem{},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cart.lockedAt(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", ErrCartLocked, userID)
+	}
+
+	// Stock must cover the combined quantity in the cart and the batch
+	requested := make(map[string]int)
+	for _, existingItem := range cart.Items {
+		requested[existingItem.ID] += existingItem.Quantity
+	}
+	for i, item := range items {
+		if results[i].Status == batchItemRejected {
+			continue
+		}
+		if err := cs.catalogFor(ctx).CheckStock(item.ID, requested[item.ID]+item.Quantity); err != nil {
+			results[i].reject(err)
+			continue
+		}
+		requested[item.ID] += item.Quantity
+	}
+	if rejected := rejectedItems(results); rejected > 0 {
+		span.SetAttributes(attribute.Int("batch.rejected", rejected))
+		return results, ErrBatchRejected
+	}
+
+	quantities := make([]int, len(items))
+	for i, item := range items {
+		quantities[i] = cart.addItem(item)
+	}
+	cart.updatedAt = time.Now()
+
+	if err := cs.store.Put(ctx, cart); err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		results[i].Quantity = quantities[i]
+		cs.categories.recordItemAdded(ctx, item)
+		cs.activity.recordAdded(ctx, cart, item.ID, item.Quantity)
+		cs.publisher.publish(ctx, events.CartItemAdded{UserID: userID, ItemID: item.ID, Quantity: item.Quantity, Price: item.Price})
+		cs.changes.publish(ctx, cartChangeItemAdded, userID, item.ID, quantities[i])
+	}
+	return results, nil
+}
+
+// recordBatchItems counts the items of a judged batch by result; batches
+// failing as a whole, e.g. on a locked cart, aren't counted
+func (cs *CartService) recordBatchItems(ctx context.Context, results []BatchItemResult, err error) {
+	if err != nil && !errors.Is(err, ErrBatchRejected) {
+		return
+	}
+	for _, result := range results {
+		cs.batchItemCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result.Status)))
+	}
+}
+
+// AddItemsToCartIdempotent adds items like AddItemsToCart, but only once
+// per idempotency key, user, namespace and tenant. A replayed batch returns
+// the first request's results. An empty key always adds.
+func (cs *CartService) AddItemsToCartIdempotent(ctx context.Context, key, userID string, items []CartItem) (results []BatchItemResult, replayed bool, err error) {
+	if key == "" {
+		results, err = cs.AddItemsToCart(ctx, userID, items)
+		return results, false, err
+	}
+
+	fingerprint, err := json.Marshal(items)
+	if err != nil {
+		return nil, false, err
+	}
+	// Keyed like the cart, so namespaces and tenants don't share keys
+	scope := storageKey(ctx, userID)
+	result, replayed, err := cs.idempotency.do(ctx, "add_items_to_cart", scope+"\x00"+key, string(fingerprint), func() (interface{}, error) {
+		results, err := cs.AddItemsToCart(ctx, userID, items)
+		return results, err
+	})
+	if replayed {
+		// Copied so concurrent replays don't share the kept results
+		return append([]BatchItemResult(nil), result.([]BatchItemResult)...), true, nil
+	}
+	results, _ = result.([]BatchItemResult)
+	return results, false, err
+}
+
+// batchAddResponse is the body of a batch add. A rejected batch is answered
+// with the ErrorEnvelope of the batch along with the item results.
+type batchAddResponse struct {
+	*ErrorEnvelope
+	Status string            `json:"status"` // success or rejected
+	Items  []BatchItemResult `json:"items,omitempty"`
+}
+
+// handleV1CartItemsBatch serves POST /v1/carts/{userID}/items:batch, adding
+// the array of items in the body all at once or, when any is invalid or
+// rejected, not at all. Retries with the same Idempotency-Key add them once.
+func (ms *MetricsServer) handleV1CartItemsBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	userID := r.PathValue("userID")
+	setRequestUser(r.Context(), userID)
+
+	var items []CartItem
+	if err := decodeJSONBody(r, &items); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	switch {
+	case len(items) == 0:
+		ms.rejectInvalidRequest(w, r, constraintViolation("items", msgMissingFields))
+		return
+	case len(items) > maxBatchItems:
+		ms.rejectInvalidRequest(w, r, constraintViolation("items", msgInvalidFieldValue))
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" && !validIdempotencyKey(key) {
+		writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "Idempotency-Key")
+		return
+	}
+
+	// Invalid items reject the batch before it reaches the service
+	results := newBatchResults(items)
+	for i, item := range items {
+		if err := validateCartItem(item); err != nil {
+			var decodeErr *requestDecodeError
+			if errors.As(err, &decodeErr) {
+				ms.service.recordDecodeFailure(r.Context(), endpointOf(r), decodeErr)
+			}
+			results[i].reject(err)
+		}
+	}
+	if rejectedItems(results) > 0 {
+		ms.service.recordBatchItems(r.Context(), results, ErrBatchRejected)
+		ms.writeBatchRejected(w, r, results)
+		return
+	}
+
+	results, replayed, err := ms.service.AddItemsToCartIdempotent(r.Context(), key, userID, items)
+	switch {
+	case errors.Is(err, ErrBatchRejected):
+		ms.writeBatchRejected(w, r, results)
+		return
+	case err != nil:
+		ms.writeServiceError(w, r, err, userID)
+		return
+	}
+
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	writeJSON(w, r, batchAddResponse{Status: "success", Items: results})
+}
+
+// writeBatchRejected answers a rejected batch with 422, the error of each
+// rejected item localized like an error response of its own
+func (ms *MetricsServer) writeBatchRejected(w http.ResponseWriter, r *http.Request, results []BatchItemResult) {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	rejected := 0
+	for i := range results {
+		result := &results[i]
+		if result.err == nil {
+			continue
+		}
+		rejected++
+
+		var decodeErr *requestDecodeError
+		key, field, args := msgInternalError, "", []interface{}{result.ItemID}
+		if errors.As(result.err, &decodeErr) {
+			key, field, args = decodeErr.MessageKey, decodeErr.Field, []interface{}{decodeErr.Field}
+		} else if _, mapped, ok := serviceErrorKey(result.err); ok {
+			key = mapped
+		} else {
+			slog.ErrorContext(r.Context(), "Batch item failed", "endpoint", endpointOf(r), "item_id", result.ItemID, "error", result.err)
+		}
+		result.Error = &ErrorEnvelope{Code: errorCode(key), Message: localize(lang, key, args...), Field: field}
+	}
+
+	envelope := newErrorEnvelope(w, r, http.StatusUnprocessableEntity, msgBatchRejected, "", rejected)
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(batchAddResponse{ErrorEnvelope: &envelope, Status: "rejected", Items: results})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrCircuitOpen is returned for calls a circuit breaker fails at once
+// because the circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Circuit states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// circuitStates are the states of a circuit, in the order they are exported
+var circuitStates = []string{circuitClosed, circuitOpen, circuitHalfOpen}
+
+// circuitBreaker guards the calls to one dependency. Closed, it lets calls
+// through and counts consecutive failures; at the threshold it opens and
+// fails calls at once, so a struggling dependency isn't kept busy and
+// callers don't wait on it. Once the open duration passes it is half-open:
+// a single probe call is let through, closing the circuit if it succeeds
+// and opening it again if it fails.
+type circuitBreaker struct {
+	name     string
+	breakers *CircuitBreakers
+
+	mutex               sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probe               uint64    // token of the latest probe admitted
+	probeStartedAt      time.Time // zero when no probe is in flight
+}
+
+// call runs fn unless the circuit is open, and records its outcome: errors
+// that failed reports true for are failures, anything else a success. A
+// call whose ctx ended first says nothing about the dependency and isn't
+// recorded. A nil breaker always runs fn.
+func (cb *circuitBreaker) call(ctx context.Context, fn func() error, failed func(error) bool) error {
+	if cb == nil {
+		return fn()
+	}
+	probe, ok := cb.admit(ctx)
+	if !ok {
+		cb.breakers.rejectCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("breaker", cb.name)))
+		return fmt.Errorf("%w: %s", ErrCircuitOpen, cb.name)
+	}
+
+	err := fn()
+	if ctx.Err() != nil {
+		cb.release(probe)
+		return err
+	}
+	cb.record(ctx, probe, err != nil && failed(err))
+	return err
+}
+
+// admit reports whether a call may go through now and, when the call is
+// the half-open circuit's probe, returns its token; 0 marks other calls
+func (cb *circuitBreaker) admit(ctx context.Context) (uint64, bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := time.Now()
+	switch cb.state {
+	case circuitOpen:
+		if now.Before(cb.openedAt.Add(cb.breakers.openDuration)) {
+			return 0, false
+		}
+		cb.transition(ctx, circuitHalfOpen)
+	case circuitHalfOpen:
+		// A probe that never reported back doesn't hold the circuit
+		// half-open for good
+		if !cb.probeStartedAt.IsZero() && now.Before(cb.probeStartedAt.Add(cb.breakers.openDuration)) {
+			return 0, false
+		}
+	default:
+		return 0, true
+	}
+	cb.probe++
+	cb.probeStartedAt = now
+	return cb.probe, true
+}
+
+// record updates the circuit with the outcome of a call. Only the latest
+// probe decides a half-open circuit; calls let through before the circuit
+// opened, and probes given up on, say nothing about the dependency now.
+func (cb *circuitBreaker) record(ctx context.Context, probe uint64, failed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if probe != 0 && probe == cb.probe && cb.state == circuitHalfOpen {
+		cb.probeStartedAt = time.Time{}
+		if failed {
+			cb.trip(ctx)
+			return
+		}
+		cb.consecutiveFailures = 0
+		cb.transition(ctx, circuitClosed)
+		return
+	}
+	if cb.state != circuitClosed {
+		return
+	}
+
+	if !failed {
+		cb.consecutiveFailures = 0
+		return
+	}
+	cb.consecutiveFailures++
+	if cb.consecutiveFailures >= cb.breakers.failureThreshold {
+		cb.trip(ctx)
+	}
+}
+
+// trip opens the circuit. Callers must hold cb.mutex.
+func (cb *circuitBreaker) trip(ctx context.Context) {
+	cb.openedAt = time.Now()
+	cb.transition(ctx, circuitOpen)
+	cb.breakers.tripCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("breaker", cb.name)))
+}
+
+// release ends a call without an outcome; when it was the probe, another
+// probe may go through
+func (cb *circuitBreaker) release(probe uint64) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if probe != 0 && probe == cb.probe {
+		cb.probeStartedAt = time.Time{}
+	}
+}
+
+// transition moves the circuit to state. Callers must hold cb.mutex.
+func (cb *circuitBreaker) transition(ctx context.Context, state string) {
+	level := slog.LevelInfo
+	if state == circuitOpen {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "Circuit breaker state changed", "breaker", cb.name, "from", cb.state, "to", state)
+	cb.state = state
+}
+
+// currentState returns the state of the circuit
+func (cb *circuitBreaker) currentState() string {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// CircuitBreakers creates the circuit breakers of the service's
+// dependencies and exports their state
+type CircuitBreakers struct {
+	failureThreshold int
+	openDuration     time.Duration
+
+	mutex    sync.Mutex
+	breakers []*circuitBreaker
+
+	// OpenTelemetry Metrics
+	stateGauge    metric.Int64ObservableGauge // Gauge: 1 for each breaker's current state, 0 for the others
+	tripCounter   metric.Int64Counter         // Counter: circuits opened by breaker
+	rejectCounter metric.Int64Counter         // Counter: calls failed at once by an open circuit
+}
+
+// NewCircuitBreakers creates the breakers configured by cfg. It returns nil
+// when circuit breaking is disabled; a nil CircuitBreakers hands out nil
+// breakers, which let every call through.
+func NewCircuitBreakers(cfg config.BreakersConfig) (*CircuitBreakers, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	meter := otel.Meter("shopping-cart-service")
+
+	cbs := &CircuitBreakers{
+		failureThreshold: cfg.FailureThreshold,
+		openDuration:     cfg.OpenDuration,
+	}
+
+	var err error
+	cbs.stateGauge, err = meter.Int64ObservableGauge(
+		"circuit_breaker_state",
+		metric.WithDescription("Circuit breaker state by breaker: 1 for the current state (closed, open, half_open), 0 for the others"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create circuit breaker state gauge: %w", err)
+	}
+
+	cbs.tripCounter, err = meter.Int64Counter(
+		"circuit_breaker_trips_total",
+		metric.WithDescription("Total number of times a circuit breaker opened by breaker"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create circuit breaker trips counter: %w", err)
+	}
+
+	cbs.rejectCounter, err = meter.Int64Counter(
+		"circuit_breaker_rejected_calls_total",
+		metric.WithDescription("Total number of calls failed at once by an open circuit breaker by breaker"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create circuit breaker rejections counter: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			cbs.mutex.Lock()
+			breakers := append([]*circuitBreaker(nil), cbs.breakers...)
+			cbs.mutex.Unlock()
+			for _, cb := range breakers {
+				current := cb.currentState()
+				for _, state := range circuitStates {
+					value := int64(0)
+					if state == current {
+						value = 1
+					}
+					observer.ObserveInt64(cbs.stateGauge, value, metric.WithAttributes(
+						attribute.String("breaker", cb.name),
+						attribute.String("state", state),
+					))
+				}
+			}
+			return nil
+		},
+		cbs.stateGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register circuit breaker callback: %w", err)
+	}
+
+	return cbs, nil
+}
+
+// breaker returns a new closed breaker named name, nil when circuit
+// breaking is disabled
+func (cbs *CircuitBreakers) breaker(name string) *circuitBreaker {
+	if cbs == nil {
+		return nil
+	}
+	cb := &circuitBreaker{name: name, breakers: cbs, state: circuitClosed}
+	cbs.mutex.Lock()
+	cbs.breakers = append(cbs.breakers, cb)
+	cbs.mutex.Unlock()
+	return cb
+}
+
+// breakerCartStore fails cart store calls at once while its circuit is
+// open, so requests don't queue on a store that keeps failing. Missing
+// carts and write conflicts are answers, not failures. Open-circuit errors are
+// ErrStoreUnavailable, which storage degradation serves from its cache.
+type breakerCartStore struct {
+	CartStore
+	breaker *circuitBreaker
+}
+
+// storeFailed reports whether err means the store failed
+func storeFailed(err error) bool {
+	return !errors.Is(err, ErrCartNotFound) && !errors.Is(err, ErrCartConflict)
+}
+
+// unavailable marks open-circuit errors as the store being unavailable
+func (s breakerCartStore) unavailable(err error) error {
+	if errors.Is(err, ErrCircuitOpen) {
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return err
+}
+
+func (s breakerCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	var cart *Cart
+	err := s.breaker.call(ctx, func() error {
+		var err error
+		cart, err = s.CartStore.Get(ctx, userID)
+		return err
+	}, storeFailed)
+	return cart, s.unavailable(err)
+}
+
+func (s breakerCartStore) Put(ctx context.Context, cart *Cart) error {
+	return s.unavailable(s.breaker.call(ctx, func() error {
+		return s.CartStore.Put(ctx, cart)
+	}, storeFailed))
+}
+
+func (s breakerCartStore) Delete(ctx context.Context, userID string) error {
+	return s.unavailable(s.breaker.call(ctx, func() error {
+		return s.CartStore.Delete(ctx, userID)
+	}, storeFailed))
+}
+
+func (s breakerCartStore) List(ctx context.Context) ([]*Cart, error) {
+	var carts []*Cart
+	err := s.breaker.call(ctx, func() error {
+		var err error
+		carts, err = s.CartStore.List(ctx)
+		return err
+	}, storeFailed)
+	return carts, s.unavailable(err)
+}
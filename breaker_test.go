@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"shopping-cart-service/config"
+)
+
+var errDependency = errors.New("dependency failed")
+
+// newTestBreaker returns a closed breaker tripping after three consecutive
+// failures. Its open duration is an hour, so tests move past it with
+// elapseOpenDuration rather than by waiting.
+func newTestBreaker(t *testing.T) *circuitBreaker {
+	t.Helper()
+	breakers, err := NewCircuitBreakers(config.BreakersConfig{Enabled: true, FailureThreshold: 3, OpenDuration: time.Hour})
+	if err != nil {
+		t.Fatalf("NewCircuitBreakers: %v", err)
+	}
+	return breakers.breaker("test")
+}
+
+// elapseOpenDuration moves the breaker past its open duration, as if it had
+// been open, or its probe in flight, that long
+func elapseOpenDuration(cb *circuitBreaker) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	past := time.Now().Add(-cb.breakers.openDuration)
+	cb.openedAt = past
+	if !cb.probeStartedAt.IsZero() {
+		cb.probeStartedAt = past
+	}
+}
+
+// trip fails calls until the breaker opens
+func trip(t *testing.T, cb *circuitBreaker) {
+	t.Helper()
+	for i := 0; i < cb.breakers.failureThreshold; i++ {
+		cb.call(context.Background(), func() error { return errDependency }, storeFailed)
+	}
+	if state := cb.currentState(); state != circuitOpen {
+		t.Fatalf("state after %d failures = %s, want %s", cb.breakers.failureThreshold, state, circuitOpen)
+	}
+}
+
+func succeed() error { return nil }
+
+func TestBreakerTripsAtThreshold(t *testing.T) {
+	cb := newTestBreaker(t)
+	ctx := context.Background()
+	fail := func() error { return errDependency }
+
+	cb.call(ctx, fail, storeFailed)
+	cb.call(ctx, fail, storeFailed)
+	cb.call(ctx, succeed, storeFailed)
+	cb.call(ctx, fail, storeFailed)
+	cb.call(ctx, fail, storeFailed)
+	if state := cb.currentState(); state != circuitClosed {
+		t.Fatalf("state after a success broke the failures up = %s, want %s", state, circuitClosed)
+	}
+
+	// Answers such as a missing cart aren't failures
+	cb.call(ctx, func() error { return ErrCartNotFound }, storeFailed)
+	cb.call(ctx, fail, storeFailed)
+	cb.call(ctx, fail, storeFailed)
+	if state := cb.currentState(); state != circuitClosed {
+		t.Fatalf("state after a missing cart broke the failures up = %s, want %s", state, circuitClosed)
+	}
+
+	cb.call(ctx, fail, storeFailed)
+	if state := cb.currentState(); state != circuitOpen {
+		t.Fatalf("state after 3 consecutive failures = %s, want %s", state, circuitOpen)
+	}
+
+	ran := false
+	err := cb.call(ctx, func() error { ran = true; return nil }, storeFailed)
+	if !errors.Is(err, ErrCircuitOpen) || ran {
+		t.Errorf("call on an open circuit = %v, ran %v; want ErrCircuitOpen without running", err, ran)
+	}
+}
+
+func TestBreakerHalfOpensAfterOpenDuration(t *testing.T) {
+	cb := newTestBreaker(t)
+	ctx := context.Background()
+	trip(t, cb)
+
+	if _, ok := cb.admit(ctx); ok {
+		t.Fatal("admitted a call before the open duration passed")
+	}
+
+	elapseOpenDuration(cb)
+	probe, ok := cb.admit(ctx)
+	if !ok || probe == 0 {
+		t.Fatalf("admit after the open duration = %d, %v; want a probe", probe, ok)
+	}
+	if state := cb.currentState(); state != circuitHalfOpen {
+		t.Fatalf("state = %s, want %s", state, circuitHalfOpen)
+	}
+	if _, ok := cb.admit(ctx); ok {
+		t.Error("admitted a second call while the probe is in flight")
+	}
+
+	// A probe that never reports back doesn't hold the circuit half-open
+	elapseOpenDuration(cb)
+	if next, ok := cb.admit(ctx); !ok || next == probe {
+		t.Errorf("admit after the probe timed out = %d, %v; want a new probe", next, ok)
+	}
+}
+
+func TestBreakerOnlyAdmittedProbeDecides(t *testing.T) {
+	tests := []struct {
+		name        string
+		probeFailed bool
+		wantState   string
+	}{
+		{"probe succeeds", false, circuitClosed},
+		{"probe fails", true, circuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestBreaker(t)
+			ctx := context.Background()
+			trip(t, cb)
+
+			elapseOpenDuration(cb)
+			stale, _ := cb.admit(ctx)
+			elapseOpenDuration(cb) // the first probe timed out
+			probe, ok := cb.admit(ctx)
+			if !ok {
+				t.Fatal("second probe not admitted")
+			}
+
+			// The outcome of a superseded probe says nothing now
+			cb.record(ctx, stale, !tt.probeFailed)
+			if state := cb.currentState(); state != circuitHalfOpen {
+				t.Fatalf("state after the superseded probe reported = %s, want %s", state, circuitHalfOpen)
+			}
+
+			cb.record(ctx, probe, tt.probeFailed)
+			if state := cb.currentState(); state != tt.wantState {
+				t.Errorf("state after the probe reported = %s, want %s", state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresCallsFromBeforeItOpened(t *testing.T) {
+	for _, failed := range []bool{false, true} {
+		cb := newTestBreaker(t)
+		ctx := context.Background()
+
+		// Let a call through while closed, then open the circuit before it
+		// reports back
+		before, ok := cb.admit(ctx)
+		if !ok || before != 0 {
+			t.Fatalf("admit while closed = %d, %v; want an ordinary call", before, ok)
+		}
+		trip(t, cb)
+
+		cb.record(ctx, before, failed)
+		if state := cb.currentState(); state != circuitOpen {
+			t.Errorf("state after a call from before the trip reported (failed %v) = %s, want %s", failed, state, circuitOpen)
+		}
+
+		elapseOpenDuration(cb)
+		probe, _ := cb.admit(ctx)
+		cb.record(ctx, before, failed)
+		if state := cb.currentState(); state != circuitHalfOpen {
+			t.Errorf("half-open state after a call from before the trip reported (failed %v) = %s, want %s", failed, state, circuitHalfOpen)
+		}
+		cb.record(ctx, probe, false)
+		if state := cb.currentState(); state != circuitClosed {
+			t.Errorf("state after the probe succeeded = %s, want %s", state, circuitClosed)
+		}
+	}
+}
+
+func TestBreakerReleasesCancelledProbe(t *testing.T) {
+	cb := newTestBreaker(t)
+	trip(t, cb)
+	elapseOpenDuration(cb)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := cb.call(ctx, func() error {
+		cancel()
+		return ctx.Err()
+	}, storeFailed)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled probe returned %v, want context.Canceled", err)
+	}
+	if state := cb.currentState(); state != circuitHalfOpen {
+		t.Fatalf("state after the probe was cancelled = %s, want %s", state, circuitHalfOpen)
+	}
+
+	// The released probe doesn't hold up the next one
+	if err := cb.call(context.Background(), succeed, storeFailed); err != nil {
+		t.Fatalf("next probe: %v", err)
+	}
+	if state := cb.currentState(); state != circuitClosed {
+		t.Errorf("state after the next probe succeeded = %s, want %s", state, circuitClosed)
+	}
+
+	// Cancelled calls don't count towards the threshold either
+	for i := 0; i < cb.breakers.failureThreshold; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		cb.call(ctx, func() error { return ctx.Err() }, storeFailed)
+	}
+	if state := cb.currentState(); state != circuitClosed {
+		t.Errorf("state after cancelled calls = %s, want %s", state, circuitClosed)
+	}
+}
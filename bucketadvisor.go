@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+const (
+	// advisorMinSamples is how many observations a histogram needs before
+	// its buckets are judged
+	advisorMinSamples = 200
+
+	// A histogram is poorly bucketed when more than advisorMaxOverflow of
+	// its observations land above the last boundary, or more than
+	// advisorMaxCrowding in a single bucket
+	advisorMaxOverflow = 0.01
+	advisorMaxCrowding = 0.5
+
+	// advisorMaxBoundaries bounds the suggested boundaries, and with them
+	// the series each histogram costs
+	advisorMaxBoundaries = 16
+)
+
+// niceSeries are the mantissas suggested boundaries are drawn from, finest
+// first; coarser series are used when a distribution spans too many decades
+var niceSeries = [][]float64{{1, 2.5, 5}, {1, 5}, {1}}
+
+// BucketAdvice is the advisor's verdict on one latency histogram
+type BucketAdvice struct {
+	Instrument string    `json:"instrument"`
+	Count      uint64    `json:"count"`
+	P50        float64   `json:"p50"`
+	P99        float64   `json:"p99"`
+	Current    []float64 `json:"current,omitempty"`
+	Suggested  []float64 `json:"suggested"`
+	Overflow   float64   `json:"overflow_ratio"` // share of observations above the last current boundary
+	Crowding   float64   `json:"crowding_ratio"` // largest share of observations in one current bucket
+	Poor       bool      `json:"poorly_bucketed"`
+	Applied    bool      `json:"applied,omitempty"` // saved to the state file, in effect from the next start
+}
+
+// BucketAdvisor watches the service's latency histograms (those named
+// *_seconds) at high resolution and suggests explicit bucket boundaries
+// for the ones whose buckets fit their distribution poorly. It reads a
+// base-2 exponential copy of every histogram through its own reader, so the
+// suggestion doesn't depend on the buckets being judged.
+//
+// The SDK can't change a live instrument's boundaries, so in apply mode
+// suggestions are saved to a state file and installed as views at the
+// next start. Histograms under a view, configured or applied, are bucketed
+// by the view in every reader and are no longer analyzed.
+type BucketAdvisor struct {
+	mode      string
+	interval  time.Duration
+	stateFile string
+	reader    *sdkmetric.ManualReader // exponential histograms; nil when off
+	current   *sdkmetric.ManualReader // the histograms as exported
+
+	mutex      sync.Mutex
+	advice     []BucketAdvice
+	analyzedAt time.Time
+	applied    map[string][]float64 // instrument -> boundaries in the state file
+
+	// OpenTelemetry Metrics
+	poorGauge metric.Int64ObservableGauge // Gauge: 1 for histograms with a pending suggestion
+}
+
+// NewBucketAdvisor creates the advisor for cfg. current is a reader of the
+// histograms as exported, whose boundaries are judged. In apply mode the
+// saved suggestions are loaded; add Views to the meter provider to apply
+// them, and Reader to let the advisor observe.
+func NewBucketAdvisor(cfg config.BucketAdvisorConfig, current *sdkmetric.ManualReader) (*BucketAdvisor, error) {
+	advisor := &BucketAdvisor{
+		mode:      cfg.Mode,
+		interval:  cfg.Interval,
+		stateFile: cfg.StateFile,
+		current:   current,
+		applied:   make(map[string][]float64),
+	}
+	if cfg.Mode == config.AdvisorOff {
+		return advisor, nil
+	}
+	advisor.reader = sdkmetric.NewManualReader(sdkmetric.WithAggregationSelector(aggregationSelector(config.HistogramExponential)))
+
+	if cfg.Mode == config.AdvisorApply {
+		data, err := os.ReadFile(cfg.StateFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read bucket advisor state: %w", err)
+		case json.Unmarshal(data, &advisor.applied) != nil:
+			return nil, fmt.Errorf("failed to parse bucket advisor state %s", cfg.StateFile)
+		}
+	}
+
+	meter := otel.Meter("shopping-cart-service")
+	var err error
+	advisor.poorGauge, err = meter.Int64ObservableGauge(
+		"histogram_bucket_advice_pending",
+		metric.WithDescription("1 for latency histograms whose buckets fit their distribution poorly and have a suggested replacement, by instrument"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket advice gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			advisor.mutex.Lock()
+			defer advisor.mutex.Unlock()
+			for _, advice := range advisor.advice {
+				pending := int64(0)
+				if advice.Poor && !advice.Applied {
+					pending = 1
+				}
+				observer.ObserveInt64(advisor.poorGauge, pending, metric.WithAttributes(attribute.String("instrument", advice.Instrument)))
+			}
+			return nil
+		},
+		advisor.poorGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register bucket advice callback: %w", err)
+	}
+
+	return advisor, nil
+}
+
+// Reader is the advisor's meter provider reader, nil when it is off
+func (a *BucketAdvisor) Reader() sdkmetric.Reader {
+	if a.reader == nil {
+		return nil
+	}
+	return a.reader
+}
+
+// Views installs the saved suggestions, except for instruments matched by a
+// configured view, which takes precedence
+func (a *BucketAdvisor) Views(configured []config.MetricViewConfig) []sdkmetric.View {
+	var views []sdkmetric.View
+	for instrument, boundaries := range a.applied {
+		if matchesView(instrument, configured) {
+			slog.Warn("Configured metric view overrides applied bucket suggestion", "instrument", instrument)
+			continue
+		}
+		views = append(views, sdkmetric.NewView(
+			sdkmetric.Instrument{Name: instrument},
+			sdkmetric.Stream{Aggregation: sdkmetric.AggregationExplicitBucketHistogram{Boundaries: boundaries}},
+		))
+	}
+	return views
+}
+
+// matchesView reports whether a configured view matches instrument
+func matchesView(instrument string, views []config.MetricViewConfig) bool {
+	for _, view := range views {
+		if matched, _ := path.Match(view.Instrument, instrument); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Run analyzes the histograms every interval until ctx is done
+func (a *BucketAdvisor) Run(ctx context.Context) {
+	if a.reader == nil {
+		return
+	}
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.analyze(ctx); err != nil {
+				slog.WarnContext(ctx, "Histogram bucket analysis failed", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// analyze judges every latency histogram with enough observations, logs
+// suggestions for poorly bucketed ones and, in apply mode, saves them
+func (a *BucketAdvisor) analyze(ctx context.Context) error {
+	var observed, exported metricdata.ResourceMetrics
+	if err := a.reader.Collect(ctx, &observed); err != nil {
+		return fmt.Errorf("failed to collect exponential histograms: %w", err)
+	}
+	if err := a.current.Collect(ctx, &exported); err != nil {
+		return fmt.Errorf("failed to collect histograms: %w", err)
+	}
+	current := explicitHistograms(exported)
+
+	var advice []BucketAdvice
+	for _, scope := range observed.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			histogram, ok := m.Data.(metricdata.ExponentialHistogram[float64])
+			if !ok || !strings.HasSuffix(m.Name, "_seconds") {
+				continue
+			}
+			distribution := newExponentialDistribution(histogram)
+			if distribution.total < advisorMinSamples {
+				continue
+			}
+
+			item := BucketAdvice{
+				Instrument: m.Name,
+				Count:      distribution.total,
+				P50:        distribution.quantile(0.5),
+				P99:        distribution.quantile(0.99),
+				Suggested:  suggestBoundaries(distribution.quantile(0.01), distribution.quantile(0.999)),
+			}
+			if buckets, ok := current[m.Name]; ok {
+				item.Current = buckets.bounds
+				item.Overflow, item.Crowding = buckets.fit()
+			}
+			item.Poor = item.Overflow > advisorMaxOverflow || item.Crowding > advisorMaxCrowding
+			if item.Poor && slices.Equal(item.Current, item.Suggested) {
+				item.Poor = false // nothing better to suggest
+			}
+			advice = append(advice, item)
+		}
+	}
+	sort.Slice(advice, func(i, j int) bool { return advice[i].Instrument < advice[j].Instrument })
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	changed := false
+	for i := range advice {
+		item := &advice[i]
+		if !item.Poor {
+			continue
+		}
+		slog.InfoContext(ctx, "Histogram buckets fit poorly",
+			"instrument", item.Instrument,
+			"current", item.Current,
+			"suggested", item.Suggested,
+			"overflow_ratio", item.Overflow,
+			"crowding_ratio", item.Crowding,
+			"p50", item.P50,
+			"p99", item.P99,
+		)
+		if a.mode == config.AdvisorApply {
+			if !slices.Equal(a.applied[item.Instrument], item.Suggested) {
+				a.applied[item.Instrument] = item.Suggested
+				changed = true
+			}
+			item.Applied = true
+		}
+	}
+	a.advice = advice
+	a.analyzedAt = time.Now().UTC()
+
+	if changed {
+		if err := a.saveLocked(); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Saved histogram bucket suggestions; they apply from the next start", "state_file", a.stateFile)
+	}
+	return nil
+}
+
+// saveLocked writes the applied suggestions to the state file, replacing
+// it atomically; the caller holds the mutex
+func (a *BucketAdvisor) saveLocked() error {
+	data, err := json.MarshalIndent(a.applied, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.stateFile), ".bucket-advisor-*")
+	if err != nil {
+		return fmt.Errorf("failed to save bucket advisor state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save bucket advisor state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save bucket advisor state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.stateFile); err != nil {
+		return fmt.Errorf("failed to save bucket advisor state: %w", err)
+	}
+	return nil
+}
+
+// explicitBuckets are an exported histogram's boundaries and its bucket
+// counts summed over every attribute set
+type explicitBuckets struct {
+	bounds []float64
+	counts []uint64
+}
+
+// explicitHistograms returns the explicit-bucket histograms in rm by name
+func explicitHistograms(rm metricdata.ResourceMetrics) map[string]*explicitBuckets {
+	histograms := make(map[string]*explicitBuckets)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			histogram, ok := m.Data.(metricdata.Histogram[float64])
+			if !ok {
+				continue
+			}
+			for _, point := range histogram.DataPoints {
+				buckets := histograms[m.Name]
+				if buckets == nil {
+					buckets = &explicitBuckets{bounds: point.Bounds, counts: make([]uint64, len(point.BucketCounts))}
+					histograms[m.Name] = buckets
+				}
+				if len(point.BucketCounts) != len(buckets.counts) {
+					continue
+				}
+				for i, count := range point.BucketCounts {
+					buckets.counts[i] += count
+				}
+			}
+		}
+	}
+	return histograms
+}
+
+// fit returns the share of observations above the last boundary and the
+// largest share in any one bucket
+func (b *explicitBuckets) fit() (overflow, crowding float64) {
+	var total, largest uint64
+	for _, count := range b.counts {
+		total += count
+		largest = max(largest, count)
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(b.counts[len(b.counts)-1]) / float64(total), float64(largest) / float64(total)
+}
+
+// exponentialDistribution is a histogram's observations as buckets with
+// upper bounds, merged over every attribute set
+type exponentialDistribution struct {
+	buckets []distributionBucket // by upper bound
+	total   uint64
+}
+
+type distributionBucket struct {
+	upper float64
+	count uint64
+}
+
+func newExponentialDistribution(histogram metricdata.ExponentialHistogram[float64]) *exponentialDistribution {
+	d := &exponentialDistribution{}
+	for _, point := range histogram.DataPoints {
+		if point.ZeroCount > 0 {
+			d.buckets = append(d.buckets, distributionBucket{upper: 0, count: point.ZeroCount})
+		}
+		// Bucket i covers (base^(offset+i), base^(offset+i+1)]
+		base := math.Exp2(math.Exp2(-float64(point.Scale)))
+		for i, count := range point.PositiveBucket.Counts {
+			if count > 0 {
+				upper := math.Pow(base, float64(point.PositiveBucket.Offset+int32(i)+1))
+				d.buckets = append(d.buckets, distributionBucket{upper: upper, count: count})
+			}
+		}
+		d.total += point.ZeroCount
+		for _, count := range point.PositiveBucket.Counts {
+			d.total += count
+		}
+	}
+	sort.Slice(d.buckets, func(i, j int) bool { return d.buckets[i].upper < d.buckets[j].upper })
+	return d
+}
+
+// quantile returns the upper bound of the bucket holding quantile q
+func (d *exponentialDistribution) quantile(q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(d.total)))
+	var seen uint64
+	for _, bucket := range d.buckets {
+		seen += bucket.count
+		if seen >= rank {
+			return bucket.upper
+		}
+	}
+	if len(d.buckets) == 0 {
+		return 0
+	}
+	return d.buckets[len(d.buckets)-1].upper
+}
+
+// suggestBoundaries returns round boundaries (1, 2.5 and 5 times powers of
+// ten) from the largest at or below low to the smallest at or above high,
+// coarsening the series when that takes too many
+func suggestBoundaries(low, high float64) []float64 {
+	if high <= 0 {
+		return nil
+	}
+	if low <= 0 || low > high {
+		low = high / 1000
+	}
+
+	var boundaries []float64
+	for _, series := range niceSeries {
+		boundaries = boundaries[:0]
+		first := niceAtOrBelow(low, series)
+		for exponent := math.Floor(math.Log10(first)); ; exponent++ {
+			decade := math.Pow(10, exponent)
+			done := false
+			for _, mantissa := range series {
+				boundary := roundBoundary(mantissa * decade)
+				if boundary < first {
+					continue
+				}
+				boundaries = append(boundaries, boundary)
+				if boundary >= high {
+					done = true
+					break
+				}
+			}
+			if done {
+				break
+			}
+		}
+		if len(boundaries) <= advisorMaxBoundaries {
+			break
+		}
+	}
+	return slices.Clone(boundaries)
+}
+
+// niceAtOrBelow returns the largest series value times a power of ten that
+// is at most v
+func niceAtOrBelow(v float64, series []float64) float64 {
+	decade := math.Pow(10, math.Floor(math.Log10(v)))
+	nice := decade
+	for _, mantissa := range series {
+		if mantissa*decade <= v {
+			nice = mantissa * decade
+		}
+	}
+	return roundBoundary(nice)
+}
+
+// roundBoundary strips floating point noise, e.g. 0.0025000000000000005
+func roundBoundary(v float64) float64 {
+	rounded, _ := strconv.ParseFloat(fmt.Sprintf("%.6g", v), 64)
+	return rounded
+}
+
+// bucketAdviceResponse is the body of /admin/histograms/advice
+type bucketAdviceResponse struct {
+	Mode       string               `json:"mode"`
+	AnalyzedAt *time.Time           `json:"analyzed_at,omitempty"`
+	Applied    map[string][]float64 `json:"applied,omitempty"`
+	Advice     []BucketAdvice       `json:"advice"`
+}
+
+// handleBucketAdvice reports the latest histogram bucket analysis, or runs
+// one on POST
+func (ms *MetricsServer) handleBucketAdvice(w http.ResponseWriter, r *http.Request) {
+	advisor := ms.service.bucketAdvisor
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if advisor.reader == nil {
+			writeError(w, r, http.StatusConflict, msgBucketAdvisorOff)
+			return
+		}
+		if err := advisor.analyze(r.Context()); err != nil {
+			ms.writeServiceError(w, r, err)
+			return
+		}
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	advisor.mutex.Lock()
+	response := bucketAdviceResponse{Mode: advisor.mode, Advice: slices.Clone(advisor.advice)}
+	if !advisor.analyzedAt.IsZero() {
+		analyzedAt := advisor.analyzedAt
+		response.AnalyzedAt = &analyzedAt
+	}
+	if len(advisor.applied) > 0 {
+		response.Applied = maps.Clone(advisor.applied)
+	}
+	advisor.mutex.Unlock()
+	if response.Advice == nil {
+		response.Advice = []BucketAdvice{}
+	}
+
+	writeJSON(w, r, response)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheRule maps a route prefix to the Cache-Control directives applied to
+// successful responses on that route
+type CacheRule struct {
+	Prefix       string
+	CacheControl string
+	MaxAge       time.Duration
+}
+
+// CachePolicy resolves the caching headers for a request path using the
+// longest matching route prefix
+type CachePolicy struct {
+	rules []CacheRule
+}
+
+// DefaultCachePolicy keeps cart and operational data out of shared caches
+func DefaultCachePolicy() *CachePolicy {
+	return NewCachePolicy([]CacheRule{
+		{Prefix: "/", CacheControl: "no-cache"},
+		{Prefix: "/cart/", CacheControl: "private, no-store"},
+		{Prefix: "/v1/carts/", CacheControl: "private, no-store"},
+		{Prefix: "/catalog/", CacheControl: "public, max-age=60", MaxAge: time.Minute},
+		{Prefix: "/profiles", CacheControl: "private, no-store"},
+		{Prefix: "/orders", CacheControl: "private, no-store"},
+		{Prefix: "/metrics", CacheControl: "no-store"},
+		{Prefix: "/health", CacheControl: "no-store"},
+		{Prefix: "/v1/limits", CacheControl: "private, no-store"},
+	})
+}
+
+// NewCachePolicy creates a CachePolicy from a set of rules
+func NewCachePolicy(rules []CacheRule) *CachePolicy {
+	sorted := make([]CacheRule, len(rules))
+	copy(sorted, rules)
+
+	// Longest prefix first so the most specific rule wins
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+
+	return &CachePolicy{rules: sorted}
+}
+
+// ParseCachePolicy parses rules of the form
+// "/catalog/=public, max-age=300;/cart/=private, no-store" and overlays them
+// on the default policy
+func ParseCachePolicy(spec string) (*CachePolicy, error) {
+	rules := DefaultCachePolicy().rules
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, directives, found := strings.Cut(entry, "=")
+		prefix = strings.TrimSpace(prefix)
+		directives = strings.TrimSpace(directives)
+		if !found || !strings.HasPrefix(prefix, "/") || directives == "" {
+			return nil, fmt.Errorf("invalid cache rule %q", entry)
+		}
+
+		rule := CacheRule{
+			Prefix:       prefix,
+			CacheControl: directives,
+			MaxAge:       parseMaxAge(directives),
+		}
+
+		replaced := false
+		for i := range rules {
+			if rules[i].Prefix == prefix {
+				rules[i] = rule
+				replaced = true
+			}
+		}
+		if !replaced {
+			rules = append(rules, rule)
+		}
+	}
+
+	return NewCachePolicy(rules), nil
+}
+
+// parseMaxAge extracts the max-age directive, if present
+func parseMaxAge(directives string) time.Duration {
+	for _, directive := range strings.Split(directives, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// ruleFor returns the rule matching path
+func (cp *CachePolicy) ruleFor(path string) (CacheRule, bool) {
+	for _, rule := range cp.rules {
+		if strings.HasPrefix(path, rule.Prefix) {
+			return rule, true
+		}
+	}
+	return CacheRule{}, false
+}
+
+// apply sets Cache-Control and Expires headers for a response
+func (cp *CachePolicy) apply(header http.Header, r *http.Request, statusCode int) {
+	if header.Get("Cache-Control") != "" {
+		return // handler chose its own policy
+	}
+
+	rule, ok := cp.ruleFor(r.URL.Path)
+	cacheable := (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		(statusCode < 300 || statusCode == http.StatusNotModified)
+
+	if !ok || !cacheable {
+		header.Set("Cache-Control", "no-store")
+		header.Set("Expires", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		return
+	}
+
+	header.Set("Cache-Control", rule.CacheControl)
+	// The namespace and tenant headers select what a path serves, e.g. the
+	// namespace's catalog, so caches must not share responses across them
+	header.Add("Vary", namespaceHeader+", "+tenantHeader)
+	if rule.MaxAge > 0 {
+		header.Set("Expires", time.Now().Add(rule.MaxAge).UTC().Format(http.TimeFormat))
+	} else {
+		header.Set("Expires", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	}
+}
+
+// withCachePolicy wraps HTTP handlers with the server's caching policy
+func (ms *MetricsServer) withCachePolicy(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(&cacheControlWriter{ResponseWriter: w, policy: ms.cachePolicy, request: r}, r)
+	}
+}
+
+// cacheControlWriter applies caching headers once the status code is known
+type cacheControlWriter struct {
+	http.ResponseWriter
+	policy      *CachePolicy
+	request     *http.Request
+	wroteHeader bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.policy.apply(cw.Header(), cw.request, code)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheControlWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,281 @@
+package cartclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrThrottled is returned for requests the client suppressed instead of
+// sending, because the service asked it to back off or the endpoint's
+// circuit is open
+var ErrThrottled = errors.New("request throttled by client backoff")
+
+// Circuit states for a single endpoint
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// Default circuit settings of a BackoffTransport
+const (
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 10 * time.Second
+)
+
+// endpointBackoff holds the client-side throttling state for one endpoint
+type endpointBackoff struct {
+	blockedUntil        time.Time
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probe               uint64    // token of the latest probe admitted
+	probeStartedAt      time.Time // zero when no probe is in flight
+}
+
+// BackoffTransport is an http.RoundTripper that honors the service's
+// throttling signals (Retry-After and RateLimit-* headers) and opens a
+// per-endpoint circuit after repeated server failures. Closed, the circuit
+// counts consecutive failures; open, requests fail at once with
+// ErrThrottled; once the open duration passes a single probe request is let
+// through, closing the circuit if it succeeds and opening it again if it
+// fails. Requests whose context ended first don't count.
+type BackoffTransport struct {
+	next             http.RoundTripper
+	failureThreshold int
+	openDuration     time.Duration
+
+	endpoints map[string]*endpointBackoff
+	mutex     sync.Mutex
+
+	// OpenTelemetry Metrics
+	throttledCounter   metric.Int64Counter     // Counter: requests suppressed locally
+	backoffHistogram   metric.Float64Histogram // Histogram: server-requested backoff durations
+	transitionsCounter metric.Int64Counter     // Counter: circuit state transitions
+}
+
+// NewBackoffTransport wraps next, http.DefaultTransport when nil, with
+// backoff honoring and circuit breaking. Its metrics are recorded with the
+// global MeterProvider.
+func NewBackoffTransport(next http.RoundTripper) *BackoffTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	transport := &BackoffTransport{
+		next:             next,
+		failureThreshold: defaultFailureThreshold,
+		openDuration:     defaultOpenDuration,
+		endpoints:        make(map[string]*endpointBackoff),
+	}
+
+	// Instrument creation only fails for invalid names; the API still
+	// returns usable no-op instruments then
+	meter := otel.Meter("shopping-cart-service/cartclient")
+	transport.throttledCounter, _ = meter.Int64Counter(
+		"client_throttled_requests_total",
+		metric.WithDescription("Total number of client requests suppressed by backoff or an open circuit"),
+		metric.WithUnit("1"),
+	)
+	transport.backoffHistogram, _ = meter.Float64Histogram(
+		"client_backoff_duration_seconds",
+		metric.WithDescription("Backoff durations requested by the server via Retry-After or RateLimit headers"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.1, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0, 60.0),
+	)
+	transport.transitionsCounter, _ = meter.Int64Counter(
+		"client_circuit_transitions_total",
+		metric.WithDescription("Total number of client circuit breaker state transitions"),
+		metric.WithUnit("1"),
+	)
+	return transport
+}
+
+// RoundTrip sends the request unless the endpoint is currently backing off
+func (bt *BackoffTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	endpoint := req.URL.Path
+
+	reason, until, probe, ok := bt.admit(ctx, endpoint)
+	if !ok {
+		bt.throttledCounter.Add(ctx, 1,
+			metric.WithAttributes(
+				attribute.String("endpoint", endpoint),
+				attribute.String("reason", reason),
+			),
+		)
+		return nil, fmt.Errorf("%w: %s blocked until %s (%s)",
+			ErrThrottled, endpoint, until.Format(time.RFC3339), reason)
+	}
+
+	resp, err := bt.next.RoundTrip(req)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up; that says nothing about the endpoint
+		bt.release(endpoint, probe)
+		return resp, err
+	}
+	bt.observe(ctx, endpoint, probe, resp, err)
+	return resp, err
+}
+
+// admit reports whether a request to endpoint may be sent right now and,
+// when it is the half-open circuit's probe, returns its token; 0 marks
+// other requests. Refused requests come with the reason and until when.
+func (bt *BackoffTransport) admit(ctx context.Context, endpoint string) (string, time.Time, uint64, bool) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	state := bt.endpointState(endpoint)
+	now := time.Now()
+
+	if now.Before(state.blockedUntil) {
+		return "retry_after", state.blockedUntil, 0, false
+	}
+
+	switch state.state {
+	case circuitOpen:
+		reopen := state.openedAt.Add(bt.openDuration)
+		if now.Before(reopen) {
+			return "circuit_open", reopen, 0, false
+		}
+		bt.transition(ctx, endpoint, state, circuitHalfOpen)
+	case circuitHalfOpen:
+		// Only a single probe request is allowed while half-open; one that
+		// never reported back doesn't hold the circuit half-open for good
+		if !state.probeStartedAt.IsZero() && now.Before(state.probeStartedAt.Add(bt.openDuration)) {
+			return "circuit_half_open", now, 0, false
+		}
+	default:
+		return "", time.Time{}, 0, true
+	}
+	state.probe++
+	state.probeStartedAt = now
+	return "", time.Time{}, state.probe, true
+}
+
+// observe updates endpoint state from the outcome of a request. Only the
+// latest probe decides a half-open circuit; requests sent before the
+// circuit opened say nothing about the endpoint now.
+func (bt *BackoffTransport) observe(ctx context.Context, endpoint string, probe uint64, resp *http.Response, err error) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	state := bt.endpointState(endpoint)
+
+	if resp != nil {
+		if delay, ok := backoffDelay(resp); ok {
+			state.blockedUntil = time.Now().Add(delay)
+			bt.backoffHistogram.Record(ctx, delay.Seconds(),
+				metric.WithAttributes(
+					attribute.String("endpoint", endpoint),
+					attribute.Int("status_code", resp.StatusCode),
+				),
+			)
+		}
+	}
+
+	// Throttling responses are handled by blockedUntil and do not count
+	// as failures, so only transport errors and other 5xx trip the circuit
+	failed := err != nil ||
+		(resp.StatusCode >= 500 && resp.StatusCode != http.StatusServiceUnavailable) ||
+		(resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "")
+
+	if probe != 0 && probe == state.probe && state.state == circuitHalfOpen {
+		state.probeStartedAt = time.Time{}
+		if failed {
+			bt.trip(ctx, endpoint, state)
+			return
+		}
+		state.consecutiveFailures = 0
+		bt.transition(ctx, endpoint, state, circuitClosed)
+		return
+	}
+	if state.state != circuitClosed {
+		return
+	}
+
+	if !failed {
+		state.consecutiveFailures = 0
+		return
+	}
+	state.consecutiveFailures++
+	if state.consecutiveFailures >= bt.failureThreshold {
+		bt.trip(ctx, endpoint, state)
+	}
+}
+
+// release ends a request without an outcome; when it was the probe,
+// another probe may go through
+func (bt *BackoffTransport) release(endpoint string, probe uint64) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	state := bt.endpointState(endpoint)
+	if probe != 0 && probe == state.probe {
+		state.probeStartedAt = time.Time{}
+	}
+}
+
+// endpointState returns the state for endpoint, creating it if needed.
+// Callers must hold bt.mutex.
+func (bt *BackoffTransport) endpointState(endpoint string) *endpointBackoff {
+	state, exists := bt.endpoints[endpoint]
+	if !exists {
+		state = &endpointBackoff{state: circuitClosed}
+		bt.endpoints[endpoint] = state
+	}
+	return state
+}
+
+// trip opens an endpoint circuit. Callers must hold bt.mutex.
+func (bt *BackoffTransport) trip(ctx context.Context, endpoint string, state *endpointBackoff) {
+	state.openedAt = time.Now()
+	bt.transition(ctx, endpoint, state, circuitOpen)
+}
+
+// transition moves an endpoint circuit to a new state and records it
+func (bt *BackoffTransport) transition(ctx context.Context, endpoint string, state *endpointBackoff, to string) {
+	state.state = to
+	bt.transitionsCounter.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.String("endpoint", endpoint),
+			attribute.String("state", to),
+		),
+	)
+}
+
+// backoffDelay extracts the delay requested by the server, if any, from
+// Retry-After or from an exhausted RateLimit-Remaining/RateLimit-Reset pair
+func backoffDelay(resp *http.Response) (time.Duration, bool) {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			if delay := time.Until(at); delay > 0 {
+				return delay, true
+			}
+			return 0, false
+		}
+	}
+
+	for _, prefix := range []string{"RateLimit-", "X-RateLimit-"} {
+		if resp.Header.Get(prefix+"Remaining") != "0" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get(prefix + "Reset")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
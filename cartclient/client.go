@@ -0,0 +1,537 @@
+// Package cartclient is the Go SDK for the shopping cart service's HTTP
+// API. Requests identify themselves as shopping-cart-go so the service
+// reports them under the go-sdk client family. Requests are traced with
+// otelhttp, timed in the cart_client_request_duration_seconds histogram and
+// retried when the service is briefly unavailable, if retrying is safe.
+// With WithBackoff they also honor the service's throttling signals and a
+// per-endpoint circuit.
+package cartclient
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Version is the SDK version sent in X-Client-Version
+const Version = "1.0.0"
+
+// userAgent identifies the SDK to the service
+const userAgent = "shopping-cart-go/" + Version
+
+// DefaultRetries is how many times a request is retried by default
+const DefaultRetries = 2
+
+const (
+	// retryBaseDelay is the wait before the first retry; it doubles with
+	// each further one
+	retryBaseDelay = 200 * time.Millisecond
+
+	// maxRetryDelay caps the wait between attempts, including waits the
+	// service asks for in Retry-After
+	maxRetryDelay = 5 * time.Second
+)
+
+// Operations, the operation attribute of the client metrics
+const (
+	opAddItem        = "add_item"
+	opGetCart        = "get_cart"
+	opRemoveItem     = "remove_item"
+	opUpdateQuantity = "update_quantity"
+	opCheckout       = "checkout"
+	opListProducts   = "list_products"
+	opGetProduct     = "get_product"
+	opLimits         = "limits"
+	opSendEvents     = "send_events"
+)
+
+// Item is a line in a cart
+type Item struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Price    float64 `json:"price"`
+	Quantity int     `json:"quantity"`
+}
+
+// Cart is a user's cart
+type Cart struct {
+	UserID string `json:"user_id"`
+	Items  []Item `json:"items"`
+}
+
+// Product is a catalog entry
+type Product struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Price    float64 `json:"price"`
+	Stock    int     `json:"stock"`
+}
+
+// Totals are an order's computed amounts
+type Totals struct {
+	Subtotal float64 `json:"subtotal"`
+	Discount float64 `json:"discount"`
+	Total    float64 `json:"total"`
+}
+
+// Order is a placed order
+type Order struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Items     []Item    `json:"items"`
+	Totals    *Totals   `json:"totals"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RateLimit is the caller's allowance under one of the service's rate limit
+// rules
+type RateLimit struct {
+	Prefix       string  `json:"prefix"`
+	Rate         float64 `json:"rate"`
+	Burst        int     `json:"burst"`
+	Remaining    int     `json:"remaining"`
+	ResetSeconds int     `json:"reset_seconds"`
+}
+
+// CheckoutQuota is how many more checkouts the user may place before the
+// service's risk check steps in
+type CheckoutQuota struct {
+	Limit         int     `json:"limit"`
+	Remaining     int     `json:"remaining"`
+	WindowSeconds float64 `json:"window_seconds"`
+	ResetSeconds  int     `json:"reset_seconds"`
+	Decision      string  `json:"decision"`
+}
+
+// Limits are the limits in effect for a caller
+type Limits struct {
+	Subject    string      `json:"subject"`
+	Namespace  string      `json:"namespace"`
+	RateLimits []RateLimit `json:"rate_limits"`
+	Cart       struct {
+		TTLSeconds                 int     `json:"ttl_seconds"`
+		CheckoutLockTimeoutSeconds float64 `json:"checkout_lock_timeout_seconds"`
+		IdempotencyTTLSeconds      float64 `json:"idempotency_ttl_seconds"`
+		MaxIdempotencyKeyLength    int     `json:"max_idempotency_key_length"`
+		Rules                      []struct {
+			Name    string `json:"name"`
+			Kind    string `json:"kind"`
+			Message string `json:"message"`
+		} `json:"rules"`
+	} `json:"cart"`
+	Checkouts *CheckoutQuota `json:"checkouts"`
+}
+
+// Event is a clickstream event reported to the service, such as one made by
+// ProductViewed or CartOpened
+type Event struct {
+	Type       string      `json:"type"`
+	OccurredAt *time.Time  `json:"occurred_at,omitempty"` // default: when the service receives it
+	Data       interface{} `json:"data"`
+}
+
+// ProductViewed is the event of a user viewing a product
+func ProductViewed(userID, productID, sessionID string) Event {
+	return Event{Type: "product.viewed", Data: map[string]string{"user_id": userID, "product_id": productID, "session_id": sessionID}}
+}
+
+// CartOpened is the event of a user opening their cart
+func CartOpened(userID, sessionID string) Event {
+	return Event{Type: "cart.opened", Data: map[string]string{"user_id": userID, "session_id": sessionID}}
+}
+
+// APIError is a non-2xx response. Code is the service's machine-readable
+// error code, e.g. CART_NOT_FOUND or VALIDATION_ERROR; Message is its
+// localized error text and Field the offending request field, if any;
+// RequestID identifies the request in the service's logs and
+// /admin/requests lookup.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Field      string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+	return fmt.Sprintf("%d %s: %s (request %s)", e.StatusCode, http.StatusText(e.StatusCode), e.Message, e.RequestID)
+}
+
+// IsNotFound reports whether err is a 404 from the service
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Client calls one service instance
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	sessionID  string
+	synthetic  string
+	userAgent  string
+	version    string
+	retries    int
+	backoff    bool
+
+	// OpenTelemetry Metrics
+	duration     metric.Float64Histogram // Histogram: call latency, retries included, by operation and status
+	retryCounter metric.Int64Counter     // Counter: retried attempts by operation
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces the default HTTP client, whose transport is
+// traced with otelhttp; a replacement brings its own instrumentation
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithAPIKey sends key in X-API-Key, for instances requiring authentication
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithSessionID sends id in X-Session-ID, so instances with session traces
+// enabled trace the client's requests as one journey
+func WithSessionID(id string) Option {
+	return func(c *Client) {
+		c.sessionID = id
+	}
+}
+
+// WithSyntheticSource sends source in X-Synthetic-Source, e.g. prober, so
+// the instance records the client's requests as synthetic traffic, outside
+// its SLOs
+func WithSyntheticSource(source string) Option {
+	return func(c *Client) {
+		c.synthetic = source
+	}
+}
+
+// WithUserAgent identifies the client as userAgent at version instead of
+// the SDK, for tools built on it such as the traffic simulator
+func WithUserAgent(userAgent, version string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+		c.version = version
+	}
+}
+
+// WithRetries sets how many times a request is retried after a transport
+// error or a 429, 502, 503 or 504 response; 0 disables retries. Only
+// requests that are safe to repeat are retried: reads, removals, quantity
+// updates and additions, which carry an Idempotency-Key. Checkouts and
+// events are never retried.
+func WithRetries(retries int) Option {
+	return func(c *Client) {
+		c.retries = retries
+	}
+}
+
+// WithBackoff sends requests through a BackoffTransport, so the client
+// stops calling an endpoint while the service asks it to back off or the
+// endpoint keeps failing. Suppressed requests fail with ErrThrottled and are
+// not retried. It wraps the transport of a client given with WithHTTPClient
+// too, leaving that client itself unchanged.
+func WithBackoff() Option {
+	return func(c *Client) {
+		c.backoff = true
+	}
+}
+
+// New creates a client for the instance at baseURL. Its metrics are
+// recorded with the global MeterProvider.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+		userAgent: userAgent,
+		version:   Version,
+		retries:   DefaultRetries,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.backoff {
+		client := *c.httpClient
+		client.Transport = NewBackoffTransport(client.Transport)
+		c.httpClient = &client
+	}
+
+	// Instrument creation only fails for invalid names; the API still
+	// returns usable no-op instruments then
+	meter := otel.Meter("shopping-cart-service/cartclient")
+	c.duration, _ = meter.Float64Histogram(
+		"cart_client_request_duration_seconds",
+		metric.WithDescription("Duration of cart service calls as seen by the client, retries included, by operation and status code (0 for transport errors)"),
+		metric.WithUnit("s"),
+	)
+	c.retryCounter, _ = meter.Int64Counter(
+		"cart_client_retries_total",
+		metric.WithDescription("Total number of retried cart service calls by operation"),
+		metric.WithUnit("1"),
+	)
+	return c
+}
+
+// AddItem adds item to the user's cart. Each call carries its own
+// Idempotency-Key, so a retry never adds the item twice.
+func (c *Client) AddItem(ctx context.Context, userID string, item Item) error {
+	return c.do(ctx, opAddItem, http.MethodPost, cartPath(userID)+"/items", item, nil)
+}
+
+// GetCart returns the user's cart
+func (c *Client) GetCart(ctx context.Context, userID string) (*Cart, error) {
+	var cart Cart
+	if err := c.do(ctx, opGetCart, http.MethodGet, cartPath(userID), nil, &cart); err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// RemoveItem removes an item from the user's cart
+func (c *Client) RemoveItem(ctx context.Context, userID, itemID string) error {
+	return c.do(ctx, opRemoveItem, http.MethodDelete, cartPath(userID)+"/items/"+url.PathEscape(itemID), nil, nil)
+}
+
+// UpdateQuantity sets the quantity of an item in the user's cart; 0
+// removes it
+func (c *Client) UpdateQuantity(ctx context.Context, userID, itemID string, quantity int) error {
+	body := map[string]int{"quantity": quantity}
+	return c.do(ctx, opUpdateQuantity, http.MethodPatch, cartPath(userID)+"/items/"+url.PathEscape(itemID), body, nil)
+}
+
+// cartPath is the versioned route of the user's cart
+func cartPath(userID string) string {
+	return "/v1/carts/" + url.PathEscape(userID)
+}
+
+// Checkout places an order for the user's whole cart
+func (c *Client) Checkout(ctx context.Context, userID string) (*Order, error) {
+	var order Order
+	if err := c.do(ctx, opCheckout, http.MethodPost, "/cart/checkout", map[string]string{"user_id": userID}, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// ListProducts returns the catalog
+func (c *Client) ListProducts(ctx context.Context) ([]Product, error) {
+	var response struct {
+		Products []Product `json:"products"`
+	}
+	if err := c.do(ctx, opListProducts, http.MethodGet, "/catalog/products", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Products, nil
+}
+
+// GetProduct returns one catalog entry
+func (c *Client) GetProduct(ctx context.Context, productID string) (*Product, error) {
+	var product Product
+	if err := c.do(ctx, opGetProduct, http.MethodGet, "/catalog/product?id="+url.QueryEscape(productID), nil, &product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// Limits returns the limits in effect for the user, or for the caller's IP
+// when userID is empty
+func (c *Client) Limits(ctx context.Context, userID string) (*Limits, error) {
+	path := "/v1/limits"
+	if userID != "" {
+		path += "?user_id=" + url.QueryEscape(userID)
+	}
+	var limits Limits
+	if err := c.do(ctx, opLimits, http.MethodGet, path, nil, &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+// SendEvents reports up to 50 clickstream events. The service accepts or
+// rejects them together.
+func (c *Client) SendEvents(ctx context.Context, events ...Event) error {
+	return c.do(ctx, opSendEvents, http.MethodPost, "/v1/events", map[string]interface{}{"events": events}, nil)
+}
+
+// do sends body as JSON, if any, and decodes a successful response into
+// out, if given. The call is timed as operation and retried if safe.
+func (c *Client) do(ctx context.Context, operation, method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	header := http.Header{}
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	header.Set("User-Agent", c.userAgent)
+	header.Set("X-Client-Version", c.version)
+	if c.apiKey != "" {
+		header.Set("X-API-Key", c.apiKey)
+	}
+	if c.sessionID != "" {
+		header.Set("X-Session-ID", c.sessionID)
+	}
+	if c.synthetic != "" {
+		header.Set("X-Synthetic-Source", c.synthetic)
+	}
+	if operation == opAddItem {
+		header.Set("Idempotency-Key", newIdempotencyKey())
+	}
+	retryable := method == http.MethodGet || method == http.MethodDelete || method == http.MethodPatch || header.Get("Idempotency-Key") != ""
+
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = c.send(ctx, method, path, header, data)
+		if !retryable || attempt >= c.retries || !shouldRetry(ctx, resp, err) {
+			break
+		}
+		delay := retryDelay(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		c.retryCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", operation)))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	c.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("operation", operation),
+		attribute.Int("status_code", statusCode),
+	))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		apiErr := &APIError{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+		var envelope struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			Field     string `json:"field"`
+			RequestID string `json:"request_id"`
+		}
+		if json.Unmarshal(body, &envelope) == nil && envelope.Code != "" {
+			apiErr.Code, apiErr.Message, apiErr.Field = envelope.Code, envelope.Message, envelope.Field
+			if envelope.RequestID != "" {
+				apiErr.RequestID = envelope.RequestID
+			}
+			return apiErr
+		}
+		// Older instances and proxies answer in plain text, the message
+		// first
+		message, _, _ := strings.Cut(string(body), "\n")
+		apiErr.Message = strings.TrimSpace(message)
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// send makes one attempt at a request
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, data []byte) (*http.Response, error) {
+	var reader io.Reader
+	if data != nil {
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	return c.httpClient.Do(req)
+}
+
+// shouldRetry reports whether an attempt failed in a way another attempt
+// may not: a transport error, throttling or an unavailable upstream
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// Throttled requests would only be suppressed again
+		return !errors.Is(err, ErrThrottled)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay is how long to wait before retrying attempt: the response's
+// Retry-After when given, else exponential backoff with full jitter
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, maxRetryDelay)
+		}
+	}
+	backoff := min(retryBaseDelay<<attempt, maxRetryDelay)
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// newIdempotencyKey returns a random Idempotency-Key
+func newIdempotencyKey() string {
+	var b [16]byte
+	crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
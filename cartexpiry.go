@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// cartAgeBuckets label carts by time since their last change for the
+// carts_by_age gauge; the last bucket is unbounded
+var cartAgeBuckets = []struct {
+	label string
+	upTo  time.Duration
+}{
+	{"0-5m", 5 * time.Minute},
+	{"5m-1h", time.Hour},
+	{"1h-6h", 6 * time.Hour},
+	{"6h-24h", 24 * time.Hour},
+	{"24h+", 0},
+}
+
+// cartAgeBucket returns the carts_by_age label for age
+func cartAgeBucket(age time.Duration) string {
+	for _, bucket := range cartAgeBuckets {
+		if bucket.upTo == 0 || age < bucket.upTo {
+			return bucket.label
+		}
+	}
+	return cartAgeBuckets[len(cartAgeBuckets)-1].label
+}
+
+// cartExpiry evicts carts left untouched for longer than the TTL. A cart's
+// age is the time since items were last added or removed; reads don't
+// extend it. Namespaces may override the TTL for their carts.
+type cartExpiry struct {
+	ttl time.Duration // 0 disables expiry outside namespaces overriding it
+
+	// OpenTelemetry Metrics
+	expiredCounter metric.Int64Counter         // Counter: carts removed by the reaper
+	ageGauge       metric.Int64ObservableGauge // Gauge: carts per age bucket
+}
+
+// newCartExpiry creates the expiry policy for the carts scan lists
+func newCartExpiry(scan *cartScan, ttl time.Duration) (*cartExpiry, error) {
+	meter := otel.Meter("shopping-cart-service")
+	ce := &cartExpiry{ttl: ttl}
+
+	var err error
+	ce.expiredCounter, err = meter.Int64Counter(
+		"carts_expired_total",
+		metric.WithDescription("Total number of carts removed after exceeding the cart TTL"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create expired carts counter: %w", err)
+	}
+
+	ce.ageGauge, err = meter.Int64ObservableGauge(
+		"carts_by_age",
+		metric.WithDescription("Current number of carts by time since their last change"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart age gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			carts, err := scan.list(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list carts: %w", err)
+			}
+
+			now := time.Now()
+			counts := make(map[string]int64, len(cartAgeBuckets))
+			for _, bucket := range cartAgeBuckets {
+				counts[bucket.label] = 0
+			}
+			for _, cart := range carts {
+				if !cart.updatedAt.IsZero() {
+					counts[cartAgeBucket(now.Sub(cart.updatedAt))]++
+				}
+			}
+			for label, count := range counts {
+				observer.ObserveInt64(ce.ageGauge, count, metric.WithAttributes(attribute.String("age", label)))
+			}
+			return nil
+		},
+		ce.ageGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register cart age callback: %w", err)
+	}
+
+	return ce, nil
+}
+
+// RunCartReaper removes expired carts every interval until ctx is
+// cancelled. It returns immediately when expiry is disabled everywhere.
+func (cs *CartService) RunCartReaper(ctx context.Context, interval time.Duration) {
+	if cs.expiry.ttl <= 0 && !cs.namespaces.expiring() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := cs.reapExpiredCarts(ctx, time.Now())
+			if err != nil {
+				slog.ErrorContext(ctx, "Cart reaper failed", "error", err)
+			}
+			if expired > 0 {
+				slog.InfoContext(ctx, "Expired idle carts", "carts", expired, "ttl", cs.expiry.ttl.String())
+			}
+		}
+	}
+}
+
+// reapExpiredCarts removes carts idle for longer than their TTL at now and
+// returns how many were removed. ctx is unscoped, so carts are listed under
+// their storage keys and each gets its namespace's TTL.
+func (cs *CartService) reapExpiredCarts(ctx context.Context, now time.Time) (int, error) {
+	carts, err := cs.store.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list carts: %w", err)
+	}
+
+	expired := 0
+	var errs []error
+	for _, listed := range carts {
+		// The listing may be stale; expireCart re-checks under the lock
+		ttl := cs.cartTTL(listed.UserID)
+		if ttl <= 0 || !listed.updatedAt.IsZero() && now.Sub(listed.updatedAt) < ttl {
+			continue
+		}
+
+		cart, err := cs.expireCart(ctx, listed.UserID, now)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cart == nil {
+			continue
+		}
+
+		expired++
+		cs.expiry.expiredCounter.Add(ctx, 1)
+		cs.hooks.runCartExpired(ctx, cart)
+		cs.publishCartExpired(ctx, cart)
+	}
+	return expired, errors.Join(errs...)
+}
+
+// expireCart removes the user's cart if it is still expired and not held by
+// a checkout, returning the removed cart. Carts stored before expiry
+// tracking have no timestamp; they are stamped now and expire one TTL
+// later.
+func (cs *CartService) expireCart(ctx context.Context, userID string, now time.Time) (*Cart, error) {
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if errors.Is(err, ErrCartNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cart.lockedAt(now):
+		return nil, nil
+	case cart.updatedAt.IsZero():
+		cart.updatedAt = now
+		return nil, cs.store.Put(ctx, cart)
+	case now.Sub(cart.updatedAt) < cs.cartTTL(userID):
+		return nil, nil
+	}
+
+	if err := cs.store.Delete(ctx, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete expired cart for user %s: %w", userID, err)
+	}
+	return cart, nil
+}
+
+// publishCartExpired publishes the cart.expired event of a removed cart,
+// in the namespace its storage key belongs to
+func (cs *CartService) publishCartExpired(ctx context.Context, cart *Cart) {
+	event := events.CartExpired{UserID: cart.UserID}
+	if namespace := cs.namespaces.ofKey(cart.UserID); namespace != nil {
+		event.UserID, _ = namespace.userOf(cart.UserID)
+		ctx = withNamespace(ctx, namespace)
+	}
+	for _, item := range cart.Items {
+		event.ItemCount += item.Quantity
+		event.Value += item.Price * float64(item.Quantity)
+	}
+	cs.publisher.publish(ctx, event)
+}
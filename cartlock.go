@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// defaultCheckoutLockTimeout bounds how long a checkout may hold a cart
+const defaultCheckoutLockTimeout = 30 * time.Second
+
+// ErrCartLocked is returned when mutating a cart that is being checked out
+var ErrCartLocked = errors.New("cart is locked for checkout")
+
+// lockedAt reports whether a checkout holds the cart at now. The lock is
+// stored with the cart so every instance sharing the store honors it.
+func (c *Cart) lockedAt(now time.Time) bool {
+	return now.Before(c.lockedUntil)
+}
+
+// checkoutLockKey returns the Redis key of the checkout lock on userID's
+// cart in the tenant and namespace of ctx
+func checkoutLockKey(ctx context.Context, userID string) string {
+	return "lock:checkout:" + storageKey(ctx, userID)
+}
+
+// checkoutLockToken identifies the checkout lock expiring at until
+func checkoutLockToken(until time.Time) string {
+	return strconv.FormatInt(until.UnixNano(), 10)
+}
+
+// lockCart marks a cart read-only for a checkout and returns the lock's
+// expiry, which identifies the lock when releasing it. The lock lapses on its
+// own after the checkout lock timeout so a stuck checkout cannot wedge the
+// cart. With carts in Redis the lock is first taken there with SET NX PX,
+// so two instances can't both find the cart unlocked and lock it.
+func (cs *CartService) lockCart(ctx context.Context, userID string) (time.Time, error) {
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	if cart.lockedAt(now) {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrCartLocked, userID)
+	}
+	until := now.Add(cs.checkoutLockTimeout)
+	if cs.checkoutLocks != nil {
+		taken, err := cs.checkoutLocks.lock(ctx, checkoutLockKey(ctx, userID), checkoutLockToken(until), cs.checkoutLockTimeout)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !taken {
+			return time.Time{}, fmt.Errorf("%w: %s", ErrCartLocked, userID)
+		}
+	}
+
+	cart.lockedUntil = until
+	if err := cs.store.Put(ctx, cart); err != nil {
+		cs.releaseCheckoutLock(ctx, userID, until)
+		return time.Time{}, err
+	}
+	return until, nil
+}
+
+// releaseCheckoutLock releases the Redis checkout lock identified by until,
+// if carts are in Redis and it hasn't lapsed
+func (cs *CartService) releaseCheckoutLock(ctx context.Context, userID string, until time.Time) {
+	if cs.checkoutLocks == nil {
+		return
+	}
+	if err := cs.checkoutLocks.unlock(ctx, checkoutLockKey(ctx, userID), checkoutLockToken(until)); err != nil {
+		slog.ErrorContext(ctx, "Failed to release checkout lock", "user_id", userID, "error", err)
+	}
+}
+
+// unlockCart releases the checkout lock identified by until, leaving any
+// newer lock taken after it lapsed in place. Carts removed by the checkout
+// are already gone and need no unlocking.
+func (cs *CartService) unlockCart(ctx context.Context, userID string, until time.Time) {
+	defer cs.cartLocks.lock(userID)()
+	// Released after the cart, so no other checkout locks it in between
+	defer cs.releaseCheckoutLock(ctx, userID, until)
+
+	cart, err := cs.store.Get(ctx, userID)
+	if err != nil {
+		if !errors.Is(err, ErrCartNotFound) {
+			slog.ErrorContext(ctx, "Failed to release checkout lock", "user_id", userID, "error", err)
+		}
+		return
+	}
+
+	if cart.lockedUntil.Equal(until) {
+		cart.lockedUntil = time.Time{}
+		if err := cs.store.Put(ctx, cart); err != nil {
+			slog.ErrorContext(ctx, "Failed to release checkout lock", "user_id", userID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// unlistedItem labels item metrics of items that are not in the catalog
+const unlistedItem = "unlisted"
+
+// cartActivityMetrics records units added to and removed from carts per
+// item, and cart sizes as they change. Items are labeled by catalog ID, so
+// client-invented IDs share the unlisted series instead of each getting
+// their own.
+type cartActivityMetrics struct {
+	catalog func(ctx context.Context) *Catalog // the catalog of the request's namespace
+
+	// OpenTelemetry Metrics
+	itemsAdded   metric.Int64Counter   // Counter: units added to carts per item
+	itemsRemoved metric.Int64Counter   // Counter: units removed from carts per item
+	cartSize     metric.Int64Histogram // Histogram: units in a cart after each change
+}
+
+// newCartActivityMetrics creates the per-item and cart size instruments,
+// looking up items in the catalog returned for each request
+func newCartActivityMetrics(catalog func(ctx context.Context) *Catalog) (*cartActivityMetrics, error) {
+	meter := otel.Meter("shopping-cart-service")
+	am := &cartActivityMetrics{catalog: catalog}
+
+	var err error
+	am.itemsAdded, err = meter.Int64Counter(
+		"cart_items_added_total",
+		metric.WithDescription("Total number of units added to carts by item"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create items added counter: %w", err)
+	}
+
+	am.itemsRemoved, err = meter.Int64Counter(
+		"cart_items_removed_total",
+		metric.WithDescription("Total number of units removed from carts by item"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create items removed counter: %w", err)
+	}
+
+	am.cartSize, err = meter.Int64Histogram(
+		"cart_size_items",
+		metric.WithDescription("Distribution of units per cart, recorded when a cart's items change"),
+		metric.WithUnit("1"),
+		metric.WithExplicitBucketBoundaries(1, 2, 3, 5, 10, 20, 50, 100),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart size histogram: %w", err)
+	}
+
+	return am, nil
+}
+
+// recordAdded counts units of itemID added to cart and records its new size
+func (am *cartActivityMetrics) recordAdded(ctx context.Context, cart *Cart, itemID string, units int) {
+	am.itemsAdded.Add(ctx, int64(units), am.itemAttributes(ctx, itemID))
+	am.recordSize(ctx, cart)
+}
+
+// recordRemoved counts units of itemID removed from cart and records its
+// new size
+func (am *cartActivityMetrics) recordRemoved(ctx context.Context, cart *Cart, itemID string, units int) {
+	am.itemsRemoved.Add(ctx, int64(units), am.itemAttributes(ctx, itemID))
+	am.recordSize(ctx, cart)
+}
+
+// recordCleared counts the units of every item removed from a cleared
+// cart and records its new size
+func (am *cartActivityMetrics) recordCleared(ctx context.Context, cart *Cart, removed []CartItem) {
+	for _, item := range removed {
+		am.itemsRemoved.Add(ctx, int64(item.Quantity), am.itemAttributes(ctx, item.ID))
+	}
+	am.recordSize(ctx, cart)
+}
+
+func (am *cartActivityMetrics) recordSize(ctx context.Context, cart *Cart) {
+	units := 0
+	for _, item := range cart.Items {
+		units += item.Quantity
+	}
+	am.cartSize.Record(ctx, int64(units), metric.WithAttributes(namespaceAttributes(ctx)...))
+}
+
+// itemAttributes labels itemID with its catalog ID, or unlistedItem
+func (am *cartActivityMetrics) itemAttributes(ctx context.Context, itemID string) metric.MeasurementOption {
+	if _, err := am.catalog(ctx).Get(itemID); err != nil {
+		itemID = unlistedItem
+	}
+	return metric.WithAttributes(append(namespaceAttributes(ctx), attribute.String("item_id", itemID))...)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"shopping-cart-service/config"
+)
+
+// Cart rule kinds
+const (
+	cartRuleEligibility = "eligibility" // item may be added; item and cart before the add
+	cartRuleLimit       = "limit"       // cart stays within limits; cart after the add
+	cartRuleDiscount    = "discount"    // amount off a line; item is the priced line
+)
+
+// defaultCartRuleCostLimit bounds the work a single evaluation may do
+const defaultCartRuleCostLimit = 10000
+
+// compiledCartRule is a cart rule ready to evaluate
+type compiledCartRule struct {
+	name    string
+	kind    string
+	message string
+	program cel.Program
+}
+
+// CartRules evaluates admin-defined CEL expressions. Expressions see:
+//
+//	user_id  string
+//	cart     {user_id, items: [{id, name, price, quantity}], subtotal, item_count}
+//	item     {id, name, price, quantity}
+//	now      timestamp
+//
+// Eligibility and limit rules must evaluate to a bool; discount rules to a
+// double amount taken off the line.
+type CartRules struct {
+	rules []compiledCartRule
+
+	// OpenTelemetry Metrics
+	evaluationCounter  metric.Int64Counter     // Counter: evaluations by rule, kind and result
+	evaluationDuration metric.Float64Histogram // Histogram: evaluation duration
+	evaluationCost     metric.Int64Histogram   // Histogram: CEL cost units per evaluation
+}
+
+// NewCartRules compiles the configured rules, rejecting expressions that
+// don't parse or type-check
+func NewCartRules(cfg config.CartRulesConfig) (*CartRules, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	env, err := cel.NewEnv(
+		cel.Variable("user_id", cel.StringType),
+		cel.Variable("cart", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("item", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("now", cel.TimestampType),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rule environment: %w", err)
+	}
+
+	costLimit := cfg.CostLimit
+	if costLimit == 0 {
+		costLimit = defaultCartRuleCostLimit
+	}
+
+	cr := &CartRules{}
+	for _, rule := range cfg.Rules {
+		switch rule.Kind {
+		case cartRuleEligibility, cartRuleLimit, cartRuleDiscount:
+		default:
+			return nil, fmt.Errorf("cart rule %s: unknown kind %q: expected %s, %s or %s", rule.Name, rule.Kind, cartRuleEligibility, cartRuleLimit, cartRuleDiscount)
+		}
+
+		ast, issues := env.Compile(rule.Expression)
+		if issues.Err() != nil {
+			return nil, fmt.Errorf("cart rule %s: %w", rule.Name, issues.Err())
+		}
+		output := ast.OutputType()
+		if rule.Kind == cartRuleDiscount {
+			if !output.IsExactType(cel.DoubleType) && !output.IsExactType(cel.DynType) {
+				return nil, fmt.Errorf("cart rule %s: discount expressions must return a double, got %s", rule.Name, output)
+			}
+		} else if !output.IsExactType(cel.BoolType) && !output.IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("cart rule %s: %s expressions must return a bool, got %s", rule.Name, rule.Kind, output)
+		}
+
+		program, err := env.Program(ast, cel.CostLimit(costLimit), cel.EvalOptions(cel.OptTrackCost))
+		if err != nil {
+			return nil, fmt.Errorf("cart rule %s: %w", rule.Name, err)
+		}
+		cr.rules = append(cr.rules, compiledCartRule{
+			name:    rule.Name,
+			kind:    rule.Kind,
+			message: rule.Message,
+			program: program,
+		})
+	}
+
+	cr.evaluationCounter, err = meter.Int64Counter(
+		"cart_rule_evaluations_total",
+		metric.WithDescription("Total number of cart rule evaluations by rule, kind and result (pass, fail, applied, skipped, error)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart rule counter: %w", err)
+	}
+
+	cr.evaluationDuration, err = meter.Float64Histogram(
+		"cart_rule_evaluation_duration_seconds",
+		metric.WithDescription("Cart rule evaluation duration in seconds by rule and kind"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart rule duration histogram: %w", err)
+	}
+
+	cr.evaluationCost, err = meter.Int64Histogram(
+		"cart_rule_evaluation_cost",
+		metric.WithDescription("CEL cost units consumed per cart rule evaluation"),
+		metric.WithUnit("1"),
+		metric.WithExplicitBucketBoundaries(1, 10, 50, 100, 500, 1000, 5000, 10000),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart rule cost histogram: %w", err)
+	}
+
+	return cr, nil
+}
+
+// ruleCart is the CEL view of a cart
+func ruleCart(cart *Cart) map[string]interface{} {
+	items := make([]interface{}, 0, len(cart.Items))
+	subtotal, count := 0.0, 0
+	for _, item := range cart.Items {
+		items = append(items, ruleItem(item))
+		subtotal += item.Price * float64(item.Quantity)
+		count += item.Quantity
+	}
+	return map[string]interface{}{
+		"user_id":    cart.UserID,
+		"items":      items,
+		"subtotal":   roundCents(subtotal),
+		"item_count": count,
+	}
+}
+
+// ruleItem is the CEL view of a cart line
+func ruleItem(item CartItem) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       item.ID,
+		"name":     item.Name,
+		"price":    item.Price,
+		"quantity": item.Quantity,
+	}
+}
+
+// eval runs one rule and records its cost and duration
+func (cr *CartRules) eval(ctx context.Context, rule compiledCartRule, vars map[string]interface{}) (interface{}, error) {
+	start := time.Now()
+	out, details, err := rule.program.Eval(vars)
+	attrs := metric.WithAttributes(attribute.String("rule", rule.name), attribute.String("kind", rule.kind))
+	cr.evaluationDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if details != nil && details.ActualCost() != nil {
+		cr.evaluationCost.Record(ctx, int64(*details.ActualCost()), attrs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Value(), nil
+}
+
+// count records the result of a rule evaluation
+func (cr *CartRules) count(ctx context.Context, rule compiledCartRule, result string) {
+	cr.evaluationCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("rule", rule.name),
+		attribute.String("kind", rule.kind),
+		attribute.String("result", result),
+	), metric.WithAttributes(namespaceAttributes(ctx)...))
+}
+
+// checkAdd evaluates the eligibility and limit rules for adding item to
+// cart, which may be nil for a new cart. A rule that fails to evaluate is
+// logged and skipped so a bad expression can't block every add.
+func (cr *CartRules) checkAdd(ctx context.Context, userID string, cart *Cart, item CartItem) error {
+	if cart == nil {
+		cart = &Cart{UserID: userID, Items: []CartItem{}}
+	}
+	after := cart.clone()
+	after.Items = append(after.Items, item)
+
+	now := time.Now()
+	for _, rule := range cr.rules {
+		vars := map[string]interface{}{"user_id": userID, "item": ruleItem(item), "now": now}
+		switch rule.kind {
+		case cartRuleEligibility:
+			vars["cart"] = ruleCart(cart)
+		case cartRuleLimit:
+			vars["cart"] = ruleCart(after)
+		default:
+			continue
+		}
+
+		out, err := cr.eval(ctx, rule, vars)
+		allowed, ok := out.(bool)
+		if err == nil && !ok {
+			err = fmt.Errorf("returned %T, want bool", out)
+		}
+		if err != nil {
+			cr.count(ctx, rule, "error")
+			slog.WarnContext(ctx, "Cart rule skipped", "rule", rule.name, "error", err)
+			continue
+		}
+		if !allowed {
+			cr.count(ctx, rule, "fail")
+			if rule.message != "" {
+				return errors.New(rule.message)
+			}
+			return fmt.Errorf("cart rule %s", rule.name)
+		}
+		cr.count(ctx, rule, "pass")
+	}
+	return nil
+}
+
+// applyDiscounts evaluates the discount rules for every priced line
+func (cr *CartRules) applyDiscounts(ctx context.Context, cart *Cart, totals *CartTotals) {
+	now := time.Now()
+	view := ruleCart(cart)
+	for _, rule := range cr.rules {
+		if rule.kind != cartRuleDiscount {
+			continue
+		}
+
+		for i, item := range cart.Items {
+			if i >= len(totals.Lines) {
+				break
+			}
+			line := &totals.Lines[i]
+
+			out, err := cr.eval(ctx, rule, map[string]interface{}{
+				"user_id": cart.UserID, "cart": view, "item": ruleItem(item), "now": now,
+			})
+			amount, ok := out.(float64)
+			if err == nil && !ok {
+				err = fmt.Errorf("returned %T, want double", out)
+			}
+			if err != nil {
+				cr.count(ctx, rule, "error")
+				slog.WarnContext(ctx, "Cart rule skipped", "rule", rule.name, "item_id", item.ID, "error", err)
+				continue
+			}
+			if amount <= 0 || line.Total <= 0 {
+				cr.count(ctx, rule, "skipped")
+				continue
+			}
+
+			discount := math.Min(roundCents(amount), line.Total)
+			line.Discount = roundCents(line.Discount + discount)
+			line.Total = roundCents(line.Total - discount)
+			line.AppliedRules = append(line.AppliedRules, rule.name)
+			totals.Discount = roundCents(totals.Discount + discount)
+			totals.Total = roundCents(totals.Total - discount)
+			cr.count(ctx, rule, "applied")
+		}
+	}
+}
+
+// checkCartRules is the OnBeforeAddItem hook enforcing eligibility and limit
+// rules against the user's current cart
+func (cs *CartService) checkCartRules(ctx context.Context, userID string, item CartItem) error {
+	cart, err := cs.store.Get(ctx, userID)
+	if err != nil && !errors.Is(err, ErrCartNotFound) {
+		// The add itself will surface the store failure
+		slog.WarnContext(ctx, "Cart rules skipped", "user_id", userID, "error", err)
+		return nil
+	}
+	return cs.cartRulesFor(ctx).checkAdd(ctx, userID, cart, item)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Cart change types, the event field of /v1/carts/{userID}/events
+const (
+	cartChangeItemAdded   = "item_added"
+	cartChangeItemRemoved = "item_removed"
+	cartChangeItemUpdated = "item_updated"
+)
+
+const (
+	// cartChangeBuffer is how many changes a subscriber may fall behind by
+	// before it is disconnected
+	cartChangeBuffer = 32
+
+	// cartStreamHeartbeat is how often idle streams send a comment, so
+	// proxies don't close them
+	cartStreamHeartbeat = 15 * time.Second
+)
+
+// cartEvent is one change to a cart, sent to the cart's stream subscribers
+type cartEvent struct {
+	ID         uint64    `json:"id"`
+	Type       string    `json:"type"`
+	UserID     string    `json:"user_id"`
+	ItemID     string    `json:"item_id"`
+	Quantity   int       `json:"quantity"` // the item's quantity in the cart after the change
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// cartChangeHub fans cart changes out to the streams subscribed to each
+// cart. Publishing never blocks: a subscriber too slow to keep up is
+// disconnected, so its client reconnects and refetches the cart rather than
+// silently missing changes.
+type cartChangeHub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[*cartSubscriber]struct{} // storage key -> subscribers
+	count       int
+	nextID      uint64
+	closed      bool
+
+	// OpenTelemetry Metrics
+	subscribersGauge metric.Int64ObservableGauge // Gauge: open cart event streams
+	slowCounter      metric.Int64Counter         // Counter: streams disconnected for falling behind
+}
+
+// cartSubscriber is one open stream; changes is closed when the stream
+// must end
+type cartSubscriber struct {
+	changes chan cartEvent
+}
+
+func newCartChangeHub() (*cartChangeHub, error) {
+	meter := otel.Meter("shopping-cart-service")
+	hub := &cartChangeHub{subscribers: make(map[string]map[*cartSubscriber]struct{})}
+
+	var err error
+	hub.subscribersGauge, err = meter.Int64ObservableGauge(
+		"cart_event_subscribers",
+		metric.WithDescription("Current number of open cart event streams"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart event subscribers gauge: %w", err)
+	}
+
+	hub.slowCounter, err = meter.Int64Counter(
+		"cart_event_slow_subscribers_total",
+		metric.WithDescription("Total number of cart event streams disconnected for falling behind"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart event slow subscribers counter: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			hub.mutex.Lock()
+			defer hub.mutex.Unlock()
+			observer.ObserveInt64(hub.subscribersGauge, int64(hub.count))
+			return nil
+		},
+		hub.subscribersGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register cart event subscribers callback: %w", err)
+	}
+
+	return hub, nil
+}
+
+// subscribe opens a stream of the changes to userID's cart. It returns
+// false once the hub is closed.
+func (h *cartChangeHub) subscribe(ctx context.Context, userID string) (*cartSubscriber, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return nil, false
+	}
+	key := storageKey(ctx, userID)
+	sub := &cartSubscriber{changes: make(chan cartEvent, cartChangeBuffer)}
+	if h.subscribers[key] == nil {
+		h.subscribers[key] = make(map[*cartSubscriber]struct{})
+	}
+	h.subscribers[key][sub] = struct{}{}
+	h.count++
+	return sub, true
+}
+
+// unsubscribe ends a stream; it is a no-op for streams already ended
+func (h *cartChangeHub) unsubscribe(ctx context.Context, userID string, sub *cartSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.remove(storageKey(ctx, userID), sub)
+}
+
+// remove drops sub and closes its channel; the caller holds the mutex
+func (h *cartChangeHub) remove(key string, sub *cartSubscriber) {
+	subs := h.subscribers[key]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, key)
+	}
+	h.count--
+	close(sub.changes)
+}
+
+// publish sends a change of userID's cart to its subscribers
+func (h *cartChangeHub) publish(ctx context.Context, changeType, userID, itemID string, quantity int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := storageKey(ctx, userID)
+	subs := h.subscribers[key]
+	if len(subs) == 0 {
+		return
+	}
+	h.nextID++
+	change := cartEvent{
+		ID:         h.nextID,
+		Type:       changeType,
+		UserID:     userID,
+		ItemID:     itemID,
+		Quantity:   quantity,
+		OccurredAt: time.Now().UTC(),
+	}
+	for sub := range subs {
+		select {
+		case sub.changes <- change:
+		default:
+			h.remove(key, sub)
+			h.slowCounter.Add(ctx, 1)
+		}
+	}
+}
+
+// Close ends every stream and refuses new ones, so open streams don't hold
+// up the server's shutdown
+func (h *cartChangeHub) Close() {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+	for key, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(key, sub)
+		}
+	}
+}
+
+// handleV1CartEvents serves GET /v1/carts/{userID}/events, a Server-Sent
+// Events stream of the changes to the cart from the time it is opened.
+// Clients subscribe first, then GET the cart; a stream that ends, e.g. for
+// falling behind, is reconnected to and the cart refetched.
+func (ms *MetricsServer) handleV1CartEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	userID := r.PathValue("userID")
+	setRequestUser(ctx, userID)
+
+	hub := ms.service.changes
+	sub, ok := hub.subscribe(ctx, userID)
+	if !ok {
+		writeError(w, r, http.StatusServiceUnavailable, msgShuttingDown)
+		return
+	}
+	defer hub.unsubscribe(ctx, userID, sub)
+
+	controller := http.NewResponseController(w)
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // nginx would otherwise buffer the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if controller.Flush() != nil {
+		return // the response can't be streamed
+	}
+
+	heartbeat := time.NewTicker(cartStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case change, open := <-sub.changes:
+			if !open {
+				return
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", strconv.FormatUint(change.ID, 10), change.Type, data)
+		}
+		if controller.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Product represents an item that can be added to a cart
+type Product struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	Price     float64   `json:"price"`
+	Stock     int       `json:"stock"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Shipping attributes of a single unit
+	Weight     float64     `json:"weight,omitempty"`
+	WeightUnit string      `json:"weight_unit,omitempty"` // kg, g, lb or oz
+	Dimensions *Dimensions `json:"dimensions,omitempty"`
+
+	version uint64
+}
+
+// Catalog holds the set of available products and tracks its modification
+// time and version so clients can issue conditional requests
+type Catalog struct {
+	products   map[string]*Product
+	version    uint64
+	modifiedAt time.Time
+	mutex      sync.RWMutex
+}
+
+// NewCatalog creates a catalog seeded with the given products
+func NewCatalog(products []Product) (*Catalog, error) {
+	catalog := &Catalog{
+		products:   make(map[string]*Product),
+		modifiedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	for _, product := range products {
+		if err := catalog.Upsert(product); err != nil {
+			return nil, err
+		}
+	}
+	return catalog, nil
+}
+
+// defaultProducts is the demo catalog used when nothing else is configured
+func defaultProducts() []Product {
+	return []Product{
+		{ID: "item1", Name: "Widget A", Category: "widgets", Price: 19.99, Stock: 100,
+			Weight: 250, WeightUnit: "g", Dimensions: &Dimensions{Length: 10, Width: 10, Height: 5, Unit: "cm"}},
+		{ID: "item2", Name: "Widget B", Category: "widgets", Price: 29.99, Stock: 100,
+			Weight: 0.8, WeightUnit: "kg", Dimensions: &Dimensions{Length: 20, Width: 15, Height: 10, Unit: "cm"}},
+		{ID: "item3", Name: "Widget C", Category: "gadgets", Price: 39.99, Stock: 50,
+			Weight: 2.5, WeightUnit: "lb", Dimensions: &Dimensions{Length: 12, Width: 8, Height: 6, Unit: "in"}},
+		{ID: "item4", Name: "Widget D", Category: "accessories", Price: 49.99, Stock: 25,
+			Weight: 1.2, WeightUnit: "kg", Dimensions: &Dimensions{Length: 60, Width: 40, Height: 30, Unit: "cm"}},
+	}
+}
+
+// catalogSourceClient fetches remote catalog sources, created on first use
+// so its pool takes the configured settings
+var catalogSourceClient = sync.OnceValue(func() *http.Client {
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: otelhttp.NewTransport(outboundPools.transport("catalog")),
+	}
+})
+
+// loadCatalogSource reads the products at source, a file path or http(s)
+// URL holding a GET /catalog/products response
+func loadCatalogSource(ctx context.Context, source string) ([]Product, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := catalogSourceClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", source, resp.Status)
+		}
+		body = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		body = file
+	}
+	defer body.Close()
+
+	var listing struct {
+		Products []Product `json:"products"`
+	}
+	if err := json.NewDecoder(body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("failed to decode catalog %s: %w", source, err)
+	}
+	if len(listing.Products) == 0 {
+		return nil, errors.New("catalog source has no products")
+	}
+	return listing.Products, nil
+}
+
+// newSourcedCatalog creates the catalog for source, which readiness loads
+// in the background as the dependency name; the instance isn't ready until
+// it has. An empty source gives the built-in demo catalog.
+func newSourcedCatalog(readiness *Readiness, name, source string) (*Catalog, error) {
+	if source == "" {
+		return NewCatalog(defaultProducts())
+	}
+
+	catalog, err := NewCatalog(nil)
+	if err != nil {
+		return nil, err
+	}
+	readiness.Require(name, func(ctx context.Context) error {
+		products, err := loadCatalogSource(ctx, source)
+		if err != nil {
+			return err
+		}
+		for _, product := range products {
+			if err := catalog.Upsert(product); err != nil {
+				return fmt.Errorf("product %s: %w", product.ID, err)
+			}
+		}
+		return nil
+	})
+	return catalog, nil
+}
+
+// Upsert adds or replaces a product, bumping the catalog version
+func (c *Catalog) Upsert(product Product) error {
+	if err := product.validateUnits(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// HTTP dates have second precision, so truncate to keep
+	// If-Modified-Since comparisons exact
+	now := time.Now().UTC().Truncate(time.Second)
+
+	c.version++
+	c.modifiedAt = now
+
+	product.UpdatedAt = now
+	product.version = c.version
+	c.products[product.ID] = &product
+	return nil
+}
+
+// CheckStock verifies that quantity units of a product are available. Items
+// that are not in the catalog are not stock-tracked and always pass.
+func (c *Catalog) CheckStock(id string, quantity int) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	product, exists := c.products[id]
+	if !exists || product.Stock >= quantity {
+		return nil
+	}
+	return fmt.Errorf("%w: %s has %d, requested %d", ErrInsufficientStock, id, product.Stock, quantity)
+}
+
+// Restock adds quantity units to a product's stock and returns the updated
+// product
+func (c *Catalog) Restock(id string, quantity int) (Product, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	product, exists := c.products[id]
+	if !exists {
+		return Product{}, fmt.Errorf("%w: %s", ErrProductNotFound, id)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	c.version++
+	c.modifiedAt = now
+
+	product.Stock += quantity
+	product.UpdatedAt = now
+	product.version = c.version
+	return *product, nil
+}
+
+// Deduct removes the stock for a set of cart items, failing without changes
+// if any stock-tracked item is short
+func (c *Catalog) Deduct(items []CartItem) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, item := range items {
+		if product, exists := c.products[item.ID]; exists && product.Stock < item.Quantity {
+			return fmt.Errorf("%w: %s has %d, requested %d", ErrInsufficientStock, item.ID, product.Stock, item.Quantity)
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	c.version++
+	c.modifiedAt = now
+	for _, item := range items {
+		if product, exists := c.products[item.ID]; exists {
+			product.Stock -= item.Quantity
+			product.UpdatedAt = now
+			product.version = c.version
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of a single product
+func (c *Catalog) Get(id string) (Product, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	product, exists := c.products[id]
+	if !exists {
+		return Product{}, fmt.Errorf("%w: %s", ErrProductNotFound, id)
+	}
+	return *product, nil
+}
+
+// CategoryOf returns the category of a product, or uncategorizedCategory
+// for items that are not in the catalog
+func (c *Catalog) CategoryOf(id string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if product, exists := c.products[id]; exists && product.Category != "" {
+		return product.Category
+	}
+	return uncategorizedCategory
+}
+
+// List returns products sorted by ID together with the catalog version and
+// modification time. A non-empty category restricts the listing to it.
+func (c *Catalog) List(category string) ([]Product, uint64, time.Time) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	products := make([]Product, 0, len(c.products))
+	for _, product := range c.products {
+		if category != "" && product.Category != category {
+			continue
+		}
+		products = append(products, *product)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].ID < products[j].ID
+	})
+
+	return products, c.version, c.modifiedAt
+}
+
+// checkNotModified evaluates If-None-Match and If-Modified-Since against the
+// current representation. It sets the validators on the response and writes
+// a 304 when the client's copy is still fresh.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modifiedAt time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modifiedAt.UTC().Format(http.TimeFormat))
+
+	// If-None-Match takes precedence over If-Modified-Since (RFC 9110 13.2.2)
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		if t, err := http.ParseTime(since); err == nil && !modifiedAt.After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ms *MetricsServer) handleListProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	category := r.URL.Query().Get("category")
+	products, version, modifiedAt := ms.service.catalogFor(r.Context()).List(category)
+	if checkNotModified(w, r, fmt.Sprintf(`W/"catalog-%d"`, version), modifiedAt) {
+		return
+	}
+
+	response := map[string]interface{}{
+		"version":  version,
+		"products": products,
+	}
+	if category != "" {
+		response["category"] = category
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (ms *MetricsServer) handleGetProduct(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	productID := r.URL.Query().Get("id")
+	if productID == "" {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "id")
+		return
+	}
+
+	product, err := ms.service.catalogFor(r.Context()).Get(productID)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, msgProductNotFound, productID)
+		return
+	}
+
+	if checkNotModified(w, r, fmt.Sprintf(`"%s-%d"`, product.ID, product.version), product.UpdatedAt) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
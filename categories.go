@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// uncategorizedCategory labels items that are not in the catalog
+const uncategorizedCategory = "uncategorized"
+
+// categoryMetrics records add-to-cart and checkout activity per product
+// category. Categories come from the catalog, so label cardinality is
+// bounded by the catalog rather than by client input.
+type categoryMetrics struct {
+	catalog func(ctx context.Context) *Catalog // the catalog of the request's namespace
+
+	// OpenTelemetry Metrics
+	unitsAdded metric.Int64Counter   // Counter: units added to carts per category
+	unitsSold  metric.Int64Counter   // Counter: units checked out per category
+	revenue    metric.Float64Counter // Counter: checked-out revenue per category
+}
+
+// newCategoryMetrics creates the per-category instruments, looking up
+// categories in the catalog returned for each request
+func newCategoryMetrics(catalog func(ctx context.Context) *Catalog) (*categoryMetrics, error) {
+	meter := otel.Meter("shopping-cart-service")
+	cm := &categoryMetrics{catalog: catalog}
+
+	var err error
+	cm.unitsAdded, err = meter.Int64Counter(
+		"cart_units_added_total",
+		metric.WithDescription("Total number of units added to carts by product category"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create units added counter: %w", err)
+	}
+
+	cm.unitsSold, err = meter.Int64Counter(
+		"checkout_units_total",
+		metric.WithDescription("Total number of units checked out by product category"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create units sold counter: %w", err)
+	}
+
+	cm.revenue, err = meter.Float64Counter(
+		"checkout_revenue_total",
+		metric.WithDescription("Total checked-out revenue after discounts by product category"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create revenue counter: %w", err)
+	}
+
+	return cm, nil
+}
+
+// recordItemAdded records an add-to-cart and adds a span event carrying the
+// item's category
+func (cm *categoryMetrics) recordItemAdded(ctx context.Context, item CartItem) {
+	category := cm.catalog(ctx).CategoryOf(item.ID)
+
+	cm.unitsAdded.Add(ctx, int64(item.Quantity),
+		metric.WithAttributes(attribute.String("category", category)),
+		metric.WithAttributes(namespaceAttributes(ctx)...),
+	)
+	trace.SpanFromContext(ctx).AddEvent("cart.item_added", trace.WithAttributes(
+		attribute.String("item.id", item.ID),
+		attribute.String("item.category", category),
+		attribute.Int("item.quantity", item.Quantity),
+	))
+}
+
+// recordCheckout records units and revenue per category for a placed order
+func (cm *categoryMetrics) recordCheckout(ctx context.Context, order *Order) {
+	span := trace.SpanFromContext(ctx)
+	catalog := cm.catalog(ctx)
+	for _, line := range order.Totals.Lines {
+		category := catalog.CategoryOf(line.ItemID)
+		attrs := metric.WithAttributes(append(namespaceAttributes(ctx), attribute.String("category", category))...)
+
+		cm.unitsSold.Add(ctx, int64(line.Quantity), attrs)
+		cm.revenue.Add(ctx, line.Total, attrs)
+		span.AddEvent("checkout.line", trace.WithAttributes(
+			attribute.String("order.id", order.ID),
+			attribute.String("item.id", line.ItemID),
+			attribute.String("item.category", category),
+			attribute.Int("item.quantity", line.Quantity),
+			attribute.Float64("line.total", line.Total),
+		))
+	}
+}
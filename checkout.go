@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Order statuses
+const (
+	orderStatusPlaced = "placed"
+)
+
+// Checkout scopes
+const (
+	checkoutScopeFull    = "full"
+	checkoutScopePartial = "partial"
+)
+
+// Errors returned by checkout
+var (
+	ErrEmptyCart        = errors.New("cart is empty")
+	ErrCheckoutRejected = errors.New("checkout rejected by risk checks")
+	ErrOrderNotFound    = errors.New("order not found")
+)
+
+// Order is a cart converted at checkout
+type Order struct {
+	ID        string      `json:"id"`
+	UserID    string      `json:"user_id"`
+	Items     []CartItem  `json:"items"`
+	Totals    *CartTotals `json:"totals"`
+	Status    string      `json:"status"`
+	CreatedAt time.Time   `json:"created_at"`
+
+	// ShippingAddress is the saved profile address the order ships to, if any
+	ShippingAddress *Address `json:"shipping_address,omitempty"`
+
+	// Scope is "partial" when only selected cart lines were checked out;
+	// Selection lists the requested item IDs in that case
+	Scope     string   `json:"scope"`
+	Selection []string `json:"selection,omitempty"`
+
+	// Risk decision for internal review; never returned to clients
+	Risk RiskAssessment `json:"-"`
+}
+
+// orderBook stores placed orders with a per-user history
+type orderBook struct {
+	orders map[string]*Order
+	byUser map[string][]string // order IDs, oldest first
+	mutex  sync.RWMutex
+}
+
+// newOrderBook creates an empty order book
+func newOrderBook() *orderBook {
+	return &orderBook{
+		orders: make(map[string]*Order),
+		byUser: make(map[string][]string),
+	}
+}
+
+// Add stores a placed order
+func (ob *orderBook) Add(order *Order) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+	ob.orders[order.ID] = order
+	ob.byUser[order.UserID] = append(ob.byUser[order.UserID], order.ID)
+}
+
+// List returns copies of a user's orders, newest first
+func (ob *orderBook) List(userID string) []*Order {
+	ob.mutex.RLock()
+	defer ob.mutex.RUnlock()
+
+	ids := ob.byUser[userID]
+	orders := make([]*Order, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		orderCopy := *ob.orders[ids[i]]
+		orders = append(orders, &orderCopy)
+	}
+	return orders
+}
+
+// Get returns a copy of an order owned by userID
+func (ob *orderBook) Get(userID, orderID string) (*Order, error) {
+	ob.mutex.RLock()
+	defer ob.mutex.RUnlock()
+
+	order, exists := ob.orders[orderID]
+	if !exists || order.UserID != userID {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	orderCopy := *order
+	return &orderCopy, nil
+}
+
+// CheckoutOptions are the optional inputs of a checkout
+type CheckoutOptions struct {
+	ClientIP   string   // client address for risk checks
+	ItemIDs    []string // lines to check out; empty checks out the whole cart
+	QuoteToken string   // signed quote whose totals are honored when valid
+	AddressID  string   // saved address to ship to; empty uses the profile default
+}
+
+// selectLines splits cart items into those named in itemIDs and the rest.
+// An empty selection selects every line.
+func selectLines(items []CartItem, itemIDs []string) (selected, remaining []CartItem, err error) {
+	if len(itemIDs) == 0 {
+		return items, nil, nil
+	}
+
+	inCart := make(map[string]bool, len(items))
+	for _, item := range items {
+		inCart[item.ID] = true
+	}
+	wanted := make(map[string]bool, len(itemIDs))
+	for _, id := range itemIDs {
+		if !inCart[id] {
+			return nil, nil, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+		}
+		wanted[id] = true
+	}
+
+	for _, item := range items {
+		if wanted[item.ID] {
+			selected = append(selected, item)
+		} else {
+			remaining = append(remaining, item)
+		}
+	}
+	return selected, remaining, nil
+}
+
+// checkoutFailureReason classifies a checkout error for
+// checkout_failures_total
+func checkoutFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrCartNotFound):
+		return "cart_not_found"
+	case errors.Is(err, ErrEmptyCart):
+		return "empty_cart"
+	case errors.Is(err, ErrItemNotFound):
+		return "item_not_found"
+	case errors.Is(err, ErrCartLocked), errors.Is(err, ErrCartConflict):
+		return "cart_locked"
+	case errors.Is(err, ErrInvalidQuote), errors.Is(err, ErrQuoteExpired), errors.Is(err, ErrQuoteMismatch):
+		return "quote"
+	case errors.Is(err, ErrAddressNotFound), errors.Is(err, ErrInvalidAddress):
+		return "address"
+	case errors.Is(err, ErrNoShippingTier):
+		return "shipping"
+	case errors.Is(err, ErrCheckoutRejected):
+		return "risk_rejected"
+	case errors.Is(err, ErrInsufficientStock):
+		return "out_of_stock"
+	case errors.Is(err, ErrDependencyUnavailable):
+		return "dependency"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "internal"
+	}
+}
+
+// Checkout places an order for the user's cart, counting failures by reason
+func (cs *CartService) Checkout(ctx context.Context, userID string, opts CheckoutOptions) (_ *Order, err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.Checkout", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+		attribute.Int("checkout.selected_lines", len(opts.ItemIDs)),
+		attribute.Bool("checkout.quoted", opts.QuoteToken != ""),
+	))
+	defer func() { endSpan(span, err) }()
+
+	order, err := cs.placeOrder(ctx, userID, opts)
+	if err != nil {
+		reason := checkoutFailureReason(err)
+		span.SetAttributes(attribute.String("checkout.failure_reason", reason))
+		cs.checkoutFailureCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("order.id", order.ID),
+		attribute.Float64("order.total", order.Totals.Total),
+	)
+
+	// Hooks get their own copy of the stored order
+	hookOrder := *order
+	cs.hooks.runAfterCheckout(ctx, &hookOrder)
+	cs.publisher.publish(ctx, orderPlacedEvent(order))
+	return order, nil
+}
+
+// orderPlacedEvent returns the order.placed event of order
+func orderPlacedEvent(order *Order) events.OrderPlaced {
+	units := 0
+	for _, item := range order.Items {
+		units += item.Quantity
+	}
+	return events.OrderPlaced{
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		ItemCount: units,
+		Subtotal:  order.Totals.Subtotal,
+		Discount:  order.Totals.Discount,
+		Total:     order.Totals.Total,
+		Scope:     order.Scope,
+	}
+}
+
+// placeOrder prices the selected lines of the user's cart (all lines when no
+// item IDs are given), runs risk checks, deducts stock and removes the
+// checked out lines from the cart. A valid quote token fixes the totals at
+// the quoted values. Orders ship to the chosen saved address or the
+// profile's default, whose country selects the shipping tiers. The cart is
+// read-only until the checkout completes,
+// fails or exceeds the checkout lock timeout.
+func (cs *CartService) placeOrder(ctx context.Context, userID string, opts CheckoutOptions) (*Order, error) {
+	lock, err := cs.lockCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Released with the caller's context: the lock deadline has passed by
+	// the time a timed-out checkout unwinds
+	defer cs.unlockCart(context.WithoutCancel(ctx), userID, lock)
+
+	ctx, cancel := context.WithDeadline(ctx, lock)
+	defer cancel()
+
+	cart, err := cs.GetCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Items) == 0 {
+		return nil, fmt.Errorf("%w for user %s", ErrEmptyCart, userID)
+	}
+
+	selected, remaining, err := selectLines(cart.Items, opts.ItemIDs)
+	if err != nil {
+		return nil, err
+	}
+	scope := checkoutScopeFull
+	if len(remaining) > 0 {
+		scope = checkoutScopePartial
+	}
+	cart = &Cart{UserID: userID, Items: selected}
+
+	address, region, err := cs.shippingDestination(ctx, userID, opts.AddressID)
+	if err != nil {
+		return nil, err
+	}
+	// Saved addresses are re-validated since provider data and country rules
+	// may have changed since they were saved
+	if address != nil {
+		normalized, err := cs.addressValidation.Validate(ctx, *address)
+		if err != nil {
+			return nil, err
+		}
+		address = &normalized
+	}
+
+	var totals *CartTotals
+	if opts.QuoteToken != "" {
+		totals, err = cs.quotes.Redeem(ctx, userID, selected, opts.QuoteToken)
+		// Quoted shipping only holds for the destination it was priced for
+		if err == nil && totals.Shipping != nil && totals.Shipping.Region != region {
+			cs.quotes.record(ctx, "mismatch")
+			err = fmt.Errorf("%w: quoted for region %q", ErrQuoteMismatch, totals.Shipping.Region)
+		}
+	} else {
+		totals, err = cs.priceCart(ctx, cart, region)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.dependencies.call(ctx, config.DependencyShipping, "quote"); err != nil {
+		return nil, err
+	}
+
+	assessment := cs.risk.Assess(ctx, CheckoutAttempt{
+		UserID:   userID,
+		ClientIP: opts.ClientIP,
+		Total:    totals.Total,
+		At:       time.Now(),
+	})
+	if assessment.Decision == RiskReject {
+		return nil, fmt.Errorf("%w: %s", ErrCheckoutRejected, strings.Join(assessment.Signals, ","))
+	}
+
+	// Payment is authorized and stock reserved with the downstream services
+	// before it is deducted here
+	if err := cs.dependencies.call(ctx, config.DependencyPayment, "authorize"); err != nil {
+		return nil, err
+	}
+	if err := cs.dependencies.call(ctx, config.DependencyInventory, "reserve"); err != nil {
+		return nil, err
+	}
+
+	// The lock has lapsed; the cart may have changed underneath us
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("checkout for user %s: %w", userID, err)
+	}
+
+	if err := cs.catalogFor(ctx).Deduct(cart.Items); err != nil {
+		return nil, err
+	}
+
+	// Stock is already deducted, so the order stands even if the cart
+	// could not be updated
+	if err := cs.removeCheckedOutLines(context.WithoutCancel(ctx), userID, selected); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove checked out lines from cart", "user_id", userID, "error", err)
+	}
+
+	order := &Order{
+		ID:        "ord_" + newRequestID()[:16],
+		UserID:    userID,
+		Items:     cart.Items,
+		Totals:    totals,
+		Status:    orderStatusPlaced,
+		CreatedAt: time.Now().UTC(),
+		Scope:     scope,
+		Risk:      assessment,
+
+		ShippingAddress: address,
+	}
+	if scope == checkoutScopePartial {
+		order.Selection = opts.ItemIDs
+	}
+	if opts.QuoteToken != "" {
+		cs.quotes.record(ctx, "honored")
+	}
+
+	cs.orders.Add(order)
+	cs.orderCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("scope", scope)))
+	cs.orderValue.Record(ctx, totals.Total, metric.WithAttributes(attribute.String("scope", scope)))
+	cs.categories.recordCheckout(ctx, order)
+
+	if assessment.Decision == RiskFlag {
+		slog.WarnContext(ctx, "Order flagged by risk checks", "order_id", order.ID, "user_id", userID, "signals", assessment.Signals)
+	}
+
+	return order, nil
+}
+
+// removeCheckedOutLines removes checked-out lines from the user's cart,
+// dropping the cart once it is empty
+func (cs *CartService) removeCheckedOutLines(ctx context.Context, userID string, lines []CartItem) error {
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if errors.Is(err, ErrCartNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	checkedOut := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		checkedOut[line.ID] = true
+	}
+	kept := cart.Items[:0]
+	for _, item := range cart.Items {
+		if !checkedOut[item.ID] {
+			kept = append(kept, item)
+		}
+	}
+	cart.Items = kept
+	cart.updatedAt = time.Now()
+
+	if len(cart.Items) == 0 {
+		return cs.store.Delete(ctx, userID)
+	}
+	return cs.store.Put(ctx, cart)
+}
+
+func (ms *MetricsServer) handleCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID     string   `json:"user_id"`
+		ItemIDs    []string `json:"item_ids"`
+		QuoteToken string   `json:"quote_token"`
+		AddressID  string   `json:"address_id"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+
+	opts := CheckoutOptions{ItemIDs: req.ItemIDs, QuoteToken: req.QuoteToken, AddressID: req.AddressID}
+	if addr, ok := clientIP(r); ok {
+		opts.ClientIP = addr.String()
+	}
+
+	order, err := ms.service.Checkout(r.Context(), req.UserID, opts)
+	switch {
+	case errors.Is(err, ErrInvalidQuote), errors.Is(err, ErrQuoteExpired), errors.Is(err, ErrQuoteMismatch):
+		writeQuoteError(w, r, err)
+		return
+	case errors.Is(err, ErrItemNotFound):
+		ms.rejectInvalidRequest(w, r, constraintViolation("item_ids", msgInvalidFieldValue))
+		return
+	case errors.Is(err, ErrAddressNotFound):
+		ms.rejectInvalidRequest(w, r, constraintViolation("address_id", msgInvalidFieldValue))
+		return
+	case errors.Is(err, ErrInvalidAddress):
+		writeError(w, r, http.StatusUnprocessableEntity, msgInvalidAddress, addressField(err))
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, r, http.StatusGatewayTimeout, msgCheckoutTimeout)
+		return
+	case errors.Is(err, ErrInsufficientStock):
+		writeError(w, r, http.StatusConflict, msgCartOutOfStock)
+		return
+	case err != nil:
+		ms.writeServiceError(w, r, err, req.UserID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// ListOrders returns a user's order history, newest first
+func (cs *CartService) ListOrders(userID string) []*Order {
+	return cs.orders.List(userID)
+}
+
+// GetOrder returns one of a user's orders
+func (cs *CartService) GetOrder(userID, orderID string) (*Order, error) {
+	return cs.orders.Get(userID, orderID)
+}
+
+func (ms *MetricsServer) handleOrders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+		return
+	}
+	setRequestUser(r.Context(), userID)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if orderID := r.URL.Query().Get("order_id"); orderID != "" {
+		order, err := ms.service.GetOrder(userID, orderID)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, msgOrderNotFound, orderID)
+			return
+		}
+		json.NewEncoder(w).Encode(order)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders": ms.service.ListOrders(userID),
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands are subcommands that query a running instance instead of
+// starting the server
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"status":  runStatus,
+	"top":     runTop,
+	"console": runConsole,
+	"replay":  runReplay,
+	"diff":    runDiff,
+	"restore": runRestore,
+	"events":  runEvents,
+	"rebuild": runRebuild,
+}
+
+// defaultServiceURL is the instance the subcommands query unless --url or
+// CART_SERVICE_URL says otherwise
+const defaultServiceURL = "http://localhost:8080"
+
+// defaultOpsURL is the ops port the subcommands calling admin endpoints
+// query unless --url (--from for recordings) or CART_SERVICE_OPS_URL says
+// otherwise
+const defaultOpsURL = "http://localhost:9091"
+
+// clearScreen moves the cursor home and clears the terminal
+const clearScreen = "\033[H\033[2J"
+
+// summaryClient fetches /admin/summary from a running instance
+type summaryClient struct {
+	baseURL    string
+	adminToken string
+	top        int
+	client     *http.Client
+}
+
+// commandFlags registers the flags shared by the subcommands
+func commandFlags(name string) (flags *flag.FlagSet, baseURL *string, timeout *time.Duration) {
+	flags = flag.NewFlagSet(name, flag.ContinueOnError)
+
+	defaultURL := os.Getenv("CART_SERVICE_URL")
+	if defaultURL == "" {
+		defaultURL = defaultServiceURL
+	}
+	baseURL = flags.String("url", defaultURL, "base URL of the instance (CART_SERVICE_URL)")
+	timeout = flags.Duration("timeout", 5*time.Second, "request timeout")
+	return flags, baseURL, timeout
+}
+
+// adminCommandFlags registers the flags shared by the subcommands calling
+// admin endpoints, whose --url is the instance's ops port
+func adminCommandFlags(name string) (flags *flag.FlagSet, opsURL, adminToken *string, timeout *time.Duration) {
+	flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	opsURL = flags.String("url", firstSet(os.Getenv("CART_SERVICE_OPS_URL"), defaultOpsURL), "base URL of the instance's ops port (CART_SERVICE_OPS_URL)")
+	adminToken = adminTokenFlag(flags)
+	timeout = flags.Duration("timeout", 5*time.Second, "request timeout")
+	return flags, opsURL, adminToken, timeout
+}
+
+// adminTokenFlag registers the token sent to admin endpoints
+func adminTokenFlag(flags *flag.FlagSet) *string {
+	return flags.String("admin-token", os.Getenv("ADMIN_TOKEN"), "admin API token (ADMIN_TOKEN)")
+}
+
+// summaryFlags registers the flags of the summary subcommands
+func summaryFlags(name string) (*flag.FlagSet, func() *summaryClient) {
+	flags, opsURL, adminToken, timeout := adminCommandFlags(name)
+	top := flags.Int("top", 10, "number of endpoints to list")
+	return flags, func() *summaryClient {
+		return &summaryClient{baseURL: *opsURL, adminToken: *adminToken, top: *top, client: &http.Client{Timeout: *timeout}}
+	}
+}
+
+// Fetch returns the instance's current summary
+func (sc *summaryClient) Fetch(ctx context.Context) (*MetricsSummary, error) {
+	url := strings.TrimSuffix(sc.baseURL, "/") + "/admin/summary?top=" + strconv.Itoa(sc.top)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sc.adminToken)
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var summary MetricsSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("failed to decode summary: %w", err)
+	}
+	return &summary, nil
+}
+
+// runStatus prints the summary once
+func runStatus(ctx context.Context, args []string) error {
+	flags, newClient := summaryFlags("status")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client := newClient()
+
+	summary, err := client.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	renderSummary(os.Stdout, client.baseURL, summary)
+	return nil
+}
+
+// runTop redraws the summary every interval until interrupted. Failed
+// fetches are shown in place so the dashboard survives restarts.
+func runTop(ctx context.Context, args []string) error {
+	flags, newClient := summaryFlags("top")
+	interval := flags.Duration("interval", 2*time.Second, "refresh interval")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", *interval)
+	}
+	client := newClient()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		summary, err := client.Fetch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		fmt.Print(clearScreen)
+		if err != nil {
+			fmt.Printf("%s  %s\n\nUnavailable: %v\n", client.baseURL, time.Now().Format(time.TimeOnly), err)
+		} else {
+			renderSummary(os.Stdout, client.baseURL, summary)
+		}
+		fmt.Printf("\nRefreshing every %s, Ctrl-C to quit\n", *interval)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// renderSummary writes summary as a small text dashboard
+func renderSummary(w io.Writer, baseURL string, summary *MetricsSummary) {
+	fmt.Fprintf(w, "%s  %s\n\n", baseURL, summary.GeneratedAt.Local().Format(time.TimeOnly))
+
+	window := time.Duration(summary.WindowSeconds * float64(time.Second))
+	fmt.Fprintf(w, "Requests  %d in %s (%.2f/s), %s errors\n",
+		summary.Requests, window, summary.RequestsPerSecond, percent(summary.ErrorRate))
+	fmt.Fprintf(w, "Latency   p50 %s  p95 %s  p99 %s\n",
+		milliseconds(summary.LatencySeconds.P50),
+		milliseconds(summary.LatencySeconds.P95),
+		milliseconds(summary.LatencySeconds.P99))
+	fmt.Fprintf(w, "Carts     %d active (%d changed today, %d abandoned), %d items, %.2f value\n\n",
+		summary.ActiveUsers, summary.Carts.UpdatedToday, summary.Carts.Abandoned, summary.Carts.Items, summary.Carts.Value)
+
+	if len(summary.TopEndpoints) == 0 {
+		fmt.Fprintln(w, "No requests in the window")
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ENDPOINT\tREQUESTS\tREQ/S\tERRORS\tERROR RATE")
+	for _, endpoint := range summary.TopEndpoints {
+		fmt.Fprintf(table, "%s\t%d\t%.2f\t%d\t%s\n",
+			endpoint.Endpoint, endpoint.Requests, endpoint.RequestsPerSecond, endpoint.Errors, percent(endpoint.ErrorRate))
+	}
+	table.Flush()
+}
+
+// percent formats a 0-1 fraction
+func percent(fraction float64) string {
+	return strconv.FormatFloat(fraction*100, 'f', 1, 64) + "%"
+}
+
+// milliseconds formats a duration in seconds
+func milliseconds(seconds float64) string {
+	return strconv.FormatFloat(seconds*1000, 'f', 1, 64) + "ms"
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Clickstream limits
+const (
+	maxClientEvents    = 50              // per POST /v1/events
+	maxClientEventAge  = 24 * time.Hour  // oldest occurred_at accepted
+	maxClientEventSkew = 5 * time.Minute // furthest occurred_at ahead of the server clock
+)
+
+// ClientEvent is one clickstream event reported by a client
+type ClientEvent struct {
+	Type       string          `json:"type"`                  // product.viewed or cart.opened
+	OccurredAt *time.Time      `json:"occurred_at,omitempty"` // default: when received
+	Data       json.RawMessage `json:"data"`
+}
+
+// ClientEventBatch is the body of POST /v1/events
+type ClientEventBatch struct {
+	Events []ClientEvent `json:"events"`
+}
+
+// handleClientEvents serves POST /v1/events: clickstream events from
+// clients, such as product views and cart opens, validated against their
+// schemas and published to the event log like the service's own, so the
+// funnel starts before the first add. A batch is accepted or rejected as a
+// whole.
+func (ms *MetricsServer) handleClientEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var batch ClientEventBatch
+	if err := decodeJSONBody(r, &batch); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	if len(batch.Events) == 0 || len(batch.Events) > maxClientEvents {
+		ms.rejectInvalidRequest(w, r, constraintViolation("events", msgInvalidFieldValue))
+		return
+	}
+
+	ctx := r.Context()
+	publisher := ms.service.publisher
+	codec := publisher.codec.Load()
+	if codec == nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, msgNotReady)
+		return
+	}
+
+	now := time.Now().UTC()
+	parsed := make([]events.Event, len(batch.Events))
+	occurredAt := make([]time.Time, len(batch.Events))
+	for i, reported := range batch.Events {
+		event, err := codec.ParseClient(reported.Type, reported.Data)
+		field := "events.data"
+		if errors.Is(err, events.ErrNotClientEvent) || errors.Is(err, events.ErrUnknownSchema) {
+			field = "events.type"
+		}
+		if err == nil {
+			occurredAt[i] = now
+			if reported.OccurredAt != nil {
+				occurredAt[i] = reported.OccurredAt.UTC()
+			}
+			if occurredAt[i].Before(now.Add(-maxClientEventAge)) || occurredAt[i].After(now.Add(maxClientEventSkew)) {
+				field, err = "events.occurred_at", errors.New("occurred_at out of range")
+			}
+		}
+		if viewed, ok := event.(*events.ProductViewed); ok && err == nil {
+			if _, lookupErr := ms.service.catalogFor(ctx).Get(viewed.ProductID); lookupErr != nil {
+				field, err = "events.data", lookupErr
+			}
+		}
+		if err != nil {
+			slog.DebugContext(ctx, "Rejected client event", "index", i, "type", reported.Type, "error", err)
+			publisher.countClientEvent(ctx, reported.Type, "invalid")
+			ms.rejectInvalidRequest(w, r, constraintViolation(field, msgInvalidFieldValue))
+			return
+		}
+		parsed[i] = event
+	}
+
+	for i, event := range parsed {
+		if i == 0 {
+			setRequestUser(ctx, clientEventUser(event))
+		}
+		publisher.publishAt(ctx, event, occurredAt[i])
+		publisher.countClientEvent(ctx, event.EventType(), "accepted")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accepted": len(parsed),
+	})
+}
+
+// clientEventUser returns the user a clickstream event is about
+func clientEventUser(event events.Event) string {
+	switch e := event.(type) {
+	case *events.ProductViewed:
+		return e.UserID
+	case *events.CartOpened:
+		return e.UserID
+	}
+	return ""
+}
+
+// countClientEvent counts a reported event; types clients may not report
+// are counted as other so they can't add series
+func (ep *EventPublisher) countClientEvent(ctx context.Context, eventType, result string) {
+	if eventType != events.TypeProductViewed && eventType != events.TypeCartOpened {
+		eventType = "other"
+	}
+	ep.clientEventCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("type", eventType),
+		attribute.String("result", result),
+	))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"shopping-cart-service/cartclient"
+)
+
+// consoleHelp lists the console commands
+const consoleHelp = `Commands:
+  user <id>                 switch the current user
+  products                  list the catalog
+  add <product-id> [qty]    add a product to the cart (default qty 1)
+  get                       show the cart
+  set <item-id> <qty>       change a line's quantity (0 removes it)
+  remove <item-id>          remove a line from the cart
+  checkout                  place an order for the whole cart
+  seed [users] [items]      fill carts for user1..N with random products
+  help                      show this help
+  quit                      leave the console`
+
+// console is an interactive shell over the Go SDK
+type console struct {
+	client *cartclient.Client
+	out    io.Writer
+	user   string
+	rng    *rand.Rand
+}
+
+// runConsole reads commands until EOF, quit or interrupt
+func runConsole(ctx context.Context, args []string) error {
+	flags, baseURL, timeout := commandFlags("console")
+	user := flags.String("user", "console", "initial user ID")
+	apiKey := flags.String("api-key", os.Getenv("CART_SERVICE_API_KEY"), "API key for instances requiring authentication (CART_SERVICE_API_KEY)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// One session per console run, so its requests form one session trace
+	// on instances with them enabled
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	sessionID := fmt.Sprintf("console-%016x", rng.Uint64())
+	c := &console{
+		client: cartclient.New(*baseURL,
+			cartclient.WithHTTPClient(&http.Client{Timeout: *timeout}),
+			cartclient.WithAPIKey(*apiKey),
+			cartclient.WithSessionID(sessionID),
+		),
+		out:  os.Stdout,
+		user: *user,
+		rng:  rng,
+	}
+	fmt.Fprintf(c.out, "Connected to %s as %s. Type help for commands.\n", *baseURL, c.user)
+
+	// Read lines in the background so an interrupt ends the console
+	// without waiting for the next line
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		fmt.Fprintf(c.out, "%s> ", c.user)
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-ctx.Done():
+			fmt.Fprintln(c.out)
+			return nil
+		}
+		if !ok {
+			fmt.Fprintln(c.out)
+			return nil
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return nil
+		}
+		if err := c.run(ctx, fields[0], fields[1:]); err != nil {
+			fmt.Fprintf(c.out, "error: %v\n", err)
+		}
+	}
+}
+
+// run executes one command
+func (c *console) run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "help":
+		fmt.Fprintln(c.out, consoleHelp)
+		return nil
+	case "user":
+		if len(args) != 1 {
+			return errors.New("usage: user <id>")
+		}
+		c.user = args[0]
+		return nil
+	case "products":
+		return c.products(ctx)
+	case "add":
+		return c.add(ctx, args)
+	case "get":
+		return c.get(ctx)
+	case "set":
+		if len(args) != 2 {
+			return errors.New("usage: set <item-id> <qty>")
+		}
+		quantity, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid quantity %q", args[1])
+		}
+		if err := c.client.UpdateQuantity(ctx, c.user, args[0], quantity); err != nil {
+			return err
+		}
+		return c.get(ctx)
+	case "remove":
+		if len(args) != 1 {
+			return errors.New("usage: remove <item-id>")
+		}
+		if err := c.client.RemoveItem(ctx, c.user, args[0]); err != nil {
+			return err
+		}
+		return c.get(ctx)
+	case "checkout":
+		return c.checkout(ctx)
+	case "seed":
+		return c.seed(ctx, args)
+	default:
+		return fmt.Errorf("unknown command %q, type help for commands", command)
+	}
+}
+
+// products prints the catalog
+func (c *console) products(ctx context.Context) error {
+	products, err := c.client.ListProducts(ctx)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tNAME\tCATEGORY\tPRICE\tSTOCK")
+	for _, product := range products {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%.2f\t%d\n", product.ID, product.Name, product.Category, product.Price, product.Stock)
+	}
+	return table.Flush()
+}
+
+// add puts a catalog product in the current user's cart at its list price
+func (c *console) add(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: add <product-id> [qty]")
+	}
+	quantity := 1
+	if len(args) == 2 {
+		parsed, err := strconv.Atoi(args[1])
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid quantity %q", args[1])
+		}
+		quantity = parsed
+	}
+
+	product, err := c.client.GetProduct(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	item := cartclient.Item{ID: product.ID, Name: product.Name, Price: product.Price, Quantity: quantity}
+	if err := c.client.AddItem(ctx, c.user, item); err != nil {
+		return err
+	}
+	return c.get(ctx)
+}
+
+// get prints the current user's cart
+func (c *console) get(ctx context.Context) error {
+	cart, err := c.client.GetCart(ctx, c.user)
+	if cartclient.IsNotFound(err) {
+		fmt.Fprintf(c.out, "%s has no cart\n", c.user)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ITEM\tNAME\tQTY\tPRICE\tLINE")
+	total := 0.0
+	for _, item := range cart.Items {
+		line := item.Price * float64(item.Quantity)
+		total += line
+		fmt.Fprintf(table, "%s\t%s\t%d\t%.2f\t%.2f\n", item.ID, item.Name, item.Quantity, item.Price, line)
+	}
+	fmt.Fprintf(table, "\t\t\t\t%.2f\n", total)
+	return table.Flush()
+}
+
+// checkout places an order and prints its totals
+func (c *console) checkout(ctx context.Context) error {
+	order, err := c.client.Checkout(ctx, c.user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Order %s %s, %d lines", order.ID, order.Status, len(order.Items))
+	if order.Totals != nil {
+		fmt.Fprintf(c.out, ", total %.2f", order.Totals.Total)
+	}
+	fmt.Fprintln(c.out)
+	return nil
+}
+
+// seed fills carts for user1..users with random in-stock products
+func (c *console) seed(ctx context.Context, args []string) error {
+	counts := []int{5, 3}
+	if len(args) > len(counts) {
+		return errors.New("usage: seed [users] [items]")
+	}
+	for i, arg := range args {
+		parsed, err := strconv.Atoi(arg)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid count %q", arg)
+		}
+		counts[i] = parsed
+	}
+	users, items := counts[0], counts[1]
+
+	products, err := c.client.ListProducts(ctx)
+	if err != nil {
+		return err
+	}
+	var available []cartclient.Product
+	for _, product := range products {
+		if product.Stock > 0 {
+			available = append(available, product)
+		}
+	}
+	if len(available) == 0 {
+		return errors.New("no products in stock")
+	}
+
+	added, failed := 0, 0
+	for u := 1; u <= users; u++ {
+		userID := fmt.Sprintf("user%d", u)
+		for i := 0; i < items; i++ {
+			product := available[c.rng.Intn(len(available))]
+			item := cartclient.Item{ID: product.ID, Name: product.Name, Price: product.Price, Quantity: c.rng.Intn(3) + 1}
+			if err := c.client.AddItem(ctx, userID, item); err != nil {
+				failed++
+				continue
+			}
+			added++
+		}
+	}
+	fmt.Fprintf(c.out, "Seeded %d users: %d items added, %d rejected\n", users, added, failed)
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrStoreUnavailable is returned while the cart store is down for
+// operations the degraded store can't serve locally
+var ErrStoreUnavailable = errors.New("cart store unavailable")
+
+// storeProbeUserID is looked up to check whether a degraded store is back
+const storeProbeUserID = "__store_probe__"
+
+// bufferedMutation is a cart change waiting for the store to recover
+type bufferedMutation struct {
+	userID string
+	cart   *Cart // nil for a delete
+}
+
+// degradedCartStore wraps the configured cart store. While the store
+// works it passes calls through and remembers the carts it sees. Once a
+// call fails it stops calling the store, serves reads from what it
+// remembered and, depending on the mode, rejects mutations or queues them
+// in a bounded buffer; a probe replays the buffer in order when the store
+// is back. Reads in degraded mode reflect the last version this instance
+// saw, so other instances' changes are missed until recovery.
+type degradedCartStore struct {
+	backend       CartStore
+	mode          string // config.DegradationReject or config.DegradationBuffer
+	cacheEntries  int
+	bufferSize    int
+	probeInterval time.Duration
+
+	mutex    sync.Mutex
+	degraded bool
+	since    time.Time        // when the store became unavailable
+	cache    map[string]*Cart // nil values mark carts known not to exist
+	buffer   []bufferedMutation
+
+	// OpenTelemetry Metrics
+	degradedGauge    metric.Int64ObservableGauge // Gauge: 1 while the store is unavailable
+	bufferedGauge    metric.Int64ObservableGauge // Gauge: mutations waiting for replay
+	operationCounter metric.Int64Counter         // Counter: operations served while degraded
+	replayCounter    metric.Int64Counter         // Counter: buffered mutations replayed
+}
+
+// newDegradedCartStore wraps backend with the degradation behavior in cfg
+func newDegradedCartStore(backend CartStore, cfg config.StorageConfig) (*degradedCartStore, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	s := &degradedCartStore{
+		backend:       backend,
+		mode:          cfg.Degradation,
+		cacheEntries:  cfg.CacheEntries,
+		bufferSize:    cfg.BufferSize,
+		probeInterval: cfg.ProbeInterval,
+		cache:         make(map[string]*Cart),
+	}
+
+	var err error
+	s.degradedGauge, err = meter.Int64ObservableGauge(
+		"storage_degraded",
+		metric.WithDescription("Whether the cart store is unavailable and requests are served in degraded mode (1) or not (0)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage degraded gauge: %w", err)
+	}
+
+	s.bufferedGauge, err = meter.Int64ObservableGauge(
+		"storage_buffered_mutations",
+		metric.WithDescription("Cart changes queued locally for replay once the store recovers"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buffered mutations gauge: %w", err)
+	}
+
+	s.operationCounter, err = meter.Int64Counter(
+		"storage_degraded_operations_total",
+		metric.WithDescription("Total number of cart store operations handled while the store was unavailable by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create degraded operations counter: %w", err)
+	}
+
+	s.replayCounter, err = meter.Int64Counter(
+		"storage_replayed_mutations_total",
+		metric.WithDescription("Total number of buffered cart changes replayed to the recovered store by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replayed mutations counter: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			degraded := int64(0)
+			if s.degraded {
+				degraded = 1
+			}
+			observer.ObserveInt64(s.degradedGauge, degraded)
+			observer.ObserveInt64(s.bufferedGauge, int64(len(s.buffer)))
+			return nil
+		},
+		s.degradedGauge, s.bufferedGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register storage degradation callback: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *degradedCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	if !s.isDegraded() {
+		cart, err := s.backend.Get(ctx, userID)
+		switch {
+		case err == nil:
+			s.remember(userID, cart)
+			return cart, nil
+		case errors.Is(err, ErrCartNotFound):
+			s.remember(userID, nil)
+			return nil, err
+		}
+		s.markDegraded(ctx, err)
+	}
+
+	s.mutex.Lock()
+	cart, known := s.cache[userID]
+	s.mutex.Unlock()
+	switch {
+	case !known:
+		s.countOperation(ctx, "get", "cache_miss")
+		return nil, fmt.Errorf("%w: cart for user %s not cached", ErrStoreUnavailable, userID)
+	case cart == nil:
+		s.countOperation(ctx, "get", "cache_hit")
+		return nil, fmt.Errorf("%w for user %s", ErrCartNotFound, userID)
+	}
+	s.countOperation(ctx, "get", "cache_hit")
+	return cart.clone(), nil
+}
+
+func (s *degradedCartStore) Put(ctx context.Context, cart *Cart) error {
+	return s.mutate(ctx, "put", bufferedMutation{userID: cart.UserID, cart: cart.clone()})
+}
+
+func (s *degradedCartStore) Delete(ctx context.Context, userID string) error {
+	return s.mutate(ctx, "delete", bufferedMutation{userID: userID})
+}
+
+// List needs every cart, which only the store has
+func (s *degradedCartStore) List(ctx context.Context) ([]*Cart, error) {
+	if s.isDegraded() {
+		s.countOperation(ctx, "list", "rejected")
+		return nil, ErrStoreUnavailable
+	}
+	carts, err := s.backend.List(ctx)
+	if err != nil {
+		s.markDegraded(ctx, err)
+		return nil, fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return carts, nil
+}
+
+// mutate applies m to the store, or buffers or rejects it while the store
+// is unavailable
+func (s *degradedCartStore) mutate(ctx context.Context, operation string, m bufferedMutation) error {
+	if !s.isDegraded() {
+		err := s.apply(ctx, m)
+		if err == nil {
+			s.remember(m.userID, m.cart)
+			return nil
+		}
+		if errors.Is(err, ErrCartConflict) {
+			// The store answered; the cart just changed under the caller
+			return err
+		}
+		s.markDegraded(ctx, err)
+	}
+
+	if s.mode != config.DegradationBuffer {
+		s.countOperation(ctx, operation, "rejected")
+		return fmt.Errorf("%w: changes are rejected until it recovers", ErrStoreUnavailable)
+	}
+
+	queued, err := s.enqueue(ctx, operation, m)
+	if !queued {
+		// Recovered in the meantime; the buffer has been replayed, so
+		// this change must not wait in it
+		return s.mutate(ctx, operation, m)
+	}
+	return err
+}
+
+// enqueue buffers m for replay. It reports false, without buffering, when
+// the store has recovered since the caller checked.
+func (s *degradedCartStore) enqueue(ctx context.Context, operation string, m bufferedMutation) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.degraded {
+		return false, nil
+	}
+	if len(s.buffer) >= s.bufferSize {
+		s.countOperation(ctx, operation, "rejected")
+		return true, fmt.Errorf("%w: change buffer is full", ErrStoreUnavailable)
+	}
+	s.buffer = append(s.buffer, m)
+	s.rememberLocked(m.userID, m.cart)
+	s.countOperation(ctx, operation, "buffered")
+	return true, nil
+}
+
+// apply writes m to the store
+func (s *degradedCartStore) apply(ctx context.Context, m bufferedMutation) error {
+	if m.cart == nil {
+		return s.backend.Delete(ctx, m.userID)
+	}
+	return s.backend.Put(ctx, m.cart)
+}
+
+// remember caches the latest known state of a cart; nil records that it
+// doesn't exist
+func (s *degradedCartStore) remember(userID string, cart *Cart) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rememberLocked(userID, cart)
+}
+
+// rememberLocked is remember for callers holding s.mutex. When the cache
+// is full an arbitrary other cart is evicted.
+func (s *degradedCartStore) rememberLocked(userID string, cart *Cart) {
+	if _, known := s.cache[userID]; !known && len(s.cache) >= s.cacheEntries {
+		for evicted := range s.cache {
+			delete(s.cache, evicted)
+			break
+		}
+	}
+	if cart != nil {
+		cart = cart.clone()
+	}
+	s.cache[userID] = cart
+}
+
+func (s *degradedCartStore) isDegraded() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.degraded
+}
+
+// markDegraded stops calls to the store until a probe finds it back
+func (s *degradedCartStore) markDegraded(ctx context.Context, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.degraded {
+		return
+	}
+	s.degraded = true
+	s.since = time.Now()
+	slog.WarnContext(ctx, "Cart store unavailable, serving in degraded mode", "mode", s.mode, "error", err)
+}
+
+// recover probes the store and, once it answers, replays the buffered
+// changes in order. Mutations wait while the replay runs so none can
+// overtake it.
+func (s *degradedCartStore) recover(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.degraded {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.probeInterval)
+	defer cancel()
+	if _, err := s.backend.Get(ctx, storeProbeUserID); err != nil && !errors.Is(err, ErrCartNotFound) {
+		return
+	}
+
+	// Changes buffered one after another for a cart were read from the
+	// cache, not the store, so each continues from the revision its
+	// predecessor wrote. A cart another instance changed during the outage
+	// conflicts; its buffered changes are dropped rather than overwrite
+	// that change.
+	revisions := make(map[string]int64)
+	conflicted := make(map[string]bool)
+	replayed := 0
+	for len(s.buffer) > 0 {
+		m := s.buffer[0]
+		if revision, ok := revisions[m.userID]; ok && m.cart != nil {
+			m.cart.revision = revision
+		}
+		if conflicted[m.userID] {
+			s.replayCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "conflict")))
+			s.buffer = s.buffer[1:]
+			continue
+		}
+		err := s.apply(ctx, m)
+		if errors.Is(err, ErrCartConflict) {
+			slog.WarnContext(ctx, "Dropped buffered cart changes, another instance changed the cart meanwhile", "user_id", m.userID)
+			conflicted[m.userID] = true
+			s.replayCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "conflict")))
+			s.buffer = s.buffer[1:]
+			continue
+		}
+		if err != nil {
+			s.replayCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "failure")))
+			slog.WarnContext(ctx, "Failed to replay buffered cart change", "user_id", s.buffer[0].userID,
+				"remaining", len(s.buffer), "error", err)
+			return
+		}
+		s.replayCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "success")))
+		revisions[m.userID] = 0
+		if m.cart != nil {
+			revisions[m.userID] = m.cart.revision
+		}
+		s.buffer = s.buffer[1:]
+		replayed++
+	}
+	s.buffer = nil
+
+	s.degraded = false
+	slog.InfoContext(ctx, "Cart store recovered", "degraded_for", time.Since(s.since).Round(time.Second).String(), "replayed", replayed)
+}
+
+func (s *degradedCartStore) countOperation(ctx context.Context, operation, result string) {
+	s.operationCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", operation),
+		attribute.String("result", result),
+	))
+}
+
+// RunStoreRecovery probes a degraded cart store every probe interval until
+// ctx is cancelled. It returns immediately when degradation is off.
+func (cs *CartService) RunStoreRecovery(ctx context.Context) {
+	if cs.degradation == nil {
+		return
+	}
+
+	ticker := time.NewTicker(cs.degradation.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cs.degradation.recover(ctx)
+		}
+	}
+}
+
+// writeStoreUnavailable answers 503 with a Retry-After of the probe
+// interval
+func (ms *MetricsServer) writeStoreUnavailable(w http.ResponseWriter, r *http.Request) {
+	retryAfter := 5 * time.Second
+	if ms.service.degradation != nil {
+		retryAfter = ms.service.degradation.probeInterval
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(max(retryAfter.Seconds(), 1))))
+	writeError(w, r, http.StatusServiceUnavailable, msgStoreUnavailable)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// z99 is the standard normal quantile of the 99th percentile
+const z99 = 2.326
+
+// latencyDistribution is a log-normal latency given by its median and 99th
+// percentile: the median is e^mu and the 99th percentile e^(mu + z99*sigma)
+type latencyDistribution struct {
+	median    time.Duration // 0 draws no latency
+	mu, sigma float64
+}
+
+// newLatencyDistribution fits a distribution to median and p99; a p99 equal
+// to the median always draws the median
+func newLatencyDistribution(median, p99 time.Duration) latencyDistribution {
+	ld := latencyDistribution{median: median}
+	if median > 0 {
+		ld.mu = math.Log(float64(median))
+		ld.sigma = (math.Log(float64(p99)) - ld.mu) / z99
+	}
+	return ld
+}
+
+// draw returns a latency from the distribution
+func (ld latencyDistribution) draw() time.Duration {
+	if ld.median <= 0 {
+		return 0
+	}
+	return time.Duration(math.Exp(ld.mu + ld.sigma*rand.NormFloat64()))
+}
+
+// ErrDependencyUnavailable is returned when a downstream dependency call
+// fails or times out
+var ErrDependencyUnavailable = errors.New("dependency unavailable")
+
+// errSimulatedFailure is the failure a simulated dependency returns
+var errSimulatedFailure = errors.New("simulated failure")
+
+// DependencyError reports a failed call to a downstream dependency
+type DependencyError struct {
+	Dependency string
+	Operation  string
+	Err        error
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Dependency, e.Operation, e.Err)
+}
+
+func (e *DependencyError) Unwrap() error { return ErrDependencyUnavailable }
+
+// simulatedDependency plays one downstream service in-process. Its side of
+// each call is traced by its own tracer provider, so traces show it as a
+// separate service.
+type simulatedDependency struct {
+	service   string // service.name of its spans, e.g. payment-service
+	latency   latencyDistribution
+	errorRate float64
+	provider  *sdktrace.TracerProvider
+	tracer    trace.Tracer
+	breaker   *circuitBreaker // nil when circuit breaking is disabled
+}
+
+// newSimulatedDependency creates a dependency with profile's latency and
+// error distribution, exporting its spans like the service's own
+func newSimulatedDependency(ctx context.Context, name string, profile config.DependencyConfig, otlpEndpoint string) (*simulatedDependency, error) {
+	service := name + "-service"
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(service),
+		attribute.String("environment", "development"),
+		attribute.Bool("simulated", true),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s resource: %w", service, err)
+	}
+	provider, err := newTracerProvider(ctx, res, otlpEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &simulatedDependency{
+		service:   service,
+		latency:   newLatencyDistribution(profile.Latency, profile.LatencyP99),
+		errorRate: profile.ErrorRate,
+		provider:  provider,
+		tracer:    provider.Tracer(service),
+	}, nil
+}
+
+// serve handles one call on the dependency's side: it takes a drawn
+// latency, or until ctx expires, and then fails at the error rate
+func (sd *simulatedDependency) serve(ctx context.Context, operation string) (err error) {
+	_, span := sd.tracer.Start(ctx, operation, trace.WithSpanKind(trace.SpanKindServer))
+	defer func() { endSpan(span, err) }()
+
+	failed := rand.Float64() < sd.errorRate
+	timer := time.NewTimer(sd.latency.draw())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if failed {
+		return errSimulatedFailure
+	}
+	return nil
+}
+
+// DependencyClients calls the simulated payment, inventory and shipping
+// services. Each call gets a client span, and the dependency a server span
+// beneath it, and is counted and timed by dependency, operation and result.
+// Calls succeed at once when the simulation is disabled.
+type DependencyClients struct {
+	enabled      bool
+	timeout      time.Duration
+	dependencies map[string]*simulatedDependency
+
+	// OpenTelemetry Metrics
+	callCounter metric.Int64Counter     // Counter: calls by dependency, operation and result
+	callLatency metric.Float64Histogram // Histogram: call durations by dependency, operation and result
+}
+
+// NewDependencyClients creates the clients of the dependencies in cfg, each
+// behind its own circuit breaker from breakers
+func NewDependencyClients(ctx context.Context, cfg config.DependenciesConfig, otlpEndpoint string, buckets []float64, breakers *CircuitBreakers) (*DependencyClients, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	dc := &DependencyClients{
+		enabled:      cfg.Enabled,
+		timeout:      cfg.Timeout,
+		dependencies: make(map[string]*simulatedDependency),
+	}
+	if cfg.Enabled {
+		for name, profile := range cfg.Profiles() {
+			dependency, err := newSimulatedDependency(ctx, name, *profile, otlpEndpoint)
+			if err != nil {
+				return nil, err
+			}
+			dependency.breaker = breakers.breaker(name)
+			dc.dependencies[name] = dependency
+		}
+	}
+
+	var err error
+	dc.callCounter, err = meter.Int64Counter(
+		"dependency_calls_total",
+		metric.WithDescription("Total number of downstream dependency calls by dependency, operation and result (success, error, timeout, circuit_open)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dependency call counter: %w", err)
+	}
+
+	dc.callLatency, err = meter.Float64Histogram(
+		"dependency_call_duration_seconds",
+		metric.WithDescription("Duration of downstream dependency calls by dependency, operation and result"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(buckets...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dependency call histogram: %w", err)
+	}
+
+	return dc, nil
+}
+
+// call makes one call to the named dependency within the call timeout. A
+// failed call returns a *DependencyError, unless ctx itself ended first.
+func (dc *DependencyClients) call(ctx context.Context, name, operation string) (err error) {
+	dependency, ok := dc.dependencies[name]
+	if !dc.enabled || !ok {
+		return nil
+	}
+
+	ctx, span := startPhaseSpan(ctx, phaseDownstream, name, name+"."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("peer.service", dependency.service),
+		attribute.String("dependency.operation", operation),
+	))
+	defer func() { endSpan(span, err) }()
+
+	callCtx, cancel := context.WithTimeout(ctx, dc.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err = dependency.breaker.call(ctx, func() error {
+		return dependency.serve(callCtx, operation)
+	}, func(error) bool { return true })
+
+	result := "success"
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		result = "circuit_open"
+	case errors.Is(err, context.DeadlineExceeded):
+		result = "timeout"
+	case err != nil:
+		result = "error"
+	}
+	attrs := metric.WithAttributes(
+		attribute.String("dependency", name),
+		attribute.String("operation", operation),
+		attribute.String("result", result),
+	)
+	dc.callCounter.Add(ctx, 1, attrs)
+	// Calls failed by an open circuit take no time worth timing
+	if result != "circuit_open" {
+		dc.callLatency.Record(ctx, time.Since(start).Seconds(), attrs)
+	}
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%s %s: %w", name, operation, ctxErr)
+		}
+		return &DependencyError{Dependency: name, Operation: operation, Err: err}
+	}
+	return nil
+}
+
+// Shutdown flushes the dependencies' spans
+func (dc *DependencyClients) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, dependency := range dc.dependencies {
+		if err := dependency.provider.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s tracer provider: %w", dependency.service, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeDependencyUnavailable answers a request that failed on a dependency
+// call with 503, naming the dependency
+func writeDependencyUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	name := "downstream"
+	var dependencyErr *DependencyError
+	if errors.As(err, &dependencyErr) {
+		name = dependencyErr.Dependency
+	}
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, http.StatusServiceUnavailable, msgDependencyFailed, name)
+}
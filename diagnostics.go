@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// configEnvVars lists the environment variables that configure the service
+var configEnvVars = []string{
+	"CACHE_POLICY",
+	"REPORTING_TIMEZONE",
+	"REPORTING_TENANT_TIMEZONES",
+	"SIGNOZ_QUERY_URL",
+	"SIGNOZ_API_KEY",
+	"GEOIP_DATABASE",
+	"EXPERIMENTS",
+	"PRICING_RULES",
+	"SHARE_SECRET",
+	"NOTIFY_WEBHOOK_URL",
+	"RISK_RULES",
+	"RISK_DELAY",
+	"SHIPPING_TIERS",
+	"CHECKOUT_LOCK_TIMEOUT",
+	"QUOTE_SECRET",
+	"QUOTE_TTL",
+	"SHIPPING_REGION_TIERS",
+	"ADDRESS_VALIDATOR_URL",
+	"CART_STORE",
+	"REDIS_URL",
+	"REDIS_KEY_PREFIX",
+	"MIDDLEWARE_PIPELINE",
+	"RATE_LIMITS",
+	"CORS_ALLOWED_ORIGINS",
+	"SHUTDOWN_TIMEOUT",
+	"CONFIG_FILE",
+	"PORT",
+	"METRICS_INTERVAL",
+	"HISTOGRAM_BUCKETS",
+	"SIMULATE_TRAFFIC",
+	"SIMULATE_URL",
+	"SIMULATE_PROFILE",
+	"SIMULATE_RPS",
+	"SIMULATE_USERS",
+	"SIMULATE_ERROR_RATE",
+	"SIMULATE_SEED",
+	"SIMULATE_DEPENDENCIES",
+	"SIMULATE_DEPENDENCY_TIMEOUT",
+	"SIMULATE_DEPENDENCY_PROFILES",
+	"GRPC_PORT",
+	"OPS_PORT",
+	"LOG_LEVEL",
+	"LOG_FORMAT",
+	"CART_TTL",
+	"CART_REAP_INTERVAL",
+	"IDEMPOTENCY_TTL",
+	"RECORDING_SAMPLE_RATE",
+	"RECORDING_USER",
+	"RECORDING_MAX_ENTRIES",
+	"RECORDING_DIR",
+	"MIRROR_URL",
+	"MIRROR_PERCENT",
+	"MIRROR_TIMEOUT",
+	"EVENTS_WEBHOOK_URL",
+	"SCHEMA_REGISTRY_URL",
+	"EVENTS_TIMEOUT",
+	"EVENTS_LOG_CAPACITY",
+	"EVENTS_MAX_ATTEMPTS",
+	"EVENTS_RETRY_BACKOFF",
+	"ADMIN_TOKEN",
+	"CATALOG_SOURCE",
+	"STORE_DEGRADATION",
+	"STORE_CACHE_ENTRIES",
+	"STORE_BUFFER_SIZE",
+	"STORE_PROBE_INTERVAL",
+	"STORE_WAL_DIR",
+	"STORE_WAL_COMPACT_INTERVAL",
+	"STORE_WAL_RETENTION",
+	"NAMESPACES",
+}
+
+// sensitiveConfigMarkers identify configuration values that must be redacted
+var sensitiveConfigMarkers = []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "HEADERS"}
+
+// redactedConfig returns the effective configuration with secrets masked
+func redactedConfig() map[string]string {
+	config := make(map[string]string)
+
+	for _, name := range configEnvVars {
+		config[name] = os.Getenv(name)
+	}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, "OTEL_") {
+			config[name] = value
+		}
+	}
+
+	for name, value := range config {
+		// Credentials embedded in URLs such as REDIS_URL
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			config[name] = u.Redacted()
+		}
+		for _, marker := range sensitiveConfigMarkers {
+			if value != "" && strings.Contains(name, marker) {
+				config[name] = "[REDACTED]"
+			}
+		}
+	}
+	return config
+}
+
+// bundleFile is a single entry in the diagnostics archive
+type bundleFile struct {
+	name    string
+	content []byte
+}
+
+// writeDiagnosticsBundle writes a gzipped tarball of diagnostic files
+func writeDiagnosticsBundle(w *bytes.Buffer, files []bundleFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    0o644,
+			Size:    int64(len(file.content)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write header for %s: %w", file.name, err)
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+	return nil
+}
+
+// collectDiagnostics gathers every file included in the bundle
+func (ms *MetricsServer) collectDiagnostics() ([]bundleFile, error) {
+	var files []bundleFile
+
+	addJSON := func(name string, value interface{}) error {
+		content, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+		files = append(files, bundleFile{name: name, content: content})
+		return nil
+	}
+
+	if err := addJSON("config.json", redactedConfig()); err != nil {
+		return nil, err
+	}
+	if err := addJSON("errors.json", ms.service.errors.Recent(0)); err != nil {
+		return nil, err
+	}
+	if err := addJSON("health.json", ms.healthSnapshot()); err != nil {
+		return nil, err
+	}
+
+	// Profiles: goroutines as readable stacks, heap in pprof format
+	var goroutines bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, 2); err != nil {
+		return nil, fmt.Errorf("failed to capture goroutine profile: %w", err)
+	}
+	files = append(files, bundleFile{name: "goroutine.txt", content: goroutines.Bytes()})
+
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		return nil, fmt.Errorf("failed to capture heap profile: %w", err)
+	}
+	files = append(files, bundleFile{name: "heap.pprof", content: heap.Bytes()})
+
+	// Metrics in Prometheus text format, as served by /metrics
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	var metrics bytes.Buffer
+	encoder := expfmt.NewEncoder(&metrics, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return nil, fmt.Errorf("failed to encode metric %s: %w", family.GetName(), err)
+		}
+	}
+	files = append(files, bundleFile{name: "metrics.prom", content: metrics.Bytes()})
+
+	return files, nil
+}
+
+func (ms *MetricsServer) handleDiagnosticsBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	files, err := ms.collectDiagnostics()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to collect diagnostics", "error", err)
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+
+	// Buffer the archive so failures can still be reported with a 500
+	var archive bytes.Buffer
+	if err := writeDiagnosticsBundle(&archive, files); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write diagnostics bundle", "error", err)
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+
+	filename := fmt.Sprintf("cart-service-diagnostics-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Write(archive.Bytes())
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultDiffIgnore are response fields that differ between any two runs
+const defaultDiffIgnore = "created_at,updated_at,generated_at,timestamp,request_id,trace_id,expires_at"
+
+// maxDiffPaths caps the differing fields listed per request
+const maxDiffPaths = 5
+
+// pathRewrite maps a route prefix on one side of a diff to another, e.g.
+// /cart/get to /v1/carts
+type pathRewrite struct {
+	from, to string
+}
+
+// apply rewrites url if it starts with the rule's prefix
+func (pr pathRewrite) apply(url string) (string, bool) {
+	if rest, found := strings.CutPrefix(url, pr.from); found {
+		return pr.to + rest, true
+	}
+	return url, false
+}
+
+// runDiff sends each recorded request to two targets, such as the current
+// and the next build, and reports where their statuses or JSON bodies
+// differ. It fails when any response differs, so it can gate a rollout.
+func runDiff(ctx context.Context, args []string) error {
+	flags, baseURL, timeout := commandFlags("diff")
+	file := flags.String("file", "", "recordings file (default: download from --from)")
+	from := recordingsFromFlag(flags)
+	adminToken := adminTokenFlag(flags)
+	targetA := flags.String("a", "", "baseline target (default: --url)")
+	targetB := flags.String("b", "", "candidate target (default: --a, for route rewrites on one instance)")
+	methods := flags.String("methods", "", "only diff these comma-separated methods, e.g. GET")
+	ignore := flags.String("ignore", defaultDiffIgnore, "comma-separated JSON fields to ignore at any depth")
+	var rewrites []pathRewrite
+	flags.Func("rewrite", "rewrite a route prefix for the candidate, as from=to (repeatable)", func(value string) error {
+		from, to, found := strings.Cut(value, "=")
+		if !found || from == "" {
+			return errors.New("expected from=to")
+		}
+		rewrites = append(rewrites, pathRewrite{from: from, to: to})
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	a := firstSet(*targetA, *baseURL)
+	b := firstSet(*targetB, a)
+	if a == b && len(rewrites) == 0 {
+		return errors.New("-b or -rewrite is required to have something to compare")
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	exchanges, err := loadRecordings(ctx, client, *file, *from, *adminToken)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool)
+	for _, method := range splitFields(*methods) {
+		allowed[strings.ToUpper(method)] = true
+	}
+	ignored := make(map[string]bool)
+	for _, field := range splitFields(*ignore) {
+		ignored[field] = true
+	}
+
+	compared, differing := 0, 0
+	for _, exchange := range exchanges {
+		if len(allowed) > 0 && !allowed[exchange.Method] {
+			continue
+		}
+
+		candidate := exchange
+		for _, rewrite := range rewrites {
+			if url, ok := rewrite.apply(exchange.URL); ok {
+				candidate.URL = url
+				break
+			}
+		}
+
+		compared++
+		diffs := diffExchange(ctx, client, a, b, exchange, candidate, ignored)
+		if len(diffs) == 0 {
+			continue
+		}
+		differing++
+		fmt.Printf("%s %s -> %s (recorded %s)\n", exchange.Method, exchange.URL, candidate.URL, exchange.RequestID)
+		for _, diff := range diffs {
+			fmt.Printf("    %s\n", diff)
+		}
+	}
+
+	fmt.Printf("\n%d compared, %d differ\n", compared, differing)
+	if differing > 0 {
+		return fmt.Errorf("%d of %d responses differ", differing, compared)
+	}
+	return nil
+}
+
+// diffExchange sends baseline to a and candidate to b and describes how the
+// responses differ, if at all
+func diffExchange(ctx context.Context, client *http.Client, a, b string, baseline, candidate RecordedExchange, ignored map[string]bool) []string {
+	statusA, bodyA, errA := replayExchange(ctx, client, a, baseline)
+	statusB, bodyB, errB := replayExchange(ctx, client, b, candidate)
+	if errA != nil || errB != nil {
+		return []string{fmt.Sprintf("request failed: a: %v, b: %v", errA, errB)}
+	}
+
+	var diffs []string
+	if statusA != statusB {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", statusA, statusB))
+	}
+
+	var valueA, valueB interface{}
+	if json.Unmarshal([]byte(bodyA), &valueA) != nil || json.Unmarshal([]byte(bodyB), &valueB) != nil {
+		// Plain-text errors are localized and may embed IDs; the status
+		// already tells them apart
+		if statusA < 400 && bodyA != bodyB {
+			diffs = append(diffs, "body differs (not JSON)")
+		}
+		return diffs
+	}
+
+	var paths []string
+	jsonDiff("$", valueA, valueB, ignored, &paths)
+	if len(paths) > maxDiffPaths {
+		paths = append(paths[:maxDiffPaths], fmt.Sprintf("... and %d more", len(paths)-maxDiffPaths))
+	}
+	return append(diffs, paths...)
+}
+
+// jsonDiff appends a description of each point where a and b differ
+func jsonDiff(path string, a, b interface{}, ignored map[string]bool, out *[]string) {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool, len(va)+len(vb))
+		for key := range va {
+			keys[key] = true
+		}
+		for key := range vb {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			if !ignored[key] {
+				sorted = append(sorted, key)
+			}
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			fieldA, inA := va[key]
+			fieldB, inB := vb[key]
+			switch {
+			case !inA:
+				*out = append(*out, fmt.Sprintf("%s.%s: only in b", path, key))
+			case !inB:
+				*out = append(*out, fmt.Sprintf("%s.%s: only in a", path, key))
+			default:
+				jsonDiff(path+"."+key, fieldA, fieldB, ignored, out)
+			}
+		}
+		return
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(va) != len(vb) {
+			*out = append(*out, fmt.Sprintf("%s: %d items != %d", path, len(va), len(vb)))
+			return
+		}
+		for i := range va {
+			jsonDiff(path+"["+strconv.Itoa(i)+"]", va[i], vb[i], ignored, out)
+		}
+		return
+	}
+
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	if string(encodedA) != string(encodedB) {
+		*out = append(*out, fmt.Sprintf("%s: %s != %s", path, encodedA, encodedB))
+	}
+}
+
+// firstSet returns the first non-empty value
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// splitFields splits a comma-separated list, dropping blanks
+func splitFields(list string) []string {
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxErrorMessageLength bounds the stored message size
+const maxErrorMessageLength = 256
+
+// ErrorRecord describes a failed request for quick triage
+type ErrorRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	RequestID  string    `json:"request_id,omitempty"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	Endpoint   string    `json:"endpoint"`
+	ErrorType  string    `json:"error_type"`
+	StatusCode int       `json:"status_code"`
+	Message    string    `json:"message"`
+}
+
+// errorLog is a bounded ring buffer of the most recent errors
+type errorLog struct {
+	records []ErrorRecord
+	next    int
+	count   int
+	mutex   sync.RWMutex
+}
+
+// newErrorLog creates a ring buffer holding up to capacity errors
+func newErrorLog(capacity int) *errorLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &errorLog{records: make([]ErrorRecord, capacity)}
+}
+
+// Add stores an error, overwriting the oldest one when full
+func (el *errorLog) Add(record ErrorRecord) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	el.records[el.next] = record
+	el.next = (el.next + 1) % len(el.records)
+	if el.count < len(el.records) {
+		el.count++
+	}
+}
+
+// Recent returns up to limit errors, newest first
+func (el *errorLog) Recent(limit int) []ErrorRecord {
+	el.mutex.RLock()
+	defer el.mutex.RUnlock()
+
+	if limit <= 0 || limit > el.count {
+		limit = el.count
+	}
+
+	recent := make([]ErrorRecord, 0, limit)
+	for i := 1; i <= limit; i++ {
+		slot := (el.next - i + len(el.records)) % len(el.records)
+		recent = append(recent, el.records[slot])
+	}
+	return recent
+}
+
+// sanitizeErrorMessage strips control characters and truncates the message
+// so arbitrary client input can't bloat or corrupt the buffer
+func sanitizeErrorMessage(message string) string {
+	message = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.TrimSpace(message))
+
+	if runes := []rune(message); len(runes) > maxErrorMessageLength {
+		message = string(runes[:maxErrorMessageLength]) + "..."
+	}
+	return message
+}
+
+// recordRecentError adds a failed request to the recent errors buffer
+func (cs *CartService) recordRecentError(ctx context.Context, errorType, endpoint string, statusCode int) {
+	record := ErrorRecord{
+		Timestamp:  time.Now().UTC(),
+		Endpoint:   endpoint,
+		ErrorType:  errorType,
+		StatusCode: statusCode,
+		Message:    http.StatusText(statusCode),
+	}
+	if info := requestInfoFrom(ctx); info != nil {
+		record.RequestID = info.ID
+		if info.ErrorMessage != "" {
+			record.Message = sanitizeErrorMessage(info.ErrorMessage)
+		}
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.TraceID = spanContext.TraceID().String()
+	}
+
+	cs.errors.Add(record)
+}
+
+func (ms *MetricsServer) handleRecentErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "limit")
+			return
+		}
+		limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": ms.service.errors.Recent(limit),
+	})
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Consumer tuning
+const (
+	consumerBatchSize   = 100              // events read from the log at a time
+	consumerMaxBackoff  = 30 * time.Second // cap on the doubling retry delay
+	maxDeadLetters      = 1000             // per consumer; the oldest are dropped beyond it
+	maxDeadLetterListed = 100              // default page of /admin/consumers/{name}/dead-letters
+)
+
+// eventRecord is one message in the event log
+type eventRecord struct {
+	offset  int64
+	message []byte
+}
+
+// eventLog is the in-process stream of published event envelopes that
+// consumers read by offset. It keeps the most recent capacity messages; a
+// consumer that falls further behind skips to the oldest one kept.
+type eventLog struct {
+	messages [][]byte
+	first    int64         // offset of messages[0]
+	capacity int           // messages kept
+	appended chan struct{} // closed, and replaced, by the next append
+	mutex    sync.Mutex
+}
+
+// newEventLog creates an empty log keeping up to capacity messages
+func newEventLog(capacity int) *eventLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &eventLog{capacity: capacity, appended: make(chan struct{})}
+}
+
+// append adds a message and returns its offset
+func (el *eventLog) append(message []byte) int64 {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	el.messages = append(el.messages, message)
+	if excess := len(el.messages) - el.capacity; excess > 0 {
+		el.messages = el.messages[excess:]
+		el.first += int64(excess)
+	}
+
+	close(el.appended)
+	el.appended = make(chan struct{})
+	return el.first + int64(len(el.messages)) - 1
+}
+
+// read returns up to max records from offset from, skipping ones no longer
+// kept, and a channel closed by the next append for callers to wait on
+// when there are none
+func (el *eventLog) read(from int64, max int) ([]eventRecord, <-chan struct{}) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	if from < el.first {
+		from = el.first
+	}
+	var records []eventRecord
+	for offset := from; offset < el.end() && len(records) < max; offset++ {
+		records = append(records, eventRecord{offset: offset, message: el.messages[offset-el.first]})
+	}
+	return records, el.appended
+}
+
+// end returns the offset the next message will get. Callers must hold
+// el.mutex.
+func (el *eventLog) end() int64 {
+	return el.first + int64(len(el.messages))
+}
+
+// next returns the offset the next message will get
+func (el *eventLog) next() int64 {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	return el.end()
+}
+
+// oldest returns the offset of the oldest message kept
+func (el *eventLog) oldest() int64 {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	return el.first
+}
+
+// EventHandler applies one event to a projection. Events are delivered at
+// least once and in log order: one whose handler fails is retried, so
+// handlers must tolerate seeing an event again.
+type EventHandler func(ctx context.Context, envelope *events.Envelope) error
+
+// DeadLetter is an event a consumer gave up on, either because it doesn't
+// match its schema or because its handler kept failing
+type DeadLetter struct {
+	Offset   int64           `json:"offset"`
+	Type     string          `json:"type,omitempty"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+	Message  json.RawMessage `json:"message"`
+}
+
+// ConsumerStatus is a consumer's position in the event log
+type ConsumerStatus struct {
+	Name        string `json:"name"`
+	Offset      int64  `json:"offset"` // next event to process
+	Lag         int64  `json:"lag"`    // events published but not yet processed
+	DeadLetters int    `json:"dead_letters"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// eventConsumer is one named subscription to the event log
+type eventConsumer struct {
+	name        string
+	handle      EventHandler
+	offset      int64         // committed: every event before it is done
+	deadLetters []DeadLetter  // oldest first
+	redrive     []DeadLetter  // dead letters queued for another try
+	wake        chan struct{} // signalled when dead letters are redriven or a rebuild is queued
+	lastError   string
+	projection  projection     // nil unless the consumer can be rebuilt
+	rebuild     *RebuildStatus // the latest rebuild, nil before the first
+}
+
+// EventConsumers runs the consumers of the event log, such as the
+// projections, each from its own committed offset. A failing event is
+// retried with exponential backoff and, once its attempts are used up,
+// moved to the consumer's dead letters so the rest of the stream keeps
+// flowing; dead letters can be redriven once the cause is fixed.
+type EventConsumers struct {
+	publisher   *EventPublisher
+	maxAttempts int
+	backoff     time.Duration
+
+	consumers []*eventConsumer
+	mutex     sync.Mutex
+
+	// OpenTelemetry Metrics
+	lagGauge        metric.Int64ObservableGauge // Gauge: events not yet processed per consumer
+	deadLetterGauge metric.Int64ObservableGauge // Gauge: dead letters held per consumer
+	consumedCounter metric.Int64Counter         // Counter: events handled by consumer, type and result
+	retryCounter    metric.Int64Counter         // Counter: handler retries by consumer and type
+}
+
+// newEventConsumers creates a runtime for the consumers of publisher's log
+func newEventConsumers(cfg config.EventsConfig, publisher *EventPublisher) (*EventConsumers, error) {
+	meter := otel.Meter("shopping-cart-service")
+	ec := &EventConsumers{publisher: publisher, maxAttempts: cfg.MaxAttempts, backoff: cfg.RetryBackoff}
+
+	var err error
+	ec.lagGauge, err = meter.Int64ObservableGauge(
+		"event_consumer_lag",
+		metric.WithDescription("Number of published events each consumer has not processed yet"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer lag gauge: %w", err)
+	}
+
+	ec.deadLetterGauge, err = meter.Int64ObservableGauge(
+		"event_consumer_dead_letters",
+		metric.WithDescription("Number of events each consumer gave up on and holds as dead letters"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer dead letter gauge: %w", err)
+	}
+
+	ec.consumedCounter, err = meter.Int64Counter(
+		"events_consumed_total",
+		metric.WithDescription("Total number of events handled by consumer, type and result (success, dead_letter, invalid, skipped)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create events consumed counter: %w", err)
+	}
+
+	ec.retryCounter, err = meter.Int64Counter(
+		"event_consumer_retries_total",
+		metric.WithDescription("Total number of event handler retries by consumer and type"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer retry counter: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			for _, status := range ec.Status() {
+				attrs := metric.WithAttributes(attribute.String("consumer", status.Name))
+				observer.ObserveInt64(ec.lagGauge, status.Lag, attrs)
+				observer.ObserveInt64(ec.deadLetterGauge, int64(status.DeadLetters), attrs)
+			}
+			return nil
+		},
+		ec.lagGauge, ec.deadLetterGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register consumer callback: %w", err)
+	}
+
+	return ec, nil
+}
+
+// Subscribe adds a consumer reading the log from its oldest kept event. It
+// must be called before Run; embedders use it for their own projections.
+func (ec *EventConsumers) Subscribe(name string, handle EventHandler) {
+	ec.subscribe(&eventConsumer{name: name, handle: handle})
+}
+
+// subscribeProjection adds a consumer applying events to p, which
+// /admin/consumers/{name}/rebuild can rebuild from the log
+func (ec *EventConsumers) subscribeProjection(name string, p projection) {
+	ec.subscribe(&eventConsumer{name: name, handle: p.apply, projection: p})
+}
+
+func (ec *EventConsumers) subscribe(consumer *eventConsumer) {
+	consumer.wake = make(chan struct{}, 1)
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	ec.consumers = append(ec.consumers, consumer)
+}
+
+// Run runs every consumer until ctx is cancelled
+func (ec *EventConsumers) Run(ctx context.Context) {
+	ec.mutex.Lock()
+	consumers := append([]*eventConsumer(nil), ec.consumers...)
+	ec.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func(consumer *eventConsumer) {
+			defer wg.Done()
+			ec.consume(ctx, consumer)
+		}(consumer)
+	}
+	wg.Wait()
+}
+
+// consume runs queued rebuilds, processes redriven dead letters and then
+// the log from the committed offset, committing after each event. An event
+// interrupted by shutdown isn't committed.
+func (ec *EventConsumers) consume(ctx context.Context, consumer *eventConsumer) {
+	for {
+		if ec.rebuildQueued(consumer) {
+			if !ec.replay(ctx, consumer) {
+				return
+			}
+			continue
+		}
+
+		if letters := ec.takeRedrive(consumer); len(letters) > 0 {
+			for i, letter := range letters {
+				if !ec.process(ctx, consumer, letter.Offset, letter.Message) {
+					ec.requeue(consumer, letters[i:])
+					return
+				}
+			}
+			continue
+		}
+
+		records, appended := ec.publisher.log.read(ec.committed(consumer), consumerBatchSize)
+		if len(records) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-appended:
+			case <-consumer.wake:
+			}
+			continue
+		}
+
+		if skipped := records[0].offset - ec.committed(consumer); skipped > 0 {
+			slog.WarnContext(ctx, "Event consumer fell behind the log", "consumer", consumer.name, "skipped", skipped)
+			ec.count(ctx, consumer, "", "skipped", skipped)
+		}
+		for _, record := range records {
+			if !ec.process(ctx, consumer, record.offset, record.message) {
+				return
+			}
+			ec.commit(consumer, record.offset+1)
+		}
+	}
+}
+
+// process decodes one message and hands it to the consumer, retrying
+// failures, and reports whether it is done with, handled or dead-lettered.
+// It returns false only when ctx is cancelled first.
+func (ec *EventConsumers) process(ctx context.Context, consumer *eventConsumer, offset int64, message []byte) bool {
+	letter := DeadLetter{Offset: offset, Message: message}
+	var envelope *events.Envelope
+
+	for attempt := 1; ; attempt++ {
+		err := ctx.Err()
+		if err != nil {
+			return false
+		}
+
+		if envelope == nil {
+			envelope, err = ec.publisher.codec.Load().Decode(ctx, message)
+			if errors.Is(err, events.ErrInvalidEvent) || errors.Is(err, events.ErrUnknownSchema) {
+				// Retrying can't make it valid
+				letter.Attempts, letter.Error = attempt, err.Error()
+				ec.deadLetter(ctx, consumer, letter, "invalid")
+				return true
+			}
+		}
+		if envelope != nil {
+			letter.Type = envelope.Type
+			if err = invoke(ctx, consumer.handle, envelope); err == nil {
+				ec.count(ctx, consumer, envelope.Type, "success", 1)
+				return true
+			}
+		}
+
+		if attempt >= ec.maxAttempts {
+			letter.Attempts, letter.Error = attempt, err.Error()
+			ec.deadLetter(ctx, consumer, letter, "dead_letter")
+			return true
+		}
+
+		ec.retryCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("consumer", consumer.name),
+			attribute.String("type", letter.Type),
+		))
+		delay := ec.backoff << (attempt - 1)
+		if delay <= 0 || delay > consumerMaxBackoff {
+			delay = consumerMaxBackoff
+		}
+		slog.WarnContext(ctx, "Event consumer failed, retrying", "consumer", consumer.name, "offset", offset, "attempt", attempt, "retry_in", delay.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// invoke runs a handler, turning a panic into an error
+func invoke(ctx context.Context, handle EventHandler, envelope *events.Envelope) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("handler panicked: %v", recovered)
+		}
+	}()
+	return handle(ctx, envelope)
+}
+
+// deadLetter keeps letter for inspection and redrive
+func (ec *EventConsumers) deadLetter(ctx context.Context, consumer *eventConsumer, letter DeadLetter, result string) {
+	letter.FailedAt = time.Now().UTC()
+	slog.ErrorContext(ctx, "Event dead-lettered", "consumer", consumer.name, "offset", letter.Offset, "type", letter.Type, "attempts", letter.Attempts, "error", letter.Error)
+
+	ec.mutex.Lock()
+	consumer.deadLetters = append(consumer.deadLetters, letter)
+	if excess := len(consumer.deadLetters) - maxDeadLetters; excess > 0 {
+		consumer.deadLetters = consumer.deadLetters[excess:]
+	}
+	consumer.lastError = letter.Error
+	ec.mutex.Unlock()
+
+	ec.count(ctx, consumer, letter.Type, result, 1)
+}
+
+func (ec *EventConsumers) count(ctx context.Context, consumer *eventConsumer, eventType, result string, n int64) {
+	ec.consumedCounter.Add(ctx, n, metric.WithAttributes(
+		attribute.String("consumer", consumer.name),
+		attribute.String("type", eventType),
+		attribute.String("result", result),
+	))
+}
+
+func (ec *EventConsumers) committed(consumer *eventConsumer) int64 {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	return consumer.offset
+}
+
+func (ec *EventConsumers) commit(consumer *eventConsumer, offset int64) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	consumer.offset = offset
+}
+
+func (ec *EventConsumers) takeRedrive(consumer *eventConsumer) []DeadLetter {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	letters := consumer.redrive
+	consumer.redrive = nil
+	return letters
+}
+
+// requeue puts redriven letters interrupted by shutdown back in the queue
+func (ec *EventConsumers) requeue(consumer *eventConsumer, letters []DeadLetter) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	consumer.redrive = append(letters, consumer.redrive...)
+}
+
+// consumer returns the named consumer, or nil
+func (ec *EventConsumers) consumer(name string) *eventConsumer {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	for _, consumer := range ec.consumers {
+		if consumer.name == name {
+			return consumer
+		}
+	}
+	return nil
+}
+
+// Status returns the position of every consumer
+func (ec *EventConsumers) Status() []ConsumerStatus {
+	end := ec.publisher.log.next()
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	statuses := make([]ConsumerStatus, 0, len(ec.consumers))
+	for _, consumer := range ec.consumers {
+		statuses = append(statuses, ConsumerStatus{
+			Name:        consumer.name,
+			Offset:      consumer.offset,
+			Lag:         end - consumer.offset,
+			DeadLetters: len(consumer.deadLetters),
+			LastError:   consumer.lastError,
+		})
+	}
+	return statuses
+}
+
+// DeadLetters returns up to limit of the consumer's dead letters, newest
+// first
+func (ec *EventConsumers) DeadLetters(name string, limit int) ([]DeadLetter, bool) {
+	consumer := ec.consumer(name)
+	if consumer == nil {
+		return nil, false
+	}
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if limit <= 0 || limit > len(consumer.deadLetters) {
+		limit = len(consumer.deadLetters)
+	}
+	letters := make([]DeadLetter, 0, limit)
+	for i := len(consumer.deadLetters) - 1; len(letters) < limit; i-- {
+		letters = append(letters, consumer.deadLetters[i])
+	}
+	return letters, true
+}
+
+// Redrive queues the consumer's dead letters for another try, ahead of the
+// rest of the log, and returns how many were queued
+func (ec *EventConsumers) Redrive(name string) (int, bool) {
+	consumer := ec.consumer(name)
+	if consumer == nil {
+		return 0, false
+	}
+
+	ec.mutex.Lock()
+	letters := consumer.deadLetters
+	consumer.deadLetters = nil
+	consumer.lastError = ""
+	consumer.redrive = append(consumer.redrive, letters...)
+	ec.mutex.Unlock()
+
+	select {
+	case consumer.wake <- struct{}{}:
+	default:
+	}
+	return len(letters), true
+}
+
+// handleConsumers serves GET /admin/consumers, every consumer's offset,
+// lag and dead letter count
+func (ms *MetricsServer) handleConsumers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"log_end":   ms.service.publisher.log.next(),
+		"consumers": ms.service.consumers.Status(),
+	})
+}
+
+// handleDeadLetters serves GET /admin/consumers/{name}/dead-letters, the
+// consumer's dead letters newest first
+func (ms *MetricsServer) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	limit := maxDeadLetterListed
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "limit")
+			return
+		}
+		limit = parsed
+	}
+
+	name := r.PathValue("name")
+	letters, ok := ms.service.consumers.DeadLetters(name, limit)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, msgConsumerNotFound, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"consumer":     name,
+		"dead_letters": letters,
+	})
+}
+
+// handleRedrive serves POST /admin/consumers/{name}/redrive, retrying the
+// consumer's dead letters
+func (ms *MetricsServer) handleRedrive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	queued, ok := ms.service.consumers.Redrive(name)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, msgConsumerNotFound, name)
+		return
+	}
+	slog.InfoContext(r.Context(), "Redriving dead letters", "consumer", name, "events", queued)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"consumer": name,
+		"queued":   queued,
+	})
+}
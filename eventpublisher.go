@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"shopping-cart-service/config"
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// eventSource names the service in published event envelopes
+const eventSource = "shopping-cart-service"
+
+// EventPublisher appends cart and order events to the in-process event log
+// as JSON envelopes carrying the ID of the schema their data was validated
+// against; consumers, including the webhook when one is configured, read
+// them from there. Events that don't match their schema are counted and
+// logged, never published.
+type EventPublisher struct {
+	codec   atomic.Pointer[events.Codec] // set once the schemas are registered
+	log     *eventLog
+	url     string // webhook, empty when not configured
+	client  *http.Client
+	timeout time.Duration
+
+	// OpenTelemetry Metrics
+	publishedCounter   metric.Int64Counter // Counter: events by type and result
+	clientEventCounter metric.Int64Counter // Counter: client-reported events by type and result
+}
+
+// NewEventPublisher creates a publisher for cfg. The schemas are
+// registered, with retries, as the readiness dependency event-schemas;
+// events published before then are dropped.
+func NewEventPublisher(cfg config.EventsConfig, readiness *Readiness) (*EventPublisher, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	client := &http.Client{Timeout: cfg.Timeout, Transport: &requestIDTransport{next: outboundPools.transport("events")}}
+	ep := &EventPublisher{
+		log:     newEventLog(cfg.LogCapacity),
+		url:     cfg.WebhookURL,
+		client:  client,
+		timeout: cfg.Timeout,
+	}
+
+	var registry events.Registry = events.NewLocalRegistry()
+	if cfg.SchemaRegistryURL != "" {
+		registry = events.NewHTTPRegistry(cfg.SchemaRegistryURL, client)
+	}
+	readiness.Require("event-schemas", func(ctx context.Context) error {
+		codec, err := events.NewCodec(ctx, registry, eventSource)
+		if err != nil {
+			return err
+		}
+		ep.codec.Store(codec)
+		return nil
+	})
+
+	var err error
+	ep.publishedCounter, err = meter.Int64Counter(
+		"events_published_total",
+		metric.WithDescription("Total number of published cart and order events by type and result (success, invalid, dropped)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create events published counter: %w", err)
+	}
+
+	ep.clientEventCounter, err = meter.Int64Counter(
+		"client_events_total",
+		metric.WithDescription("Total number of clickstream events reported to POST /v1/events by type and result (accepted, invalid)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client events counter: %w", err)
+	}
+
+	return ep, nil
+}
+
+// publish validates event and appends it to the event log
+func (ep *EventPublisher) publish(ctx context.Context, event events.Event) {
+	ep.publishAt(ctx, event, time.Now().UTC())
+}
+
+// publishAt publishes event as having occurred at occurredAt
+func (ep *EventPublisher) publishAt(ctx context.Context, event events.Event, occurredAt time.Time) {
+	eventType := event.EventType()
+
+	codec := ep.codec.Load()
+	if codec == nil {
+		// Schemas not registered yet
+		ep.count(ctx, eventType, "dropped")
+		return
+	}
+
+	meta := events.Metadata{ID: newRequestID(), OccurredAt: occurredAt}
+	if namespace := namespaceFrom(ctx); namespace != nil {
+		meta.Namespace = namespace.Name
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		meta.TraceID = spanContext.TraceID().String()
+	}
+	message, err := codec.Encode(meta, event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Event failed schema validation", "type", eventType, "error", err)
+		ep.count(ctx, eventType, "invalid")
+		return
+	}
+
+	ep.log.append(message)
+	ep.count(ctx, eventType, "success")
+}
+
+// deliver POSTs one envelope to the webhook; it is the handler of the
+// webhook consumer. The type and schema ID are repeated in headers so
+// receivers can route without parsing the body.
+func (ep *EventPublisher) deliver(ctx context.Context, envelope *events.Envelope) error {
+	message, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ep.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.url, bytes.NewReader(message))
+	if err != nil {
+		return fmt.Errorf("failed to build event request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", envelope.Type)
+	req.Header.Set("X-Schema-ID", strconv.Itoa(envelope.SchemaID))
+
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("event webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (ep *EventPublisher) count(ctx context.Context, eventType, result string) {
+	ep.publishedCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("type", eventType),
+		attribute.String("result", result),
+	))
+}
+
+// maxEventLine bounds one envelope read by the events subcommand
+const maxEventLine = 1 << 20
+
+// runEvents validates event envelopes, one JSON object per line, read from
+// the named files or stdin, the way a consumer would before using them
+func runEvents(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	registryURL := flags.String("registry", os.Getenv("SCHEMA_REGISTRY_URL"), "schema registry the events were published with (SCHEMA_REGISTRY_URL; default: the built-in schemas)")
+	timeout := flags.Duration("timeout", 5*time.Second, "registry request timeout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var registry events.Registry = events.NewLocalRegistry()
+	if *registryURL != "" {
+		registry = events.NewHTTPRegistry(*registryURL, &http.Client{Timeout: *timeout})
+	}
+	codec, err := events.NewCodec(ctx, registry, eventSource)
+	if err != nil {
+		return err
+	}
+
+	inputs := map[string]io.Reader{"stdin": os.Stdin}
+	names := []string{"stdin"}
+	if flags.NArg() > 0 {
+		inputs, names = make(map[string]io.Reader), flags.Args()
+		for _, name := range names {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			inputs[name] = file
+		}
+	}
+
+	valid, invalid := 0, 0
+	for _, name := range names {
+		scanner := bufio.NewScanner(inputs[name])
+		scanner.Buffer(nil, maxEventLine)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			envelope, err := codec.Decode(ctx, scanner.Bytes())
+			if err != nil {
+				invalid++
+				fmt.Printf("%s:%d: %v\n", name, line, err)
+				continue
+			}
+			valid++
+			fmt.Printf("%s:%d: %s %s (schema %d)\n", name, line, envelope.Type, envelope.ID, envelope.SchemaID)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	fmt.Printf("%d valid, %d invalid\n", valid, invalid)
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid events", invalid)
+	}
+	return nil
+}
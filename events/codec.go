@@ -0,0 +1,215 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// schemaFiles are the event schemas, named <type>.v<version>.json
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// producedSchema is the schema events of one type are published with
+type producedSchema struct {
+	id      int
+	version int
+	schema  *schema
+}
+
+// Codec encodes events into validated envelopes and decodes envelopes,
+// validating their data against the schema they name. It is safe for
+// concurrent use.
+type Codec struct {
+	registry Registry
+	source   string
+	produced map[string]producedSchema // event type -> latest schema
+
+	mutex sync.RWMutex
+	byID  map[int]*schema // schemas seen, including ones fetched to decode
+}
+
+// NewCodec registers the embedded schemas with registry and creates a codec
+// publishing events as source with the latest version of each
+func NewCodec(ctx context.Context, registry Registry, source string) (*Codec, error) {
+	c := &Codec{
+		registry: registry,
+		source:   source,
+		produced: make(map[string]producedSchema),
+		byID:     make(map[int]*schema),
+	}
+
+	files, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	// Registration order fixes local registry IDs
+	sort.Strings(names)
+
+	for _, name := range names {
+		eventType, version, err := parseSchemaName(name)
+		if err != nil {
+			return nil, err
+		}
+		document, err := schemaFiles.ReadFile(path.Join("schemas", name))
+		if err != nil {
+			return nil, err
+		}
+		compiled, err := compileSchema(document)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+
+		// Registries compare schemas textually, so whitespace changes
+		// mustn't produce new versions
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, document); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+		id, err := registry.Register(ctx, eventType, compact.String())
+		if err != nil {
+			return nil, err
+		}
+
+		c.byID[id] = compiled
+		if version > c.produced[eventType].version {
+			c.produced[eventType] = producedSchema{id: id, version: version, schema: compiled}
+		}
+	}
+	return c, nil
+}
+
+// parseSchemaName splits cart.item_added.v1.json into its event type and
+// version
+func parseSchemaName(name string) (string, int, error) {
+	base := strings.TrimSuffix(name, ".json")
+	i := strings.LastIndex(base, ".v")
+	if i < 0 {
+		return "", 0, fmt.Errorf("schema file %s: expected <type>.v<version>.json", name)
+	}
+	version, err := strconv.Atoi(base[i+2:])
+	if err != nil || version <= 0 {
+		return "", 0, fmt.Errorf("schema file %s: invalid version", name)
+	}
+	return base[:i], version, nil
+}
+
+// Encode validates event against its type's latest schema and returns the
+// JSON envelope to publish
+func (c *Codec) Encode(meta Metadata, event Event) ([]byte, error) {
+	eventType := event.EventType()
+	produced, ok := c.produced[eventType]
+	if !ok {
+		return nil, fmt.Errorf("%w for event type %s", ErrUnknownSchema, eventType)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if err := produced.schema.validateJSON(data); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidEvent, eventType, err)
+	}
+
+	return json.Marshal(Envelope{
+		ID:            meta.ID,
+		Type:          eventType,
+		SchemaID:      produced.id,
+		SchemaVersion: produced.version,
+		Source:        c.source,
+		OccurredAt:    meta.OccurredAt,
+		Namespace:     meta.Namespace,
+		TraceID:       meta.TraceID,
+		Data:          data,
+	})
+}
+
+// ParseClient validates data reported by a client as an event of
+// eventType against the type's latest schema and decodes it. Only the
+// clickstream event types are accepted.
+func (c *Codec) ParseClient(eventType string, data []byte) (Event, error) {
+	newEvent, ok := clientEvents[eventType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotClientEvent, eventType)
+	}
+	produced, ok := c.produced[eventType]
+	if !ok {
+		return nil, fmt.Errorf("%w for event type %s", ErrUnknownSchema, eventType)
+	}
+	if err := produced.schema.validateJSON(data); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidEvent, eventType, err)
+	}
+
+	event := newEvent()
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidEvent, eventType, err)
+	}
+	return event, nil
+}
+
+// SchemaID returns the ID of the schema events of eventType are published
+// with
+func (c *Codec) SchemaID(eventType string) (int, bool) {
+	produced, ok := c.produced[eventType]
+	return produced.id, ok
+}
+
+// Decode parses an envelope and validates its data against the schema it
+// names, fetching schemas it hasn't seen from the registry
+func (c *Codec) Decode(ctx context.Context, message []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, fmt.Errorf("%w: invalid envelope: %v", ErrInvalidEvent, err)
+	}
+	if envelope.Type == "" || len(envelope.Data) == 0 {
+		return nil, fmt.Errorf("%w: envelope has no type or data", ErrInvalidEvent)
+	}
+
+	s, err := c.schemaByID(ctx, envelope.SchemaID)
+	if err != nil {
+		return nil, err
+	}
+	if s.title != "" && s.title != envelope.Type {
+		return nil, fmt.Errorf("%w: schema %d is for %s, not %s", ErrInvalidEvent, envelope.SchemaID, s.title, envelope.Type)
+	}
+	if err := s.validateJSON(envelope.Data); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidEvent, envelope.Type, err)
+	}
+	return &envelope, nil
+}
+
+// schemaByID returns the compiled schema registered under id
+func (c *Codec) schemaByID(ctx context.Context, id int) (*schema, error) {
+	c.mutex.RLock()
+	s, ok := c.byID[id]
+	c.mutex.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	document, err := c.registry.Schema(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s, err = compileSchema([]byte(document))
+	if err != nil {
+		return nil, fmt.Errorf("schema %d: %w", id, err)
+	}
+
+	c.mutex.Lock()
+	c.byID[id] = s
+	c.mutex.Unlock()
+	return s, nil
+}
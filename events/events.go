@@ -0,0 +1,134 @@
+// Package events defines the cart and order events the service publishes,
+// and the clickstream events clients report to it.
+// Each event type has versioned JSON Schemas embedded in the package and
+// registered with a schema registry; messages carry the ID of the schema
+// their data was validated against, and consumers validate against the same
+// schema before using it.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Event types
+const (
+	TypeCartItemAdded   = "cart.item_added"
+	TypeCartItemRemoved = "cart.item_removed"
+	TypeCartExpired     = "cart.expired"
+	TypeOrderPlaced     = "order.placed"
+	TypeProductViewed   = "product.viewed"
+	TypeCartOpened      = "cart.opened"
+)
+
+// clientEvents are the event types clients may report, which ParseClient
+// accepts
+var clientEvents = map[string]func() Event{
+	TypeProductViewed: func() Event { return &ProductViewed{} },
+	TypeCartOpened:    func() Event { return &CartOpened{} },
+}
+
+// ErrNotClientEvent is returned for event types clients may not report
+var ErrNotClientEvent = errors.New("event type is not reported by clients")
+
+// ErrInvalidEvent is returned for events whose data doesn't match their
+// schema
+var ErrInvalidEvent = errors.New("event does not match its schema")
+
+// ErrUnknownSchema is returned for events naming a schema the registry
+// doesn't have
+var ErrUnknownSchema = errors.New("unknown event schema")
+
+// Event is the data of one event type
+type Event interface {
+	EventType() string
+}
+
+// CartItemAdded reports units of an item added to a cart
+type CartItemAdded struct {
+	UserID   string  `json:"user_id"`
+	ItemID   string  `json:"item_id"`
+	Quantity int     `json:"quantity"` // units added
+	Price    float64 `json:"price"`
+}
+
+func (CartItemAdded) EventType() string { return TypeCartItemAdded }
+
+// CartItemRemoved reports units of an item removed from a cart
+type CartItemRemoved struct {
+	UserID   string `json:"user_id"`
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"` // units removed
+}
+
+func (CartItemRemoved) EventType() string { return TypeCartItemRemoved }
+
+// CartExpired reports an idle cart removed after its TTL
+type CartExpired struct {
+	UserID    string  `json:"user_id"`
+	ItemCount int     `json:"item_count"` // units in the cart
+	Value     float64 `json:"value"`
+}
+
+func (CartExpired) EventType() string { return TypeCartExpired }
+
+// OrderPlaced reports a placed order
+type OrderPlaced struct {
+	OrderID   string  `json:"order_id"`
+	UserID    string  `json:"user_id"`
+	ItemCount int     `json:"item_count"` // units ordered
+	Subtotal  float64 `json:"subtotal"`
+	Discount  float64 `json:"discount"`
+	Total     float64 `json:"total"` // including shipping
+	Scope     string  `json:"scope"` // full or partial
+}
+
+func (OrderPlaced) EventType() string { return TypeOrderPlaced }
+
+// ProductViewed reports a product page view, sent by the client
+type ProductViewed struct {
+	UserID    string `json:"user_id"`
+	ProductID string `json:"product_id"`
+	SessionID string `json:"session_id,omitempty"`
+	Referrer  string `json:"referrer,omitempty"` // search, category, recommendation, direct or external
+}
+
+func (ProductViewed) EventType() string { return TypeProductViewed }
+
+// CartOpened reports a user opening their cart, sent by the client
+type CartOpened struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+func (CartOpened) EventType() string { return TypeCartOpened }
+
+// Metadata describes one occurrence of an event
+type Metadata struct {
+	ID         string
+	Source     string // the producing service
+	OccurredAt time.Time
+	Namespace  string // empty without namespaces
+	TraceID    string // the trace of the request that caused it, if any
+}
+
+// Envelope is the message published for an event. SchemaID identifies the
+// registered schema Data was validated against.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	SchemaID      int             `json:"schema_id"`
+	SchemaVersion int             `json:"schema_version"`
+	Source        string          `json:"source"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	Namespace     string          `json:"namespace,omitempty"`
+	TraceID       string          `json:"trace_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// Unmarshal decodes the envelope's data into event, typically one of the
+// types matching e.Type
+func (e *Envelope) Unmarshal(event Event) error {
+	return json.Unmarshal(e.Data, event)
+}
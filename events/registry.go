@@ -0,0 +1,129 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry stores schemas under numeric IDs. Registering a schema already
+// registered under the subject returns its existing ID.
+type Registry interface {
+	Register(ctx context.Context, subject, schema string) (int, error)
+	Schema(ctx context.Context, id int) (string, error)
+}
+
+// LocalRegistry is an in-process registry. IDs follow registration order,
+// so producers and consumers built from the same schemas agree on them;
+// deployments mixing versions should share a schema registry instead.
+type LocalRegistry struct {
+	mutex   sync.RWMutex
+	ids     map[string]int // subject and schema -> ID
+	schemas []string       // by ID - 1
+}
+
+// NewLocalRegistry creates an empty in-process registry
+func NewLocalRegistry() *LocalRegistry {
+	return &LocalRegistry{ids: make(map[string]int)}
+}
+
+func (lr *LocalRegistry) Register(_ context.Context, subject, schema string) (int, error) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+
+	key := subject + "\x00" + schema
+	if id, ok := lr.ids[key]; ok {
+		return id, nil
+	}
+	lr.schemas = append(lr.schemas, schema)
+	lr.ids[key] = len(lr.schemas)
+	return len(lr.schemas), nil
+}
+
+func (lr *LocalRegistry) Schema(_ context.Context, id int) (string, error) {
+	lr.mutex.RLock()
+	defer lr.mutex.RUnlock()
+
+	if id < 1 || id > len(lr.schemas) {
+		return "", fmt.Errorf("%w: %d", ErrUnknownSchema, id)
+	}
+	return lr.schemas[id-1], nil
+}
+
+// registryContentType is the media type of the schema registry REST API
+const registryContentType = "application/vnd.schemaregistry.v1+json"
+
+// HTTPRegistry is a client of a Confluent-compatible schema registry, such
+// as Confluent Schema Registry, Redpanda or Apicurio's compatibility API.
+// Schemas are registered with schemaType JSON.
+type HTTPRegistry struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPRegistry creates a client of the registry at baseURL
+func NewHTTPRegistry(baseURL string, client *http.Client) *HTTPRegistry {
+	return &HTTPRegistry{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+func (hr *HTTPRegistry) Register(ctx context.Context, subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schemaType": "JSON", "schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	var registered struct {
+		ID int `json:"id"`
+	}
+	if err := hr.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &registered); err != nil {
+		return 0, fmt.Errorf("failed to register schema %s: %w", subject, err)
+	}
+	return registered.ID, nil
+}
+
+func (hr *HTTPRegistry) Schema(ctx context.Context, id int) (string, error) {
+	var found struct {
+		Schema string `json:"schema"`
+	}
+	if err := hr.do(ctx, http.MethodGet, "/schemas/ids/"+strconv.Itoa(id), nil, &found); err != nil {
+		return "", fmt.Errorf("failed to fetch schema %d: %w", id, err)
+	}
+	return found.Schema, nil
+}
+
+// do sends body, if any, and decodes a successful response into out
+func (hr *HTTPRegistry) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, hr.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+	req.Header.Set("Accept", registryContentType)
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return ErrUnknownSchema
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("registry returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
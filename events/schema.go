@@ -0,0 +1,222 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// schemaKeywords are the JSON Schema keywords the validator understands.
+// Schemas using others are rejected rather than half-enforced.
+var schemaKeywords = map[string]bool{
+	"$schema": true, "$id": true, "title": true, "description": true,
+	"type": true, "required": true, "properties": true, "additionalProperties": true,
+	"items": true, "enum": true, "minimum": true, "maximum": true, "minLength": true, "format": true,
+}
+
+// schema is a compiled JSON Schema, the subset the event schemas use
+type schema struct {
+	title                string // the event type, for event schemas
+	typ                  string
+	required             []string
+	properties           map[string]*schema
+	additionalProperties bool
+	items                *schema
+	enum                 []interface{}
+	minimum              *float64
+	maximum              *float64
+	minLength            *int
+	format               string
+}
+
+// compileSchema parses a JSON Schema document
+func compileSchema(document []byte) (*schema, error) {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(document, &keywords); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	for keyword := range keywords {
+		if !schemaKeywords[keyword] {
+			return nil, fmt.Errorf("unsupported schema keyword %q", keyword)
+		}
+	}
+
+	var parsed struct {
+		Title                string                     `json:"title"`
+		Type                 string                     `json:"type"`
+		Required             []string                   `json:"required"`
+		Properties           map[string]json.RawMessage `json:"properties"`
+		AdditionalProperties *bool                      `json:"additionalProperties"`
+		Items                json.RawMessage            `json:"items"`
+		Enum                 []interface{}              `json:"enum"`
+		Minimum              *float64                   `json:"minimum"`
+		Maximum              *float64                   `json:"maximum"`
+		MinLength            *int                       `json:"minLength"`
+		Format               string                     `json:"format"`
+	}
+	if err := json.Unmarshal(document, &parsed); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	for _, allowed := range parsed.Enum {
+		switch allowed.(type) {
+		case string, float64, bool, nil:
+		default:
+			return nil, fmt.Errorf("unsupported enum value %v: only scalars are allowed", allowed)
+		}
+	}
+	switch parsed.Type {
+	case "", "object", "array", "string", "integer", "number", "boolean", "null":
+	default:
+		return nil, fmt.Errorf("unsupported schema type %q", parsed.Type)
+	}
+
+	s := &schema{
+		title:                parsed.Title,
+		typ:                  parsed.Type,
+		required:             parsed.Required,
+		additionalProperties: parsed.AdditionalProperties == nil || *parsed.AdditionalProperties,
+		enum:                 parsed.Enum,
+		minimum:              parsed.Minimum,
+		maximum:              parsed.Maximum,
+		minLength:            parsed.MinLength,
+		format:               parsed.Format,
+	}
+	if len(parsed.Properties) > 0 {
+		s.properties = make(map[string]*schema, len(parsed.Properties))
+		for name, property := range parsed.Properties {
+			compiled, err := compileSchema(property)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %w", name, err)
+			}
+			s.properties[name] = compiled
+		}
+	}
+	if len(parsed.Items) > 0 {
+		compiled, err := compileSchema(parsed.Items)
+		if err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+		s.items = compiled
+	}
+	return s, nil
+}
+
+// validateJSON checks a JSON document against s
+func (s *schema) validateJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	return s.validate(value, "data")
+}
+
+// validate checks a decoded value, naming it path in errors
+func (s *schema) validate(value interface{}, path string) error {
+	if s.typ != "" && !hasType(value, s.typ) {
+		return fmt.Errorf("%s: expected %s", path, s.typ)
+	}
+	if len(s.enum) > 0 && !inEnum(value, s.enum) {
+		return fmt.Errorf("%s: not one of the allowed values", path)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required %s", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		// Sorted so the reported error doesn't vary between runs
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.properties[name]
+			if !ok {
+				if !s.additionalProperties {
+					return fmt.Errorf("%s: unexpected property %s", path, name)
+				}
+				continue
+			}
+			if err := property.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.items != nil {
+			for i, element := range v {
+				if err := s.items.validate(element, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case json.Number:
+		number, _ := v.Float64()
+		if s.minimum != nil && number < *s.minimum {
+			return fmt.Errorf("%s: must be at least %v", path, *s.minimum)
+		}
+		if s.maximum != nil && number > *s.maximum {
+			return fmt.Errorf("%s: must be at most %v", path, *s.maximum)
+		}
+	case string:
+		if s.minLength != nil && len([]rune(v)) < *s.minLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, *s.minLength)
+		}
+		if s.format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return fmt.Errorf("%s: expected an RFC 3339 date-time", path)
+			}
+		}
+	}
+	return nil
+}
+
+// hasType reports whether value is of the JSON Schema type typ
+func hasType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case nil:
+		return typ == "null"
+	case json.Number:
+		if typ == "number" {
+			return true
+		}
+		number, err := v.Float64()
+		return typ == "integer" && err == nil && number == math.Trunc(number)
+	}
+	return false
+}
+
+// inEnum reports whether value equals one of the allowed values
+func inEnum(value interface{}, allowed []interface{}) bool {
+	for _, candidate := range allowed {
+		switch c := candidate.(type) {
+		case float64:
+			if number, ok := value.(json.Number); ok {
+				if f, err := number.Float64(); err == nil && f == c {
+					return true
+				}
+			}
+		default:
+			// compileSchema allows only scalars, which compare safely
+			if candidate == value {
+				return true
+			}
+		}
+	}
+	return false
+}
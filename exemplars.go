@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Exemplars kept per series, and series per metric
+const (
+	exemplarsPerSeries = 16
+	maxExemplarSeries  = 5000
+)
+
+// Exemplar labels, as OpenMetrics and Grafana name them
+const (
+	exemplarTraceIDName = "trace_id"
+	exemplarSpanIDName  = "span_id"
+)
+
+// exemplar is a measurement taken in a sampled trace
+type exemplar struct {
+	value   float64
+	traceID string
+	spanID  string
+	at      time.Time
+}
+
+// exemplarSeries holds the latest exemplars of one attribute set
+type exemplarSeries struct {
+	labels map[string]string // attributes as Prometheus labels
+	recent [exemplarsPerSeries]exemplar
+	next   int
+}
+
+// exemplarStore keeps recent exemplars of the metrics wrapped in an
+// exemplarHistogram or exemplarCounter, for /metrics to attach to their
+// series. The Prometheus exporter has no exemplar support of its own.
+type exemplarStore struct {
+	mutex  sync.Mutex
+	series map[string]map[attribute.Distinct]*exemplarSeries // by metric name
+}
+
+func newExemplarStore() *exemplarStore {
+	return &exemplarStore{series: make(map[string]map[attribute.Distinct]*exemplarSeries)}
+}
+
+// observe keeps value as an exemplar of the series of name with attrs when
+// ctx carries a sampled span; unsampled traces can't be looked up
+func (es *exemplarStore) observe(ctx context.Context, name string, value float64, attrs attribute.Set) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	byAttrs := es.series[name]
+	if byAttrs == nil {
+		byAttrs = make(map[attribute.Distinct]*exemplarSeries)
+		es.series[name] = byAttrs
+	}
+	series := byAttrs[attrs.Equivalent()]
+	if series == nil {
+		if len(byAttrs) >= maxExemplarSeries {
+			return
+		}
+		series = &exemplarSeries{labels: prometheusLabels(attrs)}
+		byAttrs[attrs.Equivalent()] = series
+	}
+	series.recent[series.next] = exemplar{
+		value:   value,
+		traceID: spanContext.TraceID().String(),
+		spanID:  spanContext.SpanID().String(),
+		at:      time.Now(),
+	}
+	series.next = (series.next + 1) % exemplarsPerSeries
+}
+
+// prometheusLabels names attrs the way the Prometheus exporter does
+func prometheusLabels(attrs attribute.Set) map[string]string {
+	labels := make(map[string]string, attrs.Len())
+	for iter := attrs.Iter(); iter.Next(); {
+		kv := iter.Attribute()
+		labels[strings.Map(sanitizeLabelRune, string(kv.Key))] = kv.Value.Emit()
+	}
+	return labels
+}
+
+func sanitizeLabelRune(r rune) rune {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ':' || r == '_' {
+		return r
+	}
+	return '_'
+}
+
+// latest returns the most recent exemplar of the series of name matching
+// labels with a value in (lower, upper]. Views may drop attributes, so a
+// series matches when its labels include all of labels.
+func (es *exemplarStore) latest(name string, labels []*dto.LabelPair, lower, upper float64) (exemplar, bool) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	var best exemplar
+	found := false
+	for _, series := range es.series[name] {
+		if !series.matches(labels) {
+			continue
+		}
+		for _, candidate := range series.recent {
+			if candidate.at.IsZero() || candidate.value <= lower || candidate.value > upper {
+				continue
+			}
+			if !found || candidate.at.After(best.at) {
+				best, found = candidate, true
+			}
+		}
+	}
+	return best, found
+}
+
+// matches reports whether the series has every label but the exporter's
+// scope labels
+func (s *exemplarSeries) matches(labels []*dto.LabelPair) bool {
+	for _, label := range labels {
+		name := label.GetName()
+		if name == "otel_scope_name" || name == "otel_scope_version" {
+			continue
+		}
+		if value, ok := s.labels[name]; !ok || value != label.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+// proto converts the exemplar for the Prometheus text formats
+func (e exemplar) proto() *dto.Exemplar {
+	traceIDName, spanIDName := exemplarTraceIDName, exemplarSpanIDName
+	traceID, spanID, value := e.traceID, e.spanID, e.value
+	return &dto.Exemplar{
+		Label: []*dto.LabelPair{
+			{Name: &traceIDName, Value: &traceID},
+			{Name: &spanIDName, Value: &spanID},
+		},
+		Value:     &value,
+		Timestamp: timestamppb.New(e.at),
+	}
+}
+
+// exemplarGatherer attaches the stored exemplars to the gathered counters
+// and histogram buckets. They are only served in the OpenMetrics format,
+// which Prometheus asks for when its exemplar storage is enabled.
+type exemplarGatherer struct {
+	prometheus.Gatherer
+	store *exemplarStore
+}
+
+func (g exemplarGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		name := family.GetName()
+		g.store.mutex.Lock()
+		_, tracked := g.store.series[name]
+		g.store.mutex.Unlock()
+		if !tracked {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			switch {
+			case m.GetCounter() != nil:
+				if e, ok := g.store.latest(name, m.GetLabel(), math.Inf(-1), math.Inf(1)); ok {
+					m.Counter.Exemplar = e.proto()
+				}
+			case m.GetHistogram() != nil:
+				lower := math.Inf(-1)
+				for _, bucket := range m.Histogram.GetBucket() {
+					if e, ok := g.store.latest(name, m.GetLabel(), lower, bucket.GetUpperBound()); ok {
+						bucket.Exemplar = e.proto()
+					}
+					lower = bucket.GetUpperBound()
+				}
+			}
+		}
+	}
+	return families, err
+}
+
+// exemplarHistogram keeps exemplars of a histogram's measurements
+type exemplarHistogram struct {
+	metric.Float64Histogram
+	name  string
+	store *exemplarStore
+}
+
+func (h exemplarHistogram) Record(ctx context.Context, value float64, options ...metric.RecordOption) {
+	h.Float64Histogram.Record(ctx, value, options...)
+	h.store.observe(ctx, h.name, value, metric.NewRecordConfig(options).Attributes())
+}
+
+// exemplarCounter keeps exemplars of a counter's increments
+type exemplarCounter struct {
+	metric.Int64Counter
+	name  string
+	store *exemplarStore
+}
+
+func (c exemplarCounter) Add(ctx context.Context, incr int64, options ...metric.AddOption) {
+	c.Int64Counter.Add(ctx, incr, options...)
+	c.store.observe(ctx, c.name, float64(incr), metric.NewAddConfig(options).Attributes())
+}
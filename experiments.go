@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// experimentBuckets is the resolution of variant weights
+const experimentBuckets = 10000
+
+// ExperimentVariant is one arm of an experiment with a relative weight
+type ExperimentVariant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Experiment deterministically splits users across variants
+type Experiment struct {
+	Name     string              `json:"name"`
+	Salt     string              `json:"-"`
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+// ExperimentManager assigns users to experiment variants. Assignment is a
+// pure function of user ID, experiment salt and weights, so it is sticky
+// across requests and instances without any shared state.
+type ExperimentManager struct {
+	experiments []Experiment
+
+	// OpenTelemetry Metrics
+	exposureCounter metric.Int64Counter // Counter: assignments served via the API
+}
+
+// ParseExperiments parses definitions of the form
+// "checkout_button:salt1:control=50,blue=50;pricing:salt2:control=90,new=10"
+func ParseExperiments(spec string) ([]Experiment, error) {
+	var experiments []Experiment
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid experiment %q: expected name:salt:variant=weight,...", entry)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("duplicate experiment %q", parts[0])
+		}
+		seen[parts[0]] = true
+
+		experiment := Experiment{Name: parts[0], Salt: parts[1]}
+		total := 0
+		for _, variantSpec := range strings.Split(parts[2], ",") {
+			name, weightValue, found := strings.Cut(strings.TrimSpace(variantSpec), "=")
+			weight, err := strconv.Atoi(weightValue)
+			if !found || name == "" || err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid variant %q in experiment %s", variantSpec, experiment.Name)
+			}
+			experiment.Variants = append(experiment.Variants, ExperimentVariant{Name: name, Weight: weight})
+			total += weight
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("experiment %s has no weighted variants", experiment.Name)
+		}
+
+		experiments = append(experiments, experiment)
+	}
+
+	return experiments, nil
+}
+
+// NewExperimentManager creates a manager for the given experiments
+func NewExperimentManager(experiments []Experiment) (*ExperimentManager, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	manager := &ExperimentManager{experiments: experiments}
+	sort.Slice(manager.experiments, func(i, j int) bool {
+		return manager.experiments[i].Name < manager.experiments[j].Name
+	})
+
+	var err error
+	manager.exposureCounter, err = meter.Int64Counter(
+		"experiment_exposures_total",
+		metric.WithDescription("Total number of experiment assignments served, by experiment and variant"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create experiment exposure counter: %w", err)
+	}
+
+	return manager, nil
+}
+
+// variantFor returns the variant assigned to userID
+func (e Experiment) variantFor(userID string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(e.Salt))
+	hash.Write([]byte{':'})
+	hash.Write([]byte(userID))
+	bucket := int(hash.Sum64() % experimentBuckets)
+
+	total := 0
+	for _, variant := range e.Variants {
+		total += variant.Weight
+	}
+
+	// Scale the bucket into the weight range and walk cumulative weights
+	point := bucket * total / experimentBuckets
+	cumulative := 0
+	for _, variant := range e.Variants {
+		cumulative += variant.Weight
+		if point < cumulative {
+			return variant.Name
+		}
+	}
+	return e.Variants[len(e.Variants)-1].Name
+}
+
+// Assign returns the variant for every experiment, keyed by experiment name
+func (em *ExperimentManager) Assign(userID string) map[string]string {
+	assignments := make(map[string]string, len(em.experiments))
+	for _, experiment := range em.experiments {
+		assignments[experiment.Name] = experiment.variantFor(userID)
+	}
+	return assignments
+}
+
+// Baggage encodes a user's assignments as W3C baggage members prefixed with
+// "exp." so downstream services can read them
+func (em *ExperimentManager) Baggage(userID string) (baggage.Baggage, error) {
+	var members []baggage.Member
+	for _, experiment := range em.experiments {
+		member, err := baggage.NewMember("exp."+experiment.Name, experiment.variantFor(userID))
+		if err != nil {
+			return baggage.Baggage{}, fmt.Errorf("failed to encode experiment %s: %w", experiment.Name, err)
+		}
+		members = append(members, member)
+	}
+	return baggage.New(members...)
+}
+
+// experimentAttributes returns experiment attributes for the user in ctx
+func (em *ExperimentManager) experimentAttributes(ctx context.Context) []attribute.KeyValue {
+	info := requestInfoFrom(ctx)
+	if em == nil || info == nil || info.UserID == "" {
+		return nil
+	}
+
+	attrs := make([]attribute.KeyValue, 0, len(em.experiments))
+	for _, experiment := range em.experiments {
+		attrs = append(attrs, attribute.String("experiment_"+experiment.Name, experiment.variantFor(info.UserID)))
+	}
+	return attrs
+}
+
+func (ms *MetricsServer) handleExperiments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+		return
+	}
+	setRequestUser(r.Context(), userID)
+
+	experiments := ms.service.experiments
+	assignments := experiments.Assign(userID)
+	bag, err := experiments.Baggage(userID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+
+	for name, variant := range assignments {
+		experiments.exposureCounter.Add(r.Context(), 1,
+			metric.WithAttributes(
+				attribute.String("experiment", name),
+				attribute.String("variant", variant),
+			),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"assignments": assignments,
+		"features":    ms.service.featuresFor(r.Context()).Cohorts(userID),
+		"baggage":     bag.String(),
+	})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"plugin"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"shopping-cart-service/config"
+)
+
+// Extension kinds
+const (
+	extensionWASM   = "wasm"
+	extensionPlugin = "plugin"
+)
+
+// Extension hook points
+const (
+	extensionHookPricing    = "pricing"
+	extensionHookValidation = "validation"
+)
+
+// defaultExtensionTimeout bounds a single extension call
+const defaultExtensionTimeout = 50 * time.Millisecond
+
+// wasmMemoryLimitPages caps a WASM extension's memory at 16 MiB
+const wasmMemoryLimitPages = 256
+
+// errExtensionTimeout is returned when an extension exceeds its timeout
+var errExtensionTimeout = errors.New("extension timed out")
+
+// Extension is a loaded business-rule module. It exchanges JSON documents
+// with the service: pricing extensions receive a pricingInput and return a
+// pricingOutput, validation extensions receive a validationInput and return
+// a validationOutput.
+type Extension interface {
+	Name() string
+	Call(ctx context.Context, input []byte) ([]byte, error)
+	Close(ctx context.Context) error
+}
+
+// pricingInput is sent to pricing extensions after the configured rules ran
+type pricingInput struct {
+	Cart   *Cart       `json:"cart"`
+	Totals *CartTotals `json:"totals"`
+}
+
+// pricingOutput lists extra per-line discounts
+type pricingOutput struct {
+	Adjustments []struct {
+		ItemID   string  `json:"item_id"`
+		Discount float64 `json:"discount"`
+		Rule     string  `json:"rule"`
+	} `json:"adjustments"`
+}
+
+// validationInput is sent to validation extensions before an item is added
+type validationInput struct {
+	UserID string   `json:"user_id"`
+	Item   CartItem `json:"item"`
+}
+
+// validationOutput accepts or rejects the item
+type validationOutput struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// wasmExtension runs a WASM module in a wazero sandbox. The module exports
+// alloc(size) -> ptr and evaluate(ptr, len) -> (ptr << 32 | len); a fresh
+// instance handles every call so calls never share state. WASI is available
+// without filesystem, network or clock access beyond wazero's defaults.
+type wasmExtension struct {
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// newWASMExtension compiles the module at path
+func newWASMExtension(ctx context.Context, name, path string) (*wasmExtension, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryLimitPages))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile %s: %w", path, err)
+	}
+	for _, export := range []string{"alloc", "evaluate"} {
+		if _, ok := compiled.ExportedFunctions()[export]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("%s does not export %s", path, export)
+		}
+	}
+
+	return &wasmExtension{name: name, runtime: runtime, compiled: compiled}, nil
+}
+
+func (we *wasmExtension) Name() string { return we.name }
+
+func (we *wasmExtension) Call(ctx context.Context, input []byte) ([]byte, error) {
+	// Anonymous instances so concurrent calls don't collide on the name;
+	// reactor modules built with TinyGo initialize through _initialize
+	module, err := we.runtime.InstantiateModule(ctx, we.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate: %w", err)
+	}
+	defer module.Close(context.WithoutCancel(ctx))
+
+	results, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, input) {
+		return nil, errors.New("alloc returned an out-of-range pointer")
+	}
+
+	results, err = module.ExportedFunction("evaluate").Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("evaluate: %w", err)
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	output, ok := module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("evaluate returned an out-of-range result")
+	}
+	// Memory is released with the instance, so copy the result out
+	return append([]byte(nil), output...), nil
+}
+
+func (we *wasmExtension) Close(ctx context.Context) error {
+	return we.runtime.Close(ctx)
+}
+
+// pluginEvaluate is the signature of the Evaluate symbol a Go plugin exports
+type pluginEvaluate = func(ctx context.Context, input []byte) ([]byte, error)
+
+// pluginExtension calls a Go plugin built with -buildmode=plugin. Plugins
+// run in-process and can't be interrupted, so a call that times out is
+// abandoned rather than stopped; prefer WASM for untrusted rules. Plugins
+// require a cgo-enabled build of the service.
+type pluginExtension struct {
+	name     string
+	evaluate pluginEvaluate
+}
+
+// newPluginExtension opens the plugin at path and looks up Evaluate
+func newPluginExtension(name, path string) (*pluginExtension, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin %s: %w", path, err)
+	}
+	symbol, err := p.Lookup("Evaluate")
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	evaluate, ok := symbol.(pluginEvaluate)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: Evaluate has type %T, want func(context.Context, []byte) ([]byte, error)", path, symbol)
+	}
+	return &pluginExtension{name: name, evaluate: evaluate}, nil
+}
+
+func (pe *pluginExtension) Name() string { return pe.name }
+
+func (pe *pluginExtension) Call(ctx context.Context, input []byte) ([]byte, error) {
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- result{err: fmt.Errorf("plugin panicked: %v", recovered)}
+			}
+		}()
+		output, err := pe.evaluate(ctx, input)
+		done <- result{output: output, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.output, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (pe *pluginExtension) Close(context.Context) error {
+	// Go plugins can't be unloaded
+	return nil
+}
+
+// loadedExtension is an extension bound to its hook point and timeout
+type loadedExtension struct {
+	Extension
+	hook    string
+	timeout time.Duration
+}
+
+// Extensions holds the configured extensions by hook point
+type Extensions struct {
+	pricing    []loadedExtension
+	validation []loadedExtension
+	all        []loadedExtension
+
+	// OpenTelemetry Metrics
+	callCounter  metric.Int64Counter     // Counter: extension calls by extension, hook and result
+	callDuration metric.Float64Histogram // Histogram: extension call duration
+}
+
+// LoadExtensions loads the extensions listed in the configuration
+func LoadExtensions(ctx context.Context, configs []config.ExtensionConfig) (*Extensions, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	extensions := &Extensions{}
+
+	var err error
+	extensions.callCounter, err = meter.Int64Counter(
+		"extension_calls_total",
+		metric.WithDescription("Total number of extension calls by extension, hook and result (ok, rejected, error, timeout)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create extension call counter: %w", err)
+	}
+
+	extensions.callDuration, err = meter.Float64Histogram(
+		"extension_call_duration_seconds",
+		metric.WithDescription("Extension call duration in seconds by extension and hook"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create extension duration histogram: %w", err)
+	}
+
+	for _, cfg := range configs {
+		var extension Extension
+		switch cfg.Kind {
+		case extensionWASM:
+			extension, err = newWASMExtension(ctx, cfg.Name, cfg.Path)
+		case extensionPlugin:
+			extension, err = newPluginExtension(cfg.Name, cfg.Path)
+		default:
+			err = fmt.Errorf("unknown kind %q: expected %s or %s", cfg.Kind, extensionWASM, extensionPlugin)
+		}
+		if err != nil {
+			extensions.Close(ctx)
+			return nil, fmt.Errorf("extension %s: %w", cfg.Name, err)
+		}
+
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = defaultExtensionTimeout
+		}
+		loaded := loadedExtension{Extension: extension, hook: cfg.Hook, timeout: timeout}
+		extensions.all = append(extensions.all, loaded)
+
+		switch cfg.Hook {
+		case extensionHookPricing:
+			extensions.pricing = append(extensions.pricing, loaded)
+		case extensionHookValidation:
+			extensions.validation = append(extensions.validation, loaded)
+		default:
+			extensions.Close(ctx)
+			return nil, fmt.Errorf("extension %s: unknown hook %q: expected %s or %s", cfg.Name, cfg.Hook, extensionHookPricing, extensionHookValidation)
+		}
+		slog.Info("Loaded extension", "extension", cfg.Name, "kind", cfg.Kind, "hook", cfg.Hook)
+	}
+
+	return extensions, nil
+}
+
+// call runs one extension under its timeout and decodes its JSON output
+// into out, returning how long the call took
+func (e *Extensions) call(ctx context.Context, ext loadedExtension, in, out interface{}) (time.Duration, error) {
+	input, err := json.Marshal(in)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode extension input: %w", err)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, ext.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := ext.Call(callCtx, input)
+	elapsed := time.Since(start)
+	if callCtx.Err() == context.DeadlineExceeded {
+		return elapsed, fmt.Errorf("%w after %s", errExtensionTimeout, ext.timeout)
+	}
+	if err != nil {
+		return elapsed, err
+	}
+	if err := json.Unmarshal(output, out); err != nil {
+		return elapsed, fmt.Errorf("invalid extension output: %w", err)
+	}
+	return elapsed, nil
+}
+
+// callResult returns the result label of a failed extension call
+func callResult(err error) string {
+	if errors.Is(err, errExtensionTimeout) {
+		return "timeout"
+	}
+	return "error"
+}
+
+// record counts an extension call and its duration
+func (e *Extensions) record(ctx context.Context, ext loadedExtension, result string, duration time.Duration) {
+	attrs := []attribute.KeyValue{
+		attribute.String("extension", ext.Name()),
+		attribute.String("hook", ext.hook),
+	}
+	e.callDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(attrs...))
+	e.callCounter.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("result", result))...))
+}
+
+// adjustPrices applies pricing extension discounts to totals. Extensions
+// that fail or time out are skipped so a broken rule can't block pricing.
+func (e *Extensions) adjustPrices(ctx context.Context, cart *Cart, totals *CartTotals) {
+	for _, ext := range e.pricing {
+		var out pricingOutput
+		elapsed, err := e.call(ctx, ext, pricingInput{Cart: cart, Totals: totals}, &out)
+		if err != nil {
+			e.record(ctx, ext, callResult(err), elapsed)
+			slog.WarnContext(ctx, "Pricing extension skipped", "extension", ext.Name(), "error", err)
+			continue
+		}
+		e.record(ctx, ext, "ok", elapsed)
+
+		for _, adjustment := range out.Adjustments {
+			if adjustment.Discount <= 0 {
+				continue
+			}
+			for i := range totals.Lines {
+				line := &totals.Lines[i]
+				if line.ItemID != adjustment.ItemID {
+					continue
+				}
+				discount := math.Min(roundCents(adjustment.Discount), line.Total)
+				line.Discount = roundCents(line.Discount + discount)
+				line.Total = roundCents(line.Total - discount)
+				line.AppliedRules = append(line.AppliedRules, ext.Name()+":"+adjustment.Rule)
+				totals.Discount = roundCents(totals.Discount + discount)
+				totals.Total = roundCents(totals.Total - discount)
+			}
+		}
+	}
+}
+
+// validateItem asks the validation extensions whether item may be added.
+// Only an explicit rejection blocks the add; failures are logged and the
+// item is allowed.
+func (e *Extensions) validateItem(ctx context.Context, userID string, item CartItem) error {
+	for _, ext := range e.validation {
+		var out validationOutput
+		elapsed, err := e.call(ctx, ext, validationInput{UserID: userID, Item: item}, &out)
+		if err != nil {
+			e.record(ctx, ext, callResult(err), elapsed)
+			slog.WarnContext(ctx, "Validation extension skipped", "extension", ext.Name(), "error", err)
+			continue
+		}
+		if !out.Allowed {
+			e.record(ctx, ext, "rejected", elapsed)
+			return fmt.Errorf("extension %s: %s", ext.Name(), out.Reason)
+		}
+		e.record(ctx, ext, "ok", elapsed)
+	}
+	return nil
+}
+
+// Close releases every loaded extension
+func (e *Extensions) Close(ctx context.Context) error {
+	var errs []error
+	for _, ext := range e.all {
+		if err := ext.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("extension %s: %w", ext.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
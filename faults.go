@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// anyEndpoint is the fault endpoint matching every application route
+// without a fault of its own
+const anyEndpoint = "*"
+
+// FaultRule injects latency and errors into the requests of one endpoint
+type FaultRule struct {
+	Endpoint     string  `json:"endpoint"`       // route pattern, e.g. /cart/add, or * for every application route
+	LatencyRate  float64 `json:"latency_rate"`   // fraction of requests delayed
+	LatencyMS    int     `json:"latency_ms"`     // median delay
+	LatencyP99MS int     `json:"latency_p99_ms"` // 99th percentile delay; 0 always delays latency_ms
+	ErrorRate    float64 `json:"error_rate"`     // fraction of requests failed
+	StatusCode   int     `json:"status_code"`    // of failed requests, default 500
+
+	// DurationSeconds removes the rule that long after it is set; 0 keeps
+	// it until deleted
+	DurationSeconds int        `json:"duration_seconds,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+}
+
+// validate checks rule, filling in defaults
+func (rule *FaultRule) validate() error {
+	switch {
+	case rule.Endpoint != anyEndpoint && !strings.HasPrefix(rule.Endpoint, "/"):
+		return constraintViolation("endpoint", msgInvalidFieldValue)
+	case rule.Endpoint == "/admin/faults":
+		// Faults must always be removable
+		return constraintViolation("endpoint", msgInvalidFieldValue)
+	case rule.LatencyRate < 0 || rule.LatencyRate > 1:
+		return constraintViolation("latency_rate", msgInvalidFieldValue)
+	case rule.LatencyMS < 0:
+		return constraintViolation("latency_ms", msgInvalidFieldValue)
+	case rule.LatencyP99MS != 0 && rule.LatencyP99MS < rule.LatencyMS:
+		return constraintViolation("latency_p99_ms", msgInvalidFieldValue)
+	case rule.ErrorRate < 0 || rule.ErrorRate > 1:
+		return constraintViolation("error_rate", msgInvalidFieldValue)
+	case rule.StatusCode != 0 && (rule.StatusCode < 400 || rule.StatusCode > 599):
+		return constraintViolation("status_code", msgInvalidFieldValue)
+	case rule.DurationSeconds < 0:
+		return constraintViolation("duration_seconds", msgInvalidFieldValue)
+	}
+	if rule.StatusCode == 0 {
+		rule.StatusCode = http.StatusInternalServerError
+	}
+	if rule.LatencyP99MS == 0 {
+		rule.LatencyP99MS = rule.LatencyMS
+	}
+	return nil
+}
+
+// ambientFaults is the background jitter that gives the demo dashboards a
+// latency distribution to show: 30% of requests delayed around 50ms.
+// DELETE /admin/faults removes it for a clean baseline.
+var ambientFaults = []FaultRule{
+	{Endpoint: anyEndpoint, LatencyRate: 0.3, LatencyMS: 50, LatencyP99MS: 99},
+}
+
+// activeFault is a set rule and its fitted latency distribution
+type activeFault struct {
+	rule    FaultRule
+	latency latencyDistribution
+}
+
+// FaultInjector delays and fails requests by the fault rules set through
+// /admin/faults, so alert conditions can be triggered on demand. Rules
+// apply where a pipeline includes "chaos".
+type FaultInjector struct {
+	faults map[string]*activeFault // by endpoint
+	mutex  sync.RWMutex
+
+	// OpenTelemetry Metrics
+	injectedCounter metric.Int64Counter // Counter: injected faults by endpoint and kind
+}
+
+// NewFaultInjector creates an injector with rules set
+func NewFaultInjector(rules []FaultRule) (*FaultInjector, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	fi := &FaultInjector{faults: make(map[string]*activeFault)}
+	for _, rule := range rules {
+		if err := fi.Set(rule); err != nil {
+			return nil, fmt.Errorf("fault %s: %w", rule.Endpoint, err)
+		}
+	}
+
+	var err error
+	fi.injectedCounter, err = meter.Int64Counter(
+		"faults_injected_total",
+		metric.WithDescription("Total number of injected faults by endpoint and fault (latency, error)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create faults injected counter: %w", err)
+	}
+
+	return fi, nil
+}
+
+// Set validates rule and replaces any fault on its endpoint
+func (fi *FaultInjector) Set(rule FaultRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	rule.ExpiresAt = nil
+	if rule.DurationSeconds > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(rule.DurationSeconds) * time.Second)
+		rule.ExpiresAt = &expiresAt
+	}
+
+	fault := &activeFault{
+		rule:    rule,
+		latency: newLatencyDistribution(time.Duration(rule.LatencyMS)*time.Millisecond, time.Duration(rule.LatencyP99MS)*time.Millisecond),
+	}
+
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	fi.faults[rule.Endpoint] = fault
+	return nil
+}
+
+// Remove deletes the fault on endpoint, reporting whether there was one
+func (fi *FaultInjector) Remove(endpoint string) bool {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	fault, ok := fi.faults[endpoint]
+	delete(fi.faults, endpoint)
+	return ok && !fault.expired(time.Now())
+}
+
+// Clear deletes every fault
+func (fi *FaultInjector) Clear() {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	fi.faults = make(map[string]*activeFault)
+}
+
+// List returns the unexpired rules by endpoint, dropping expired ones
+func (fi *FaultInjector) List() []FaultRule {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	now := time.Now()
+	rules := make([]FaultRule, 0, len(fi.faults))
+	for endpoint, fault := range fi.faults {
+		if fault.expired(now) {
+			delete(fi.faults, endpoint)
+			continue
+		}
+		rules = append(rules, fault.rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Endpoint < rules[j].Endpoint })
+	return rules
+}
+
+func (af *activeFault) expired(now time.Time) bool {
+	return af.rule.ExpiresAt != nil && !now.Before(*af.rule.ExpiresAt)
+}
+
+// lookup returns the fault on endpoint, falling back to the * fault for
+// application routes; the readiness, health, metrics and admin endpoints
+// are only faulted by name
+func (fi *FaultInjector) lookup(endpoint string) *activeFault {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+
+	fault, ok := fi.faults[endpoint]
+	if !ok && readinessGated(endpoint) {
+		fault, ok = fi.faults[anyEndpoint]
+	}
+	if !ok || fault.expired(time.Now()) {
+		return nil
+	}
+	return fault
+}
+
+// wrap is the chaos middleware: it delays a request at the latency rate
+// and then fails it at the error rate of its endpoint's fault
+func (fi *FaultInjector) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpoint := endpointOf(r)
+		fault := fi.lookup(endpoint)
+		if fault == nil {
+			handler(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if rand.Float64() < fault.rule.LatencyRate {
+			delay := fault.latency.draw()
+			fi.record(ctx, endpoint, "latency", attribute.Int64("fault.latency_ms", delay.Milliseconds()))
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		if rand.Float64() < fault.rule.ErrorRate {
+			fi.record(ctx, endpoint, "error", attribute.Int("fault.status_code", fault.rule.StatusCode))
+			writeError(w, r, fault.rule.StatusCode, msgSimulatedError, fault.rule.StatusCode)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// record counts an injected fault and marks it on the request's span
+func (fi *FaultInjector) record(ctx context.Context, endpoint, kind string, detail attribute.KeyValue) {
+	fi.injectedCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("endpoint", endpoint),
+		attribute.String("fault", kind),
+	))
+	trace.SpanFromContext(ctx).AddEvent("fault injected", trace.WithAttributes(
+		attribute.String("fault", kind),
+		detail,
+	))
+}
+
+// handleFaults lists (GET), sets (PUT) or removes (DELETE) injected
+// faults. A PUT body is one FaultRule, replacing any fault on its
+// endpoint; DELETE removes the fault on ?endpoint=..., or every fault
+// without one. Like every admin endpoint it requires the admin token, as
+// faults reach production routes.
+func (ms *MetricsServer) handleFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rule FaultRule
+		if err := decodeJSONBody(r, &rule); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		if err := ms.faults.Set(rule); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+	case http.MethodDelete:
+		endpoint := r.URL.Query().Get("endpoint")
+		if endpoint == "" {
+			ms.faults.Clear()
+		} else if !ms.faults.Remove(endpoint) {
+			writeError(w, r, http.StatusNotFound, msgFaultNotFound, endpoint)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"faults": ms.faults.List(),
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Built-in features that can be rolled out gradually
+const (
+	// featureCartRulePricing applies CEL discount rules when pricing carts
+	featureCartRulePricing = "cart_rule_pricing"
+)
+
+// builtinFeatureDefaults is whether each built-in feature is on for
+// everyone while no rollout is configured for it
+var builtinFeatureDefaults = map[string]bool{
+	featureCartRulePricing: true,
+}
+
+// Cohorts a user can fall in for a feature, stamped on request metrics
+const (
+	featureCohortListed  = "cohort"  // named in the feature's cohort list
+	featureCohortRollout = "rollout" // inside the rollout percentage
+	featureCohortOff     = "off"
+)
+
+// featureRollout is one configured rollout
+type featureRollout struct {
+	name    string
+	percent float64
+	buckets int // of experimentBuckets that get the feature
+	cohort  map[string]bool
+}
+
+// cohortFor returns which cohort userID falls in. The percentage bucket is
+// a hash of feature and user, so users keep their assignment across
+// requests and instances, and raising the percentage only adds users.
+func (fr featureRollout) cohortFor(userID string) string {
+	if fr.cohort[userID] {
+		return featureCohortListed
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(fr.name))
+	hash.Write([]byte{':'})
+	hash.Write([]byte(userID))
+	if int(hash.Sum64()%experimentBuckets) < fr.buckets {
+		return featureCohortRollout
+	}
+	return featureCohortOff
+}
+
+// FeatureRollouts decides per user whether gradually rolled out features
+// are enabled, for the built-in features and for embedders gating their
+// own code paths
+type FeatureRollouts struct {
+	rollouts  []featureRollout // sorted by name
+	namespace string           // whose overrides these are, empty for the instance's
+
+	// OpenTelemetry Metrics
+	percentGauge metric.Float64ObservableGauge // Gauge: configured rollout percentage
+}
+
+// NewFeatureRollouts creates the rollouts configured in features
+func NewFeatureRollouts(features []config.FeatureConfig) (*FeatureRollouts, error) {
+	return newFeatureRollouts(features, "")
+}
+
+// newFeatureRollouts creates the rollouts of a namespace overriding the
+// instance's; its percentages are reported with a namespace attribute
+func newFeatureRollouts(features []config.FeatureConfig, namespace string) (*FeatureRollouts, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	fr := &FeatureRollouts{namespace: namespace}
+	for _, feature := range features {
+		rollout := featureRollout{
+			name:    feature.Name,
+			percent: feature.Percent,
+			buckets: int(feature.Percent / 100 * experimentBuckets),
+			cohort:  make(map[string]bool, len(feature.Cohort)),
+		}
+		for _, userID := range feature.Cohort {
+			rollout.cohort[userID] = true
+		}
+		fr.rollouts = append(fr.rollouts, rollout)
+	}
+	sort.Slice(fr.rollouts, func(i, j int) bool { return fr.rollouts[i].name < fr.rollouts[j].name })
+
+	var err error
+	fr.percentGauge, err = meter.Float64ObservableGauge(
+		"feature_rollout_percent",
+		metric.WithDescription("Configured rollout percentage of each feature"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create feature rollout gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			for _, rollout := range fr.rollouts {
+				attrs := []attribute.KeyValue{attribute.String("feature", rollout.name)}
+				if fr.namespace != "" {
+					attrs = append(attrs, attribute.String("namespace", fr.namespace))
+				}
+				observer.ObserveFloat64(fr.percentGauge, rollout.percent, metric.WithAttributes(attrs...))
+			}
+			return nil
+		},
+		fr.percentGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register feature rollout callback: %w", err)
+	}
+
+	return fr, nil
+}
+
+// Enabled reports whether feature is on for userID. Built-in features
+// without a rollout keep their default; other unconfigured features are off.
+func (fr *FeatureRollouts) Enabled(feature, userID string) bool {
+	for _, rollout := range fr.rollouts {
+		if rollout.name == feature {
+			return rollout.cohortFor(userID) != featureCohortOff
+		}
+	}
+	return builtinFeatureDefaults[feature]
+}
+
+// Cohorts returns the user's cohort for every configured feature
+func (fr *FeatureRollouts) Cohorts(userID string) map[string]string {
+	cohorts := make(map[string]string, len(fr.rollouts))
+	for _, rollout := range fr.rollouts {
+		cohorts[rollout.name] = rollout.cohortFor(userID)
+	}
+	return cohorts
+}
+
+// featureAttributes returns the cohort of the user in ctx for each
+// configured feature, so canary impact can be compared on request metrics
+func (fr *FeatureRollouts) featureAttributes(ctx context.Context) []attribute.KeyValue {
+	info := requestInfoFrom(ctx)
+	if fr == nil || info == nil || info.UserID == "" {
+		return nil
+	}
+
+	attrs := make([]attribute.KeyValue, 0, len(fr.rollouts))
+	for _, rollout := range fr.rollouts {
+		attrs = append(attrs, attribute.String("feature_"+rollout.name, rollout.cohortFor(info.UserID)))
+	}
+	return attrs
+}
+
+// Features returns the service's feature rollouts
+func (cs *CartService) Features() *FeatureRollouts {
+	return cs.features
+}
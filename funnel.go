@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/events"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Funnel stages a user can reach, in order
+const (
+	stageViewed uint8 = 1 << iota
+	stageAdded
+	stageCheckedOut
+)
+
+// funnelBucket is the granularity of the funnel's sliding windows
+const funnelBucket = time.Minute
+
+// funnelOverall labels the funnel across every category
+const funnelOverall = "all"
+
+// FunnelConversion is how many users reached each funnel stage within a
+// window, each stage counting only users who also reached the ones before
+// it, and the conversion rates between them
+type FunnelConversion struct {
+	Category       string  `json:"category"` // all for the whole funnel
+	Viewed         int     `json:"viewed"`
+	Added          int     `json:"added"`
+	CheckedOut     int     `json:"checked_out"`
+	ViewToAdd      float64 `json:"view_to_add"`
+	AddToCheckout  float64 `json:"add_to_checkout"`
+	ViewToCheckout float64 `json:"view_to_checkout"`
+}
+
+// FunnelWindow is the funnel over one sliding window, overall and per
+// category
+type FunnelWindow struct {
+	Window     string             `json:"window"`
+	Overall    FunnelConversion   `json:"overall"`
+	Categories []FunnelConversion `json:"categories"`
+}
+
+// FunnelReport is the funnel of one namespace
+type FunnelReport struct {
+	Namespace string         `json:"namespace,omitempty"`
+	Windows   []FunnelWindow `json:"windows"`
+}
+
+// funnelNamespace is the funnel state of one namespace
+type funnelNamespace struct {
+	buckets map[int64]map[string]map[string]uint8 // minute -> category -> user -> stages reached
+	carts   map[string]map[string]int             // user -> category -> units in cart
+}
+
+// conversionFunnel is the funnel projection: which users viewed a product,
+// added it to their cart and checked it out, per minute and category, so
+// conversion can be read over any sliding window up to the longest
+// configured. Views and adds are attributed to the product's category; a
+// checkout to every category in the cart.
+type conversionFunnel struct {
+	windows    []time.Duration                 // exported as metrics
+	catalog    func(namespace string) *Catalog // categorizes products
+	namespaces map[string]*funnelNamespace
+	mutex      sync.RWMutex
+
+	// OpenTelemetry Metrics
+	rateGauge  metric.Float64ObservableGauge // Gauge: conversion rate by window, category and transition
+	usersGauge metric.Int64ObservableGauge   // Gauge: users reaching each stage by window and category
+}
+
+func newConversionFunnel(windows []time.Duration, catalog func(namespace string) *Catalog) *conversionFunnel {
+	windows = append([]time.Duration(nil), windows...)
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return &conversionFunnel{
+		windows:    windows,
+		catalog:    catalog,
+		namespaces: make(map[string]*funnelNamespace),
+	}
+}
+
+// registerMetrics exports the funnel over its configured windows
+func (cf *conversionFunnel) registerMetrics() error {
+	meter := otel.Meter("shopping-cart-service")
+
+	var err error
+	cf.rateGauge, err = meter.Float64ObservableGauge(
+		"funnel_conversion_rate",
+		metric.WithDescription("Share of users moving between funnel stages (view_to_add, add_to_checkout, view_to_checkout) over a sliding window, by category"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create funnel conversion gauge: %w", err)
+	}
+
+	cf.usersGauge, err = meter.Int64ObservableGauge(
+		"funnel_users",
+		metric.WithDescription("Number of users reaching each funnel stage (viewed, added, checked_out) over a sliding window, by category"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create funnel users gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			for _, report := range cf.reports(time.Now(), cf.windows) {
+				for _, window := range report.Windows {
+					for _, conversion := range append([]FunnelConversion{window.Overall}, window.Categories...) {
+						attrs := []attribute.KeyValue{
+							attribute.String("window", window.Window),
+							attribute.String("category", conversion.Category),
+						}
+						if report.Namespace != "" {
+							attrs = append(attrs, attribute.String("namespace", report.Namespace))
+						}
+						rate := func(transition string, value float64) {
+							observer.ObserveFloat64(cf.rateGauge, value, metric.WithAttributes(append(attrs, attribute.String("transition", transition))...))
+						}
+						rate("view_to_add", conversion.ViewToAdd)
+						rate("add_to_checkout", conversion.AddToCheckout)
+						rate("view_to_checkout", conversion.ViewToCheckout)
+						users := func(stage string, value int) {
+							observer.ObserveInt64(cf.usersGauge, int64(value), metric.WithAttributes(append(attrs, attribute.String("stage", stage))...))
+						}
+						users("viewed", conversion.Viewed)
+						users("added", conversion.Added)
+						users("checked_out", conversion.CheckedOut)
+					}
+				}
+			}
+			return nil
+		},
+		cf.rateGauge, cf.usersGauge,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register funnel callback: %w", err)
+	}
+	return nil
+}
+
+// longest returns the longest configured window, which bounds the buckets
+// kept
+func (cf *conversionFunnel) longest() time.Duration {
+	return cf.windows[len(cf.windows)-1]
+}
+
+// apply is the funnel consumer's handler
+func (cf *conversionFunnel) apply(_ context.Context, envelope *events.Envelope) error {
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+
+	state, ok := cf.namespaces[envelope.Namespace]
+	if !ok {
+		state = &funnelNamespace{
+			buckets: make(map[int64]map[string]map[string]uint8),
+			carts:   make(map[string]map[string]int),
+		}
+		cf.namespaces[envelope.Namespace] = state
+	}
+	minute := envelope.OccurredAt.Truncate(funnelBucket).Unix()
+
+	switch envelope.Type {
+	case events.TypeProductViewed:
+		var event events.ProductViewed
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		category := cf.catalog(envelope.Namespace).CategoryOf(event.ProductID)
+		state.reach(minute, event.UserID, stageViewed, category)
+	case events.TypeCartItemAdded:
+		var event events.CartItemAdded
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		category := cf.catalog(envelope.Namespace).CategoryOf(event.ItemID)
+		cart := state.carts[event.UserID]
+		if cart == nil {
+			cart = make(map[string]int)
+			state.carts[event.UserID] = cart
+		}
+		cart[category] += event.Quantity
+		state.reach(minute, event.UserID, stageAdded, category)
+	case events.TypeCartItemRemoved:
+		var event events.CartItemRemoved
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		category := cf.catalog(envelope.Namespace).CategoryOf(event.ItemID)
+		if cart := state.carts[event.UserID]; cart != nil {
+			cart[category] -= event.Quantity
+			if cart[category] <= 0 {
+				delete(cart, category)
+			}
+		}
+	case events.TypeCartExpired:
+		var event events.CartExpired
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		delete(state.carts, event.UserID)
+	case events.TypeOrderPlaced:
+		// A partial checkout is attributed to every category in the cart
+		var event events.OrderPlaced
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		categories := make([]string, 0, len(state.carts[event.UserID]))
+		for category := range state.carts[event.UserID] {
+			categories = append(categories, category)
+		}
+		state.reach(minute, event.UserID, stageCheckedOut, categories...)
+		delete(state.carts, event.UserID)
+	default:
+		return nil
+	}
+
+	cutoff := time.Now().Add(-cf.longest() - funnelBucket).Unix()
+	for bucket := range state.buckets {
+		if bucket < cutoff {
+			delete(state.buckets, bucket)
+		}
+	}
+	return nil
+}
+
+// reach records user reaching stage in minute, overall and in each
+// category. Callers must hold the funnel's mutex.
+func (fn *funnelNamespace) reach(minute int64, user string, stage uint8, categories ...string) {
+	bucket := fn.buckets[minute]
+	if bucket == nil {
+		bucket = make(map[string]map[string]uint8)
+		fn.buckets[minute] = bucket
+	}
+	for _, category := range append(categories, funnelOverall) {
+		users := bucket[category]
+		if users == nil {
+			users = make(map[string]uint8)
+			bucket[category] = users
+		}
+		users[user] |= stage
+	}
+}
+
+// conversions returns the funnel of every category over the window ending
+// at now, overall first. Callers must hold the funnel's mutex.
+func (fn *funnelNamespace) conversions(now time.Time, window time.Duration) (FunnelConversion, []FunnelConversion) {
+	since := now.Add(-window).Truncate(funnelBucket).Unix()
+	reached := make(map[string]map[string]uint8) // category -> user -> stages
+	for minute, bucket := range fn.buckets {
+		if minute < since || minute > now.Unix() {
+			continue
+		}
+		for category, users := range bucket {
+			if reached[category] == nil {
+				reached[category] = make(map[string]uint8)
+			}
+			for user, stages := range users {
+				reached[category][user] |= stages
+			}
+		}
+	}
+
+	overall := FunnelConversion{Category: funnelOverall}
+	categories := []FunnelConversion{}
+	for _, category := range unionKeys(reached, nil) {
+		conversion := FunnelConversion{Category: category}
+		for _, stages := range reached[category] {
+			if stages&stageViewed == 0 {
+				continue
+			}
+			conversion.Viewed++
+			if stages&stageAdded == 0 {
+				continue
+			}
+			conversion.Added++
+			if stages&stageCheckedOut != 0 {
+				conversion.CheckedOut++
+			}
+		}
+		conversion.ViewToAdd = ratio(conversion.Added, conversion.Viewed)
+		conversion.AddToCheckout = ratio(conversion.CheckedOut, conversion.Added)
+		conversion.ViewToCheckout = ratio(conversion.CheckedOut, conversion.Viewed)
+		if category == funnelOverall {
+			overall = conversion
+		} else {
+			categories = append(categories, conversion)
+		}
+	}
+	return overall, categories
+}
+
+// ratio returns part over whole, 0 when whole is
+func ratio(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole)
+}
+
+// reports returns the funnel of every namespace over each of windows
+// ending at now, by namespace
+func (cf *conversionFunnel) reports(now time.Time, windows []time.Duration) []FunnelReport {
+	cf.mutex.RLock()
+	defer cf.mutex.RUnlock()
+
+	reports := make([]FunnelReport, 0, len(cf.namespaces))
+	for _, namespace := range unionKeys(cf.namespaces, nil) {
+		report := FunnelReport{Namespace: namespace, Windows: make([]FunnelWindow, 0, len(windows))}
+		for _, window := range windows {
+			overall, categories := cf.namespaces[namespace].conversions(now, window)
+			report.Windows = append(report.Windows, FunnelWindow{Window: windowLabel(window), Overall: overall, Categories: categories})
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// windowLabel formats a window without its zero units, e.g. 15m or 1h
+func windowLabel(window time.Duration) string {
+	label := window.String()
+	if strings.HasSuffix(label, "m0s") {
+		label = strings.TrimSuffix(label, "0s")
+	}
+	if strings.HasSuffix(label, "h0m") {
+		label = strings.TrimSuffix(label, "0m")
+	}
+	return label
+}
+
+func (cf *conversionFunnel) fresh() projection {
+	return newConversionFunnel(cf.windows, cf.catalog)
+}
+
+// diff lists the funnel counts that differ from rebuilt's over the
+// configured windows, as of now
+func (cf *conversionFunnel) diff(rebuilt projection) []string {
+	now := time.Now()
+	live := make(map[string]FunnelReport)
+	for _, report := range cf.reports(now, cf.windows) {
+		live[report.Namespace] = report
+	}
+	replayed := make(map[string]FunnelReport)
+	for _, report := range rebuilt.(*conversionFunnel).reports(now, cf.windows) {
+		replayed[report.Namespace] = report
+	}
+
+	var differences []string
+	for _, namespace := range unionKeys(live, replayed) {
+		a, b := funnelCounts(live[namespace]), funnelCounts(replayed[namespace])
+		for _, key := range unionKeys(a, b) {
+			if a[key] != b[key] {
+				differences = append(differences, fmt.Sprintf("namespace %s %s: live %d, rebuilt %d", namespaceLabel(namespace), key, a[key], b[key]))
+			}
+		}
+	}
+	return differences
+}
+
+// funnelCounts flattens a report's user counts, keyed by window, category
+// and stage
+func funnelCounts(report FunnelReport) map[string]int {
+	counts := make(map[string]int)
+	for _, window := range report.Windows {
+		for _, conversion := range append([]FunnelConversion{window.Overall}, window.Categories...) {
+			prefix := window.Window + " " + conversion.Category + " "
+			counts[prefix+"viewed"] = conversion.Viewed
+			counts[prefix+"added"] = conversion.Added
+			counts[prefix+"checked_out"] = conversion.CheckedOut
+		}
+	}
+	return counts
+}
+
+func (cf *conversionFunnel) replace(rebuilt projection) {
+	namespaces := rebuilt.(*conversionFunnel).namespaces
+
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	cf.namespaces = namespaces
+}
+
+// handleFunnel serves GET /admin/analytics/funnel, the view, add and
+// checkout funnel of each namespace over the configured windows, or over
+// ?window=<duration> up to the longest of them
+func (ms *MetricsServer) handleFunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	funnel := ms.service.funnel
+	windows := funnel.windows
+	if value := r.URL.Query().Get("window"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window < funnelBucket || window > funnel.longest() {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "window")
+			return
+		}
+		windows = []time.Duration{window}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespaces": funnel.reports(time.Now(), windows),
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Why a gauge read was served an earlier scan's carts
+const (
+	staleCached    = "cached"    // the last scan was within the window
+	staleCoalesced = "coalesced" // a scan was in flight and was waited for
+)
+
+// cartScan lists the carts for the observable gauges that summarize every
+// cart. Each metric reader, the Prometheus exporter on every scrape and
+// the OTLP reader every interval, runs the gauge callbacks on its own, so
+// a burst of scrapes would otherwise scan the whole store once per gauge
+// per scrape. Concurrent reads share one scan in flight, and reads within
+// the window after a scan are served its carts.
+type cartScan struct {
+	store  CartStore
+	window time.Duration
+
+	mutex    sync.Mutex
+	carts    []*Cart       // the last successful scan's; read-only
+	at       time.Time     // when the last successful scan started
+	inflight chan struct{} // closed when the scan in flight finishes, nil when none is
+	err      error         // the last scan's error, for the reads it coalesced
+
+	// OpenTelemetry Metrics
+	staleCounter metric.Int64Counter // Counter: reads served an earlier scan by reason
+}
+
+// newCartScan creates the shared scan of store's carts; a zero window
+// only coalesces concurrent reads
+func newCartScan(store CartStore, window time.Duration) (*cartScan, error) {
+	staleCounter, err := otel.Meter("shopping-cart-service").Int64Counter(
+		"gauge_stale_reads_total",
+		metric.WithDescription("Total number of cart gauge reads served an earlier store scan by reason (cached, coalesced)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stale gauge reads counter: %w", err)
+	}
+	return &cartScan{store: store, window: window, staleCounter: staleCounter}, nil
+}
+
+// list returns every cart, from a scan within the window or in flight if
+// there is one. The carts are shared between readers and must not be
+// modified.
+func (scan *cartScan) list(ctx context.Context) ([]*Cart, error) {
+	scan.mutex.Lock()
+	if !scan.at.IsZero() && time.Since(scan.at) < scan.window {
+		carts := scan.carts
+		scan.mutex.Unlock()
+		scan.staleCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", staleCached)))
+		return carts, nil
+	}
+	if inflight := scan.inflight; inflight != nil {
+		scan.mutex.Unlock()
+		select {
+		case <-inflight:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		scan.staleCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", staleCoalesced)))
+		scan.mutex.Lock()
+		defer scan.mutex.Unlock()
+		if scan.err != nil {
+			return nil, scan.err
+		}
+		return scan.carts, nil
+	}
+	inflight := make(chan struct{})
+	scan.inflight = inflight
+	scan.mutex.Unlock()
+
+	// Other readers may be waiting on the scan, so it isn't cut short
+	// when this one gives up
+	start := time.Now()
+	carts, err := scan.store.List(context.WithoutCancel(ctx))
+
+	scan.mutex.Lock()
+	defer scan.mutex.Unlock()
+	scan.err = err
+	if err == nil {
+		scan.carts, scan.at = carts, start
+	}
+	scan.inflight = nil
+	close(inflight)
+	return carts, err
+}
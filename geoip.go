@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// geoUnknown is reported for addresses not covered by the database
+const geoUnknown = "unknown"
+
+// maxGeoCacheEntries bounds the per-IP lookup cache
+const maxGeoCacheEntries = 10000
+
+// geoRegion is the coarse location attached to telemetry
+type geoRegion struct {
+	Continent string
+	Country   string
+}
+
+// geoNetworks indexes networks by prefix length for longest-prefix lookups
+type geoNetworks map[int]map[netip.Prefix]geoRegion
+
+// GeoIPResolver resolves client IPs to coarse regions using an in-process
+// database of "network,continent,country" CSV rows, reloaded when the file
+// changes
+type GeoIPResolver struct {
+	path       string
+	networks   geoNetworks
+	modifiedAt time.Time
+	cache      map[netip.Addr]geoRegion
+	mutex      sync.RWMutex
+
+	// OpenTelemetry Metrics
+	lookupCounter metric.Int64Counter // Counter: lookups by cache result
+	reloadCounter metric.Int64Counter // Counter: database reloads by status
+}
+
+// NewGeoIPResolver loads the database at path. It returns nil when path is
+// empty, which disables region enrichment.
+func NewGeoIPResolver(path string) (*GeoIPResolver, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	meter := otel.Meter("shopping-cart-service")
+	resolver := &GeoIPResolver{path: path}
+
+	var err error
+	resolver.lookupCounter, err = meter.Int64Counter(
+		"geoip_lookups_total",
+		metric.WithDescription("Total number of GeoIP lookups by cache result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create geoip lookup counter: %w", err)
+	}
+
+	resolver.reloadCounter, err = meter.Int64Counter(
+		"geoip_database_reloads_total",
+		metric.WithDescription("Total number of GeoIP database reloads by status"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create geoip reload counter: %w", err)
+	}
+
+	if err := resolver.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// loadGeoNetworks parses the CSV database file
+func loadGeoNetworks(path string) (geoNetworks, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geoip database: %w", err)
+	}
+	defer file.Close()
+
+	networks := make(geoNetworks)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("geoip database line %d: expected network,continent,country", line)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("geoip database line %d: %w", line, err)
+		}
+		prefix = prefix.Masked()
+
+		if networks[prefix.Bits()] == nil {
+			networks[prefix.Bits()] = make(map[netip.Prefix]geoRegion)
+		}
+		networks[prefix.Bits()][prefix] = geoRegion{
+			Continent: strings.ToUpper(strings.TrimSpace(fields[1])),
+			Country:   strings.ToUpper(strings.TrimSpace(fields[2])),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read geoip database: %w", err)
+	}
+
+	return networks, nil
+}
+
+// Reload re-reads the database and clears the lookup cache
+func (gr *GeoIPResolver) Reload(ctx context.Context) error {
+	info, err := os.Stat(gr.path)
+	if err == nil {
+		var networks geoNetworks
+		networks, err = loadGeoNetworks(gr.path)
+		if err == nil {
+			gr.mutex.Lock()
+			gr.networks = networks
+			gr.modifiedAt = info.ModTime()
+			gr.cache = make(map[netip.Addr]geoRegion)
+			gr.mutex.Unlock()
+		}
+	}
+
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+	gr.reloadCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("status", status)))
+
+	return err
+}
+
+// WatchForChanges reloads the database whenever its modification time
+// changes, until ctx is cancelled
+func (gr *GeoIPResolver) WatchForChanges(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(gr.path)
+			if err != nil {
+				continue
+			}
+			gr.mutex.RLock()
+			changed := !info.ModTime().Equal(gr.modifiedAt)
+			gr.mutex.RUnlock()
+
+			if changed {
+				if err := gr.Reload(ctx); err != nil {
+					slog.ErrorContext(ctx, "Failed to reload GeoIP database, keeping previous version", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Lookup resolves addr to a region, using the cache when possible
+func (gr *GeoIPResolver) Lookup(ctx context.Context, addr netip.Addr) geoRegion {
+	addr = addr.Unmap()
+
+	gr.mutex.RLock()
+	region, cached := gr.cache[addr]
+	gr.mutex.RUnlock()
+	if cached {
+		gr.lookupCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "cache_hit")))
+		return region
+	}
+
+	gr.mutex.Lock()
+	defer gr.mutex.Unlock()
+
+	region = geoRegion{Continent: geoUnknown, Country: geoUnknown}
+	result := "unresolved"
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			break
+		}
+		if match, ok := gr.networks[bits][prefix]; ok {
+			region = match
+			result = "cache_miss"
+			break
+		}
+	}
+
+	// Reset rather than evict individually; the cache is only an optimization
+	if len(gr.cache) >= maxGeoCacheEntries {
+		gr.cache = make(map[netip.Addr]geoRegion)
+	}
+	gr.cache[addr] = region
+
+	gr.lookupCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	return region
+}
+
+// TrustedProxies are the networks of the proxies in front of the service.
+// Only their X-Forwarded-For entries are believed, as any client can send
+// the header.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses CIDRs such as 10.0.0.0/8
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// trusts reports whether addr is a trusted proxy
+func (tp TrustedProxies) trusts(addr netip.Addr) bool {
+	for _, prefix := range tp {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the originating client address of r: the peer address,
+// unless the peer is a trusted proxy. Then X-Forwarded-For is walked back
+// from the nearest hop and the first address that isn't a trusted proxy
+// is the client; hops past an unparsable entry are not believed.
+func (tp TrustedProxies) resolve(r *http.Request) (netip.Addr, bool) {
+	addr, ok := peerIP(r)
+	if !ok || !tp.trusts(addr) {
+		return addr, ok
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !tp.trusts(addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// wrap records the client address of each request for clientIP
+func (tp TrustedProxies) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.ClientIP, _ = tp.resolve(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the originating client address resolved for the
+// request, else its peer address
+func clientIP(r *http.Request) (netip.Addr, bool) {
+	if info := requestInfoFrom(r.Context()); info != nil && info.ClientIP.IsValid() {
+		return info.ClientIP, true
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address the request came from
+func peerIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr.Unmap(), err == nil
+}
+
+// regionAttributes returns the region attributes for the request in ctx.
+// They are omitted entirely when GeoIP enrichment is disabled.
+func regionAttributes(ctx context.Context) []attribute.KeyValue {
+	info := requestInfoFrom(ctx)
+	if info == nil || info.Region == nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.String("geo_continent", info.Region.Continent),
+		attribute.String("geo_country", info.Region.Country),
+	}
+}
+
+// annotateRequestRegion resolves the client region and stamps it on the
+// request info and active span
+func (ms *MetricsServer) annotateRequestRegion(ctx context.Context, r *http.Request) {
+	info := requestInfoFrom(ctx)
+	if ms.geoip == nil || info == nil {
+		return
+	}
+
+	region := geoRegion{Continent: geoUnknown, Country: geoUnknown}
+	if addr, ok := clientIP(r); ok {
+		region = ms.geoip.Lookup(ctx, addr)
+	}
+	info.Region = &region
+
+	trace.SpanFromContext(ctx).SetAttributes(regionAttributes(ctx)...)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServiceName is the fully qualified service in proto/cart/v1/cart.proto
+const grpcServiceName = "shoppingcart.v1.CartService"
+
+// GRPCServer serves cart operations over gRPC alongside the HTTP API.
+// otelgrpc records rpc.server.* metrics and server spans; the service's own
+// interceptor adds per-method request counts and latency labeled by status
+// code so RPCs can be compared with the http_* series.
+type GRPCServer struct {
+	service *CartService
+	server  *grpc.Server
+	address string
+
+	// OpenTelemetry Metrics
+	requestCounter metric.Int64Counter     // Counter: RPCs by method and code
+	requestLatency metric.Float64Histogram // Histogram: RPC latency
+}
+
+// NewGRPCServer creates a gRPC server for port, recording latency with the
+// configured histogram buckets and checking credentials with auth
+func NewGRPCServer(service *CartService, port string, buckets []float64, auth *Authenticator) (*GRPCServer, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	gs := &GRPCServer{service: service, address: ":" + port}
+
+	var err error
+	gs.requestCounter, err = meter.Int64Counter(
+		"grpc_requests_total",
+		metric.WithDescription("Total number of gRPC requests by method and status code"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC request counter: %w", err)
+	}
+
+	gs.requestLatency, err = meter.Float64Histogram(
+		"grpc_request_duration_seconds",
+		metric.WithDescription("gRPC request latency in seconds"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(buckets...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC latency histogram: %w", err)
+	}
+
+	gs.server = grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(gs.withMetrics, auth.unaryInterceptor),
+		grpc.ForceServerCodec(wireCodec{}),
+	)
+	gs.server.RegisterService(&cartServiceDesc, gs)
+
+	return gs, nil
+}
+
+// Start listens on the server's port and serves until Shutdown
+func (gs *GRPCServer) Start() error {
+	listener, err := net.Listen("tcp", gs.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC: %w", err)
+	}
+	slog.Info("Starting gRPC server", "address", gs.address)
+	return gs.server.Serve(listener)
+}
+
+// Shutdown stops accepting RPCs and waits for in-flight ones, cancelling
+// any still running when ctx expires
+func (gs *GRPCServer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		gs.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		gs.server.Stop()
+		return ctx.Err()
+	}
+}
+
+// withMetrics identifies the RPC like the HTTP middleware does and records
+// its outcome
+func (gs *GRPCServer) withMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-request-id"); len(values) > 0 {
+			requestID = values[0]
+		}
+	}
+	if !validRequestID(requestID) {
+		requestID = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+	ctx = withRequestInfo(ctx, &requestInfo{ID: requestID})
+
+	var resp interface{}
+	var err error
+	if gs.service.readiness.Ready() {
+		resp, err = handler(ctx, req)
+	} else {
+		err = status.Error(codes.Unavailable, "service is starting up")
+	}
+
+	code := status.Code(err)
+	attrs := metric.WithAttributes(
+		attribute.String("method", info.FullMethod),
+		attribute.String("code", code.String()),
+	)
+	gs.requestCounter.Add(ctx, 1, attrs)
+	gs.requestLatency.Record(ctx, time.Since(start).Seconds(), attrs)
+
+	return resp, err
+}
+
+// grpcStatus maps service errors to gRPC status codes
+func grpcStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrCartNotFound), errors.Is(err, ErrItemNotFound), errors.Is(err, ErrProductNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrInsufficientStock):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrCartLocked), errors.Is(err, ErrRejectedByHook):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrStoreUnavailable), errors.Is(err, ErrDependencyUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// invalidArgument reports a missing or invalid request field
+func invalidArgument(err error) error {
+	var decodeErr *requestDecodeError
+	if errors.As(err, &decodeErr) {
+		return status.Errorf(codes.InvalidArgument, "invalid value for %s", decodeErr.Field)
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// AddToCart implements shoppingcart.v1.CartService/AddToCart
+func (gs *GRPCServer) AddToCart(ctx context.Context, req *wireAddToCartRequest) (*wireCart, error) {
+	setRequestUser(ctx, req.UserID)
+	if req.UserID == "" {
+		return nil, invalidArgument(constraintViolation("user_id", msgMissingFields))
+	}
+	if err := validateCartItem(req.Item.CartItem); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	if err := gs.service.AddToCart(ctx, req.UserID, req.Item.CartItem); err != nil {
+		return nil, grpcStatus(err)
+	}
+	return gs.cart(ctx, req.UserID)
+}
+
+// GetCart implements shoppingcart.v1.CartService/GetCart
+func (gs *GRPCServer) GetCart(ctx context.Context, req *wireGetCartRequest) (*wireCart, error) {
+	setRequestUser(ctx, req.UserID)
+	if req.UserID == "" {
+		return nil, invalidArgument(constraintViolation("user_id", msgMissingFields))
+	}
+	return gs.cart(ctx, req.UserID)
+}
+
+// RemoveFromCart implements shoppingcart.v1.CartService/RemoveFromCart
+func (gs *GRPCServer) RemoveFromCart(ctx context.Context, req *wireRemoveFromCartRequest) (*wireCart, error) {
+	setRequestUser(ctx, req.UserID)
+	if req.UserID == "" {
+		return nil, invalidArgument(constraintViolation("user_id", msgMissingFields))
+	}
+	if req.ItemID == "" {
+		return nil, invalidArgument(constraintViolation("item_id", msgMissingFields))
+	}
+
+	if err := gs.service.RemoveFromCart(ctx, req.UserID, req.ItemID); err != nil {
+		return nil, grpcStatus(err)
+	}
+	return gs.cart(ctx, req.UserID)
+}
+
+// cart returns the user's cart as a response message
+func (gs *GRPCServer) cart(ctx context.Context, userID string) (*wireCart, error) {
+	cart, err := gs.service.GetCart(ctx, userID)
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+	return &wireCart{UserID: cart.UserID, Items: cart.Items}, nil
+}
+
+// cartServiceServer is the server API of shoppingcart.v1.CartService
+type cartServiceServer interface {
+	AddToCart(ctx context.Context, req *wireAddToCartRequest) (*wireCart, error)
+	GetCart(ctx context.Context, req *wireGetCartRequest) (*wireCart, error)
+	RemoveFromCart(ctx context.Context, req *wireRemoveFromCartRequest) (*wireCart, error)
+}
+
+// cartServiceDesc describes shoppingcart.v1.CartService in the form
+// protoc-gen-go-grpc would generate
+var cartServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*cartServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "AddToCart", Handler: addToCartHandler},
+		{MethodName: "GetCart", Handler: getCartHandler},
+		{MethodName: "RemoveFromCart", Handler: removeFromCartHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/cart/v1/cart.proto",
+}
+
+func addToCartHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wireAddToCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	gs := srv.(cartServiceServer)
+	if interceptor == nil {
+		return gs.AddToCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/AddToCart"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return gs.AddToCart(ctx, req.(*wireAddToCartRequest))
+	})
+}
+
+func getCartHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wireGetCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	gs := srv.(cartServiceServer)
+	if interceptor == nil {
+		return gs.GetCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/GetCart"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return gs.GetCart(ctx, req.(*wireGetCartRequest))
+	})
+}
+
+func removeFromCartHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wireRemoveFromCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	gs := srv.(cartServiceServer)
+	if interceptor == nil {
+		return gs.RemoveFromCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/RemoveFromCart"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return gs.RemoveFromCart(ctx, req.(*wireRemoveFromCartRequest))
+	})
+}
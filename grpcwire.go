@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// wireMessage is a gRPC message encoded by hand against
+// proto/cart/v1/cart.proto. The handful of cart messages don't justify a
+// protoc step in the build; the wire format is standard protobuf, so
+// clients generate stubs from the .proto as usual.
+type wireMessage interface {
+	marshalWire() []byte
+	unmarshalWire(b []byte) error
+}
+
+// wireCodec is the gRPC codec for wireMessage values. It registers as
+// "proto" so standard clients talk to it unchanged.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return message.marshalWire(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return message.unmarshalWire(data)
+}
+
+func (wireCodec) Name() string { return "proto" }
+
+// consumeFields calls field for every field in b. field returns the bytes
+// it consumed, or 0 for fields it doesn't know, which are skipped.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = field(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeString decodes a string field into dst
+func consumeString(typ protowire.Type, b []byte, dst *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	value, n := protowire.ConsumeString(b)
+	if n > 0 {
+		*dst = value
+	}
+	return n
+}
+
+// appendString encodes a string field, omitting the proto3 default
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// appendMessage encodes a nested message field
+func appendMessage(b []byte, num protowire.Number, message wireMessage) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message.marshalWire())
+}
+
+// wireCartItem is shoppingcart.v1.CartItem
+type wireCartItem struct {
+	CartItem
+}
+
+func (m *wireCartItem) marshalWire() []byte {
+	var b []byte
+	b = appendString(b, 1, m.ID)
+	b = appendString(b, 2, m.Name)
+	if m.Price != 0 {
+		b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(m.Price))
+	}
+	if m.Quantity != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(int32(m.Quantity))))
+	}
+	return b
+}
+
+func (m *wireCartItem) unmarshalWire(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1:
+			return consumeString(typ, b, &m.ID)
+		case num == 2:
+			return consumeString(typ, b, &m.Name)
+		case num == 3 && typ == protowire.Fixed64Type:
+			value, n := protowire.ConsumeFixed64(b)
+			m.Price = math.Float64frombits(value)
+			return n
+		case num == 4 && typ == protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			m.Quantity = int(int32(value))
+			return n
+		}
+		return 0
+	})
+}
+
+// wireCart is shoppingcart.v1.Cart
+type wireCart struct {
+	UserID string
+	Items  []CartItem
+}
+
+func (m *wireCart) marshalWire() []byte {
+	var b []byte
+	b = appendString(b, 1, m.UserID)
+	for _, item := range m.Items {
+		b = appendMessage(b, 2, &wireCartItem{item})
+	}
+	return b
+}
+
+func (m *wireCart) unmarshalWire(b []byte) error {
+	var itemErr error
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1:
+			return consumeString(typ, b, &m.UserID)
+		case num == 2 && typ == protowire.BytesType:
+			body, n := protowire.ConsumeBytes(b)
+			if n > 0 {
+				var item wireCartItem
+				if err := item.unmarshalWire(body); err != nil {
+					itemErr = err
+				}
+				m.Items = append(m.Items, item.CartItem)
+			}
+			return n
+		}
+		return 0
+	})
+	if err != nil {
+		return err
+	}
+	return itemErr
+}
+
+// wireAddToCartRequest is shoppingcart.v1.AddToCartRequest
+type wireAddToCartRequest struct {
+	UserID string
+	Item   wireCartItem
+}
+
+func (m *wireAddToCartRequest) marshalWire() []byte {
+	b := appendString(nil, 1, m.UserID)
+	return appendMessage(b, 2, &m.Item)
+}
+
+func (m *wireAddToCartRequest) unmarshalWire(b []byte) error {
+	var itemErr error
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1:
+			return consumeString(typ, b, &m.UserID)
+		case num == 2 && typ == protowire.BytesType:
+			body, n := protowire.ConsumeBytes(b)
+			if n > 0 {
+				itemErr = m.Item.unmarshalWire(body)
+			}
+			return n
+		}
+		return 0
+	})
+	if err != nil {
+		return err
+	}
+	return itemErr
+}
+
+// wireGetCartRequest is shoppingcart.v1.GetCartRequest
+type wireGetCartRequest struct {
+	UserID string
+}
+
+func (m *wireGetCartRequest) marshalWire() []byte {
+	return appendString(nil, 1, m.UserID)
+}
+
+func (m *wireGetCartRequest) unmarshalWire(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeString(typ, b, &m.UserID)
+		}
+		return 0
+	})
+}
+
+// wireRemoveFromCartRequest is shoppingcart.v1.RemoveFromCartRequest
+type wireRemoveFromCartRequest struct {
+	UserID string
+	ItemID string
+}
+
+func (m *wireRemoveFromCartRequest) marshalWire() []byte {
+	b := appendString(nil, 1, m.UserID)
+	return appendString(b, 2, m.ItemID)
+}
+
+func (m *wireRemoveFromCartRequest) unmarshalWire(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.UserID)
+		case 2:
+			return consumeString(typ, b, &m.ItemID)
+		}
+		return 0
+	})
+}
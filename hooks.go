@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrRejectedByHook is returned when an OnBeforeAddItem hook rejects an item
+var ErrRejectedByHook = errors.New("rejected by hook")
+
+// Hook names, used as the hook label on hook metrics
+const (
+	hookBeforeAddItem   = "before_add_item"
+	hookAfterCheckout   = "after_checkout"
+	hookCartExpired     = "cart_expired"
+	hookRequestComplete = "request_complete"
+)
+
+// BeforeAddItemHook runs before an item is added to a cart. Returning an
+// error rejects the add.
+type BeforeAddItemHook func(ctx context.Context, userID string, item CartItem) error
+
+// AfterCheckoutHook runs after an order has been placed
+type AfterCheckoutHook func(ctx context.Context, order *Order)
+
+// CartExpiredHook runs after an expired cart has been removed
+type CartExpiredHook func(ctx context.Context, cart *Cart)
+
+// RequestCompleteHook runs after an HTTP request has been served and its
+// metrics recorded
+type RequestCompleteHook func(ctx context.Context, r *http.Request, statusCode int, duration time.Duration)
+
+// Hooks holds lifecycle hooks registered by embedders. Hooks run inline on
+// the request path in registration order, so they should be quick; a hook
+// that panics is recovered and counted rather than failing the request.
+type Hooks struct {
+	mutex           sync.RWMutex
+	beforeAddItem   []BeforeAddItemHook
+	afterCheckout   []AfterCheckoutHook
+	cartExpired     []CartExpiredHook
+	requestComplete []RequestCompleteHook
+
+	// OpenTelemetry Metrics
+	invocationCounter metric.Int64Counter // Counter: hook runs by hook and result
+}
+
+// newHooks creates an empty hook registry
+func newHooks() (*Hooks, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	hooks := &Hooks{}
+
+	var err error
+	hooks.invocationCounter, err = meter.Int64Counter(
+		"hook_invocations_total",
+		metric.WithDescription("Total number of lifecycle hook runs by hook and result (ok, rejected, panic)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hook invocation counter: %w", err)
+	}
+
+	return hooks, nil
+}
+
+// Hooks returns the service's hook registry
+func (cs *CartService) Hooks() *Hooks {
+	return cs.hooks
+}
+
+// OnBeforeAddItem registers a hook that may veto items added to carts
+func (h *Hooks) OnBeforeAddItem(hook BeforeAddItemHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.beforeAddItem = append(h.beforeAddItem, hook)
+}
+
+// OnAfterCheckout registers a hook that runs for every placed order
+func (h *Hooks) OnAfterCheckout(hook AfterCheckoutHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.afterCheckout = append(h.afterCheckout, hook)
+}
+
+// OnCartExpired registers a hook that runs when an expired cart is removed
+func (h *Hooks) OnCartExpired(hook CartExpiredHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.cartExpired = append(h.cartExpired, hook)
+}
+
+// OnRequestComplete registers a hook that runs after every served request
+func (h *Hooks) OnRequestComplete(hook RequestCompleteHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.requestComplete = append(h.requestComplete, hook)
+}
+
+// invoke runs fn, recovering panics, and counts the outcome
+func (h *Hooks) invoke(ctx context.Context, name string, fn func() error) (err error) {
+	result := "ok"
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result = "panic"
+			err = nil
+			slog.ErrorContext(ctx, "Hook panicked", "hook", name, "panic", fmt.Sprint(recovered))
+		}
+		h.invocationCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("hook", name),
+			attribute.String("result", result),
+		))
+	}()
+
+	if err = fn(); err != nil {
+		result = "rejected"
+	}
+	return err
+}
+
+// runBeforeAddItem runs the add-item hooks, stopping at the first rejection
+func (h *Hooks) runBeforeAddItem(ctx context.Context, userID string, item CartItem) error {
+	h.mutex.RLock()
+	hooks := h.beforeAddItem
+	h.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		if err := h.invoke(ctx, hookBeforeAddItem, func() error { return hook(ctx, userID, item) }); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejectedByHook, err)
+		}
+	}
+	return nil
+}
+
+// runAfterCheckout runs the checkout hooks for a placed order
+func (h *Hooks) runAfterCheckout(ctx context.Context, order *Order) {
+	h.mutex.RLock()
+	hooks := h.afterCheckout
+	h.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		h.invoke(ctx, hookAfterCheckout, func() error { hook(ctx, order); return nil })
+	}
+}
+
+// runCartExpired runs the expiry hooks for a removed cart
+func (h *Hooks) runCartExpired(ctx context.Context, cart *Cart) {
+	h.mutex.RLock()
+	hooks := h.cartExpired
+	h.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		h.invoke(ctx, hookCartExpired, func() error { hook(ctx, cart); return nil })
+	}
+}
+
+// runRequestComplete runs the request hooks for a served request
+func (h *Hooks) runRequestComplete(ctx context.Context, r *http.Request, statusCode int, duration time.Duration) {
+	h.mutex.RLock()
+	hooks := h.requestComplete
+	h.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		h.invoke(ctx, hookRequestComplete, func() error { hook(ctx, r, statusCode, duration); return nil })
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrIdempotencyKeyReused is returned when a key is sent again with a
+// different request
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotencySweepInterval is how often expired keys are dropped
+const idempotencySweepInterval = time.Minute
+
+// idempotentRequest is the first request made with a key
+type idempotentRequest struct {
+	fingerprint string        // identifies the request body the key was first used with
+	done        chan struct{} // closed once the first request has finished
+	result      interface{}   // what the first request returned, for its replays
+	err         error
+	expiresAt   time.Time
+}
+
+// idempotencyStore remembers, for the TTL, which keyed requests have
+// succeeded so retries don't apply them again. Failed requests are
+// forgotten, so a retry runs them again. Keys are only known to the
+// instance that first saw them.
+type idempotencyStore struct {
+	ttl       time.Duration
+	requests  map[string]*idempotentRequest
+	lastSweep time.Time
+	mutex     sync.Mutex
+
+	// OpenTelemetry Metrics
+	keyCounter metric.Int64Counter // Counter: keyed requests by result
+}
+
+// newIdempotencyStore creates a store keeping keys for ttl
+func newIdempotencyStore(ttl time.Duration) (*idempotencyStore, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	st := &idempotencyStore{
+		ttl:       ttl,
+		requests:  make(map[string]*idempotentRequest),
+		lastSweep: time.Now(),
+	}
+
+	var err error
+	st.keyCounter, err = meter.Int64Counter(
+		"idempotent_requests_total",
+		metric.WithDescription("Total number of requests with an Idempotency-Key by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create idempotent requests counter: %w", err)
+	}
+
+	return st, nil
+}
+
+// do runs fn unless a request with key and the same fingerprint already
+// succeeded, in which case it reports the replay and returns that request's
+// result without running fn. A retry that arrives while the first request
+// is still running waits for its outcome.
+func (st *idempotencyStore) do(ctx context.Context, operation, key, fingerprint string, fn func() (interface{}, error)) (interface{}, bool, error) {
+	now := time.Now()
+
+	st.mutex.Lock()
+	if now.Sub(st.lastSweep) >= idempotencySweepInterval {
+		st.sweepLocked(now)
+	}
+	first, exists := st.requests[key]
+	if !exists {
+		first = &idempotentRequest{fingerprint: fingerprint, done: make(chan struct{}), expiresAt: now.Add(st.ttl)}
+		st.requests[key] = first
+	}
+	st.mutex.Unlock()
+
+	if exists {
+		if first.fingerprint != fingerprint {
+			st.count(ctx, operation, "conflict")
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		select {
+		case <-first.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if first.err != nil {
+			// That attempt failed and was forgotten, so this one runs
+			return st.do(ctx, operation, key, fingerprint, fn)
+		}
+		st.count(ctx, operation, "replayed")
+		return first.result, true, nil
+	}
+
+	result, err := fn()
+	st.mutex.Lock()
+	first.result = result
+	first.err = err
+	if err != nil {
+		delete(st.requests, key)
+	}
+	st.mutex.Unlock()
+	close(first.done)
+
+	st.count(ctx, operation, "executed")
+	return result, false, err
+}
+
+// sweepLocked drops expired keys of finished requests. Callers must hold
+// st.mutex.
+func (st *idempotencyStore) sweepLocked(now time.Time) {
+	st.lastSweep = now
+	for key, request := range st.requests {
+		select {
+		case <-request.done:
+			if now.After(request.expiresAt) {
+				delete(st.requests, key)
+			}
+		default:
+		}
+	}
+}
+
+func (st *idempotencyStore) count(ctx context.Context, operation, result string) {
+	st.keyCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", operation),
+		attribute.String("result", result),
+	))
+}
+
+// validIdempotencyKey reports whether a client-supplied key is usable:
+// 1-255 printable ASCII characters
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// AddToCartIdempotent adds item like AddToCart, but only once per
+// idempotency key, user, namespace and tenant: a retry with the same key
+// and item reports replayed without adding it again. An empty key always
+// adds.
+func (cs *CartService) AddToCartIdempotent(ctx context.Context, key, userID string, item CartItem) (replayed bool, err error) {
+	if key == "" {
+		return false, cs.AddToCart(ctx, userID, item)
+	}
+
+	fingerprint, err := json.Marshal(item)
+	if err != nil {
+		return false, err
+	}
+	// Keyed like the cart, so namespaces and tenants don't share keys
+	scope := storageKey(ctx, userID)
+	_, replayed, err = cs.idempotency.do(ctx, "add_to_cart", scope+"\x00"+key, string(fingerprint), func() (interface{}, error) {
+		return nil, cs.AddToCart(ctx, userID, item)
+	})
+	return replayed, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// RateLimitStatus is the caller's allowance under one rate limit rule
+type RateLimitStatus struct {
+	Prefix       string  `json:"prefix"`
+	Rate         float64 `json:"rate"`  // requests per second
+	Burst        int     `json:"burst"` // bucket size
+	Remaining    int     `json:"remaining"`
+	ResetSeconds int     `json:"reset_seconds,omitempty"` // until the next request is allowed, when none remain
+}
+
+// CartRuleLimit is a cart rule that can reject an addition
+type CartRuleLimit struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// CartLimits are the limits on the caller's cart
+type CartLimits struct {
+	TTLSeconds                 int             `json:"ttl_seconds,omitempty"` // idle time before expiry; 0 never expires
+	CheckoutLockTimeoutSeconds float64         `json:"checkout_lock_timeout_seconds"`
+	IdempotencyTTLSeconds      float64         `json:"idempotency_ttl_seconds"`
+	MaxIdempotencyKeyLength    int             `json:"max_idempotency_key_length"`
+	Rules                      []CartRuleLimit `json:"rules"`
+}
+
+// CheckoutQuotaStatus is the caller's checkout quota before the risk check
+// steps in
+type CheckoutQuotaStatus struct {
+	Limit         int     `json:"limit"`
+	Remaining     int     `json:"remaining"`
+	WindowSeconds float64 `json:"window_seconds"`
+	ResetSeconds  int     `json:"reset_seconds,omitempty"`
+	Decision      string  `json:"decision"` // taken once the limit is exceeded
+}
+
+// LimitsResponse is the body of GET /v1/limits
+type LimitsResponse struct {
+	Subject    string               `json:"subject"` // who the limits apply to: user:<id> or ip:<address>
+	Namespace  string               `json:"namespace,omitempty"`
+	RateLimits []RateLimitStatus    `json:"rate_limits"`
+	Cart       CartLimits           `json:"cart"`
+	Checkouts  *CheckoutQuotaStatus `json:"checkouts,omitempty"`
+}
+
+// handleV1Limits reports the limits in effect for the caller, so clients
+// can pace themselves instead of discovering the limits through 429s: the
+// rate limits of its authenticated subject or else its IP, and the cart and
+// checkout limits of the user in the user_id query parameter. Reading the
+// limits spends nothing but the token of the request itself.
+func (ms *MetricsServer) handleV1Limits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	userID := r.URL.Query().Get("user_id")
+	if userID != "" {
+		setRequestUser(ctx, userID)
+	}
+	subject, _ := rateLimitSubject(r)
+	now := time.Now()
+	cs := ms.service
+
+	response := LimitsResponse{
+		Subject:    subject,
+		RateLimits: []RateLimitStatus{},
+		Cart: CartLimits{
+			CheckoutLockTimeoutSeconds: cs.checkoutLockTimeout.Seconds(),
+			IdempotencyTTLSeconds:      cs.idempotency.ttl.Seconds(),
+			MaxIdempotencyKeyLength:    maxIdempotencyKeyLength,
+			Rules:                      cs.cartRulesFor(ctx).constraints(),
+		},
+	}
+
+	for _, rule := range ms.limiter.limits() {
+		remaining, wait := ms.limiter.peek(rule, subject, now)
+		response.RateLimits = append(response.RateLimits, RateLimitStatus{
+			Prefix:       rule.Prefix,
+			Rate:         rule.Rate,
+			Burst:        rule.Burst,
+			Remaining:    remaining,
+			ResetSeconds: int(math.Ceil(wait.Seconds())),
+		})
+	}
+
+	key := userID
+	if namespace := namespaceFrom(ctx); namespace != nil {
+		response.Namespace = namespace.Name
+		key = namespace.key(userID)
+	}
+	if ttl := cs.cartTTL(key); ttl > 0 {
+		response.Cart.TTLSeconds = int(ttl.Seconds())
+	}
+
+	if userID != "" {
+		if quota, ok := cs.risk.CheckoutQuota(userID, now); ok {
+			response.Checkouts = &CheckoutQuotaStatus{
+				Limit:         quota.Limit,
+				Remaining:     quota.Remaining,
+				WindowSeconds: quota.Window.Seconds(),
+				ResetSeconds:  int(math.Ceil(quota.Reset.Seconds())),
+				Decision:      string(quota.Decision),
+			}
+		}
+	}
+
+	writeJSON(w, r, response)
+}
+
+// constraints returns the eligibility and limit rules, the ones that can
+// reject an addition
+func (cr *CartRules) constraints() []CartRuleLimit {
+	limits := []CartRuleLimit{}
+	for _, rule := range cr.rules {
+		if rule.kind == cartRuleDiscount {
+			continue
+		}
+		limits = append(limits, CartRuleLimit{Name: rule.name, Kind: rule.kind, Message: rule.message})
+	}
+	return limits
+}
@@ -0,0 +1,80 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// limitsRefreshInterval is how often the generator rereads the service's
+// limits
+const limitsRefreshInterval = time.Minute
+
+// watchLimits keeps the rate ceiling in line with the service's rate limits
+// until ctx is done
+func (g *Generator) watchLimits(ctx context.Context) {
+	ticker := time.NewTicker(limitsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		g.refreshLimits(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshLimits reads GET /v1/limits and caps the rate at what the
+// generator may send under the tightest rate limit. Its requests share one
+// set of credentials and one IP, so they share the buckets too and that is
+// the lowest rule rate. Without rate limits, or against instances without
+// the endpoint, the rate is uncapped; when the limits can't be read the
+// previous ceiling stays.
+func (g *Generator) refreshLimits(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.baseURL+"/v1/limits", nil)
+	if err != nil {
+		return
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var limits struct {
+		RateLimits []struct {
+			Rate float64 `json:"rate"`
+		} `json:"rate_limits"`
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+	case resp.StatusCode != http.StatusOK:
+		return
+	case json.NewDecoder(resp.Body).Decode(&limits) != nil:
+		return
+	}
+
+	lowest := 0.0
+	for _, rule := range limits.RateLimits {
+		if lowest == 0 || rule.Rate < lowest {
+			lowest = rule.Rate
+		}
+	}
+
+	g.mutex.Lock()
+	changed := lowest != g.rateLimit
+	g.rateLimit = lowest
+	g.mutex.Unlock()
+	if changed {
+		slog.InfoContext(ctx, "Traffic generator rate ceiling updated", "rps", lowest)
+	}
+}
+
+// ceilingLocked returns the highest rate the service's rate limits allow
+// the generator, 0 when unlimited. Callers hold the mutex.
+func (g *Generator) ceilingLocked() float64 {
+	return g.rateLimit
+}
@@ -0,0 +1,553 @@
+// Package loadgen generates demo traffic against a running cart service.
+// A Generator issues a weighted mix of catalog, cart and checkout requests
+// at a rate shaped by a traffic profile, so different alert conditions can
+// be reproduced on demand. Decisions come from a seeded random source, so
+// the same seed replays the same request sequence.
+package loadgen
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/cartclient"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Config selects what a Generator sends
+type Config struct {
+	Enabled   bool    `json:"enabled"`
+	Profile   string  `json:"profile"`
+	TargetRPS float64 `json:"target_rps"` // baseline rate the profile shapes
+	Users     int     `json:"users"`      // distinct simulated user IDs
+	ErrorRate float64 `json:"error_rate"` // fraction of requests sent to /simulate-error
+	Seed      int64   `json:"seed"`       // 0 picks a random seed
+}
+
+// DefaultConfig reproduces the traffic of the original built-in simulator
+func DefaultConfig() Config {
+	return Config{
+		Enabled:   true,
+		Profile:   ProfileSteady,
+		TargetRPS: 3,
+		Users:     5,
+		ErrorRate: 0.05,
+	}
+}
+
+// maxTargetRPS keeps a typo from turning the demo into a load test
+const maxTargetRPS = 1000
+
+// ConfigError reports an invalid Config field
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Validate reports the first invalid field
+func (c Config) Validate() error {
+	switch {
+	case !validProfile(c.Profile):
+		return &ConfigError{Field: "profile", Reason: fmt.Sprintf("expected one of %s", strings.Join(Profiles, ", "))}
+	case c.TargetRPS <= 0 || c.TargetRPS > maxTargetRPS:
+		return &ConfigError{Field: "target_rps", Reason: fmt.Sprintf("must be in (0, %d]", maxTargetRPS)}
+	case c.Users <= 0:
+		return &ConfigError{Field: "users", Reason: "must be positive"}
+	case c.ErrorRate < 0 || c.ErrorRate > 1:
+		return &ConfigError{Field: "error_rate", Reason: "must be between 0 and 1"}
+	}
+	return nil
+}
+
+// Status is a Generator's configuration and progress
+type Status struct {
+	Config
+	CurrentRPS  float64   `json:"current_rps"`
+	RateCeiling float64   `json:"rate_ceiling,omitempty"` // cap from the service's rate limits, if any
+	Sent        int64     `json:"sent"`
+	Dropped     int64     `json:"dropped"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// Request actions
+const (
+	actionViewProduct = "view_product"
+	actionAddItem     = "add_item"
+	actionGetCart     = "get_cart"
+	actionCatalog     = "catalog"
+	actionHealth      = "health"
+	actionCheckout    = "checkout"
+	actionRestock     = "restock"
+	actionSubscribe   = "subscribe"
+	actionSimulateErr = "simulate_error"
+)
+
+// actionWeights is the mix of requests apart from injected errors; product
+// views and adds dominate like a shopping session, with occasional
+// checkouts and restocks
+var actionWeights = []struct {
+	action string
+	weight int
+}{
+	{actionViewProduct, 30},
+	{actionAddItem, 50},
+	{actionGetCart, 15},
+	{actionCatalog, 10},
+	{actionHealth, 10},
+	{actionCheckout, 3},
+	{actionRestock, 1},
+}
+
+// items are the products the simulated users add to their carts
+var items = []cartclient.Item{
+	{ID: "item1", Name: "Widget A", Price: 19.99, Quantity: 1},
+	{ID: "item2", Name: "Widget B", Price: 29.99, Quantity: 2},
+	{ID: "item3", Name: "Widget C", Price: 39.99, Quantity: 1},
+	{ID: "item4", Name: "Widget D", Price: 49.99, Quantity: 3},
+}
+
+// job is one decided request, handed to a worker
+type job struct {
+	action  string
+	userID  string
+	item    cartclient.Item
+	restock int
+}
+
+// workers bounds concurrent requests; jobs arriving while every worker is
+// busy are dropped rather than queued so the rate stays honest
+const workers = 16
+
+// startDelay gives the server time to start listening
+const startDelay = 5 * time.Second
+
+// Generator sends traffic to one cart service instance
+type Generator struct {
+	baseURL    string
+	opsURL     string // operational endpoints (health, admin), baseURL unless SetOpsURL moved them
+	adminToken string // sent to the admin endpoints
+	client     *http.Client
+	cart       *cartclient.Client // cart, checkout and event calls
+
+	mutex     sync.Mutex
+	config    Config
+	rng       *rand.Rand
+	startedAt time.Time
+	rate      float64
+	sent      int64
+	dropped   int64
+	changed   chan struct{}
+
+	// Lowest rate limit of the service, 0 when unlimited
+	rateLimit float64
+
+	// Catalog validator, revalidated with If-None-Match like a browser
+	catalogETag string
+
+	// OpenTelemetry Metrics
+	requestCounter metric.Int64Counter           // Counter: generated requests by action and result
+	targetRate     metric.Float64ObservableGauge // Gauge: current profile rate
+}
+
+// New creates a generator targeting baseURL. transport carries the
+// requests, letting the caller add tracing, backoff or client headers.
+// Cart, checkout and event requests go through the Go SDK, configured by
+// opts; they aren't retried, so every decided request is sent once.
+func New(baseURL string, transport http.RoundTripper, config Config, opts ...cartclient.Option) (*Generator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	meter := otel.Meter("shopping-cart-service")
+
+	g := &Generator{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		opsURL:  strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		changed: make(chan struct{}, 1),
+	}
+	opts = append([]cartclient.Option{cartclient.WithHTTPClient(g.client), cartclient.WithRetries(0)}, opts...)
+	g.cart = cartclient.New(baseURL, opts...)
+	g.apply(config)
+
+	var err error
+	g.requestCounter, err = meter.Int64Counter(
+		"loadgen_requests_total",
+		metric.WithDescription("Total number of simulated requests by action and result (success, client_error, server_error, transport_error, dropped)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create loadgen request counter: %w", err)
+	}
+
+	g.targetRate, err = meter.Float64ObservableGauge(
+		"loadgen_target_rps",
+		metric.WithDescription("Request rate the traffic profile currently asks for"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create loadgen rate gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		rate := 0.0
+		if g.config.Enabled {
+			rate = g.rate
+		}
+		observer.ObserveFloat64(g.targetRate, rate, metric.WithAttributes(attribute.String("profile", g.config.Profile)))
+		return nil
+	}, g.targetRate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register loadgen callback: %w", err)
+	}
+
+	return g, nil
+}
+
+// apply installs config, reseeding and restarting the profile clock;
+// callers hold the mutex or own g exclusively
+func (g *Generator) apply(config Config) {
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	g.config = config
+	g.rng = rand.New(rand.NewSource(config.Seed))
+	g.startedAt = time.Now()
+	g.rate = rateAt(config.Profile, config.TargetRPS, 0)
+}
+
+// Reconfigure replaces the configuration. The profile clock restarts and
+// the random source is reseeded, so a fixed seed replays from the start.
+func (g *Generator) Reconfigure(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	g.apply(config)
+	g.mutex.Unlock()
+
+	// Wake Run so a long delay from the old rate doesn't linger
+	select {
+	case g.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Config returns the current configuration, with the effective seed
+func (g *Generator) Config() Config {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.config
+}
+
+// Status returns the configuration and progress
+func (g *Generator) Status() Status {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	status := Status{Config: g.config, RateCeiling: g.ceilingLocked(), Sent: g.sent, Dropped: g.dropped, StartedAt: g.startedAt}
+	if g.config.Enabled {
+		status.CurrentRPS = g.rate
+	}
+	return status
+}
+
+// Run generates traffic until ctx is cancelled
+func (g *Generator) Run(ctx context.Context) {
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				g.do(ctx, j)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	select {
+	case <-time.After(startDelay):
+	case <-ctx.Done():
+		return
+	}
+	go g.watchLimits(ctx)
+
+	for ctx.Err() == nil {
+		next, delay, enabled := g.next()
+		if !enabled {
+			select {
+			case <-g.changed:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-g.changed:
+			// Drop the decided job; the new configuration decides afresh
+			timer.Stop()
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		select {
+		case jobs <- next:
+			g.count(&g.sent)
+		default:
+			g.count(&g.dropped)
+			g.requestCounter.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("action", next.action),
+				attribute.String("result", "dropped"),
+			))
+		}
+	}
+}
+
+// count increments one of the progress counters
+func (g *Generator) count(counter *int64) {
+	g.mutex.Lock()
+	*counter++
+	g.mutex.Unlock()
+}
+
+// next decides the next request and how long to wait before sending it.
+// Arrivals are Poisson at the profile's current rate, capped at the rate
+// limits' ceiling.
+func (g *Generator) next() (job, time.Duration, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.config.Enabled {
+		return job{}, 0, false
+	}
+
+	g.rate = rateAt(g.config.Profile, g.config.TargetRPS, time.Since(g.startedAt))
+	rate := g.rate
+	if ceiling := g.ceilingLocked(); ceiling > 0 && ceiling < rate {
+		rate = ceiling
+	}
+	delay := time.Duration(g.rng.ExpFloat64() / rate * float64(time.Second))
+
+	j := job{
+		userID: fmt.Sprintf("user%d", g.rng.Intn(g.config.Users)+1),
+		item:   items[g.rng.Intn(len(items))],
+	}
+	if g.rng.Float64() < g.config.ErrorRate {
+		j.action = actionSimulateErr
+		return j, delay, true
+	}
+
+	total := 0
+	for _, entry := range actionWeights {
+		total += entry.weight
+	}
+	pick := g.rng.Intn(total)
+	for _, entry := range actionWeights {
+		if pick < entry.weight {
+			j.action = entry.action
+			break
+		}
+		pick -= entry.weight
+	}
+	if j.action == actionRestock {
+		j.restock = g.rng.Intn(20) + 10
+	}
+	return j, delay, true
+}
+
+// SetOpsURL sends the health checks and restocks to opsURL, for instances
+// serving operational endpoints on their own port, and the restocks with
+// adminToken. Call it before Run.
+func (g *Generator) SetOpsURL(opsURL, adminToken string) {
+	g.opsURL = strings.TrimSuffix(opsURL, "/")
+	g.adminToken = adminToken
+}
+
+// do sends the request for j
+func (g *Generator) do(ctx context.Context, j job) {
+	switch j.action {
+	case actionViewProduct:
+		g.record(ctx, j.action, g.cart.SendEvents(ctx, cartclient.Event{
+			Type: "product.viewed",
+			Data: map[string]string{"user_id": j.userID, "product_id": j.item.ID},
+		}))
+	case actionAddItem:
+		err := g.cart.AddItem(ctx, j.userID, j.item)
+		g.record(ctx, j.action, err)
+		// Out of stock: ask to be notified when it is back
+		var apiErr *cartclient.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+			g.post(ctx, actionSubscribe, g.baseURL+"/catalog/subscriptions", map[string]interface{}{
+				"user_id":    j.userID,
+				"product_id": j.item.ID,
+			}, nil)
+		}
+	case actionGetCart:
+		_, err := g.cart.GetCart(ctx, j.userID)
+		g.record(ctx, j.action, err)
+	case actionCatalog:
+		g.getCatalog(ctx)
+	case actionHealth:
+		g.get(ctx, j.action, g.opsURL+"/health", nil)
+	case actionCheckout:
+		_, err := g.cart.Checkout(ctx, j.userID)
+		g.record(ctx, j.action, err)
+	case actionRestock:
+		g.post(ctx, j.action, g.opsURL+"/admin/catalog/restock", map[string]interface{}{
+			"product_id": j.item.ID,
+			"quantity":   j.restock,
+		}, http.Header{"Authorization": {"Bearer " + g.adminToken}})
+	case actionSimulateErr:
+		g.get(ctx, j.action, g.baseURL+"/simulate-error", nil)
+	}
+}
+
+// getCatalog fetches the product list, revalidating the cached copy
+func (g *Generator) getCatalog(ctx context.Context) {
+	g.mutex.Lock()
+	etag := g.catalogETag
+	g.mutex.Unlock()
+
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	resp := g.get(ctx, actionCatalog, g.baseURL+"/catalog/products", header)
+	if resp != nil && resp.StatusCode == http.StatusOK {
+		g.mutex.Lock()
+		g.catalogETag = resp.Header.Get("ETag")
+		g.mutex.Unlock()
+	}
+}
+
+// get sends a GET to target and returns the response with its body
+// closed, or nil
+func (g *Generator) get(ctx context.Context, action, target string, header http.Header) *http.Response {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return g.send(ctx, action, req)
+}
+
+// post sends body as JSON to target and returns the status code, or 0 on
+// failure
+func (g *Generator) post(ctx context.Context, action, target string, body interface{}, header http.Header) int {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(string(data)))
+	if err != nil {
+		return 0
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if resp := g.send(ctx, action, req); resp != nil {
+		return resp.StatusCode
+	}
+	return 0
+}
+
+// send performs req and counts the outcome. Each request carries its own
+// X-Request-ID, logged on server errors, so a failed generated request can
+// be found in the service's request lookup and logs.
+func (g *Generator) send(ctx context.Context, action string, req *http.Request) *http.Response {
+	requestID := newRequestID()
+	req.Header.Set("X-Request-ID", requestID)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		g.countResult(ctx, action, "transport_error")
+		return nil
+	}
+	resp.Body.Close()
+	result := resultOf(resp.StatusCode)
+	if result == "server_error" {
+		slog.DebugContext(ctx, "Generated request failed", "action", action, "request_id", requestID, "status", resp.StatusCode)
+	}
+	g.countResult(ctx, action, result)
+	return resp
+}
+
+// record counts the outcome of an SDK call. Failed calls carry the
+// service's request ID, logged on server errors like send's.
+func (g *Generator) record(ctx context.Context, action string, err error) {
+	var apiErr *cartclient.APIError
+	switch {
+	case err == nil:
+		g.countResult(ctx, action, "success")
+	case errors.As(err, &apiErr):
+		result := resultOf(apiErr.StatusCode)
+		if result == "server_error" {
+			slog.DebugContext(ctx, "Generated request failed", "action", action, "request_id", apiErr.RequestID, "status", apiErr.StatusCode)
+		}
+		g.countResult(ctx, action, result)
+	default:
+		g.countResult(ctx, action, "transport_error")
+	}
+}
+
+// resultOf classifies a response status
+func resultOf(statusCode int) string {
+	switch {
+	case statusCode >= 500:
+		return "server_error"
+	case statusCode >= 400:
+		return "client_error"
+	}
+	return "success"
+}
+
+// countResult adds a generated request to the request counter. Requests cut
+// short by shutdown aren't worth counting.
+func (g *Generator) countResult(ctx context.Context, action, result string) {
+	if ctx.Err() != nil {
+		return
+	}
+	g.requestCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("action", action),
+		attribute.String("result", result),
+	))
+}
+
+// newRequestID returns a random request ID. It doesn't draw from the seeded
+// source, so IDs don't change the replayed request sequence.
+func newRequestID() string {
+	var b [16]byte
+	crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,71 @@
+package loadgen
+
+import (
+	"math"
+	"time"
+)
+
+// Traffic profiles shaping the request rate over time
+const (
+	// ProfileSteady holds the target rate
+	ProfileSteady = "steady"
+
+	// ProfileBurst adds a 10s burst at 5x the target every minute, for
+	// short-window alerts that should fire and resolve
+	ProfileBurst = "burst"
+
+	// ProfileSpike runs at the target with a 30s spike at 10x every five
+	// minutes, for saturation and latency alerts
+	ProfileSpike = "spike"
+
+	// ProfileDiurnal follows a compressed day: a sine wave between 20% and
+	// 180% of the target with a ten-minute period
+	ProfileDiurnal = "diurnal"
+)
+
+// Profiles lists the supported profiles
+var Profiles = []string{ProfileSteady, ProfileBurst, ProfileSpike, ProfileDiurnal}
+
+// Profile timings
+const (
+	burstPeriod   = time.Minute
+	burstLength   = 10 * time.Second
+	burstFactor   = 5.0
+	spikePeriod   = 5 * time.Minute
+	spikeLength   = 30 * time.Second
+	spikeFactor   = 10.0
+	diurnalPeriod = 10 * time.Minute
+	diurnalSwing  = 0.8
+	minRate       = 0.01 // requests per second; keeps delays finite
+)
+
+// validProfile reports whether name is a supported profile
+func validProfile(name string) bool {
+	for _, profile := range Profiles {
+		if profile == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rateAt returns the requests per second a profile asks for elapsed into
+// a run
+func rateAt(profile string, target float64, elapsed time.Duration) float64 {
+	rate := target
+	switch profile {
+	case ProfileBurst:
+		if elapsed%burstPeriod < burstLength {
+			rate = target * burstFactor
+		}
+	case ProfileSpike:
+		// The first spike comes one period in so runs start at baseline
+		if elapsed >= spikePeriod && elapsed%spikePeriod < spikeLength {
+			rate = target * spikeFactor
+		}
+	case ProfileDiurnal:
+		phase := 2 * math.Pi * float64(elapsed%diurnalPeriod) / float64(diurnalPeriod)
+		rate = target * (1 + diurnalSwing*math.Sin(phase))
+	}
+	return math.Max(rate, minRate)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logLevel is the minimum level logged. /admin/log-level changes it at
+// runtime.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging installs the structured logger as the default for both slog
+// and the log package, so third-party log output is structured too
+func setupLogging(cfg config.LogConfig) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if cfg.Format == config.LogFormatText {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// parseLogLevel parses debug, info, warn or error, in any case
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, errors.New("expected debug, info, warn or error")
+	}
+	return level, nil
+}
+
+// logRequest logs a completed request with its endpoint, status and
+// duration; the handler adds the request ID, user and trace
+func logRequest(ctx context.Context, level slog.Level, msg string, r *http.Request, statusCode int, duration time.Duration, attrs ...slog.Attr) {
+	attrs = append(attrs,
+		slog.String("method", r.Method),
+		slog.String("endpoint", r.URL.Path),
+		slog.Int("status", statusCode),
+		slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+	)
+	slog.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID and user from the request context, and
+// the active span's trace and span IDs, so log lines can be joined with
+// request lookups and traces in SigNoz
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.ID))
+		if info.UserID != "" && !hasAttr(record, "user_id") {
+			record.AddAttrs(slog.String("user_id", info.UserID))
+		}
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// hasAttr reports whether the record already carries key
+func hasAttr(record slog.Record, key string) bool {
+	found := false
+	record.Attrs(func(attr slog.Attr) bool {
+		found = attr.Key == key
+		return !found
+	})
+	return found
+}
+
+// handleLogLevel reports (GET) or changes (PUT) the minimum log level
+func (ms *MetricsServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		if req.Level == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("level", msgMissingFields))
+			return
+		}
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			ms.rejectInvalidRequest(w, r, constraintViolation("level", msgInvalidFieldValue))
+			return
+		}
+		if previous := logLevel.Level(); level != previous {
+			logLevel.Set(level)
+			slog.WarnContext(r.Context(), "Log level changed", "from", previous.String(), "to", level.String())
+		}
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
@@ -3,21 +3,38 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
-	"strings"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"shopping-cart-service/config"
+	"shopping-cart-service/events"
+	"shopping-cart-service/loadgen"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Service identity, reported with traces, metrics and profiles
+const (
+	serviceName    = "shopping-cart-service"
+	serviceVersion = "1.0.0"
 )
 
 // CartItem represents an item in a user's shopping cart
@@ -32,39 +49,125 @@ type CartItem struct {
 type Cart struct {
 	UserID string     `json:"user_id"`
 	Items  []CartItem `json:"items"`
-	mutex  sync.RWMutex
+
+	lockedUntil time.Time // read-only while a checkout holds it
+	updatedAt   time.Time // last item change, for expiry
+	revision    int64     // store revision it was read at, for stores that check writes against it
 }
 
 // CartService manages shopping carts with OpenTelemetry metrics
 type CartService struct {
-	carts map[string]*Cart
-	mutex sync.RWMutex
+	store       CartStore          // cart persistence (memory, redis or postgres)
+	closeStore  func() error       // releases store connections on shutdown
+	degradation *degradedCartStore // wraps store when storage degradation is enabled, else nil
+	cartLocks   cartLocks          // serializes read-modify-write cart updates
+	catalog     *Catalog
+	namespaces  *Namespaces // logical environments selected per request, nil when none are configured
+	tenancy     *Tenancy    // scopes requests to their tenant, nil when tenancy is disabled
+
+	checkoutLockTimeout time.Duration // how long a checkout may hold a cart read-only
+	checkoutLocks       *redisStore   // takes checkout locks atomically across instances, nil unless carts are in Redis
+
+	// Supporting subsystems
+	readiness         *Readiness         // startup dependencies that gate /ready
+	calendar          *ReportingCalendar // reporting day boundaries per tenant timezone
+	window            *requestWindow     // recent request aggregates for local self-checks
+	requests          *requestLog        // recent requests for request ID lookups
+	errors            *errorLog          // recent errors for triage
+	experiments       *ExperimentManager // sticky A/B variant assignment
+	features          *FeatureRollouts   // gradual feature rollout by user cohort
+	pricing           *PricingEngine     // config-defined price adjustments
+	shares            *CartSharer        // signed cart share links
+	quotes            *PriceQuoter       // signed price holds honored at checkout
+	orders            *orderBook         // placed orders
+	profiles          *customerProfiles  // display names, regional defaults and saved addresses
+	addressValidation *AddressValidation // shipping address checks and normalization
+	returns           *returnsDesk       // return merchandise authorizations
+	risk              *RiskGate          // checkout fraud/velocity checks
+	categories        *categoryMetrics   // add-to-cart and revenue by category
+	shipping          *ShippingEstimator // tiered shipping by billable weight
+	scheduler         *JobScheduler      // cron-scheduled background jobs
+	templates         *templateStore     // saved cart templates and their schedules
+
+	hooks              *Hooks                  // embedder lifecycle hooks
+	extensions         *Extensions             // WASM and Go plugin business rules
+	cartRules          *CartRules              // CEL eligibility, limit and discount rules
+	stockSubscriptions *stockSubscriptions     // back-in-stock waiting lists
+	notifications      *NotificationDispatcher // user notifications (log or webhook)
+	expiry             *cartExpiry             // idle cart TTL
+	scan               *cartScan               // store scans shared by the cart gauges
+	idempotency        *idempotencyStore       // Idempotency-Key results of cart additions
+	restorer           *cartRestorer           // point-in-time restores from the WAL history
+	routeMetrics       *routeMetricSwitches    // request metrics turned off per route
+	activity           *cartActivityMetrics    // units added and removed per item, and cart sizes
+	publisher          *EventPublisher         // cart and order events and their in-process log
+	consumers          *EventConsumers         // projections and other consumers of the event log
+	analytics          *eventAnalytics         // cart and order totals projected from events
+	recommendations    *recommender            // products often in carts together, projected from events
+	funnel             *conversionFunnel       // view, add and checkout conversion, projected from events
+	changes            *cartChangeHub          // live cart changes for /v1/carts/{userID}/events streams
+	bucketAdvisor      *BucketAdvisor          // latency histogram bucket suggestions, idle unless enabled
+	dependencies       *DependencyClients      // simulated payment, inventory and shipping services
+	exemplars          *exemplarStore          // traces of recent latency and error measurements, for /metrics
 
 	// OpenTelemetry Metrics
-	errorCounter   metric.Int64Counter         // Counter: tracks error requests
-	requestLatency metric.Float64Histogram     // Histogram: measures request latency
-	cartItemsGauge metric.Int64ObservableGauge // Gauge: tracks cart items count
+	errorCounter   metric.Int64Counter           // Counter: tracks error requests
+	requestLatency metric.Float64Histogram       // Histogram: measures request latency
+	cartItemsGauge metric.Int64ObservableGauge   // Gauge: tracks cart items count
+	cartValueGauge metric.Float64ObservableGauge // Gauge: total value of items in carts
 
 	// Additional metrics for comprehensive monitoring
-	requestCounter metric.Int64Counter         // Counter: total requests
-	activeUsers    metric.Int64ObservableGauge // Gauge: active users count
+	requestCounter         metric.Int64Counter         // Counter: total requests
+	requestsInFlight       metric.Int64UpDownCounter   // UpDownCounter: requests being handled
+	activeUsers            metric.Int64ObservableGauge // Gauge: active users count
+	decodeFailureCounter   metric.Int64Counter         // Counter: rejected request bodies
+	deprecatedRouteCounter metric.Int64Counter         // Counter: requests to deprecated route aliases
+	syntheticCounter       metric.Int64Counter         // Counter: synthetic requests by source
+	batchItemCounter       metric.Int64Counter         // Counter: items of batch adds by result
+	orderCounter           metric.Int64Counter         // Counter: placed orders by checkout scope
+	orderValue             metric.Float64Histogram     // Histogram: order totals by checkout scope
+	checkoutFailureCounter metric.Int64Counter         // Counter: failed checkouts by reason
+	panicCounter           metric.Int64Counter         // Counter: recovered handler panics by endpoint
+
+	metricsReader *sdkmetric.ManualReader // on-demand collection for JSON snapshots
+
+	// OpenTelemetry Tracing
+	tracer         trace.Tracer
+	meterProvider  *sdkmetric.MeterProvider // flushed on shutdown
+	tracerProvider *sdktrace.TracerProvider // flushed on shutdown
+	serverTiming   bool                     // Server-Timing headers from phase spans
 }
 
 // MetricsServer wraps the CartService with HTTP handlers
 type MetricsServer struct {
-	service *CartService
-	server  *http.Server
+	service     *CartService
+	server      *http.Server
+	ops         *http.Server // operational endpoints on their own port, nil when they share server's
+	cachePolicy *CachePolicy
+	pipelines   MiddlewarePipelines // middleware order per route group
+	cors        *CORSPolicy         // used when a pipeline includes "cors"
+	signoz      *SigNozClient       // optional, nil when self-reporting is disabled
+	geoip       *GeoIPResolver      // optional, nil when region enrichment is disabled
+	loadgen     *loadgen.Generator  // built-in traffic generator, idle when disabled
+	recorder    *RequestRecorder    // request capture, idle until sampling or a user is selected
+	mirror      *TrafficMirror      // used when a pipeline includes "mirror"
+	limiter     *RateLimiter        // used when a pipeline includes "ratelimit"; nil limits nothing
+	faults      *FaultInjector      // used when a pipeline includes "chaos"
+	auth        *Authenticator      // used when a pipeline includes "auth"; passes everything unless enabled
+	sessions    *SessionTracer      // wraps every route; passes everything unless enabled
+	enricher    *SpanEnricher       // used when a pipeline includes "enrich"; passes everything without mappings
+	adminToken  string              // guards the admin endpoints; empty disables them
 }
 
 // NewCartService creates a new CartService with OpenTelemetry metrics
-func NewCartService() (*CartService, error) {
+func NewCartService(cfg *config.Config) (*CartService, error) {
 	// Create resource with service information
 	res, err := resource.Merge(
 		resource.Default(),
 		resource.NewWithAttributes(
 			semconv.SchemaURL,
-			semconv.ServiceName("shopping-cart-service"),
-			semconv.ServiceVersion("1.0.0"),
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(serviceVersion),
 			semconv.ServiceInstanceID("instance-1"),
 			attribute.String("environment", "development"),
 		),
@@ -73,28 +176,395 @@ func NewCartService() (*CartService, error) {
 		return nil, fmt.Errorf("failed to create resource: %w", err)
 	}
 
-	// Create Prometheus exporter
-	exporter, err := prometheus.New()
+	// Prometheus and/or OTLP readers for the configured exporters
+	readers, err := newMetricReaders(context.Background(), cfg.Telemetry)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create prometheus exporter: %w", err)
+		return nil, err
+	}
+
+	// Manual reader backing the JSON metrics snapshot endpoint
+	metricsReader := sdkmetric.NewManualReader()
+
+	// Bucket advisor, observing the histograms through a reader of its own
+	// when enabled
+	bucketAdvisor, err := NewBucketAdvisor(cfg.Telemetry.BucketAdvisor, metricsReader)
+	if err != nil {
+		return nil, err
+	}
+	if reader := bucketAdvisor.Reader(); reader != nil {
+		readers = append(readers, reader)
 	}
 
 	// Create meter provider
-	meterProvider := sdkmetric.NewMeterProvider(
+	meterOpts := []sdkmetric.Option{
 		sdkmetric.WithResource(res),
-		sdkmetric.WithReader(exporter),
-		sdkmetric.WithInterval(5*time.Second), // Collection interval
-	)
+		sdkmetric.WithReader(metricsReader),
+	}
+	for _, reader := range readers {
+		meterOpts = append(meterOpts, sdkmetric.WithReader(reader))
+	}
+	views := metricViews(cfg.Telemetry.Metrics.Views)
+	views = append(views, bucketAdvisor.Views(cfg.Telemetry.Metrics.Views)...)
+	if len(views) > 0 {
+		meterOpts = append(meterOpts, sdkmetric.WithView(views...))
+	}
+	meterProvider := sdkmetric.NewMeterProvider(meterOpts...)
 
 	// Set global meter provider
 	otel.SetMeterProvider(meterProvider)
 
+	// Outbound connection pools, reported as the pool_* metrics, take the
+	// configured settings from here on
+	if err := outboundPools.configure(cfg.Pools); err != nil {
+		return nil, err
+	}
+
+	// Create tracer provider, exporting over OTLP when configured
+	tracerProvider, err := newTracerProvider(context.Background(), res, cfg.Telemetry.OTLPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTracerProvider(tracerProvider)
+	if cfg.Telemetry.ServerTiming {
+		tracerProvider.RegisterSpanProcessor(&serverTimingProcessor{})
+	}
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
 	// Get meter
 	meter := otel.Meter("shopping-cart-service")
 
+	// Noisy routes, such as health checks, may skip request metrics
+	routeMetrics, err := newRouteMetricSwitches(cfg.Telemetry.Metrics.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reporting boundaries follow each tenant's local timezone
+	tenantZones, err := ParseTenantTimezones(os.Getenv("REPORTING_TENANT_TIMEZONES"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tenant timezones: %w", err)
+	}
+	calendar, err := NewReportingCalendar(os.Getenv("REPORTING_TIMEZONE"), tenantZones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reporting calendar: %w", err)
+	}
+
+	// A/B experiments stamped on request metrics
+	experimentDefs, err := ParseExperiments(os.Getenv("EXPERIMENTS"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse experiments: %w", err)
+	}
+	experiments, err := NewExperimentManager(experimentDefs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Features rolled out to a share of users, also stamped on request metrics
+	features, err := NewFeatureRollouts(cfg.Features)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pricing rules evaluate time windows in the tenant's reporting timezone
+	pricingRules, err := ParsePricingRules(os.Getenv("PRICING_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pricing rules: %w", err)
+	}
+	pricing, err := NewPricingEngine(pricingRules, calendar)
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := NewCartSharer(os.Getenv("SHARE_SECRET"))
+	if err != nil {
+		return nil, err
+	}
+
+	quoteTTL := defaultQuoteTTL
+	if value := os.Getenv("QUOTE_TTL"); value != "" {
+		if quoteTTL, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid QUOTE_TTL: %w", err)
+		}
+	}
+	quotes, err := NewPriceQuoter(os.Getenv("QUOTE_SECRET"), quoteTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkout velocity checks over a one hour window
+	riskRules, err := ParseRiskRules(os.Getenv("RISK_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse risk rules: %w", err)
+	}
+	riskDelay := 2 * time.Second
+	if value := os.Getenv("RISK_DELAY"); value != "" {
+		if riskDelay, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid RISK_DELAY: %w", err)
+		}
+	}
+	risk, err := NewRiskGate(newVelocityRiskChecker(riskRules, time.Hour), riskDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	checkoutLockTimeout := defaultCheckoutLockTimeout
+	if value := os.Getenv("CHECKOUT_LOCK_TIMEOUT"); value != "" {
+		if checkoutLockTimeout, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid CHECKOUT_LOCK_TIMEOUT: %w", err)
+		}
+	}
+
+	// Tiered shipping by billable weight
+	shippingTiers, err := ParseShippingTiers(os.Getenv("SHIPPING_TIERS"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse shipping tiers: %w", err)
+	}
+	regionTiers, err := ParseRegionShippingTiers(os.Getenv("SHIPPING_REGION_TIERS"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse regional shipping tiers: %w", err)
+	}
+
+	// Address checks use the built-in country rules, then ADDRESS_VALIDATOR_URL when set
+	addressValidation, err := NewAddressValidation(os.Getenv("ADDRESS_VALIDATOR_URL"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Calls to the store and the simulated dependencies are cut short
+	// while they keep failing
+	breakers, err := NewCircuitBreakers(cfg.Breakers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Carts and profiles live in CART_STORE (memory by default)
+	store, profileStore, closeStore, err := openStores(context.Background(), os.Getenv("CART_STORE"), os.Getenv("REDIS_URL"), cfg.Storage, cfg.Pools.Redis)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+
+	// Instances sharing carts in Redis take checkout locks there, where
+	// taking one is atomic
+	var checkoutLocks *redisStore
+	if carts, ok := store.(*redisCartStore); ok {
+		checkoutLocks = carts.redisStore
+	}
+
+	// Past cart state can be restored from the write-ahead log history
+	wal, _ := store.(*walCartStore)
+	restorer, err := newCartRestorer(wal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Beneath degradation, so an open circuit is served from its cache
+	if breakers != nil {
+		store = breakerCartStore{CartStore: store, breaker: breakers.breaker("store")}
+	}
+
+	// Optionally keep serving from a local cache while the store is down
+	var degradation *degradedCartStore
+	if cfg.Storage.Degradation != config.DegradationOff {
+		degradation, err = newDegradedCartStore(store, cfg.Storage)
+		if err != nil {
+			return nil, err
+		}
+		store = degradation
+	}
+
+	// Namespaces keep their carts apart within the one store
+	if len(cfg.Namespaces) > 0 {
+		store = namespacedCartStore{store}
+	}
+	// Tenants' carts are kept apart within each namespace
+	if cfg.Tenancy.Enabled {
+		store = tenantCartStore{store}
+	}
+	store = tracedCartStore{store}
+
+	returns, err := newReturnsDesk()
+	if err != nil {
+		return nil, err
+	}
+
+	scheduler, err := NewJobScheduler(cfg.Telemetry.HistogramBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := newHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	// Pricing and validation extensions from the config file
+	extensions, err := LoadExtensions(context.Background(), cfg.Extensions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load extensions: %w", err)
+	}
+	hooks.OnBeforeAddItem(extensions.validateItem)
+
+	// CEL eligibility, limit and discount rules from the config file
+	cartRules, err := NewCartRules(cfg.CartRules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile cart rules: %w", err)
+	}
+
+	// The gauges summarizing every cart share their store scans
+	scan, err := newCartScan(store, cfg.Telemetry.GaugeCacheWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	// Idle carts are removed after the configured TTL
+	expiry, err := newCartExpiry(scan, cfg.Carts.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retried additions with the same Idempotency-Key are applied once
+	idempotency, err := newIdempotencyStore(cfg.Carts.IdempotencyTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Back-in-stock notifications go to NOTIFY_WEBHOOK_URL when set
+	stockSubs, err := newStockSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	notifications, err := NewNotificationDispatcher(os.Getenv("NOTIFY_WEBHOOK_URL"), cfg.Notifications)
+	if err != nil {
+		return nil, err
+	}
+
+	// A configured catalog source loads in the background; the instance
+	// isn't ready until it has
+	readiness, err := newReadiness()
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := newSourcedCatalog(readiness, "catalog", cfg.Catalog.Source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load catalog: %w", err)
+	}
+
+	// Each namespace has its own catalog, loaded alongside the default one,
+	// and may override the cart TTL, features and cart rules
+	namespaces, err := newNamespaces(cfg, catalog, readiness, features, cartRules)
+	if err != nil {
+		return nil, err
+	}
+	catalogFor := func(ctx context.Context) *Catalog {
+		return namespaceCatalog(ctx, catalog)
+	}
+	categories, err := newCategoryMetrics(catalogFor)
+	if err != nil {
+		return nil, err
+	}
+	activity, err := newCartActivityMetrics(catalogFor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cart and order events go to the in-process event log
+	publisher, err := NewEventPublisher(cfg.Events, readiness)
+	if err != nil {
+		return nil, err
+	}
+	consumers, err := newEventConsumers(cfg.Events, publisher)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cart changes are also pushed to open event streams
+	changes, err := newCartChangeHub()
+	if err != nil {
+		return nil, err
+	}
+
+	// Simulated downstream services called by checkout and cart additions
+	dependencies, err := NewDependencyClients(context.Background(), cfg.Simulation.Dependencies, cfg.Telemetry.OTLPEndpoint, cfg.Telemetry.HistogramBuckets, breakers)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize service
 	service := &CartService{
-		carts: make(map[string]*Cart),
+		store:       store,
+		closeStore:  closeStore,
+		degradation: degradation,
+		catalog:     catalog,
+		namespaces:  namespaces,
+		tenancy:     newTenancy(cfg.Tenancy),
+		readiness:   readiness,
+		calendar:    calendar,
+		window:      newRequestWindow(5*time.Minute, cfg.Telemetry.HistogramBuckets),
+		requests:    newRequestLog(1000),
+		errors:      newErrorLog(100),
+
+		checkoutLockTimeout: checkoutLockTimeout,
+		checkoutLocks:       checkoutLocks,
+
+		experiments: experiments,
+		features:    features,
+		pricing:     pricing,
+		shares:      shares,
+		quotes:      quotes,
+		orders:      newOrderBook(),
+		profiles:    newCustomerProfiles(profileStore),
+
+		addressValidation: addressValidation,
+		returns:           returns,
+		risk:              risk,
+		categories:        categories,
+		activity:          activity,
+		publisher:         publisher,
+		consumers:         consumers,
+		changes:           changes,
+		bucketAdvisor:     bucketAdvisor,
+		analytics:         newEventAnalytics(),
+		recommendations:   newRecommender(),
+		dependencies:      dependencies,
+		shipping:          NewShippingEstimator(shippingTiers, regionTiers),
+		scheduler:         scheduler,
+		templates:         newTemplateStore(),
+		metricsReader:     metricsReader,
+		exemplars:         newExemplarStore(),
+
+		tracer:         otel.Tracer("shopping-cart-service"),
+		meterProvider:  meterProvider,
+		tracerProvider: tracerProvider,
+		serverTiming:   cfg.Telemetry.ServerTiming,
+
+		hooks:              hooks,
+		extensions:         extensions,
+		cartRules:          cartRules,
+		stockSubscriptions: stockSubs,
+		notifications:      notifications,
+		expiry:             expiry,
+		scan:               scan,
+		idempotency:        idempotency,
+		restorer:           restorer,
+		routeMetrics:       routeMetrics,
+	}
+	hooks.OnBeforeAddItem(service.checkCartRules)
+
+	service.funnel = newConversionFunnel(cfg.Events.FunnelWindows, service.catalogOfNamespace)
+	if err := service.funnel.registerMetrics(); err != nil {
+		return nil, err
+	}
+
+	// Projections built from the event log, and the webhook when set
+	consumers.subscribeProjection("analytics", service.analytics)
+	consumers.subscribeProjection("recommendations", service.recommendations)
+	consumers.subscribeProjection("funnel", service.funnel)
+	consumers.Subscribe("notifications", service.notifyFromEvents)
+	if cfg.Events.WebhookURL != "" {
+		consumers.Subscribe("webhook", publisher.deliver)
 	}
 
 	// Create Counter metric for error requests
@@ -106,6 +576,7 @@ func NewCartService() (*CartService, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create error counter: %w", err)
 	}
+	service.errorCounter = exemplarCounter{Int64Counter: service.errorCounter, name: "http_requests_errors_total", store: service.exemplars}
 
 	// Create Counter metric for total requests
 	service.requestCounter, err = meter.Int64Counter(
@@ -117,16 +588,108 @@ func NewCartService() (*CartService, error) {
 		return nil, fmt.Errorf("failed to create request counter: %w", err)
 	}
 
+	// Create UpDownCounter metric for requests being handled
+	service.requestsInFlight, err = meter.Int64UpDownCounter(
+		"http_requests_in_flight",
+		metric.WithDescription("Number of HTTP requests currently being handled by endpoint"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create in-flight requests counter: %w", err)
+	}
+
+	// Create Counter metric for recovered handler panics
+	service.panicCounter, err = meter.Int64Counter(
+		"http_panics_total",
+		metric.WithDescription("Total number of HTTP handler panics recovered by endpoint"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create panic counter: %w", err)
+	}
+
+	// Create Counter metric for request decode/validation failures
+	service.decodeFailureCounter, err = meter.Int64Counter(
+		"http_request_decode_failures_total",
+		metric.WithDescription("Total number of rejected request bodies by endpoint, reason and field"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decode failure counter: %w", err)
+	}
+
+	// Create Counter metric for requests to deprecated routes
+	service.deprecatedRouteCounter, err = meter.Int64Counter(
+		"http_deprecated_requests_total",
+		metric.WithDescription("Total number of requests to deprecated route aliases by endpoint"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deprecated route counter: %w", err)
+	}
+
+	// Create Counter metric for the items of batch adds
+	service.batchItemCounter, err = meter.Int64Counter(
+		"cart_batch_items_total",
+		metric.WithDescription("Total number of items in batch adds by result (added, rejected, or not_added when other items were rejected)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create batch item counter: %w", err)
+	}
+
+	// Create Counter metric for synthetic requests, which SLOs leave out
+	service.syntheticCounter, err = meter.Int64Counter(
+		"synthetic_requests_total",
+		metric.WithDescription("Total number of synthetic requests (simulator, probers, self-test) by source, endpoint and status code"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create synthetic request counter: %w", err)
+	}
+
+	// Create Counter metric for placed orders
+	service.orderCounter, err = meter.Int64Counter(
+		"orders_total",
+		metric.WithDescription("Total number of placed orders by checkout scope (full or partial)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order counter: %w", err)
+	}
+
+	// Create Histogram metric for order value
+	service.orderValue, err = meter.Float64Histogram(
+		"order_value",
+		metric.WithDescription("Distribution of order totals including shipping by checkout scope"),
+		metric.WithUnit("1"),
+		metric.WithExplicitBucketBoundaries(10, 25, 50, 100, 250, 500, 1000, 2500),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order value histogram: %w", err)
+	}
+
+	// Create Counter metric for failed checkouts
+	service.checkoutFailureCounter, err = meter.Int64Counter(
+		"checkout_failures_total",
+		metric.WithDescription("Total number of failed checkouts by reason"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkout failure counter: %w", err)
+	}
+
 	// Create Histogram metric for request latency
 	service.requestLatency, err = meter.Float64Histogram(
 		"http_request_duration_seconds",
 		metric.WithDescription("HTTP request latency in seconds"),
 		metric.WithUnit("s"),
-		metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0),
+		metric.WithExplicitBucketBoundaries(cfg.Telemetry.HistogramBuckets...),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create latency histogram: %w", err)
 	}
+	service.requestLatency = exemplarHistogram{Float64Histogram: service.requestLatency, name: "http_request_duration_seconds", store: service.exemplars}
 
 	// Create Observable Gauge for cart items count
 	service.cartItemsGauge, err = meter.Int64ObservableGauge(
@@ -138,6 +701,16 @@ func NewCartService() (*CartService, error) {
 		return nil, fmt.Errorf("failed to create cart items gauge: %w", err)
 	}
 
+	// Create Observable Gauge for cart value
+	service.cartValueGauge, err = meter.Float64ObservableGauge(
+		"cart_value_total",
+		metric.WithDescription("Total value of items in user carts at their cart prices"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart value gauge: %w", err)
+	}
+
 	// Create Observable Gauge for active users
 	service.activeUsers, err = meter.Int64ObservableGauge(
 		"active_users_total",
@@ -152,6 +725,7 @@ func NewCartService() (*CartService, error) {
 	_, err = meter.RegisterCallback(
 		service.observeCartMetrics,
 		service.cartItemsGauge,
+		service.cartValueGauge,
 		service.activeUsers,
 	)
 	if err != nil {
@@ -163,22 +737,25 @@ func NewCartService() (*CartService, error) {
 
 // observeCartMetrics collects gauge metrics
 func (cs *CartService) observeCartMetrics(ctx context.Context, observer metric.Observer) error {
-	cs.mutex.RLock()
-	defer cs.mutex.RUnlock()
+	carts, err := cs.scan.list(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list carts: %w", err)
+	}
 
-	// Count total items across all carts
+	// Count total items and their value across all carts
 	totalItems := int64(0)
-	for _, cart := range cs.carts {
-		cart.mutex.RLock()
+	totalValue := 0.0
+	for _, cart := range carts {
 		for _, item := range cart.Items {
 			totalItems += int64(item.Quantity)
+			totalValue += item.Price * float64(item.Quantity)
 		}
-		cart.mutex.RUnlock()
 	}
 
 	// Observe metrics
 	observer.ObserveInt64(cs.cartItemsGauge, totalItems)
-	observer.ObserveInt64(cs.activeUsers, int64(len(cs.carts)))
+	observer.ObserveFloat64(cs.cartValueGauge, totalValue)
+	observer.ObserveInt64(cs.activeUsers, int64(len(carts)))
 
 	return nil
 }
@@ -191,10 +768,14 @@ func (cs *CartService) recordError(ctx context.Context, errorType, endpoint stri
 			attribute.String("endpoint", endpoint),
 			attribute.Int("status_code", statusCode),
 		),
+		metric.WithAttributes(trafficAttributes(ctx, endpoint)...),
+		metric.WithAttributes(namespaceAttributes(ctx)...),
+		metric.WithAttributes(tenantAttributes(ctx)...),
 	)
 }
 
-// recordRequest increments the request counter
+// recordRequest increments the request counter, and the synthetic request
+// counter for synthetic traffic
 func (cs *CartService) recordRequest(ctx context.Context, method, endpoint string, statusCode int) {
 	cs.requestCounter.Add(ctx, 1,
 		metric.WithAttributes(
@@ -202,7 +783,21 @@ func (cs *CartService) recordRequest(ctx context.Context, method, endpoint strin
 			attribute.String("endpoint", endpoint),
 			attribute.Int("status_code", statusCode),
 		),
+		metric.WithAttributes(clientAttributes(ctx)...),
+		metric.WithAttributes(trafficAttributes(ctx, endpoint)...),
+		metric.WithAttributes(regionAttributes(ctx)...),
+		metric.WithAttributes(namespaceAttributes(ctx)...),
+		metric.WithAttributes(tenantAttributes(ctx)...),
+		metric.WithAttributes(cs.experiments.experimentAttributes(ctx)...),
+		metric.WithAttributes(cs.featuresFor(ctx).featureAttributes(ctx)...),
 	)
+	if info := requestInfoFrom(ctx); info != nil && info.Synthetic != "" {
+		cs.syntheticCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("source", info.Synthetic),
+			attribute.String("endpoint", endpoint),
+			attribute.Int("status_code", statusCode),
+		))
+	}
 }
 
 // recordLatency records request latency
@@ -213,106 +808,360 @@ func (cs *CartService) recordLatency(ctx context.Context, duration time.Duration
 			attribute.String("endpoint", endpoint),
 			attribute.Int("status_code", statusCode),
 		),
+		metric.WithAttributes(clientAttributes(ctx)...),
+		metric.WithAttributes(trafficAttributes(ctx, endpoint)...),
+		metric.WithAttributes(regionAttributes(ctx)...),
+		metric.WithAttributes(namespaceAttributes(ctx)...),
+		metric.WithAttributes(tenantAttributes(ctx)...),
+		metric.WithAttributes(cs.experiments.experimentAttributes(ctx)...),
+		metric.WithAttributes(cs.featuresFor(ctx).featureAttributes(ctx)...),
 	)
 }
 
 // AddToCart adds an item to a user's cart
-func (cs *CartService) AddToCart(ctx context.Context, userID string, item CartItem) error {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
+func (cs *CartService) AddToCart(ctx context.Context, userID string, item CartItem) (err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.AddToCart", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+		attribute.String("item.id", item.ID),
+		attribute.Int("item.quantity", item.Quantity),
+	))
+	defer func() { endSpan(span, err) }()
+
+	// Hooks and the inventory service may call out, so they run before
+	// the cart is locked
+	if err := cs.hooks.runBeforeAddItem(ctx, userID, item); err != nil {
+		return err
+	}
+	if err := cs.dependencies.call(ctx, config.DependencyInventory, "check_availability"); err != nil {
+		return err
+	}
+
+	defer cs.cartLocks.lock(userID)()
 
-	cart, exists := cs.carts[userID]
-	if !exists {
-		cart = &Cart{
+	cart, err := cs.store.Get(ctx, userID)
+	if errors.Is(err, ErrCartNotFound) {
+		cart, err = &Cart{
 			UserID: userID,
 			Items:  []CartItem{},
-		}
-		cs.carts[userID] = cart
+		}, nil
+	}
+	if err != nil {
+		return err
 	}
 
-	cart.mutex.Lock()
-	defer cart.mutex.Unlock()
+	if cart.lockedAt(time.Now()) {
+		return fmt.Errorf("%w: %s", ErrCartLocked, userID)
+	}
 
-	// Check if item already exists
-	for i, existingItem := range cart.Items {
+	// Stock must cover the combined quantity in the cart
+	requested := item.Quantity
+	for _, existingItem := range cart.Items {
 		if existingItem.ID == item.ID {
-			cart.Items[i].Quantity += item.Quantity
-			return nil
+			requested += existingItem.Quantity
 		}
 	}
+	if err := cs.catalogFor(ctx).CheckStock(item.ID, requested); err != nil {
+		return err
+	}
+
+	quantity := cart.addItem(item)
+	cart.updatedAt = time.Now()
 
-	// Add new item
-	cart.Items = append(cart.Items, item)
+	if err := cs.store.Put(ctx, cart); err != nil {
+		return err
+	}
+	cs.categories.recordItemAdded(ctx, item)
+	cs.activity.recordAdded(ctx, cart, item.ID, item.Quantity)
+	cs.publisher.publish(ctx, events.CartItemAdded{UserID: userID, ItemID: item.ID, Quantity: item.Quantity, Price: item.Price})
+	cs.changes.publish(ctx, cartChangeItemAdded, userID, item.ID, quantity)
 	return nil
 }
 
+// addItem adds item to the cart, merged into the line of the same item if
+// there is one, and returns the item's quantity in the cart
+func (c *Cart) addItem(item CartItem) int {
+	for i, existingItem := range c.Items {
+		if existingItem.ID == item.ID {
+			c.Items[i].Quantity += item.Quantity
+			return c.Items[i].Quantity
+		}
+	}
+	c.Items = append(c.Items, item)
+	return item.Quantity
+}
+
 // GetCart retrieves a user's cart
-func (cs *CartService) GetCart(ctx context.Context, userID string) (*Cart, error) {
-	cs.mutex.RLock()
-	defer cs.mutex.RUnlock()
+func (cs *CartService) GetCart(ctx context.Context, userID string) (_ *Cart, err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.GetCart", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+	))
+	defer func() { endSpan(span, err) }()
+
+	// Stores return copies, so callers cannot race with other updates
+	return cs.store.Get(ctx, userID)
+}
 
-	cart, exists := cs.carts[userID]
-	if !exists {
-		return nil, fmt.Errorf("cart not found for user %s", userID)
+// RemoveFromCart removes an item from a user's cart
+func (cs *CartService) RemoveFromCart(ctx context.Context, userID, itemID string) (err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.RemoveFromCart", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+		attribute.String("item.id", itemID),
+	))
+	defer func() { endSpan(span, err) }()
+
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if err != nil {
+		return err
 	}
 
-	cart.mutex.RLock()
-	defer cart.mutex.RUnlock()
+	if cart.lockedAt(time.Now()) {
+		return fmt.Errorf("%w: %s", ErrCartLocked, userID)
+	}
 
-	// Create a copy to avoid race conditions
-	cartCopy := &Cart{
-		UserID: cart.UserID,
-		Items:  make([]CartItem, len(cart.Items)),
+	for i, item := range cart.Items {
+		if item.ID == itemID {
+			cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+			cart.updatedAt = time.Now()
+			if err := cs.store.Put(ctx, cart); err != nil {
+				return err
+			}
+			cs.activity.recordRemoved(ctx, cart, itemID, item.Quantity)
+			cs.publisher.publish(ctx, events.CartItemRemoved{UserID: userID, ItemID: itemID, Quantity: item.Quantity})
+			cs.changes.publish(ctx, cartChangeItemRemoved, userID, itemID, 0)
+			return nil
+		}
 	}
-	copy(cartCopy.Items, cart.Items)
 
-	return cartCopy, nil
+	return fmt.Errorf("%w: %s", ErrItemNotFound, itemID)
 }
 
-// RemoveFromCart removes an item from a user's cart
-func (cs *CartService) RemoveFromCart(ctx context.Context, userID, itemID string) error {
-	cs.mutex.RLock()
-	cart, exists := cs.carts[userID]
-	cs.mutex.RUnlock()
+// ClearCart removes every item from a user's cart, or with deleteCart the
+// cart itself, reporting each item as removed
+func (cs *CartService) ClearCart(ctx context.Context, userID string, deleteCart bool) (err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.ClearCart", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+		attribute.Bool("cart.delete", deleteCart),
+	))
+	defer func() { endSpan(span, err) }()
 
-	if !exists {
-		return fmt.Errorf("cart not found for user %s", userID)
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if cart.lockedAt(time.Now()) {
+		return fmt.Errorf("%w: %s", ErrCartLocked, userID)
 	}
 
-	cart.mutex.Lock()
-	defer cart.mutex.Unlock()
+	removed := cart.Items
+	cart.Items = []CartItem{}
+	cart.updatedAt = time.Now()
+	if deleteCart {
+		err = cs.store.Delete(ctx, userID)
+	} else {
+		err = cs.store.Put(ctx, cart)
+	}
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("cart.removed_items", len(removed)))
+	cs.activity.recordCleared(ctx, cart, removed)
+	for _, item := range removed {
+		cs.publisher.publish(ctx, events.CartItemRemoved{UserID: userID, ItemID: item.ID, Quantity: item.Quantity})
+		cs.changes.publish(ctx, cartChangeItemRemoved, userID, item.ID, 0)
+	}
+	return nil
+}
+
+// UpdateQuantity sets the quantity of an item already in a user's cart,
+// removing the item when quantity <= 0. Increases must be covered by stock.
+func (cs *CartService) UpdateQuantity(ctx context.Context, userID, itemID string, quantity int) (err error) {
+	ctx, span := cs.tracer.Start(ctx, "CartService.UpdateQuantity", trace.WithAttributes(
+		attribute.String("cart.user_id", userID),
+		attribute.String("item.id", itemID),
+		attribute.Int("item.quantity", quantity),
+	))
+	defer func() { endSpan(span, err) }()
+
+	defer cs.cartLocks.lock(userID)()
+
+	cart, err := cs.store.Get(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if cart.lockedAt(time.Now()) {
+		return fmt.Errorf("%w: %s", ErrCartLocked, userID)
+	}
 
 	for i, item := range cart.Items {
-		if item.ID == itemID {
+		if item.ID != itemID {
+			continue
+		}
+
+		added := quantity - item.Quantity
+		if quantity <= 0 {
 			cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
-			return nil
+			added = -item.Quantity
+		} else {
+			if added > 0 {
+				if err := cs.catalogFor(ctx).CheckStock(itemID, quantity); err != nil {
+					return err
+				}
+			}
+			cart.Items[i].Quantity = quantity
+		}
+		cart.updatedAt = time.Now()
+
+		if err := cs.store.Put(ctx, cart); err != nil {
+			return err
+		}
+		switch {
+		case added > 0:
+			item.Quantity = added
+			cs.categories.recordItemAdded(ctx, item)
+			cs.activity.recordAdded(ctx, cart, itemID, added)
+			cs.publisher.publish(ctx, events.CartItemAdded{UserID: userID, ItemID: itemID, Quantity: added, Price: item.Price})
+		case added < 0:
+			cs.activity.recordRemoved(ctx, cart, itemID, -added)
+			cs.publisher.publish(ctx, events.CartItemRemoved{UserID: userID, ItemID: itemID, Quantity: -added})
 		}
+		if quantity <= 0 {
+			cs.changes.publish(ctx, cartChangeItemRemoved, userID, itemID, 0)
+		} else {
+			cs.changes.publish(ctx, cartChangeItemUpdated, userID, itemID, quantity)
+		}
+		return nil
 	}
 
-	return fmt.Errorf("item %s not found in cart", itemID)
+	return fmt.Errorf("%w: %s", ErrItemNotFound, itemID)
 }
 
 // NewMetricsServer creates a new HTTP server with metrics endpoints
-func NewMetricsServer(service *CartService, port string) *MetricsServer {
+func NewMetricsServer(service *CartService, port, opsPort string, cachePolicy *CachePolicy, pipelines MiddlewarePipelines, cors *CORSPolicy, signoz *SigNozClient, geoip *GeoIPResolver, generator *loadgen.Generator, recorder *RequestRecorder, mirror *TrafficMirror, limiter *RateLimiter, faults *FaultInjector, auth *Authenticator, sessions *SessionTracer, enricher *SpanEnricher, proxies TrustedProxies, adminToken string) *MetricsServer {
 	mux := http.NewServeMux()
 
+	// Operational endpoints get their own listener when opsPort is set, so
+	// the public port serves only the application APIs
+	ops := mux
+	if opsPort != "" {
+		ops = http.NewServeMux()
+	}
+
+	if cachePolicy == nil {
+		cachePolicy = DefaultCachePolicy()
+	}
+	if pipelines == nil {
+		pipelines = MiddlewarePipelines{defaultPipelineGroup: defaultPipeline}
+	}
+	if cors == nil {
+		cors = NewCORSPolicy("")
+	}
+
 	server := &MetricsServer{
 		service: service,
 		server: &http.Server{
 			Addr:    ":" + port,
-			Handler: mux,
+			Handler: withRequestID(proxies.wrap(service.tenancy.route(service.namespaces.route(withTracing(mux))))),
 		},
+		cachePolicy: cachePolicy,
+		pipelines:   pipelines,
+		cors:        cors,
+		signoz:      signoz,
+		geoip:       geoip,
+		loadgen:     generator,
+		recorder:    recorder,
+		limiter:     limiter,
+		auth:        auth,
+		sessions:    sessions,
+		enricher:    enricher,
+		mirror:      mirror,
+		faults:      faults,
+		adminToken:  adminToken,
+	}
+	if opsPort != "" {
+		server.ops = &http.Server{
+			Addr:    ":" + opsPort,
+			Handler: withRequestID(proxies.wrap(service.tenancy.route(service.namespaces.route(withTracing(ops))))),
+		}
 	}
 
-	// Add middleware for metrics collection
-	mux.HandleFunc("/cart/add", server.withMetrics(server.handleAddToCart))
-	mux.HandleFunc("/cart/get", server.withMetrics(server.handleGetCart))
-	mux.HandleFunc("/cart/remove", server.withMetrics(server.handleRemoveFromCart))
-	mux.HandleFunc("/health", server.withMetrics(server.handleHealth))
-	mux.HandleFunc("/simulate-error", server.withMetrics(server.handleSimulateError))
-
-	// Prometheus metrics endpoint
-	mux.Handle("/metrics", promhttp.Handler())
+	// Each route is wrapped in its group's middleware pipeline
+	server.handle(mux, "/v1/carts/{userID}", server.handleV1Cart)
+	server.handle(mux, "/v1/carts/{userID}/items", server.handleV1CartItems)
+	server.handle(mux, "/v1/carts/{userID}/items:batch", server.handleV1CartItemsBatch)
+	server.handle(mux, "/v1/carts/{userID}/items/{itemID}", server.handleV1CartItem)
+	server.handle(mux, "/v1/carts/{userID}/events", server.handleV1CartEvents)
+	server.handle(mux, "/v1/limits", server.handleV1Limits)
+	server.handle(mux, "/v1/events", server.handleClientEvents)
+
+	// Flat cart routes, deprecated in favor of /v1
+	server.handle(mux, "/cart/add", server.deprecated("/v1/carts/{userID}/items", server.handleAddToCart))
+	server.handle(mux, "/cart/get", server.deprecated("/v1/carts/{userID}", server.handleGetCart))
+	server.handle(mux, "/cart/remove", server.deprecated("/v1/carts/{userID}/items/{itemID}", server.handleRemoveFromCart))
+	server.handle(mux, "/cart/item", server.deprecated("/v1/carts/{userID}/items/{itemID}", server.handleUpdateQuantity))
+
+	server.handle(mux, "/cart/totals", server.handleCartTotals)
+	server.handle(mux, "/cart/share", server.handleCreateShare)
+	server.handle(mux, "/cart/shared", server.handleViewShare)
+	server.handle(mux, "/cart/shared/clone", server.handleCloneShare)
+	server.handle(mux, "/cart/quote", server.handleQuote)
+	server.handle(mux, "/cart/checkout", server.handleCheckout)
+	server.handle(mux, "/cart/templates", server.handleTemplates)
+	server.handle(mux, "/cart/schedules", server.handleSchedules)
+	server.handle(mux, "/catalog/products", server.handleListProducts)
+	server.handle(mux, "/catalog/product", server.handleGetProduct)
+	server.handle(mux, "/catalog/subscriptions", server.handleStockSubscription)
+	server.handle(mux, "/catalog/recommendations", server.handleRecommendations)
+	server.handle(mux, "/profiles", server.handleProfiles)
+	server.handle(mux, "/profiles/addresses", server.handleProfileAddresses)
+	server.handle(mux, "/orders", server.handleOrders)
+	server.handle(mux, "/returns", server.handleReturns)
+	server.handle(mux, "/experiments", server.handleExperiments)
+	server.handle(mux, "/simulate-error", server.handleSimulateError)
+	server.handle(mux, "/openapi.json", server.handleOpenAPI)
+	server.handle(mux, "/docs", server.handleAPIDocs)
+
+	// Probes, metrics and admin endpoints, on the ops port when configured.
+	// Every admin endpoint requires the admin token.
+	server.handle(ops, "/health", server.handleHealth)
+	server.handle(ops, "/ready", server.handleReady)
+	server.handleAdmin(ops, "/admin/self-check", server.handleSelfCheck)
+	server.handleAdmin(ops, "/admin/debug/bundle", server.handleDiagnosticsBundle)
+	server.handleAdmin(ops, "/admin/metrics.json", server.handleMetricsJSON)
+	server.handleAdmin(ops, "/admin/histograms/advice", server.handleBucketAdvice)
+	server.handleAdmin(ops, "/admin/catalog/restock", server.handleRestock)
+	server.handleAdmin(ops, "/admin/returns/transition", server.handleReturnTransition)
+	server.handleAdmin(ops, "/admin/errors", server.handleRecentErrors)
+	server.handleAdmin(ops, "/admin/summary", server.handleSummary)
+	server.handleAdmin(ops, "/admin/analytics", server.handleAnalytics)
+	server.handleAdmin(ops, "/admin/analytics/funnel", server.handleFunnel)
+	server.handleAdmin(ops, "/admin/consumers", server.handleConsumers)
+	server.handleAdmin(ops, "/admin/consumers/{name}/dead-letters", server.handleDeadLetters)
+	server.handleAdmin(ops, "/admin/consumers/{name}/redrive", server.handleRedrive)
+	server.handleAdmin(ops, "/admin/consumers/{name}/rebuild", server.handleRebuild)
+	server.handleAdmin(ops, "/admin/faults", server.handleFaults)
+	server.handleAdmin(ops, "/admin/loadgen", server.handleLoadGenerator)
+	server.handleAdmin(ops, "/admin/log-level", server.handleLogLevel)
+	server.handleAdmin(ops, "/admin/recordings", server.handleRecordings)
+	server.handleAdmin(ops, "/admin/recordings/settings", server.handleRecordingSettings)
+	server.handleAdmin(ops, "/admin/requests/", server.handleLookupRequest)
+	server.handleAdmin(ops, "/admin/carts", server.handleListCarts)
+	server.handleAdmin(ops, "/admin/carts/", server.handleInspectCart)
+	server.handleAdmin(ops, "/admin/restore", server.handleRestore)
+	server.handleAdmin(ops, "/admin/restore/promote", server.handleRestorePromote)
+
+	// Prometheus metrics endpoint, with exemplars linking the latency
+	// histogram and error counter to traces in the OpenMetrics format
+	ops.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(
+		exemplarGatherer{Gatherer: prometheus.DefaultGatherer, store: service.exemplars},
+		promhttp.HandlerOpts{EnableOpenMetrics: true},
+	)))
 
 	return server
 }
@@ -321,25 +1170,65 @@ func NewMetricsServer(service *CartService, port string) *MetricsServer {
 func (ms *MetricsServer) withMetrics(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+
+		// withRequestID has identified the request so support can look it
+		// up later
 		ctx := r.Context()
+		info := requestInfoFrom(ctx)
+		if info == nil {
+			info = &requestInfo{ID: newRequestID(), Client: parseClient(r)}
+			info.Synthetic = parseSyntheticSource(r, info.Client)
+			w.Header().Set("X-Request-ID", info.ID)
+			r = r.WithContext(withRequestInfo(ctx, info))
+			ctx = r.Context()
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", info.ID))
+		annotateSpanWithClient(ctx)
+		if info.Synthetic != "" {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("synthetic.source", info.Synthetic))
+		}
+		trace.SpanFromContext(ctx).SetAttributes(namespaceAttributes(ctx)...)
+		if tenant := tenantFrom(ctx); tenant != nil {
+			// Spans carry every tenant's ID, unlike the metrics
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("tenant.id", tenant.ID))
+		}
+		ms.annotateRequestRegion(ctx, r)
+
+		// Counted until the handler returns, even if it panics, so stuck
+		// handlers show up before they complete
+		endpoint := endpointOf(r)
+		switches := ms.service.routeMetrics
+		if switches.enabled(ctx, endpoint, config.MetricRequestsInFlight) {
+			inFlight := metric.WithAttributes(attribute.String("endpoint", endpoint))
+			ms.service.requestsInFlight.Add(ctx, 1, inFlight)
+			defer ms.service.requestsInFlight.Add(ctx, -1, inFlight)
+		}
 
 		// Create a custom response writer to capture status code
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
-		// Add random latency for demonstration
-		if rand.Float32() < 0.3 { // 30% chance of additional latency
-			time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+		// Call the actual handler, capturing the exchange when the
+		// recorder might keep it
+		if settings, body, ok := ms.recorder.capture(r); ok {
+			recording := &recordingWriter{responseWriter: wrapped}
+			handler(recording, r)
+			ms.recorder.finish(ctx, settings, r, body, recording, start)
+		} else {
+			handler(wrapped, r)
 		}
 
-		// Call the actual handler
-		handler(wrapped, r)
-
 		// Record metrics
 		duration := time.Since(start)
 		statusCode := wrapped.statusCode
 
-		ms.service.recordRequest(ctx, r.Method, r.URL.Path, statusCode)
-		ms.service.recordLatency(ctx, duration, r.Method, r.URL.Path, statusCode)
+		if switches.enabled(ctx, endpoint, config.MetricRequests) {
+			ms.service.recordRequest(ctx, r.Method, endpoint, statusCode)
+		}
+		if switches.enabled(ctx, endpoint, config.MetricRequestDuration) {
+			ms.service.recordLatency(ctx, duration, r.Method, endpoint, statusCode)
+		}
+		ms.service.window.Record(endpoint, duration, statusCode)
+		ms.service.recordCompletedRequest(ctx, r, start, duration, statusCode)
 
 		// Record error if status code indicates an error
 		if statusCode >= 400 {
@@ -347,8 +1236,19 @@ func (ms *MetricsServer) withMetrics(handler http.HandlerFunc) http.HandlerFunc
 			if statusCode >= 500 {
 				errorType = "server_error"
 			}
-			ms.service.recordError(ctx, errorType, r.URL.Path, statusCode)
+			if switches.enabled(ctx, endpoint, config.MetricRequestErrors) {
+				ms.service.recordError(ctx, errorType, endpoint, statusCode)
+			}
+			ms.service.recordRecentError(ctx, errorType, endpoint, statusCode)
+		}
+
+		// Server errors are logged whether or not the route's pipeline
+		// includes the access log
+		if statusCode >= 500 {
+			logRequest(ctx, slog.LevelError, "Request failed", r, statusCode, duration, slog.String("error", info.ErrorMessage))
 		}
+
+		ms.service.hooks.runRequestComplete(ctx, r, statusCode, duration)
 	}
 }
 
@@ -363,11 +1263,17 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// event streams
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // HTTP Handlers
 
 func (ms *MetricsServer) handleAddToCart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
 		return
 	}
 
@@ -376,51 +1282,74 @@ func (ms *MetricsServer) handleAddToCart(w http.ResponseWriter, r *http.Request)
 		Item   CartItem `json:"item"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
 		return
 	}
 
-	if req.UserID == "" || req.Item.ID == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+	if err := validateCartItem(req.Item); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
 		return
 	}
+	ms.addItem(w, r, req.UserID, req.Item)
+}
 
-	err := ms.service.AddToCart(r.Context(), req.UserID, req.Item)
+// addItem adds a validated item to the user's cart, once per
+// Idempotency-Key, and writes the response
+func (ms *MetricsServer) addItem(w http.ResponseWriter, r *http.Request, userID string, item CartItem) {
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" && !validIdempotencyKey(key) {
+		writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "Idempotency-Key")
+		return
+	}
+
+	replayed, err := ms.service.AddToCartIdempotent(r.Context(), key, userID, item)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ms.writeServiceError(w, r, err, item.ID)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	writeJSON(w, r, map[string]string{"status": "success"})
 }
 
 func (ms *MetricsServer) handleGetCart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
 		return
 	}
 
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
-		http.Error(w, "Missing user_id parameter", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
 		return
 	}
+	setRequestUser(r.Context(), userID)
+	ms.writeCart(w, r, userID)
+}
 
+// writeCart responds with the user's cart
+func (ms *MetricsServer) writeCart(w http.ResponseWriter, r *http.Request, userID string) {
 	cart, err := ms.service.GetCart(r.Context(), userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		ms.writeServiceError(w, r, err, userID)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cart)
+	writeJSON(w, r, cart)
 }
 
 func (ms *MetricsServer) handleRemoveFromCart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
 		return
 	}
 
@@ -429,28 +1358,110 @@ func (ms *MetricsServer) handleRemoveFromCart(w http.ResponseWriter, r *http.Req
 		ItemID string `json:"item_id"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
 		return
 	}
 
-	err := ms.service.RemoveFromCart(r.Context(), req.UserID, req.ItemID)
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+	if req.ItemID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("item_id", msgMissingFields))
+		return
+	}
+	ms.removeItem(w, r, req.UserID, req.ItemID)
+}
+
+// removeItem removes an item from the user's cart and writes the response
+func (ms *MetricsServer) removeItem(w http.ResponseWriter, r *http.Request, userID, itemID string) {
+	err := ms.service.RemoveFromCart(r.Context(), userID, itemID)
+	if errors.Is(err, ErrItemNotFound) {
+		writeError(w, r, http.StatusNotFound, msgItemNotFound, itemID)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		ms.writeServiceError(w, r, err, userID)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	writeJSON(w, r, map[string]string{"status": "success"})
+}
+
+// handleUpdateQuantity sets an item's quantity; 0 or less removes it
+func (ms *MetricsServer) handleUpdateQuantity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID   string `json:"user_id"`
+		ItemID   string `json:"item_id"`
+		Quantity *int   `json:"quantity"`
+	}
+
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+	if req.ItemID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("item_id", msgMissingFields))
+		return
+	}
+	if req.Quantity == nil {
+		ms.rejectInvalidRequest(w, r, constraintViolation("quantity", msgMissingFields))
+		return
+	}
+	ms.setQuantity(w, r, req.UserID, req.ItemID, *req.Quantity)
+}
+
+// setQuantity sets an item's quantity in the user's cart and writes the
+// response
+func (ms *MetricsServer) setQuantity(w http.ResponseWriter, r *http.Request, userID, itemID string, quantity int) {
+	err := ms.service.UpdateQuantity(r.Context(), userID, itemID, quantity)
+	if errors.Is(err, ErrCartNotFound) {
+		writeError(w, r, http.StatusNotFound, msgCartNotFound, userID)
+		return
+	}
+	if err != nil {
+		ms.writeServiceError(w, r, err, itemID)
+		return
+	}
+
+	writeJSON(w, r, map[string]string{"status": "success"})
 }
 
 func (ms *MetricsServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	json.NewEncoder(w).Encode(ms.healthSnapshot())
+}
+
+// healthSnapshot reports the current health status of the service
+func (ms *MetricsServer) healthSnapshot() map[string]string {
+	snapshot := map[string]string{
 		"status":    "healthy",
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 		"service":   "shopping-cart-service",
-	})
+	}
+	// A degraded store still serves, so it doesn't fail the probe
+	if ms.service.degradation != nil {
+		snapshot["storage"] = "ok"
+		if ms.service.degradation.isDegraded() {
+			snapshot["storage"] = "degraded"
+		}
+	}
+	return snapshot
 }
 
 func (ms *MetricsServer) handleSimulateError(w http.ResponseWriter, r *http.Request) {
@@ -458,91 +1469,208 @@ func (ms *MetricsServer) handleSimulateError(w http.ResponseWriter, r *http.Requ
 	errorTypes := []int{400, 401, 403, 404, 500, 502, 503}
 	statusCode := errorTypes[rand.Intn(len(errorTypes))]
 
-	http.Error(w, fmt.Sprintf("Simulated error with status %d", statusCode), statusCode)
+	writeError(w, r, statusCode, msgSimulatedError, statusCode)
 }
 
-// Start starts the HTTP server
+// Start starts the HTTP server, and the ops server when configured. It
+// returns the first server's error, http.ErrServerClosed after Shutdown.
 func (ms *MetricsServer) Start() error {
-	log.Printf("Starting server on %s", ms.server.Addr)
-	log.Printf("Metrics available at http://localhost%s/metrics", ms.server.Addr)
-	log.Printf("Health check at http://localhost%s/health", ms.server.Addr)
-	return ms.server.ListenAndServe()
+	if ms.ops == nil {
+		slog.Info("Starting server", "address", ms.server.Addr,
+			"metrics", "http://localhost"+ms.server.Addr+"/metrics",
+			"health", "http://localhost"+ms.server.Addr+"/health")
+		return ms.server.ListenAndServe()
+	}
+
+	slog.Info("Starting server", "address", ms.server.Addr, "ops_address", ms.ops.Addr,
+		"metrics", "http://localhost"+ms.ops.Addr+"/metrics",
+		"health", "http://localhost"+ms.ops.Addr+"/health")
+	serveErr := make(chan error, 2)
+	go func() { serveErr <- ms.ops.ListenAndServe() }()
+	go func() { serveErr <- ms.server.ListenAndServe() }()
+	return <-serveErr
 }
 
-// simulateTraffic generates sample traffic for demonstration
-func simulateTraffic(baseURL string) {
-	go func() {
-		time.Sleep(5 * time.Second) // Wait for server to start
+func main() {
+	// SIGINT/SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Subcommands query a running instance instead of starting one
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(ctx, os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
-		client := &http.Client{Timeout: 10 * time.Second}
-		userIDs := []string{"user1", "user2", "user3", "user4", "user5"}
+	// Defaults < --config YAML file < environment < command-line flags
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if err := setupLogging(cfg.Log); err != nil {
+		fatal("Invalid log level", "error", err)
+	}
 
-		items := []CartItem{
-			{ID: "item1", Name: "Widget A", Price: 19.99, Quantity: 1},
-			{ID: "item2", Name: "Widget B", Price: 29.99, Quantity: 2},
-			{ID: "item3", Name: "Widget C", Price: 39.99, Quantity: 1},
-			{ID: "item4", Name: "Widget D", Price: 49.99, Quantity: 3},
-		}
+	// Size the Go runtime to the container's CPU and memory limits
+	runtimeLimits := applyRuntimeLimits(cfg.Runtime)
+	if cfg.SelfTest {
+		// Only the self-test's own requests should reach the instance, and
+		// simulated dependency failures would make its checks flaky
+		cfg.Simulation.Enabled = false
+		cfg.Simulation.Dependencies.Enabled = false
+	}
 
-		for {
-			// Add items to random user carts
-			userID := userIDs[rand.Intn(len(userIDs))]
-			item := items[rand.Intn(len(items))]
+	// Create cart service with OpenTelemetry metrics
+	service, err := NewCartService(cfg)
+	if err != nil {
+		fatal("Failed to create cart service", "error", err)
+	}
+	if err := runtimeLimits.registerMetrics(); err != nil {
+		fatal("Failed to register runtime limit metrics", "error", err)
+	}
 
-			reqData := map[string]interface{}{
-				"user_id": userID,
-				"item":    item,
-			}
+	// Load per-route caching policy
+	cachePolicy, err := ParseCachePolicy(os.Getenv("CACHE_POLICY"))
+	if err != nil {
+		fatal("Invalid CACHE_POLICY", "error", err)
+	}
 
-			jsonData, _ := json.Marshal(reqData)
-			resp, err := client.Post(baseURL+"/cart/add", "application/json",
-				strings.NewReader(string(jsonData)))
-			if err == nil {
-				resp.Body.Close()
-			}
+	// Optional SigNoz query API integration for /admin/self-check
+	signoz := NewSigNozClient(os.Getenv("SIGNOZ_QUERY_URL"), os.Getenv("SIGNOZ_API_KEY"))
 
-			// Occasionally get cart
-			if rand.Float32() < 0.3 {
-				resp, err := client.Get(fmt.Sprintf("%s/cart/get?user_id=%s", baseURL, userID))
-				if err == nil {
-					resp.Body.Close()
-				}
-			}
+	// Optional GeoIP region enrichment, reloaded when the file changes
+	geoip, err := NewGeoIPResolver(os.Getenv("GEOIP_DATABASE"))
+	if err != nil {
+		fatal("Failed to load GeoIP database", "error", err)
+	}
+	if geoip != nil {
+		go geoip.WatchForChanges(ctx, time.Minute)
+	}
 
-			// Occasionally simulate errors
-			if rand.Float32() < 0.1 {
-				resp, err := client.Get(baseURL + "/simulate-error")
-				if err == nil {
-					resp.Body.Close()
-				}
-			}
+	// Run scheduled jobs such as recurring cart templates
+	go service.scheduler.Run(ctx, 30*time.Second)
 
-			// Health check
-			if rand.Float32() < 0.2 {
-				resp, err := client.Get(baseURL + "/health")
-				if err == nil {
-					resp.Body.Close()
-				}
-			}
+	// Replay buffered cart changes once a degraded store recovers
+	go service.RunStoreRecovery(ctx)
 
-			time.Sleep(time.Duration(rand.Intn(1000)+500) * time.Millisecond)
-		}
-	}()
-}
+	// Remove carts idle for longer than the cart TTL
+	go service.RunCartReaper(ctx, cfg.Carts.ReapInterval)
 
-func main() {
-	// Create cart service with OpenTelemetry metrics
-	service, err := NewCartService()
+	// Feed the event log to the projections and the events webhook
+	go service.consumers.Run(ctx)
+
+	// Suggest better buckets for poorly bucketed latency histograms
+	go service.bucketAdvisor.Run(ctx)
+
+	// Push pprof profiles to PROFILING_ENDPOINT when set
+	profiler, err := NewContinuousProfiler(cfg.Telemetry.Profiling)
+	if err != nil {
+		fatal("Failed to create continuous profiler", "error", err)
+	}
+	go profiler.Run(ctx)
+
+	// Middleware order per route group, e.g. "default=metrics,chaos,cache;catalog=metrics,compression,cache"
+	pipelines, err := ParseMiddlewarePipelines(os.Getenv("MIDDLEWARE_PIPELINE"))
+	if err != nil {
+		fatal("Invalid MIDDLEWARE_PIPELINE", "error", err)
+	}
+	cors := NewCORSPolicy(os.Getenv("CORS_ALLOWED_ORIGINS"))
+
+	// Token buckets per caller by route prefix
+	limiter, err := NewRateLimiter(cfg.RateLimits)
+	if err != nil {
+		fatal("Failed to create rate limiter", "error", err)
+	}
+
+	// Proxies whose X-Forwarded-For names the client
+	proxies, err := ParseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		fatal("Invalid trusted proxies", "error", err)
+	}
+
+	// API key and JWT authentication of the application APIs, when enabled
+	auth, err := NewAuthenticator(cfg.Auth)
+	if err != nil {
+		fatal("Failed to create authenticator", "error", err)
+	}
+
+	// Session traces stitching each client session's requests together,
+	// when enabled
+	sessions, err := NewSessionTracer(cfg.Telemetry.SessionTraces)
 	if err != nil {
-		log.Fatalf("Failed to create cart service: %v", err)
+		fatal("Failed to create session tracer", "error", err)
+	}
+	go sessions.Run(ctx)
+
+	// Business context copied from requests onto their spans
+	enricher := NewSpanEnricher(cfg.Telemetry.SpanAttributes)
+
+	// Built-in traffic generator; created even when disabled so
+	// /admin/loadgen can turn it on
+	generator, err := newLoadGenerator(cfg)
+	if err != nil {
+		fatal("Failed to create traffic generator", "error", err)
+	}
+	go generator.Run(ctx)
+
+	// Request recorder; /admin/recordings/settings turns capture on and off
+	recorder, err := NewRequestRecorder(cfg.Recording)
+	if err != nil {
+		fatal("Failed to create request recorder", "error", err)
+	}
+
+	// Optional shadow traffic to a secondary target such as a canary
+	mirror, err := NewTrafficMirror(cfg.Mirror)
+	if err != nil {
+		fatal("Failed to create traffic mirror", "error", err)
+	}
+
+	// Latency and error injection; /admin/faults changes it at runtime
+	faults, err := NewFaultInjector(ambientFaults)
+	if err != nil {
+		fatal("Failed to create fault injector", "error", err)
 	}
 
 	// Create HTTP server
-	server := NewMetricsServer(service, "8080")
+	server := NewMetricsServer(service, cfg.Server.Port, cfg.Server.OpsPort, cachePolicy, pipelines, cors, signoz, geoip, generator, recorder, mirror, limiter, faults, auth, sessions, enricher, proxies, cfg.Server.AdminToken)
+
+	// Prime caches and exercise the request paths once the startup
+	// dependencies have loaded, so the first requests after a deploy
+	// don't pay for the cold start
+	if cfg.Warmup.Enabled {
+		service.readiness.RequireWarmup("warmup", newWarmer(cfg.Warmup, server, cfg.Simulation.APIKey).run)
+	}
+
+	// Load the catalog and other startup dependencies; /ready reports 503
+	// until they have
+	go service.readiness.Run(ctx)
+
+	// Smoke-test the instance and exit, e.g. as a deployment gate
+	if cfg.SelfTest {
+		if err := runSelfTest(ctx, cfg, server, service); err != nil {
+			fatal("Self-test failed", "error", err)
+		}
+		slog.Info("Self-test passed")
+		return
+	}
 
-	// Start traffic simulation
-	simulateTraffic("http://localhost:8080")
+	// gRPC API on its own port
+	var grpcServer *GRPCServer
+	if cfg.Server.GRPCPort != "" {
+		grpcServer, err = NewGRPCServer(service, cfg.Server.GRPCPort, cfg.Telemetry.HistogramBuckets, auth)
+		if err != nil {
+			fatal("Failed to create gRPC server", "error", err)
+		}
+	}
 
-	// Start server
-	log.Fatal(server.Start())
+	// Serve until a shutdown signal, then drain and flush telemetry
+	if err := serveUntilDone(ctx, server, grpcServer, service, cfg.Server.ShutdownTimeout); err != nil {
+		fatal("Server failed", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
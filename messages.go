@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sentinel errors returned by the service layer. Handlers map them to
+// localized messages instead of echoing err.Error() to clients.
+var (
+	ErrCartNotFound      = errors.New("cart not found")
+	ErrItemNotFound      = errors.New("item not found")
+	ErrProductNotFound   = errors.New("product not found")
+	ErrInsufficientStock = errors.New("insufficient stock")
+)
+
+// Message keys for user-facing error strings
+const (
+	msgMethodNotAllowed     = "method_not_allowed"
+	msgInvalidJSON          = "invalid_json"
+	msgMissingFields        = "missing_fields"
+	msgMissingParameter     = "missing_parameter"
+	msgInvalidParameter     = "invalid_parameter"
+	msgUnknownField         = "unknown_field"
+	msgInvalidFieldType     = "invalid_field_type"
+	msgInvalidFieldValue    = "invalid_field_value"
+	msgCartNotFound         = "cart_not_found"
+	msgItemNotFound         = "item_not_found"
+	msgProductNotFound      = "product_not_found"
+	msgRequestNotFound      = "request_not_found"
+	msgInvalidShareToken    = "invalid_share_token"
+	msgShareTokenExpired    = "share_token_expired"
+	msgTemplateNotFound     = "template_not_found"
+	msgInsufficientStock    = "insufficient_stock"
+	msgEmptyCart            = "empty_cart"
+	msgCheckoutRejected     = "checkout_rejected"
+	msgCartOutOfStock       = "cart_out_of_stock"
+	msgNoShippingTier       = "no_shipping_tier"
+	msgCartLocked           = "cart_locked"
+	msgCartConflict         = "cart_conflict"
+	msgCheckoutTimeout      = "checkout_timeout"
+	msgInvalidQuote         = "invalid_quote"
+	msgQuoteExpired         = "quote_expired"
+	msgQuoteMismatch        = "quote_mismatch"
+	msgOrderNotFound        = "order_not_found"
+	msgReturnNotFound       = "return_not_found"
+	msgInvalidTransition    = "invalid_transition"
+	msgProfileNotFound      = "profile_not_found"
+	msgAddressNotFound      = "address_not_found"
+	msgAddressLimit         = "address_limit"
+	msgInvalidAddress       = "invalid_address"
+	msgItemRejected         = "item_rejected"
+	msgUnauthorized         = "unauthorized"
+	msgAdminDisabled        = "admin_disabled"
+	msgUnauthenticated      = "unauthenticated"
+	msgForbiddenUser        = "forbidden_user"
+	msgConflictingUser      = "conflicting_user"
+	msgNotReady             = "not_ready"
+	msgShuttingDown         = "shutting_down"
+	msgBucketAdvisorOff     = "bucket_advisor_off"
+	msgBatchRejected        = "batch_rejected"
+	msgStoreUnavailable     = "store_unavailable"
+	msgIdempotencyKeyReused = "idempotency_key_reused"
+	msgRateLimited          = "rate_limited"
+	msgRestoreUnavailable   = "restore_unavailable"
+	msgRestoreOutOfRange    = "restore_out_of_range"
+	msgNoStagedRestore      = "no_staged_restore"
+	msgUnknownNamespace     = "unknown_namespace"
+	msgMissingTenant        = "missing_tenant"
+	msgInvalidTenant        = "invalid_tenant"
+	msgConsumerNotFound     = "consumer_not_found"
+	msgNotAProjection       = "not_a_projection"
+	msgRebuildInProgress    = "rebuild_in_progress"
+	msgFaultNotFound        = "fault_not_found"
+	msgDependencyFailed     = "dependency_failed"
+	msgSimulatedError       = "simulated_error"
+	msgInternalError        = "internal_error"
+)
+
+// defaultLanguage is used when no Accept-Language entry is supported
+const defaultLanguage = "en"
+
+// messageCatalog holds format strings per language and message key.
+// Every key must exist in the default language.
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		msgMethodNotAllowed:     "Method not allowed",
+		msgInvalidJSON:          "Invalid JSON",
+		msgMissingFields:        "Missing required fields",
+		msgMissingParameter:     "Missing %s parameter",
+		msgInvalidParameter:     "Invalid %s parameter",
+		msgUnknownField:         "Unknown field %s",
+		msgInvalidFieldType:     "Invalid type for field %s",
+		msgInvalidFieldValue:    "Invalid value for field %s",
+		msgCartNotFound:         "Cart not found for user %s",
+		msgItemNotFound:         "Item %s not found in cart",
+		msgProductNotFound:      "Product %s not found",
+		msgRequestNotFound:      "Request %s not found",
+		msgInvalidShareToken:    "Invalid share link",
+		msgShareTokenExpired:    "Share link has expired",
+		msgTemplateNotFound:     "Template %s not found",
+		msgInsufficientStock:    "Not enough stock for %s; subscribe at /catalog/subscriptions to be notified when it is back",
+		msgEmptyCart:            "Cart is empty",
+		msgCheckoutRejected:     "Checkout could not be completed; please contact support",
+		msgCartOutOfStock:       "Some items in the cart are no longer in stock",
+		msgNoShippingTier:       "The cart is too heavy to ship",
+		msgCartLocked:           "Cart is locked while a checkout is in progress",
+		msgCartConflict:         "Cart was changed by another request; please try again",
+		msgCheckoutTimeout:      "Checkout timed out; please try again",
+		msgInvalidQuote:         "Invalid quote token",
+		msgQuoteExpired:         "Quote has expired; request a new quote",
+		msgQuoteMismatch:        "Cart changed since the quote; request a new quote",
+		msgOrderNotFound:        "Order %s not found",
+		msgReturnNotFound:       "Return %s not found",
+		msgInvalidTransition:    "Cannot %s this return in its current state",
+		msgProfileNotFound:      "Profile not found for user %s",
+		msgAddressNotFound:      "Address %s not found",
+		msgAddressLimit:         "At most %d saved addresses are allowed",
+		msgInvalidAddress:       "Shipping address is invalid: check %s",
+		msgItemRejected:         "Item %s cannot be added to the cart",
+		msgUnauthorized:         "A valid admin token is required",
+		msgAdminDisabled:        "Admin token is not configured on this instance",
+		msgUnauthenticated:      "A valid API key or bearer token is required",
+		msgForbiddenUser:        "These credentials can't act on user %s",
+		msgConflictingUser:      "The body names a different user than the URL",
+		msgNotReady:             "Service is starting up; retry shortly",
+		msgShuttingDown:         "Service is shutting down; retry shortly",
+		msgBucketAdvisorOff:     "The histogram bucket advisor is off (BUCKET_ADVISOR_MODE)",
+		msgBatchRejected:        "%d of the items were rejected, so none were added",
+		msgStoreUnavailable:     "Cart storage is temporarily unavailable; please retry",
+		msgIdempotencyKeyReused: "Idempotency-Key was already used with a different request",
+		msgRateLimited:          "Too many requests; retry after the time in Retry-After",
+		msgRestoreUnavailable:   "Point-in-time restore needs a write-ahead log (STORE_WAL_DIR)",
+		msgRestoreOutOfRange:    "Cart history doesn't reach back to %s",
+		msgNoStagedRestore:      "No restore is staged",
+		msgUnknownNamespace:     "Unknown namespace %s",
+		msgMissingTenant:        "Missing tenant; name it in the %s header",
+		msgInvalidTenant:        "Invalid tenant %s",
+		msgConsumerNotFound:     "Event consumer %s not found",
+		msgNotAProjection:       "Event consumer %s is not a projection and can't be rebuilt",
+		msgRebuildInProgress:    "A rebuild of %s is already in progress",
+		msgFaultNotFound:        "No fault is injected into %s",
+		msgDependencyFailed:     "The %s service is temporarily unavailable; please retry",
+		msgSimulatedError:       "Simulated error with status %d",
+		msgInternalError:        "Internal server error",
+	},
+	"es": {
+		msgMethodNotAllowed:     "Método no permitido",
+		msgInvalidJSON:          "JSON no válido",
+		msgMissingFields:        "Faltan campos obligatorios",
+		msgMissingParameter:     "Falta el parámetro %s",
+		msgInvalidParameter:     "El parámetro %s no es válido",
+		msgUnknownField:         "Campo desconocido %s",
+		msgInvalidFieldType:     "Tipo no válido para el campo %s",
+		msgInvalidFieldValue:    "Valor no válido para el campo %s",
+		msgCartNotFound:         "No se encontró el carrito del usuario %s",
+		msgItemNotFound:         "El artículo %s no está en el carrito",
+		msgProductNotFound:      "No se encontró el producto %s",
+		msgRequestNotFound:      "No se encontró la solicitud %s",
+		msgInvalidShareToken:    "Enlace para compartir no válido",
+		msgShareTokenExpired:    "El enlace para compartir ha caducado",
+		msgTemplateNotFound:     "Plantilla %s no encontrada",
+		msgInsufficientStock:    "No hay existencias suficientes de %s; suscríbase en /catalog/subscriptions para recibir un aviso cuando vuelva a estar disponible",
+		msgEmptyCart:            "El carrito está vacío",
+		msgCheckoutRejected:     "No se pudo completar la compra; póngase en contacto con soporte",
+		msgCartOutOfStock:       "Algunos artículos del carrito ya no están disponibles",
+		msgNoShippingTier:       "El carrito es demasiado pesado para enviarlo",
+		msgCartLocked:           "El carrito está bloqueado mientras se procesa una compra",
+		msgCartConflict:         "Otra solicitud modificó el carrito; inténtelo de nuevo",
+		msgCheckoutTimeout:      "La compra ha excedido el tiempo de espera; inténtelo de nuevo",
+		msgInvalidQuote:         "Token de cotización no válido",
+		msgQuoteExpired:         "La cotización ha caducado; solicite una nueva",
+		msgQuoteMismatch:        "El carrito cambió después de la cotización; solicite una nueva",
+		msgOrderNotFound:        "Pedido %s no encontrado",
+		msgReturnNotFound:       "Devolución %s no encontrada",
+		msgInvalidTransition:    "No se puede aplicar %s a esta devolución en su estado actual",
+		msgProfileNotFound:      "Perfil no encontrado para el usuario %s",
+		msgAddressNotFound:      "Dirección %s no encontrada",
+		msgAddressLimit:         "Se permiten como máximo %d direcciones guardadas",
+		msgInvalidAddress:       "La dirección de envío no es válida: revise %s",
+		msgItemRejected:         "El artículo %s no se puede añadir al carrito",
+		msgUnauthorized:         "Se requiere un token de administrador válido",
+		msgAdminDisabled:        "El token de administrador no está configurado en esta instancia",
+		msgUnauthenticated:      "Se requiere una clave de API o un token bearer válido",
+		msgForbiddenUser:        "Estas credenciales no pueden actuar sobre el usuario %s",
+		msgConflictingUser:      "El cuerpo indica un usuario distinto al de la URL",
+		msgNotReady:             "El servicio se está iniciando; inténtelo de nuevo en breve",
+		msgShuttingDown:         "El servicio se está deteniendo; inténtelo de nuevo en breve",
+		msgBucketAdvisorOff:     "El asesor de intervalos de histogramas está desactivado (BUCKET_ADVISOR_MODE)",
+		msgBatchRejected:        "Se rechazaron %d de los artículos, así que no se añadió ninguno",
+		msgStoreUnavailable:     "El almacenamiento de carritos no está disponible temporalmente; inténtelo de nuevo",
+		msgIdempotencyKeyReused: "La Idempotency-Key ya se usó con una solicitud diferente",
+		msgRateLimited:          "Demasiadas solicitudes; vuelva a intentarlo tras el tiempo indicado en Retry-After",
+		msgRestoreUnavailable:   "La restauración a un momento dado requiere un registro de escritura anticipada (STORE_WAL_DIR)",
+		msgRestoreOutOfRange:    "El historial de carritos no llega hasta %s",
+		msgNoStagedRestore:      "No hay ninguna restauración preparada",
+		msgUnknownNamespace:     "Espacio de nombres %s desconocido",
+		msgMissingTenant:        "Falta el inquilino; indíquelo en la cabecera %s",
+		msgInvalidTenant:        "Inquilino %s no válido",
+		msgConsumerNotFound:     "No se encontró el consumidor de eventos %s",
+		msgNotAProjection:       "El consumidor de eventos %s no es una proyección y no se puede reconstruir",
+		msgRebuildInProgress:    "Ya hay una reconstrucción de %s en curso",
+		msgFaultNotFound:        "No hay ningún fallo inyectado en %s",
+		msgDependencyFailed:     "El servicio %s no está disponible temporalmente; inténtelo de nuevo",
+		msgSimulatedError:       "Error simulado con estado %d",
+		msgInternalError:        "Error interno del servidor",
+	},
+	"de": {
+		msgMethodNotAllowed:     "Methode nicht erlaubt",
+		msgInvalidJSON:          "Ungültiges JSON",
+		msgMissingFields:        "Pflichtfelder fehlen",
+		msgMissingParameter:     "Parameter %s fehlt",
+		msgInvalidParameter:     "Ungültiger Parameter %s",
+		msgUnknownField:         "Unbekanntes Feld %s",
+		msgInvalidFieldType:     "Ungültiger Typ für Feld %s",
+		msgInvalidFieldValue:    "Ungültiger Wert für Feld %s",
+		msgCartNotFound:         "Warenkorb für Benutzer %s nicht gefunden",
+		msgItemNotFound:         "Artikel %s nicht im Warenkorb gefunden",
+		msgProductNotFound:      "Produkt %s nicht gefunden",
+		msgRequestNotFound:      "Anfrage %s nicht gefunden",
+		msgInvalidShareToken:    "Ungültiger Freigabelink",
+		msgShareTokenExpired:    "Der Freigabelink ist abgelaufen",
+		msgTemplateNotFound:     "Vorlage %s nicht gefunden",
+		msgInsufficientStock:    "Nicht genügend Bestand für %s; abonnieren Sie /catalog/subscriptions, um benachrichtigt zu werden, sobald der Artikel wieder verfügbar ist",
+		msgEmptyCart:            "Der Warenkorb ist leer",
+		msgCheckoutRejected:     "Der Bestellvorgang konnte nicht abgeschlossen werden; bitte wenden Sie sich an den Support",
+		msgCartOutOfStock:       "Einige Artikel im Warenkorb sind nicht mehr vorrätig",
+		msgNoShippingTier:       "Der Warenkorb ist zu schwer für den Versand",
+		msgCartLocked:           "Der Warenkorb ist während eines laufenden Bestellvorgangs gesperrt",
+		msgCartConflict:         "Der Warenkorb wurde von einer anderen Anfrage geändert; bitte erneut versuchen",
+		msgCheckoutTimeout:      "Zeitüberschreitung beim Bestellvorgang; bitte versuchen Sie es erneut",
+		msgInvalidQuote:         "Ungültiges Angebotstoken",
+		msgQuoteExpired:         "Das Angebot ist abgelaufen; fordern Sie ein neues an",
+		msgQuoteMismatch:        "Der Warenkorb hat sich seit dem Angebot geändert; fordern Sie ein neues an",
+		msgOrderNotFound:        "Bestellung %s nicht gefunden",
+		msgReturnNotFound:       "Rücksendung %s nicht gefunden",
+		msgInvalidTransition:    "Aktion %s ist für diese Rücksendung im aktuellen Status nicht möglich",
+		msgProfileNotFound:      "Profil für Benutzer %s nicht gefunden",
+		msgAddressNotFound:      "Adresse %s nicht gefunden",
+		msgAddressLimit:         "Es sind höchstens %d gespeicherte Adressen erlaubt",
+		msgInvalidAddress:       "Die Lieferadresse ist ungültig: %s prüfen",
+		msgItemRejected:         "Artikel %s kann nicht in den Warenkorb gelegt werden",
+		msgUnauthorized:         "Ein gültiges Admin-Token ist erforderlich",
+		msgAdminDisabled:        "Auf dieser Instanz ist kein Admin-Token konfiguriert",
+		msgUnauthenticated:      "Ein gültiger API-Schlüssel oder Bearer-Token ist erforderlich",
+		msgForbiddenUser:        "Diese Anmeldedaten dürfen nicht für Benutzer %s handeln",
+		msgConflictingUser:      "Der Body nennt einen anderen Benutzer als die URL",
+		msgNotReady:             "Der Dienst wird gestartet; bitte gleich erneut versuchen",
+		msgShuttingDown:         "Der Dienst wird beendet; bitte gleich erneut versuchen",
+		msgBucketAdvisorOff:     "Der Histogramm-Bucket-Berater ist ausgeschaltet (BUCKET_ADVISOR_MODE)",
+		msgBatchRejected:        "%d der Artikel wurden abgelehnt, daher wurde keiner hinzugefügt",
+		msgStoreUnavailable:     "Der Warenkorbspeicher ist vorübergehend nicht verfügbar; bitte erneut versuchen",
+		msgIdempotencyKeyReused: "Der Idempotency-Key wurde bereits für eine andere Anfrage verwendet",
+		msgRateLimited:          "Zu viele Anfragen; nach der in Retry-After angegebenen Zeit erneut versuchen",
+		msgRestoreUnavailable:   "Die Wiederherstellung zu einem Zeitpunkt erfordert ein Write-Ahead-Log (STORE_WAL_DIR)",
+		msgRestoreOutOfRange:    "Der Warenkorbverlauf reicht nicht bis %s zurück",
+		msgNoStagedRestore:      "Es ist keine Wiederherstellung vorbereitet",
+		msgUnknownNamespace:     "Unbekannter Namespace %s",
+		msgMissingTenant:        "Mandant fehlt; geben Sie ihn im Header %s an",
+		msgInvalidTenant:        "Ungültiger Mandant %s",
+		msgConsumerNotFound:     "Event-Consumer %s nicht gefunden",
+		msgNotAProjection:       "Event-Consumer %s ist keine Projektion und kann nicht neu aufgebaut werden",
+		msgRebuildInProgress:    "Ein Neuaufbau von %s läuft bereits",
+		msgFaultNotFound:        "In %s ist kein Fehler injiziert",
+		msgDependencyFailed:     "Der Dienst %s ist vorübergehend nicht verfügbar; bitte erneut versuchen",
+		msgSimulatedError:       "Simulierter Fehler mit Status %d",
+		msgInternalError:        "Interner Serverfehler",
+	},
+	"fr": {
+		msgMethodNotAllowed:     "Méthode non autorisée",
+		msgInvalidJSON:          "JSON invalide",
+		msgMissingFields:        "Champs obligatoires manquants",
+		msgMissingParameter:     "Paramètre %s manquant",
+		msgInvalidParameter:     "Paramètre %s invalide",
+		msgUnknownField:         "Champ inconnu %s",
+		msgInvalidFieldType:     "Type invalide pour le champ %s",
+		msgInvalidFieldValue:    "Valeur invalide pour le champ %s",
+		msgCartNotFound:         "Panier introuvable pour l'utilisateur %s",
+		msgItemNotFound:         "Article %s introuvable dans le panier",
+		msgProductNotFound:      "Produit %s introuvable",
+		msgRequestNotFound:      "Requête %s introuvable",
+		msgInvalidShareToken:    "Lien de partage invalide",
+		msgShareTokenExpired:    "Le lien de partage a expiré",
+		msgTemplateNotFound:     "Modèle %s introuvable",
+		msgInsufficientStock:    "Stock insuffisant pour %s ; abonnez-vous via /catalog/subscriptions pour être averti de son retour",
+		msgEmptyCart:            "Le panier est vide",
+		msgCheckoutRejected:     "La commande n'a pas pu être finalisée ; veuillez contacter le support",
+		msgCartOutOfStock:       "Certains articles du panier ne sont plus en stock",
+		msgNoShippingTier:       "Le panier est trop lourd pour être expédié",
+		msgCartLocked:           "Le panier est verrouillé pendant une commande en cours",
+		msgCartConflict:         "Le panier a été modifié par une autre requête ; veuillez réessayer",
+		msgCheckoutTimeout:      "La commande a expiré ; veuillez réessayer",
+		msgInvalidQuote:         "Jeton de devis invalide",
+		msgQuoteExpired:         "Le devis a expiré ; demandez-en un nouveau",
+		msgQuoteMismatch:        "Le panier a changé depuis le devis ; demandez-en un nouveau",
+		msgOrderNotFound:        "Commande %s introuvable",
+		msgReturnNotFound:       "Retour %s introuvable",
+		msgInvalidTransition:    "Impossible d'appliquer %s à ce retour dans son état actuel",
+		msgProfileNotFound:      "Profil introuvable pour l'utilisateur %s",
+		msgAddressNotFound:      "Adresse %s introuvable",
+		msgAddressLimit:         "Au plus %d adresses enregistrées sont autorisées",
+		msgInvalidAddress:       "L'adresse de livraison est invalide : vérifiez %s",
+		msgItemRejected:         "L'article %s ne peut pas être ajouté au panier",
+		msgUnauthorized:         "Un jeton d'administration valide est requis",
+		msgAdminDisabled:        "Aucun jeton d'administration n'est configuré sur cette instance",
+		msgUnauthenticated:      "Une clé d'API ou un jeton bearer valide est requis",
+		msgForbiddenUser:        "Ces identifiants ne peuvent pas agir pour l'utilisateur %s",
+		msgConflictingUser:      "Le corps désigne un autre utilisateur que l'URL",
+		msgNotReady:             "Le service démarre ; réessayez dans un instant",
+		msgShuttingDown:         "Le service s'arrête ; réessayez dans un instant",
+		msgBucketAdvisorOff:     "Le conseiller de seuils d'histogrammes est désactivé (BUCKET_ADVISOR_MODE)",
+		msgBatchRejected:        "%d des articles ont été refusés, aucun n'a donc été ajouté",
+		msgStoreUnavailable:     "Le stockage des paniers est temporairement indisponible ; veuillez réessayer",
+		msgIdempotencyKeyReused: "L'Idempotency-Key a déjà été utilisée pour une autre requête",
+		msgRateLimited:          "Trop de requêtes ; réessayez après le délai indiqué par Retry-After",
+		msgRestoreUnavailable:   "La restauration à un instant donné nécessite un journal d'écriture anticipée (STORE_WAL_DIR)",
+		msgRestoreOutOfRange:    "L'historique des paniers ne remonte pas jusqu'à %s",
+		msgNoStagedRestore:      "Aucune restauration n'est préparée",
+		msgUnknownNamespace:     "Espace de noms %s inconnu",
+		msgMissingTenant:        "Locataire manquant ; indiquez-le dans l'en-tête %s",
+		msgInvalidTenant:        "Locataire %s invalide",
+		msgConsumerNotFound:     "Consommateur d'événements %s introuvable",
+		msgNotAProjection:       "Le consommateur d'événements %s n'est pas une projection et ne peut pas être reconstruit",
+		msgRebuildInProgress:    "Une reconstruction de %s est déjà en cours",
+		msgFaultNotFound:        "Aucune panne n'est injectée dans %s",
+		msgDependencyFailed:     "Le service %s est temporairement indisponible ; veuillez réessayer",
+		msgSimulatedError:       "Erreur simulée avec le statut %d",
+		msgInternalError:        "Erreur interne du serveur",
+	},
+}
+
+// negotiateLanguage picks the best supported language from an
+// Accept-Language header, falling back to English
+func negotiateLanguage(header string) string {
+	type candidate struct {
+		tag     string
+		quality float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		candidates = append(candidates, candidate{tag: tag, quality: quality})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+
+	for _, c := range candidates {
+		// Match on the primary subtag so "es-MX" resolves to "es"
+		primary, _, _ := strings.Cut(c.tag, "-")
+		if _, ok := messageCatalog[primary]; ok {
+			return primary
+		}
+	}
+
+	return defaultLanguage
+}
+
+// localize renders a message in the given language with English fallback
+func localize(lang, key string, args ...interface{}) string {
+	format, ok := messageCatalog[lang][key]
+	if !ok {
+		format = messageCatalog[defaultLanguage][key]
+	}
+	// Callers mapping errors generically pass the same arguments to every
+	// message, so extra ones are dropped rather than rendered as %!(EXTRA)
+	if verbs := strings.Count(format, "%") - 2*strings.Count(format, "%%"); len(args) > verbs {
+		args = args[:verbs]
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// writeError writes a localized JSON error envelope for the request's
+// Accept-Language preference
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, key string, args ...interface{}) {
+	writeErrorEnvelope(w, r, statusCode, key, "", args...)
+}
+
+// writeFieldError writes a validation error about one request field, which
+// the envelope names and the message takes as its argument
+func writeFieldError(w http.ResponseWriter, r *http.Request, statusCode int, key, field string) {
+	writeErrorEnvelope(w, r, statusCode, key, field, field)
+}
+
+// writeErrorEnvelope writes the ErrorEnvelope of every error response and
+// records the error on the request and its span
+func writeErrorEnvelope(w http.ResponseWriter, r *http.Request, statusCode int, key, field string, args ...interface{}) {
+	envelope := newErrorEnvelope(w, r, statusCode, key, field, args...)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(envelope)
+}
+
+// newErrorEnvelope localizes the envelope of an error response, records
+// the error on the request and its span and sets the response headers,
+// leaving the status and body to the caller
+func newErrorEnvelope(w http.ResponseWriter, r *http.Request, statusCode int, key, field string, args ...interface{}) ErrorEnvelope {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	message := localize(defaultLanguage, key, args...)
+	envelope := ErrorEnvelope{
+		Code:    errorCode(key),
+		Message: localize(lang, key, args...),
+		Field:   field,
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.ErrorMessage = message
+		// Quoted in bug reports, so support can find the request
+		envelope.RequestID = info.ID
+	}
+	trace.SpanFromContext(r.Context()).RecordError(errors.New(message),
+		trace.WithAttributes(
+			attribute.String("error.key", key),
+			attribute.String("error.code", envelope.Code),
+			attribute.Int("http.status_code", statusCode),
+		),
+	)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return envelope
+}
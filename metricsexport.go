@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// metricExporters build the meter provider reader for each exporter name
+var metricExporters = map[string]func(ctx context.Context, telemetry config.TelemetryConfig) (sdkmetric.Reader, error){
+	config.ExporterPrometheus: newPrometheusReader,
+	config.ExporterOTLP:       newOTLPMetricReader,
+}
+
+// newMetricReaders returns the readers for the configured exporters. With
+// none listed, Prometheus is served and OTLP is pushed when an endpoint is
+// configured, matching the service's behavior before exporters were
+// selectable.
+func newMetricReaders(ctx context.Context, telemetry config.TelemetryConfig) ([]sdkmetric.Reader, error) {
+	exporters := telemetry.Metrics.Exporters
+	if len(exporters) == 0 {
+		exporters = []string{config.ExporterPrometheus}
+		if otlpEnabled("METRICS", telemetry.MetricsEndpoint()) {
+			exporters = append(exporters, config.ExporterOTLP)
+		}
+	}
+
+	var readers []sdkmetric.Reader
+	for _, name := range exporters {
+		newReader, ok := metricExporters[name]
+		if !ok {
+			// "none"; config validation rejects anything else
+			continue
+		}
+		reader, err := newReader(ctx, telemetry)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, reader)
+	}
+	return readers, nil
+}
+
+// metricViews returns the meter provider views configured in
+// telemetry.metrics.views, applied to every reader
+func metricViews(views []config.MetricViewConfig) []sdkmetric.View {
+	var built []sdkmetric.View
+	for _, view := range views {
+		stream := sdkmetric.Stream{
+			Name:        view.Rename,
+			Description: view.Description,
+			Aggregation: viewAggregation(view),
+		}
+		if len(view.KeepAttributes) > 0 {
+			stream.AttributeFilter = attributeKeyFilter(view.KeepAttributes, true)
+		} else if len(view.DropAttributes) > 0 {
+			stream.AttributeFilter = attributeKeyFilter(view.DropAttributes, false)
+		}
+		built = append(built, sdkmetric.NewView(sdkmetric.Instrument{Name: view.Instrument}, stream))
+	}
+	return built
+}
+
+// viewAggregation returns the aggregation a view selects, nil keeping the
+// instrument's
+func viewAggregation(view config.MetricViewConfig) sdkmetric.Aggregation {
+	switch view.Aggregation {
+	case config.AggregationDrop:
+		return sdkmetric.AggregationDrop{}
+	case config.AggregationSum:
+		return sdkmetric.AggregationSum{}
+	case config.AggregationLastValue:
+		return sdkmetric.AggregationLastValue{}
+	case config.AggregationHistogram:
+		return sdkmetric.AggregationExplicitBucketHistogram{Boundaries: view.Buckets}
+	case config.AggregationExponentialHistogram:
+		return exponentialHistogram
+	}
+	return nil
+}
+
+// exponentialHistogram uses the SDK's default size and scale limits
+var exponentialHistogram = sdkmetric.AggregationBase2ExponentialHistogram{MaxSize: 160, MaxScale: 20}
+
+// aggregationSelector maps a histogram aggregation preference to a
+// selector, per the OTEL_EXPORTER_OTLP_METRICS_DEFAULT_HISTOGRAM_AGGREGATION
+// definitions. Exponential histograms ignore bucket boundaries set on the
+// instruments; metric views choosing an aggregation still take precedence.
+func aggregationSelector(preference string) sdkmetric.AggregationSelector {
+	if preference != config.HistogramExponential {
+		return sdkmetric.DefaultAggregationSelector
+	}
+	return func(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+		if kind == sdkmetric.InstrumentKindHistogram {
+			return exponentialHistogram
+		}
+		return sdkmetric.DefaultAggregationSelector(kind)
+	}
+}
+
+// attributeKeyFilter keeps the attributes whose keys are listed, or with
+// keep false, those whose keys aren't
+func attributeKeyFilter(keys []string, keep bool) attribute.Filter {
+	listed := make(map[attribute.Key]bool, len(keys))
+	for _, key := range keys {
+		listed[attribute.Key(key)] = true
+	}
+	return func(kv attribute.KeyValue) bool {
+		return listed[kv.Key] == keep
+	}
+}
+
+// newPrometheusReader serves metrics on /metrics
+func newPrometheusReader(_ context.Context, _ config.TelemetryConfig) (sdkmetric.Reader, error) {
+	exporter, err := prometheus.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prometheus exporter: %w", err)
+	}
+	return exporter, nil
+}
+
+// newOTLPMetricReader pushes metrics over OTLP every collection interval.
+// Without an explicit endpoint the exporter reads OTEL_EXPORTER_OTLP_*.
+func newOTLPMetricReader(ctx context.Context, telemetry config.TelemetryConfig) (sdkmetric.Reader, error) {
+	var exporter sdkmetric.Exporter
+	var err error
+	switch telemetry.Metrics.Protocol {
+	case config.ProtocolHTTP:
+		exporter, err = otlpmetrichttp.New(ctx, otlpMetricHTTPOptions(telemetry)...)
+	default:
+		exporter, err = otlpmetricgrpc.New(ctx, otlpMetricGRPCOptions(telemetry)...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	}
+	return sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(telemetry.CollectionInterval)), nil
+}
+
+// otlpMetricGRPCOptions returns the OTLP/gRPC exporter options
+func otlpMetricGRPCOptions(telemetry config.TelemetryConfig) []otlpmetricgrpc.Option {
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithTemporalitySelector(temporalitySelector(telemetry.Metrics.Temporality)),
+		otlpmetricgrpc.WithAggregationSelector(aggregationSelector(telemetry.Metrics.HistogramAggregation)),
+	}
+	if endpoint := telemetry.MetricsEndpoint(); endpoint != "" {
+		host, insecure := otlpTarget(endpoint)
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(host))
+		if insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+	}
+	if len(telemetry.Metrics.Headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(telemetry.Metrics.Headers))
+	}
+	return opts
+}
+
+// otlpMetricHTTPOptions returns the OTLP/HTTP exporter options. An
+// endpoint with a path posts there instead of /v1/metrics.
+func otlpMetricHTTPOptions(telemetry config.TelemetryConfig) []otlpmetrichttp.Option {
+	opts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithTemporalitySelector(temporalitySelector(telemetry.Metrics.Temporality)),
+		otlpmetrichttp.WithAggregationSelector(aggregationSelector(telemetry.Metrics.HistogramAggregation)),
+	}
+	if endpoint := telemetry.MetricsEndpoint(); endpoint != "" {
+		host, insecure := otlpTarget(endpoint)
+		opts = append(opts, otlpmetrichttp.WithEndpoint(host))
+		if insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if u, err := url.Parse(endpoint); err == nil && u.Host != "" && u.Path != "" && u.Path != "/" {
+			opts = append(opts, otlpmetrichttp.WithURLPath(u.Path))
+		}
+	}
+	if len(telemetry.Metrics.Headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(telemetry.Metrics.Headers))
+	}
+	return opts
+}
+
+// temporalitySelector maps a temporality preference to a selector, per the
+// OTEL_EXPORTER_OTLP_METRICS_TEMPORALITY_PREFERENCE definitions
+func temporalitySelector(preference string) sdkmetric.TemporalitySelector {
+	switch preference {
+	case config.TemporalityDelta:
+		return func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch kind {
+			case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindObservableCounter, sdkmetric.InstrumentKindHistogram:
+				return metricdata.DeltaTemporality
+			}
+			return metricdata.CumulativeTemporality
+		}
+	case config.TemporalityLowMemory:
+		return func(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch kind {
+			case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindHistogram:
+				return metricdata.DeltaTemporality
+			}
+			return metricdata.CumulativeTemporality
+		}
+	}
+	return sdkmetric.DefaultTemporalitySelector
+}
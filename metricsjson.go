@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// metricSnapshot is the JSON representation of a single instrument
+type metricSnapshot struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Unit        string          `json:"unit,omitempty"`
+	Scope       string          `json:"scope"`
+	Type        string          `json:"type"`
+	Monotonic   *bool           `json:"monotonic,omitempty"`
+	DataPoints  []dataPointJSON `json:"data_points"`
+}
+
+// dataPointJSON is a flattened data point for any aggregation type
+type dataPointJSON struct {
+	Attributes   map[string]interface{} `json:"attributes"`
+	Value        interface{}            `json:"value,omitempty"`
+	Count        *uint64                `json:"count,omitempty"`
+	Sum          interface{}            `json:"sum,omitempty"`
+	Bounds       []float64              `json:"bounds,omitempty"`
+	BucketCounts []uint64               `json:"bucket_counts,omitempty"`
+	StartTime    time.Time              `json:"start_time"`
+	Time         time.Time              `json:"time"`
+}
+
+// attributesJSON converts an attribute set into a plain map
+func attributesJSON(set attribute.Set) map[string]interface{} {
+	attrs := make(map[string]interface{}, set.Len())
+	for _, kv := range set.ToSlice() {
+		attrs[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return attrs
+}
+
+// sumPointsJSON flattens sum and gauge data points
+func sumPointsJSON[N int64 | float64](points []metricdata.DataPoint[N]) []dataPointJSON {
+	out := make([]dataPointJSON, 0, len(points))
+	for _, point := range points {
+		out = append(out, dataPointJSON{
+			Attributes: attributesJSON(point.Attributes),
+			Value:      point.Value,
+			StartTime:  point.StartTime,
+			Time:       point.Time,
+		})
+	}
+	return out
+}
+
+// histogramPointsJSON flattens explicit-bucket histogram data points
+func histogramPointsJSON[N int64 | float64](points []metricdata.HistogramDataPoint[N]) []dataPointJSON {
+	out := make([]dataPointJSON, 0, len(points))
+	for _, point := range points {
+		count := point.Count
+		out = append(out, dataPointJSON{
+			Attributes:   attributesJSON(point.Attributes),
+			Count:        &count,
+			Sum:          point.Sum,
+			Bounds:       point.Bounds,
+			BucketCounts: point.BucketCounts,
+			StartTime:    point.StartTime,
+			Time:         point.Time,
+		})
+	}
+	return out
+}
+
+// snapshotMetrics converts collected resource metrics into JSON snapshots
+func snapshotMetrics(rm metricdata.ResourceMetrics) []metricSnapshot {
+	var snapshots []metricSnapshot
+
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			snapshot := metricSnapshot{
+				Name:        m.Name,
+				Description: m.Description,
+				Unit:        m.Unit,
+				Scope:       scope.Scope.Name,
+			}
+
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				snapshot.Type = "sum"
+				snapshot.Monotonic = &data.IsMonotonic
+				snapshot.DataPoints = sumPointsJSON(data.DataPoints)
+			case metricdata.Sum[float64]:
+				snapshot.Type = "sum"
+				snapshot.Monotonic = &data.IsMonotonic
+				snapshot.DataPoints = sumPointsJSON(data.DataPoints)
+			case metricdata.Gauge[int64]:
+				snapshot.Type = "gauge"
+				snapshot.DataPoints = sumPointsJSON(data.DataPoints)
+			case metricdata.Gauge[float64]:
+				snapshot.Type = "gauge"
+				snapshot.DataPoints = sumPointsJSON(data.DataPoints)
+			case metricdata.Histogram[int64]:
+				snapshot.Type = "histogram"
+				snapshot.DataPoints = histogramPointsJSON(data.DataPoints)
+			case metricdata.Histogram[float64]:
+				snapshot.Type = "histogram"
+				snapshot.DataPoints = histogramPointsJSON(data.DataPoints)
+			default:
+				snapshot.Type = "unsupported"
+			}
+
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	return snapshots
+}
+
+func (ms *MetricsServer) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := ms.service.metricsReader.Collect(r.Context(), &rm); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to collect metrics snapshot", "error", err)
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timestamp": time.Now().UTC(),
+		"metrics":   snapshotMetrics(rm),
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxMirroredBody caps the request bodies buffered for mirroring; larger
+// requests are served but not mirrored
+const maxMirroredBody = 1 << 20
+
+// maxMirrorsInFlight bounds concurrent shadow requests so a slow shadow
+// can't pile up goroutines; requests beyond it are dropped
+const maxMirrorsInFlight = 64
+
+// mirrorSkippedHeaders are set by the shadow transport rather than copied
+var mirrorSkippedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Traceparent":       true,
+	"Tracestate":        true,
+}
+
+// TrafficMirror duplicates a percentage of live requests to a shadow
+// target, such as a canary build, and compares its status codes with the
+// ones clients got. Shadow responses are otherwise discarded.
+type TrafficMirror struct {
+	target   string  // shadow base URL; empty disables mirroring
+	fraction float64 // of requests mirrored
+	client   *http.Client
+	inFlight chan struct{} // semaphore of maxMirrorsInFlight
+
+	// OpenTelemetry Metrics
+	mirroredCounter   metric.Int64Counter     // Counter: mirrored requests by result
+	divergenceCounter metric.Int64Counter     // Counter: status code mismatches
+	shadowLatency     metric.Float64Histogram // Histogram: shadow response time
+}
+
+// NewTrafficMirror creates the mirror for cfg. It passes requests through
+// untouched when no target is configured.
+func NewTrafficMirror(cfg config.MirrorConfig) (*TrafficMirror, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	tm := &TrafficMirror{
+		target:   strings.TrimSuffix(cfg.TargetURL, "/"),
+		fraction: cfg.Percent / 100,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: otelhttp.NewTransport(outboundPools.transport("mirror")),
+			// Shadow redirects aren't followed; the status is what's compared
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, maxMirrorsInFlight),
+	}
+
+	var err error
+	tm.mirroredCounter, err = meter.Int64Counter(
+		"mirrored_requests_total",
+		metric.WithDescription("Total number of requests mirrored to the shadow target by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mirrored requests counter: %w", err)
+	}
+
+	tm.divergenceCounter, err = meter.Int64Counter(
+		"mirror_status_divergences_total",
+		metric.WithDescription("Total number of mirrored requests whose shadow status code differed from the primary"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mirror divergence counter: %w", err)
+	}
+
+	tm.shadowLatency, err = meter.Float64Histogram(
+		"mirror_shadow_duration_seconds",
+		metric.WithDescription("Shadow target response time for mirrored requests"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mirror latency histogram: %w", err)
+	}
+
+	return tm, nil
+}
+
+// wrap is the mirror middleware. The shadow request is sent after the
+// primary response, so mirroring adds no latency; admin routes are never
+// mirrored.
+func (tm *TrafficMirror) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tm == nil || tm.target == "" || strings.HasPrefix(r.URL.Path, "/admin/") || rand.Float64() >= tm.fraction {
+			handler(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, maxMirroredBody+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if err != nil || len(body) > maxMirroredBody {
+				tm.mirroredCounter.Add(r.Context(), 1, metric.WithAttributes(
+					attribute.String("endpoint", endpointOf(r)),
+					attribute.String("result", "skipped"),
+				))
+				handler(w, r)
+				return
+			}
+		}
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(wrapped, r)
+
+		select {
+		case tm.inFlight <- struct{}{}:
+		default:
+			tm.mirroredCounter.Add(r.Context(), 1, metric.WithAttributes(
+				attribute.String("endpoint", endpointOf(r)),
+				attribute.String("result", "dropped"),
+			))
+			return
+		}
+
+		// The shadow request outlives the primary one but stays in its trace
+		ctx := context.WithoutCancel(r.Context())
+		shadow, err := tm.shadowRequest(ctx, r, body, w.Header().Get("X-Request-ID"))
+		if err != nil {
+			<-tm.inFlight
+			return
+		}
+		go func() {
+			defer func() { <-tm.inFlight }()
+			tm.send(ctx, shadow, endpointOf(r), wrapped.statusCode)
+		}()
+	}
+}
+
+// shadowRequest copies r, with the buffered body, for the shadow target
+func (tm *TrafficMirror) shadowRequest(ctx context.Context, r *http.Request, body []byte, requestID string) (*http.Request, error) {
+	shadow, err := http.NewRequestWithContext(ctx, r.Method, tm.target+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.Header {
+		if !mirrorSkippedHeaders[name] {
+			shadow.Header[name] = append([]string(nil), values...)
+		}
+	}
+	shadow.Header.Set("X-Mirrored-From", requestID)
+	return shadow, nil
+}
+
+// send delivers a shadow request and compares its status with the
+// primary's
+func (tm *TrafficMirror) send(ctx context.Context, shadow *http.Request, endpoint string, primaryStatus int) {
+	start := time.Now()
+	resp, err := tm.client.Do(shadow)
+	if err != nil {
+		tm.mirroredCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", endpoint),
+			attribute.String("result", "error"),
+		))
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	tm.shadowLatency.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("endpoint", endpoint),
+	))
+
+	result := "match"
+	if resp.StatusCode != primaryStatus {
+		result = "diverged"
+		tm.divergenceCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", endpoint),
+			attribute.String("primary_status", strconv.Itoa(primaryStatus)),
+			attribute.String("shadow_status", strconv.Itoa(resp.StatusCode)),
+		))
+	}
+	tm.mirroredCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("endpoint", endpoint),
+		attribute.String("result", result),
+	))
+}
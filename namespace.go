@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// namespaceHeader selects the namespace of a request; a /ns/{namespace}
+// path prefix does the same and takes precedence
+const (
+	namespaceHeader     = "X-Namespace"
+	namespacePathPrefix = "/ns/"
+)
+
+// namespaceKeyPrefix starts the storage keys of carts in declared
+// namespaces, "ns:<namespace>:<user>". Default namespace carts keep the
+// bare user ID, so enabling namespaces leaves existing carts where they are.
+const namespaceKeyPrefix = "ns:"
+
+// Namespace is a logical environment within the instance, such as staging
+// or demo, with its own carts and catalog and optionally its own cart TTL,
+// feature rollouts and cart rules
+type Namespace struct {
+	Name      string
+	catalog   *Catalog
+	cartTTL   *time.Duration   // nil inherits carts.ttl
+	features  *FeatureRollouts // the instance's unless overridden
+	cartRules *CartRules       // the instance's unless overridden
+}
+
+// key returns the storage key of userID's cart in the namespace
+func (n *Namespace) key(userID string) string {
+	if n.Name == config.DefaultNamespace {
+		return userID
+	}
+	return namespaceKeyPrefix + n.Name + ":" + userID
+}
+
+// userOf returns the user whose cart is stored under key, and whether the
+// key belongs to the namespace
+func (n *Namespace) userOf(key string) (string, bool) {
+	if n.Name == config.DefaultNamespace {
+		return key, !strings.HasPrefix(key, namespaceKeyPrefix)
+	}
+	return strings.CutPrefix(key, namespaceKeyPrefix+n.Name+":")
+}
+
+// Namespaces routes requests to the namespace they select
+type Namespaces struct {
+	byName     map[string]*Namespace
+	defaultsTo *Namespace // requests selecting none
+}
+
+// newNamespaces creates the namespaces declared in cfg, each with its own
+// catalog that readiness loads as the dependency catalog:<name>, and with
+// its overrides applied over the instance's features and cart rules.
+// Requests selecting none use the default namespace, which has the
+// instance's settings. It returns nil when none are declared.
+func newNamespaces(cfg *config.Config, catalog *Catalog, readiness *Readiness, features *FeatureRollouts, cartRules *CartRules) (*Namespaces, error) {
+	if len(cfg.Namespaces) == 0 {
+		return nil, nil
+	}
+
+	fallback := &Namespace{Name: config.DefaultNamespace, catalog: catalog, features: features, cartRules: cartRules}
+	ns := &Namespaces{
+		byName:     map[string]*Namespace{fallback.Name: fallback},
+		defaultsTo: fallback,
+	}
+	for _, declared := range cfg.Namespaces {
+		namespace := &Namespace{Name: declared.Name, cartTTL: declared.Overrides.CartTTL, features: features, cartRules: cartRules}
+
+		var err error
+		namespace.catalog, err = newSourcedCatalog(readiness, "catalog:"+declared.Name, declared.CatalogSource)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load catalog of namespace %s: %w", declared.Name, err)
+		}
+		if len(declared.Overrides.Features) > 0 {
+			namespace.features, err = newFeatureRollouts(cfg.NamespaceFeatures(declared), declared.Name)
+			if err != nil {
+				return nil, fmt.Errorf("namespace %s: %w", declared.Name, err)
+			}
+		}
+		if len(declared.Overrides.CartRules) > 0 {
+			namespace.cartRules, err = NewCartRules(cfg.NamespaceCartRules(declared))
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile cart rules of namespace %s: %w", declared.Name, err)
+			}
+		}
+		ns.byName[declared.Name] = namespace
+	}
+	return ns, nil
+}
+
+// ofKey returns the namespace whose cart is stored under key, nil when no
+// namespaces are declared or key names an undeclared one
+func (ns *Namespaces) ofKey(key string) *Namespace {
+	if ns == nil {
+		return nil
+	}
+	rest, found := strings.CutPrefix(key, namespaceKeyPrefix)
+	if !found {
+		return ns.defaultsTo
+	}
+	name, _, _ := strings.Cut(rest, ":")
+	return ns.byName[name]
+}
+
+// expiring reports whether any namespace overrides the cart TTL to expire
+// its carts
+func (ns *Namespaces) expiring() bool {
+	if ns == nil {
+		return false
+	}
+	for _, namespace := range ns.byName {
+		if namespace.cartTTL != nil && *namespace.cartTTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// route serves each request in the namespace it selects, stripping any
+// /ns/{namespace} prefix so routing sees the usual path. Unknown
+// namespaces are rejected with 404. With no namespaces declared requests
+// pass through unscoped.
+func (ns *Namespaces) route(next http.Handler) http.Handler {
+	if ns == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(namespaceHeader)
+		prefixed := false
+		if rest, found := strings.CutPrefix(r.URL.Path, namespacePathPrefix); found {
+			name, _, _ = strings.Cut(rest, "/")
+			prefixed = true
+		}
+
+		namespace := ns.defaultsTo
+		if name != "" {
+			namespace = ns.byName[name]
+		}
+		if namespace == nil {
+			writeError(w, r, http.StatusNotFound, msgUnknownNamespace, name)
+			return
+		}
+
+		r = r.Clone(withNamespace(r.Context(), namespace))
+		if prefixed {
+			// Namespace names need no escaping, so the raw path has the
+			// same prefix
+			prefix := namespacePathPrefix + name
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+		}
+		w.Header().Set(namespaceHeader, namespace.Name)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type namespaceContextKey struct{}
+
+// withNamespace scopes ctx to namespace; nil leaves it unscoped
+func withNamespace(ctx context.Context, namespace *Namespace) context.Context {
+	return context.WithValue(ctx, namespaceContextKey{}, namespace)
+}
+
+// unscoped returns ctx with no namespace or tenant, so the cart store sees
+// every cart under its storage key
+func unscoped(ctx context.Context) context.Context {
+	return withTenant(withNamespace(ctx, nil), nil)
+}
+
+// namespaceFrom returns the namespace ctx is scoped to, nil for background
+// work and when no namespaces are declared
+func namespaceFrom(ctx context.Context) *Namespace {
+	namespace, _ := ctx.Value(namespaceContextKey{}).(*Namespace)
+	return namespace
+}
+
+// namespaceAttributes returns the namespace attribute for the request in
+// ctx. It is omitted entirely when no namespaces are declared.
+func namespaceAttributes(ctx context.Context) []attribute.KeyValue {
+	namespace := namespaceFrom(ctx)
+	if namespace == nil {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.String("namespace", namespace.Name)}
+}
+
+// namespaceCatalog returns the catalog of ctx's namespace, or fallback
+func namespaceCatalog(ctx context.Context, fallback *Catalog) *Catalog {
+	if namespace := namespaceFrom(ctx); namespace != nil {
+		return namespace.catalog
+	}
+	return fallback
+}
+
+// catalogFor returns the catalog of ctx's namespace
+func (cs *CartService) catalogFor(ctx context.Context) *Catalog {
+	return namespaceCatalog(ctx, cs.catalog)
+}
+
+// catalogOfNamespace returns the catalog of the namespace named in an
+// event, the instance's for the default namespace or an undeclared one
+func (cs *CartService) catalogOfNamespace(name string) *Catalog {
+	if cs.namespaces != nil {
+		if namespace, ok := cs.namespaces.byName[name]; ok {
+			return namespace.catalog
+		}
+	}
+	return cs.catalog
+}
+
+// featuresFor returns the feature rollouts of ctx's namespace
+func (cs *CartService) featuresFor(ctx context.Context) *FeatureRollouts {
+	if namespace := namespaceFrom(ctx); namespace != nil {
+		return namespace.features
+	}
+	return cs.features
+}
+
+// cartRulesFor returns the cart rules of ctx's namespace
+func (cs *CartService) cartRulesFor(ctx context.Context) *CartRules {
+	if namespace := namespaceFrom(ctx); namespace != nil {
+		return namespace.cartRules
+	}
+	return cs.cartRules
+}
+
+// cartTTL returns how long the cart stored under key may sit idle: its
+// namespace's override, else carts.ttl
+func (cs *CartService) cartTTL(key string) time.Duration {
+	if namespace := cs.namespaces.ofKey(key); namespace != nil && namespace.cartTTL != nil {
+		return *namespace.cartTTL
+	}
+	return cs.expiry.ttl
+}
+
+// namespacedCartStore keeps each namespace's carts apart in the store it
+// wraps. Calls scoped to a namespace see only its carts, by user ID;
+// unscoped calls, such as the cart reaper's, see every cart by storage key.
+type namespacedCartStore struct {
+	CartStore
+}
+
+func (s namespacedCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	namespace := namespaceFrom(ctx)
+	if namespace == nil {
+		return s.CartStore.Get(ctx, userID)
+	}
+	cart, err := s.CartStore.Get(ctx, namespace.key(userID))
+	if err != nil {
+		return nil, err
+	}
+	cart = cart.clone()
+	cart.UserID = userID
+	return cart, nil
+}
+
+func (s namespacedCartStore) Put(ctx context.Context, cart *Cart) error {
+	namespace := namespaceFrom(ctx)
+	if namespace == nil {
+		return s.CartStore.Put(ctx, cart)
+	}
+	stored := cart.clone()
+	stored.UserID = namespace.key(cart.UserID)
+	return s.CartStore.Put(ctx, stored)
+}
+
+func (s namespacedCartStore) Delete(ctx context.Context, userID string) error {
+	namespace := namespaceFrom(ctx)
+	if namespace == nil {
+		return s.CartStore.Delete(ctx, userID)
+	}
+	return s.CartStore.Delete(ctx, namespace.key(userID))
+}
+
+func (s namespacedCartStore) List(ctx context.Context) ([]*Cart, error) {
+	carts, err := s.CartStore.List(ctx)
+	namespace := namespaceFrom(ctx)
+	if err != nil || namespace == nil {
+		return carts, err
+	}
+
+	scoped := carts[:0]
+	for _, cart := range carts {
+		if userID, ok := namespace.userOf(cart.UserID); ok {
+			cart = cart.clone()
+			cart.UserID = userID
+			scoped = append(scoped, cart)
+		}
+	}
+	return scoped, nil
+}
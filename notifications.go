@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Notification types
+const (
+	notificationBackInStock = "back_in_stock"
+	notificationOrderPlaced = "order_placed"
+	notificationCartExpired = "cart_expired"
+)
+
+// Notification is a user-facing event delivered by a Notifier
+type Notification struct {
+	Type      string    `json:"type"`
+	UserID    string    `json:"user_id"`
+	ProductID string    `json:"product_id,omitempty"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Notifier delivers notifications to users
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// logNotifier writes notifications to the service log. It is used when no
+// webhook is configured.
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, notification Notification) error {
+	slog.InfoContext(ctx, "Notification", "type", notification.Type, "user_id", notification.UserID, "message", notification.Message)
+	return nil
+}
+
+// webhookNotifier POSTs notifications as JSON to a configured URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (wn *webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Reasons a notification is dropped without delivery
+const (
+	notificationEvicted  = "evicted"  // the oldest queued, for a newer one
+	notificationRejected = "rejected" // the new one, as the queue was full
+	notificationShutdown = "shutdown" // dispatched after the dispatcher closed
+)
+
+// NotificationDispatcher delivers notifications asynchronously on a fixed
+// pool of workers fed by a bounded queue, so a slow webhook can't pile up
+// a goroutine per notification, and counts the outcome of each delivery
+type NotificationDispatcher struct {
+	notifier Notifier
+	timeout  time.Duration
+	policy   string // what Dispatch does when the queue is full
+
+	queue   chan Notification
+	workers int
+	busy    atomic.Int64 // workers delivering a notification
+	closed  bool         // guarded by closing
+	closing sync.RWMutex // held for writing to close queue, for reading to send on it
+	done    chan struct{}
+
+	// OpenTelemetry Metrics
+	deliveryCounter metric.Int64Counter // Counter: deliveries by type and result
+	dropCounter     metric.Int64Counter // Counter: notifications dropped by type and reason
+	blockedCounter  metric.Int64Counter // Counter: dispatches that waited for room in the queue
+}
+
+// NewNotificationDispatcher creates a dispatcher delivering to webhookURL, or
+// to the service log when webhookURL is empty, and starts its workers
+func NewNotificationDispatcher(webhookURL string, cfg config.NotificationsConfig) (*NotificationDispatcher, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	var notifier Notifier = logNotifier{}
+	if webhookURL != "" {
+		notifier = &webhookNotifier{
+			url:    webhookURL,
+			client: &http.Client{Timeout: 5 * time.Second, Transport: &requestIDTransport{next: outboundPools.transport("notifications")}},
+		}
+	}
+
+	dispatcher := &NotificationDispatcher{
+		notifier: notifier,
+		timeout:  10 * time.Second,
+		policy:   cfg.QueueFullPolicy,
+		queue:    make(chan Notification, cfg.QueueSize),
+		workers:  cfg.Workers,
+		done:     make(chan struct{}),
+	}
+
+	var err error
+	dispatcher.deliveryCounter, err = meter.Int64Counter(
+		"notifications_sent_total",
+		metric.WithDescription("Total number of notification deliveries by type and result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notification counter: %w", err)
+	}
+
+	dispatcher.dropCounter, err = meter.Int64Counter(
+		"notifications_dropped_total",
+		metric.WithDescription("Total number of notifications dropped undelivered by type and reason (evicted, rejected, shutdown)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dropped notification counter: %w", err)
+	}
+
+	dispatcher.blockedCounter, err = meter.Int64Counter(
+		"notification_dispatches_blocked_total",
+		metric.WithDescription("Total number of notification dispatches that waited for room in the full queue"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blocked dispatch counter: %w", err)
+	}
+
+	queueDepth, err := meter.Int64ObservableGauge(
+		"notification_queue_depth",
+		metric.WithDescription("Notifications waiting for a delivery worker"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notification queue depth gauge: %w", err)
+	}
+	queueCapacity, err := meter.Int64ObservableGauge(
+		"notification_queue_capacity",
+		metric.WithDescription("Notifications the queue holds before its queue full policy applies"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notification queue capacity gauge: %w", err)
+	}
+	busyWorkers, err := meter.Int64ObservableGauge(
+		"notification_workers_busy",
+		metric.WithDescription("Notification delivery workers delivering a notification"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create busy notification workers gauge: %w", err)
+	}
+	workers, err := meter.Int64ObservableGauge(
+		"notification_workers",
+		metric.WithDescription("Notification delivery workers in the pool"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notification workers gauge: %w", err)
+	}
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			observer.ObserveInt64(queueDepth, int64(len(dispatcher.queue)))
+			observer.ObserveInt64(queueCapacity, int64(cap(dispatcher.queue)))
+			observer.ObserveInt64(busyWorkers, dispatcher.busy.Load())
+			observer.ObserveInt64(workers, int64(dispatcher.workers))
+			return nil
+		},
+		queueDepth, queueCapacity, busyWorkers, workers,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register notification queue callback: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < dispatcher.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatcher.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(dispatcher.done)
+	}()
+
+	return dispatcher, nil
+}
+
+// Dispatch queues a notification for delivery in the background. When the
+// queue is full it waits for room, evicts the oldest queued notification
+// or drops this one, as the queue full policy says.
+func (nd *NotificationDispatcher) Dispatch(notification Notification) {
+	nd.closing.RLock()
+	defer nd.closing.RUnlock()
+	if nd.closed {
+		nd.drop(notification, notificationShutdown)
+		return
+	}
+
+	for {
+		select {
+		case nd.queue <- notification:
+			return
+		default:
+		}
+
+		switch nd.policy {
+		case config.QueueFullBlock:
+			nd.blockedCounter.Add(context.Background(), 1)
+			nd.queue <- notification
+			return
+		case config.QueueFullDropOldest:
+			// A worker may take the oldest first, leaving room to retry
+			select {
+			case oldest := <-nd.queue:
+				nd.drop(oldest, notificationEvicted)
+			default:
+			}
+		default:
+			nd.drop(notification, notificationRejected)
+			return
+		}
+	}
+}
+
+// drop counts and logs a notification dropped undelivered
+func (nd *NotificationDispatcher) drop(notification Notification, reason string) {
+	slog.Warn("Notification dropped", "type", notification.Type, "user_id", notification.UserID, "reason", reason)
+	nd.dropCounter.Add(context.Background(), 1,
+		metric.WithAttributes(
+			attribute.String("type", notification.Type),
+			attribute.String("reason", reason),
+		),
+	)
+}
+
+// work delivers queued notifications until the queue is closed
+func (nd *NotificationDispatcher) work() {
+	for notification := range nd.queue {
+		nd.busy.Add(1)
+		ctx, cancel := context.WithTimeout(context.Background(), nd.timeout)
+		if err := nd.Deliver(ctx, notification); err != nil {
+			slog.ErrorContext(ctx, "Failed to deliver notification", "type", notification.Type, "user_id", notification.UserID, "error", err)
+		}
+		cancel()
+		nd.busy.Add(-1)
+	}
+}
+
+// Close stops accepting notifications and waits for the queued ones to be
+// delivered, or ctx to expire
+func (nd *NotificationDispatcher) Close(ctx context.Context) error {
+	nd.closing.Lock()
+	if !nd.closed {
+		nd.closed = true
+		close(nd.queue)
+	}
+	nd.closing.Unlock()
+
+	select {
+	case <-nd.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d notifications undelivered: %w", len(nd.queue), ctx.Err())
+	}
+}
+
+// Deliver delivers a notification and returns the delivery error, for
+// callers that retry
+func (nd *NotificationDispatcher) Deliver(ctx context.Context, notification Notification) error {
+	err := nd.notifier.Notify(ctx, notification)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	nd.deliveryCounter.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.String("type", notification.Type),
+			attribute.String("result", result),
+		),
+	)
+	return err
+}
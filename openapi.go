@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPIVersion is the version of the cart API the spec describes
+const openAPIVersion = "1.0.0"
+
+// apiDocsRoute reports whether a route serves the API description, which
+// is public like the probes
+func apiDocsRoute(pattern string) bool {
+	return pattern == "/openapi.json" || pattern == "/docs"
+}
+
+// apiOperation describes one cart endpoint for the OpenAPI spec. Request
+// and response schemas are generated from the Go values given, so the
+// spec follows the types the handlers decode and encode.
+type apiOperation struct {
+	method     string
+	path       string
+	summary    string
+	tag        string
+	deprecated bool
+	params     []apiParam
+	request    interface{} // JSON body, nil for none
+	status     int         // success status code
+	response   interface{} // JSON body of the success response
+	stream     bool        // the response is an event stream of response values
+	errors     []int       // error status codes, answered with an ErrorEnvelope
+}
+
+// apiParam is a path, query or header parameter
+type apiParam struct {
+	name        string
+	in          string
+	required    bool
+	description string
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{name: name, in: "path", required: true, description: description}
+}
+
+func queryParam(name string, required bool, description string) apiParam {
+	return apiParam{name: name, in: "query", required: required, description: description}
+}
+
+// statusResponse is the body of cart changes that return no resource
+type statusResponse struct {
+	Status string `json:"status"` // always "success"
+}
+
+var (
+	userIDParam         = pathParam("userID", "The user whose cart it is")
+	itemIDParam         = pathParam("itemID", "The item's product ID")
+	userIDQueryParam    = queryParam("user_id", true, "The user whose cart it is")
+	idempotencyKeyParam = apiParam{name: "Idempotency-Key", in: "header", description: "Retries with the same key add the item once"}
+)
+
+// apiOperations are the cart endpoints, in the order the spec lists them
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/v1/carts/{userID}", tag: "carts",
+		summary: "Get a cart",
+		params:  []apiParam{userIDParam},
+		status:  http.StatusOK, response: Cart{},
+		errors: []int{http.StatusNotFound},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/carts/{userID}", tag: "carts",
+		summary: "Remove every item from a cart, or delete the cart",
+		params:  []apiParam{userIDParam, queryParam("delete", false, "true deletes the cart instead of leaving it empty")},
+		status:  http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusLocked},
+	},
+	{
+		method: http.MethodPost, path: "/v1/carts/{userID}/items", tag: "carts",
+		summary: "Add an item to a cart",
+		params:  []apiParam{userIDParam, idempotencyKeyParam},
+		request: CartItem{},
+		status:  http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusLocked},
+	},
+	{
+		method: http.MethodPost, path: "/v1/carts/{userID}/items:batch", tag: "carts",
+		summary: "Add up to 100 items to a cart at once, or none when any is rejected; a rejected batch's 422 response also lists each item's result",
+		params:  []apiParam{userIDParam, idempotencyKeyParam},
+		request: []CartItem{},
+		status:  http.StatusOK, response: batchAddResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusLocked},
+	},
+	{
+		method: http.MethodPatch, path: "/v1/carts/{userID}/items/{itemID}", tag: "carts",
+		summary: "Set an item's quantity; 0 or less removes it",
+		params:  []apiParam{userIDParam, itemIDParam},
+		request: struct {
+			Quantity *int `json:"quantity"`
+		}{},
+		status: http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusLocked},
+	},
+	{
+		method: http.MethodDelete, path: "/v1/carts/{userID}/items/{itemID}", tag: "carts",
+		summary: "Remove an item from a cart",
+		params:  []apiParam{userIDParam, itemIDParam},
+		status:  http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusNotFound, http.StatusLocked},
+	},
+	{
+		method: http.MethodGet, path: "/v1/carts/{userID}/events", tag: "carts",
+		summary: "Stream a cart's changes as Server-Sent Events",
+		params:  []apiParam{userIDParam},
+		status:  http.StatusOK, response: cartEvent{}, stream: true,
+		errors: []int{http.StatusServiceUnavailable},
+	},
+	{
+		method: http.MethodGet, path: "/v1/limits", tag: "carts",
+		summary: "Get the limits in effect for the caller",
+		params:  []apiParam{queryParam("user_id", false, "The user to report limits for; the client IP when omitted")},
+		status:  http.StatusOK, response: LimitsResponse{},
+	},
+	{
+		method: http.MethodGet, path: "/cart/totals", tag: "cart",
+		summary: "Price a cart, including discounts and shipping",
+		params:  []apiParam{userIDQueryParam},
+		status:  http.StatusOK, response: CartTotals{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		method: http.MethodPost, path: "/cart/quote", tag: "cart",
+		summary: "Hold the cart's prices for checkout",
+		request: struct {
+			UserID    string   `json:"user_id"`
+			ItemIDs   []string `json:"item_ids,omitempty"`
+			AddressID string   `json:"address_id,omitempty"`
+		}{},
+		status: http.StatusOK, response: struct {
+			Totals     CartTotals `json:"totals"`
+			QuoteToken string     `json:"quote_token"`
+			ExpiresAt  time.Time  `json:"expires_at"`
+		}{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		method: http.MethodPost, path: "/cart/checkout", tag: "cart",
+		summary: "Check out the cart, or some of its lines",
+		request: struct {
+			UserID     string   `json:"user_id"`
+			ItemIDs    []string `json:"item_ids,omitempty"`
+			QuoteToken string   `json:"quote_token,omitempty"`
+			AddressID  string   `json:"address_id,omitempty"`
+		}{},
+		status: http.StatusCreated, response: Order{},
+		errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusGone, http.StatusUnprocessableEntity, http.StatusLocked, http.StatusGatewayTimeout},
+	},
+	{
+		method: http.MethodPost, path: "/cart/share", tag: "cart",
+		summary: "Create a read-only share link of a cart",
+		request: struct {
+			UserID     string `json:"user_id"`
+			TTLSeconds int    `json:"ttl_seconds,omitempty"`
+		}{},
+		status: http.StatusOK, response: struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+			Path      string    `json:"path"`
+		}{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		method: http.MethodGet, path: "/cart/shared", tag: "cart",
+		summary: "View a shared cart",
+		params:  []apiParam{queryParam("token", true, "The share token")},
+		status:  http.StatusOK, response: struct {
+			ReadOnly bool `json:"read_only"`
+			Cart     Cart `json:"cart"`
+		}{},
+		errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusGone},
+	},
+	{
+		method: http.MethodPost, path: "/cart/shared/clone", tag: "cart",
+		summary: "Copy a shared cart's items into your own cart",
+		request: struct {
+			Token  string `json:"token"`
+			UserID string `json:"user_id"`
+		}{},
+		status: http.StatusOK, response: Cart{},
+		errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusGone},
+	},
+	{
+		method: http.MethodGet, path: "/cart/templates", tag: "cart",
+		summary: "List a user's saved cart templates",
+		params:  []apiParam{userIDQueryParam},
+		status:  http.StatusOK, response: struct {
+			Templates []CartTemplate `json:"templates"`
+		}{},
+		errors: []int{http.StatusBadRequest},
+	},
+	{
+		method: http.MethodPost, path: "/cart/templates", tag: "cart",
+		summary: "Save the cart as a template",
+		request: struct {
+			UserID string `json:"user_id"`
+			Name   string `json:"name"`
+		}{},
+		status: http.StatusCreated, response: CartTemplate{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		method: http.MethodGet, path: "/cart/schedules", tag: "cart",
+		summary: "List a user's template schedules and their runs",
+		params:  []apiParam{userIDQueryParam},
+		status:  http.StatusOK, response: struct {
+			Schedules []struct {
+				Schedule CartSchedule `json:"schedule"`
+				Status   *JobStatus   `json:"status,omitempty"`
+			} `json:"schedules"`
+		}{},
+		errors: []int{http.StatusBadRequest},
+	},
+	{
+		method: http.MethodPost, path: "/cart/schedules", tag: "cart",
+		summary: "Re-create a template on a cron schedule",
+		request: struct {
+			UserID     string `json:"user_id"`
+			TemplateID string `json:"template_id"`
+			Cron       string `json:"cron"`
+			Action     string `json:"action,omitempty"` // recreate or auto_checkout
+		}{},
+		status: http.StatusCreated, response: CartSchedule{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		method: http.MethodPost, path: "/cart/add", tag: "cart", deprecated: true,
+		summary: "Add an item to a cart; use POST /v1/carts/{userID}/items",
+		params:  []apiParam{idempotencyKeyParam},
+		request: struct {
+			UserID string   `json:"user_id"`
+			Item   CartItem `json:"item"`
+		}{},
+		status: http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusLocked},
+	},
+	{
+		method: http.MethodGet, path: "/cart/get", tag: "cart", deprecated: true,
+		summary: "Get a cart; use GET /v1/carts/{userID}",
+		params:  []apiParam{userIDQueryParam},
+		status:  http.StatusOK, response: Cart{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		method: http.MethodPatch, path: "/cart/item", tag: "cart", deprecated: true,
+		summary: "Set an item's quantity; use PATCH /v1/carts/{userID}/items/{itemID}",
+		request: struct {
+			UserID   string `json:"user_id"`
+			ItemID   string `json:"item_id"`
+			Quantity *int   `json:"quantity"`
+		}{},
+		status: http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusLocked},
+	},
+	{
+		method: http.MethodDelete, path: "/cart/remove", tag: "cart", deprecated: true,
+		summary: "Remove an item from a cart; use DELETE /v1/carts/{userID}/items/{itemID}",
+		request: struct {
+			UserID string `json:"user_id"`
+			ItemID string `json:"item_id"`
+		}{},
+		status: http.StatusOK, response: statusResponse{},
+		errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusLocked},
+	},
+}
+
+// openAPISpec builds the OpenAPI 3 document of operations
+func openAPISpec(operations []apiOperation) map[string]interface{} {
+	schemas := newSchemaGenerator()
+	errorRef := schemas.schemaOf(reflect.TypeOf(ErrorEnvelope{}))
+
+	paths := make(map[string]map[string]interface{})
+	for _, op := range operations {
+		operation := map[string]interface{}{
+			"summary":     op.summary,
+			"tags":        []string{op.tag},
+			"operationId": operationID(op),
+		}
+		if op.deprecated {
+			operation["deprecated"] = true
+		}
+
+		var params []map[string]interface{}
+		for _, param := range op.params {
+			params = append(params, map[string]interface{}{
+				"name":        param.name,
+				"in":          param.in,
+				"required":    param.required,
+				"description": param.description,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.schemaOf(reflect.TypeOf(op.request))},
+				},
+			}
+		}
+
+		contentType := "application/json"
+		if op.stream {
+			contentType = "text/event-stream"
+		}
+		responses := map[string]interface{}{
+			strconv.Itoa(op.status): map[string]interface{}{
+				"description": http.StatusText(op.status),
+				"content": map[string]interface{}{
+					contentType: map[string]interface{}{"schema": schemas.schemaOf(reflect.TypeOf(op.response))},
+				},
+			},
+		}
+		for _, status := range op.errors {
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": http.StatusText(status),
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": errorRef},
+				},
+			}
+		}
+		operation["responses"] = responses
+
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]interface{})
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Shopping Cart Service",
+			"version":     openAPIVersion,
+			"description": "Cart APIs of the shopping cart service. Errors are answered with an ErrorEnvelope whose code clients can branch on.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		// Credentials are only required when authentication is enabled
+		"security": []map[string][]string{{"apiKey": {}}, {"bearer": {}}, {}},
+	}
+}
+
+// operationID names an operation after its method and path, e.g.
+// getV1CartsUserIDItems
+func operationID(op apiOperation) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(op.method))
+	for _, segment := range strings.Split(op.path, "/") {
+		segment = strings.Trim(segment, "{}")
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '_' || r == ':' }) {
+			id.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return id.String()
+}
+
+// schemaGenerator derives JSON schemas from Go types the way encoding/json
+// encodes them. Named structs become components referenced by name.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{schemas: make(map[string]interface{})}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaOf returns the schema of t, registering the named structs it uses
+func (g *schemaGenerator) schemaOf(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:] // cartEvent -> CartEvent
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = nil // placeholder, so recursive types terminate
+			g.schemas[name] = g.structSchema(t)
+		}
+		return ref
+	}
+	// Interfaces hold any JSON value
+	return map[string]interface{}{}
+}
+
+// structSchema returns the object schema of a struct's JSON fields. Fields
+// without omitempty are always encoded, so they are required.
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	g.addFields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds t's JSON fields, including those of embedded structs
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded, embeddedRequired := field.Type, required
+			if embedded.Kind() == reflect.Pointer {
+				// A nil pointer leaves all of its fields out
+				embedded, embeddedRequired = embedded.Elem(), new([]string)
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.addFields(embedded, properties, embeddedRequired)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schemaOf(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// openAPIDocument is the encoded spec, built on first use
+var openAPIDocument = sync.OnceValues(func() ([]byte, error) {
+	return json.MarshalIndent(openAPISpec(apiOperations), "", "  ")
+})
+
+// handleOpenAPI serves the OpenAPI 3 spec of the cart endpoints
+func (ms *MetricsServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	document, err := openAPIDocument()
+	if err != nil {
+		ms.writeServiceError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(document)
+}
+
+// swaggerUIPage renders /openapi.json with Swagger UI, whose assets load
+// from the jsDelivr CDN
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Shopping Cart Service API</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://cdn.jsdelivr.net/npm/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// handleAPIDocs serves Swagger UI for the spec
+func (ms *MetricsServer) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Request phases, timed by phase spans into Server-Timing and the
+// request_phase_duration_seconds histogram
+const (
+	phaseAuth          = "auth"
+	phaseValidation    = "validation"
+	phaseStore         = "store"
+	phaseDownstream    = "downstream" // calls to the simulated dependencies
+	phaseSerialization = "serialization"
+)
+
+// requestPhases lists the phases in the order a request passes them
+var requestPhases = []string{phaseAuth, phaseValidation, phaseStore, phaseDownstream, phaseSerialization}
+
+// Store operations, the operation of store phase spans
+const (
+	storeRead  = "read"
+	storeWrite = "write"
+)
+
+// phaseKey marks the spans whose durations make up a phase
+const phaseKey = attribute.Key("request.phase")
+
+// phaseDurations is the request_phase_duration_seconds histogram, created
+// on first use, after the service's MeterProvider is installed
+var phaseDurations = sync.OnceValue(func() metric.Float64Histogram {
+	histogram, err := otel.Meter("shopping-cart-service").Float64Histogram(
+		"request_phase_duration_seconds",
+		metric.WithDescription("Time spent in each internal phase of requests (auth, validation, store, downstream, serialization), by operation and endpoint"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5),
+	)
+	if err != nil {
+		slog.Warn("Failed to create request phase histogram", "error", err)
+		return noop.Float64Histogram{}
+	}
+	return histogram
+})
+
+// phaseSpan is a span timing part of a request phase. Ending it records its
+// duration in the phase histogram too, so the breakdown is measured for
+// every request, whether or not the sampler keeps its trace.
+type phaseSpan struct {
+	trace.Span
+	ctx       context.Context
+	phase     string
+	operation string
+	start     time.Time
+}
+
+// startPhaseSpan starts a span timing operation, part of a request phase.
+// Spans of the same phase add up, e.g. every store call of a request.
+func startPhaseSpan(ctx context.Context, phase, operation, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	opts = append(opts, trace.WithAttributes(phaseKey.String(phase)))
+	ctx, span := otel.Tracer("shopping-cart-service").Start(ctx, name, opts...)
+	return ctx, &phaseSpan{Span: span, ctx: ctx, phase: phase, operation: operation, start: time.Now()}
+}
+
+// End records the phase duration and ends the span. Work outside requests,
+// such as the cart reaper's store calls, is labeled endpoint "background".
+func (s *phaseSpan) End(options ...trace.SpanEndOption) {
+	endpoint := routeOf(s.ctx)
+	if endpoint == "" {
+		endpoint = "background"
+	}
+	phaseDurations().Record(s.ctx, time.Since(s.start).Seconds(), metric.WithAttributes(
+		attribute.String("phase", s.phase),
+		attribute.String("operation", s.operation),
+		attribute.String("endpoint", endpoint),
+	))
+	s.Span.End(options...)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a handler with cross-cutting behavior
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Middleware names usable in MIDDLEWARE_PIPELINE
+const (
+	middlewareMetrics     = "metrics"
+	middlewareCache       = "cache"
+	middlewareLogging     = "logging"
+	middlewareCORS        = "cors"
+	middlewareCompression = "compression"
+	middlewareChaos       = "chaos"
+	middlewareMirror      = "mirror"
+	middlewareRateLimit   = "ratelimit"
+	middlewareAuth        = "auth"
+	middlewareEnrich      = "enrich"
+)
+
+// knownMiddleware lists every middleware a pipeline may name
+var knownMiddleware = map[string]bool{
+	middlewareMetrics:     true,
+	middlewareCache:       true,
+	middlewareLogging:     true,
+	middlewareCORS:        true,
+	middlewareCompression: true,
+	middlewareChaos:       true,
+	middlewareMirror:      true,
+	middlewareRateLimit:   true,
+	middlewareAuth:        true,
+	middlewareEnrich:      true,
+}
+
+// defaultPipelineGroup is the route group whose pipeline applies to groups
+// without their own
+const defaultPipelineGroup = "default"
+
+// defaultPipeline reproduces the historical wrapping: metrics outermost so
+// injected latency is measured, caching headers innermost. Enrichment,
+// auth, the rate limiter and mirror pass requests through unless span
+// attributes are mapped, auth is enabled, limits or a shadow target are
+// configured; rejected and throttled requests are measured and enriched but
+// not mirrored.
+var defaultPipeline = []string{middlewareMetrics, middlewareEnrich, middlewareAuth, middlewareRateLimit, middlewareMirror, middlewareChaos, middlewareCache}
+
+// MiddlewarePipelines maps route groups to middleware names, outermost first
+type MiddlewarePipelines map[string][]string
+
+// ParseMiddlewarePipelines parses "group=name,name;group=name,..." and
+// overlays it on the default pipeline. Groups are the first path segment of
+// a route (cart, catalog, profiles, returns, admin, ...), versioned routes
+// belonging to the group they replace, or "default".
+func ParseMiddlewarePipelines(spec string) (MiddlewarePipelines, error) {
+	pipelines := MiddlewarePipelines{defaultPipelineGroup: defaultPipeline}
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		group, names, found := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		if !found || group == "" {
+			return nil, fmt.Errorf("invalid pipeline %q: expected group=middleware,...", entry)
+		}
+
+		var pipeline []string
+		seen := make(map[string]bool)
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !knownMiddleware[name] {
+				return nil, fmt.Errorf("pipeline %s: unknown middleware %q (available: %s)", group, name, strings.Join(middlewareNames(), ", "))
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("pipeline %s: middleware %q listed twice", group, name)
+			}
+			seen[name] = true
+			pipeline = append(pipeline, name)
+		}
+		pipelines[group] = pipeline
+	}
+
+	return pipelines, nil
+}
+
+// middlewareNames returns the known middleware names, sorted
+func middlewareNames() []string {
+	names := make([]string, 0, len(knownMiddleware))
+	for name := range knownMiddleware {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// versionedGroups maps the resources of versioned routes to the group of
+// the flat routes they replace
+var versionedGroups = map[string]string{"carts": "cart"}
+
+// routeGroup returns the pipeline group of a route pattern. Versioned
+// routes share the group of the routes they replace, so /v1/carts/... is
+// in cart.
+func routeGroup(pattern string) string {
+	path := strings.TrimPrefix(pattern, "/")
+	if resource, found := strings.CutPrefix(path, apiVersion+"/"); found {
+		path = resource
+		group, _, _ := strings.Cut(path, "/")
+		if replaced, ok := versionedGroups[group]; ok {
+			return replaced
+		}
+	}
+	group, _, _ := strings.Cut(path, "/")
+	return group
+}
+
+type routeKey struct{}
+
+// endpointOf returns the route pattern r matched, such as
+// /v1/carts/{userID}, which labels its metrics so path parameters don't
+// give every user their own series. Requests not routed through handle
+// use their path.
+func endpointOf(r *http.Request) string {
+	if pattern := routeOf(r.Context()); pattern != "" {
+		return pattern
+	}
+	return r.URL.Path
+}
+
+// routeOf returns the route pattern of the request being served in ctx,
+// empty outside requests routed through handle
+func routeOf(ctx context.Context) string {
+	pattern, _ := ctx.Value(routeKey{}).(string)
+	return pattern
+}
+
+// For returns the pipeline of a route group
+func (mp MiddlewarePipelines) For(group string) []string {
+	if pipeline, ok := mp[group]; ok {
+		return pipeline
+	}
+	return mp[defaultPipelineGroup]
+}
+
+// middleware returns the server's middleware by name
+func (ms *MetricsServer) middleware() map[string]Middleware {
+	return map[string]Middleware{
+		middlewareMetrics:     ms.withMetrics,
+		middlewareCache:       ms.withCachePolicy,
+		middlewareLogging:     withAccessLog,
+		middlewareCORS:        ms.cors.wrap,
+		middlewareCompression: withCompression,
+		middlewareChaos:       ms.faults.wrap,
+		middlewareMirror:      ms.mirror.wrap,
+		middlewareRateLimit:   ms.limiter.wrap,
+		middlewareAuth:        ms.auth.wrap,
+		middlewareEnrich:      ms.enricher.wrap,
+	}
+}
+
+// handle registers handler for pattern wrapped in its route group's pipeline
+func (ms *MetricsServer) handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	pipeline := ms.pipelines.For(routeGroup(pattern))
+	middleware := ms.middleware()
+
+	// Innermost, so rejected and panicking requests still show in metrics
+	// and logs
+	handler = ms.withRecovery(handler)
+	if readinessGated(pattern) {
+		handler = ms.service.readiness.gate(handler)
+	}
+
+	// Wrap innermost first so the first name ends up outermost
+	for i := len(pipeline) - 1; i >= 0; i-- {
+		handler = middleware[pipeline[i]](handler)
+	}
+	// Outside the pipeline, so session spans cover rejected requests too
+	handler = ms.sessions.wrap(handler)
+	// Outermost, so the total covers the whole pipeline
+	if ms.service.serverTiming {
+		handler = withServerTiming(handler)
+	}
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, pattern)))
+	})
+}
+
+// withAccessLog logs one line per request
+func withAccessLog(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		handler(wrapped, r)
+
+		logRequest(r.Context(), slog.LevelInfo, "Request completed", r, wrapped.statusCode, time.Since(start))
+	}
+}
+
+// CORSPolicy answers preflight requests and sets the Access-Control headers
+// for allowed origins
+type CORSPolicy struct {
+	origins map[string]bool
+	any     bool
+}
+
+// NewCORSPolicy creates a policy for a comma-separated origin list, where
+// "*" (the default) allows any origin
+func NewCORSPolicy(spec string) *CORSPolicy {
+	if strings.TrimSpace(spec) == "" {
+		spec = "*"
+	}
+
+	policy := &CORSPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(spec, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			policy.any = true
+		} else if origin != "" {
+			policy.origins[origin] = true
+		}
+	}
+	return policy
+}
+
+func (cp *CORSPolicy) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !cp.any && !cp.origins[origin] {
+			handler(w, r)
+			return
+		}
+
+		if cp.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, ETag, Retry-After, Idempotent-Replayed, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Deprecation, Link-Template, X-Namespace")
+
+		// Preflight requests are answered here rather than by the handler
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept-Language, If-None-Match, If-Modified-Since, X-Request-ID, X-Session-ID, Idempotency-Key, X-Namespace")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// withCompression gzips responses for clients that accept it
+func withCompression(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			handler(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		handler(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(name, "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body once the status code is known.
+// Bodiless responses (204, 304) and responses a handler already encoded are
+// passed through unchanged.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if !gw.wroteHeader {
+		gw.wroteHeader = true
+		header := gw.Header()
+		if code != http.StatusNoContent && code != http.StatusNotModified && header.Get("Content-Encoding") == "" {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			gw.gz = gzip.NewWriter(gw.ResponseWriter)
+		}
+	}
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(b)
+	}
+	return gw.gz.Write(b)
+}
+
+// Close flushes the gzip stream, if one was started
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// FlushError writes out what has been compressed so far, so event streams reach
+// the client through the compression middleware
+func (gw *gzipResponseWriter) FlushError() error {
+	if gw.gz != nil {
+		if err := gw.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(gw.ResponseWriter).Flush()
+}
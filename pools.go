@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// poolStats is a snapshot of a connection pool
+type poolStats struct {
+	inUse, idle int64
+	max         int64         // connection limit; 0 is unbounded
+	waits       int64         // acquisitions that found no idle connection
+	waitTime    time.Duration // spent by those acquisitions
+	timeouts    int64         // acquisitions that gave up waiting
+}
+
+// connectionPools tracks the connection pools of the service's outbound
+// clients, the HTTP clients, redis and postgres, reporting their
+// utilization, waits and dial latency as the pool_* metrics, so a
+// saturated pool shows as such rather than as slow dependencies
+type connectionPools struct {
+	mutex sync.Mutex
+	http  config.HTTPPoolConfig
+	pools map[string]func() poolStats
+
+	dialDuration metric.Float64Histogram // Histogram: dial latency by pool and result
+}
+
+// outboundPools holds the service's connection pools. NewCartService
+// configures it before any outbound client is created.
+var outboundPools = &connectionPools{
+	http:         config.Default().Pools.HTTP,
+	pools:        make(map[string]func() poolStats),
+	dialDuration: noop.Float64Histogram{},
+}
+
+// configure applies the pool settings to the pools created from now on and
+// registers the pool metrics
+func (cp *connectionPools) configure(cfg config.PoolsConfig) error {
+	cp.mutex.Lock()
+	cp.http = cfg.HTTP
+	cp.mutex.Unlock()
+
+	return cp.registerMetrics()
+}
+
+// registerMetrics creates the pool instruments, observing every registered
+// pool at collection
+func (cp *connectionPools) registerMetrics() error {
+	meter := otel.Meter("shopping-cart-service")
+
+	connections, err := meter.Int64ObservableGauge(
+		"pool_connections",
+		metric.WithDescription("Current number of outbound pool connections by pool and state (in_use, idle)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create pool connections gauge: %w", err)
+	}
+	maxConnections, err := meter.Int64ObservableGauge(
+		"pool_max_connections",
+		metric.WithDescription("Connection limit of each outbound pool; 0 is unbounded"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create pool max connections gauge: %w", err)
+	}
+	waits, err := meter.Int64ObservableCounter(
+		"pool_waits_total",
+		metric.WithDescription("Total number of outbound pool acquisitions that found no idle connection, so waited or dialed"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create pool waits counter: %w", err)
+	}
+	waitTime, err := meter.Float64ObservableCounter(
+		"pool_wait_duration_seconds_total",
+		metric.WithDescription("Total time outbound pool acquisitions spent without an idle connection"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create pool wait duration counter: %w", err)
+	}
+	timeouts, err := meter.Int64ObservableCounter(
+		"pool_timeouts_total",
+		metric.WithDescription("Total number of outbound pool acquisitions that timed out waiting for a connection"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create pool timeouts counter: %w", err)
+	}
+
+	dialDuration, err := meter.Float64Histogram(
+		"pool_dial_duration_seconds",
+		metric.WithDescription("Time to dial new outbound pool connections by pool and result"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create pool dial duration histogram: %w", err)
+	}
+	cp.mutex.Lock()
+	cp.dialDuration = dialDuration
+	cp.mutex.Unlock()
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			for name, stats := range cp.snapshot() {
+				pool := attribute.String("pool", name)
+				observer.ObserveInt64(connections, stats.inUse, metric.WithAttributes(pool, attribute.String("state", "in_use")))
+				observer.ObserveInt64(connections, stats.idle, metric.WithAttributes(pool, attribute.String("state", "idle")))
+				observer.ObserveInt64(maxConnections, stats.max, metric.WithAttributes(pool))
+				observer.ObserveInt64(waits, stats.waits, metric.WithAttributes(pool))
+				observer.ObserveFloat64(waitTime, stats.waitTime.Seconds(), metric.WithAttributes(pool))
+				observer.ObserveInt64(timeouts, stats.timeouts, metric.WithAttributes(pool))
+			}
+			return nil
+		},
+		connections, maxConnections, waits, waitTime, timeouts,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register pool metrics callback: %w", err)
+	}
+	return nil
+}
+
+// register reports the pool name with stats from now on, replacing a pool
+// of the same name
+func (cp *connectionPools) register(name string, stats func() poolStats) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.pools[name] = stats
+}
+
+// snapshot reads the stats of every pool
+func (cp *connectionPools) snapshot() map[string]poolStats {
+	cp.mutex.Lock()
+	names := make([]string, 0, len(cp.pools))
+	stats := make([]func() poolStats, 0, len(cp.pools))
+	for name, read := range cp.pools {
+		names = append(names, name)
+		stats = append(stats, read)
+	}
+	cp.mutex.Unlock()
+
+	snapshot := make(map[string]poolStats, len(names))
+	for i, name := range names {
+		snapshot[name] = stats[i]()
+	}
+	return snapshot
+}
+
+// dialFunc dials connections of a pool
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// instrumentDial times the dials of the pool name
+func (cp *connectionPools) instrumentDial(name string, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		cp.mutex.Lock()
+		dialDuration := cp.dialDuration
+		cp.mutex.Unlock()
+		dialDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+			attribute.String("pool", name),
+			attribute.String("result", result),
+		))
+		return conn, err
+	}
+}
+
+// transport creates the HTTP connection pool of the outbound client name,
+// with the configured pool settings. Each client has a pool of its own, so
+// one slow dependency can't exhaust the connections of the others.
+func (cp *connectionPools) transport(name string) http.RoundTripper {
+	cp.mutex.Lock()
+	cfg := cp.http
+	cp.mutex.Unlock()
+
+	t := &pooledTransport{maxConns: int64(cfg.MaxConnsPerHost)}
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+	dial := cp.instrumentDial(name, dialer.DialContext)
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.MaxIdleConns = cfg.MaxIdleConns
+	base.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	base.MaxConnsPerHost = cfg.MaxConnsPerHost
+	base.IdleConnTimeout = cfg.IdleConnTimeout
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		t.open.Add(1)
+		return &pooledConn{Conn: conn, open: &t.open}, nil
+	}
+	t.base = base
+
+	cp.register(name, t.stats)
+	return t
+}
+
+// pooledTransport is an outbound HTTP client's connection pool, counting
+// its connections and the requests that waited for one
+type pooledTransport struct {
+	base     *http.Transport
+	maxConns int64 // per host; 0 is unbounded
+
+	open      atomic.Int64 // dialed and not yet closed
+	inUse     atomic.Int64 // serving a request
+	waits     atomic.Int64
+	waitNanos atomic.Int64
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var acquired atomic.Bool
+	var start time.Time
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { start = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			acquired.Store(true)
+			t.inUse.Add(1)
+			if !info.Reused {
+				t.waits.Add(1)
+				t.waitNanos.Add(int64(time.Since(start)))
+			}
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	switch {
+	case !acquired.Load():
+	case err != nil:
+		t.inUse.Add(-1)
+	default:
+		// The connection returns to the pool once the body is closed
+		resp.Body = &pooledBody{ReadCloser: resp.Body, inUse: &t.inUse}
+	}
+	return resp, err
+}
+
+// stats reports the pool. Idle connections are those open and not in use;
+// HTTP pools don't time out waiting, so only the request's context ends a
+// wait.
+func (t *pooledTransport) stats() poolStats {
+	inUse := t.inUse.Load()
+	return poolStats{
+		inUse:    inUse,
+		idle:     max(t.open.Load()-inUse, 0),
+		max:      t.maxConns,
+		waits:    t.waits.Load(),
+		waitTime: time.Duration(t.waitNanos.Load()),
+	}
+}
+
+// pooledConn uncounts a pool connection when it is closed
+type pooledConn struct {
+	net.Conn
+	open   *atomic.Int64
+	closed sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.closed.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// pooledBody releases a response's connection when the body is closed
+type pooledBody struct {
+	io.ReadCloser
+	inUse  *atomic.Int64
+	closed sync.Once
+}
+
+func (b *pooledBody) Close() error {
+	b.closed.Do(func() { b.inUse.Add(-1) })
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// postgresMigrations are the schema versions, each a list of statements
+// applied in one transaction at startup. Append new versions; never edit
+// released ones, instances that applied them won't run them again.
+var postgresMigrations = [][]string{
+	// 1: carts and profiles keyed by user, items and profiles as JSON
+	{
+		`CREATE TABLE carts (
+			user_id      TEXT PRIMARY KEY,
+			items        JSONB NOT NULL,
+			locked_until TIMESTAMPTZ,
+			updated_at   TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE profiles (
+			user_id TEXT PRIMARY KEY,
+			profile JSONB NOT NULL
+		)`,
+	},
+	// 2: the cart reaper and inspection endpoints scan by last change
+	{
+		`CREATE INDEX carts_updated_at ON carts (updated_at)`,
+	},
+}
+
+// postgresMigrationLock is the advisory lock key instances starting
+// together take turns migrating under
+const postgresMigrationLock = 0x636172742d737663 // "cart-svc"
+
+// Queries of the postgres store by the operation label of their metrics.
+// They are prepared at startup and re-prepared by database/sql on pooled
+// connections as needed.
+var postgresQueries = map[string]string{
+	"cart.get": `SELECT items, locked_until, updated_at FROM carts WHERE user_id = $1`,
+	"cart.put": `INSERT INTO carts (user_id, items, locked_until, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET items = EXCLUDED.items, locked_until = EXCLUDED.locked_until, updated_at = EXCLUDED.updated_at`,
+	"cart.delete":    `DELETE FROM carts WHERE user_id = $1`,
+	"cart.list":      `SELECT user_id, items, locked_until, updated_at FROM carts ORDER BY user_id`,
+	"profile.get":    `SELECT profile FROM profiles WHERE user_id = $1`,
+	"profile.put":    `INSERT INTO profiles (user_id, profile) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET profile = EXCLUDED.profile`,
+	"profile.delete": `DELETE FROM profiles WHERE user_id = $1`,
+	"profile.list":   `SELECT profile FROM profiles ORDER BY user_id`,
+}
+
+// postgresStore stores carts and profiles in PostgreSQL, so several
+// instances can share them durably
+type postgresStore struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+
+	// OpenTelemetry Metrics
+	queryDuration    metric.Float64Histogram     // Histogram: query latency by operation
+	queryErrors      metric.Int64Counter         // Counter: failed queries by operation
+	connectionsGauge metric.Int64ObservableGauge // Gauge: pool connections by state
+}
+
+// newPostgresStore connects to the database cfg names, migrates its schema
+// to the latest version and prepares the store's queries
+func newPostgresStore(ctx context.Context, cfg config.PostgresConfig) (*postgresStore, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("POSTGRES_URL is required when CART_STORE=%s", storePostgres)
+	}
+	connConfig, err := pgx.ParseConfig(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid POSTGRES_URL: %w", err)
+	}
+	connConfig.DialFunc = pgconn.DialFunc(outboundPools.instrumentDial("postgres", dialFunc(connConfig.DialFunc)))
+	db := stdlib.OpenDB(*connConfig)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	store, err := openPostgresStore(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	outboundPools.register("postgres", func() poolStats {
+		stats := db.Stats()
+		return poolStats{
+			inUse:    int64(stats.InUse),
+			idle:     int64(stats.Idle),
+			max:      int64(stats.MaxOpenConnections),
+			waits:    stats.WaitCount,
+			waitTime: stats.WaitDuration,
+		}
+	})
+	return store, nil
+}
+
+func openPostgresStore(ctx context.Context, db *sql.DB) (*postgresStore, error) {
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if err := migratePostgres(ctx, db); err != nil {
+		return nil, err
+	}
+
+	store := &postgresStore{db: db, statements: make(map[string]*sql.Stmt, len(postgresQueries))}
+	for operation, query := range postgresQueries {
+		statement, err := db.PrepareContext(ctx, query)
+		if err != nil {
+			store.closeStatements()
+			return nil, fmt.Errorf("failed to prepare postgres %s: %w", operation, err)
+		}
+		store.statements[operation] = statement
+	}
+
+	if err := store.registerMetrics(); err != nil {
+		store.closeStatements()
+		return nil, err
+	}
+	return store, nil
+}
+
+// migratePostgres applies the migrations newer than the database's schema
+// version, recorded in schema_migrations. It fails when the database is
+// newer than this build, e.g. during a rollback past a migration.
+func migratePostgres(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin postgres migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(postgresMigrationLock)); err != nil {
+		return fmt.Errorf("failed to lock postgres schema: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read postgres schema version: %w", err)
+	}
+	latest := len(postgresMigrations)
+	if current > latest {
+		return fmt.Errorf("postgres schema version %d is newer than this build's %d", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	for version := current + 1; version <= latest; version++ {
+		for _, statement := range postgresMigrations[version-1] {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("postgres migration %d failed: %w", version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return fmt.Errorf("failed to record postgres migration %d: %w", version, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit postgres migrations: %w", err)
+	}
+	slog.InfoContext(ctx, "Migrated postgres schema", "from_version", current, "to_version", latest)
+	return nil
+}
+
+// registerMetrics creates the query and connection pool instruments
+func (ps *postgresStore) registerMetrics() error {
+	meter := otel.Meter("shopping-cart-service")
+
+	var err error
+	ps.queryDuration, err = meter.Float64Histogram(
+		"db_query_duration_seconds",
+		metric.WithDescription("Duration of cart store database queries by operation"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create database query duration histogram: %w", err)
+	}
+
+	ps.queryErrors, err = meter.Int64Counter(
+		"db_query_errors_total",
+		metric.WithDescription("Total number of failed cart store database queries by operation"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create database query errors counter: %w", err)
+	}
+
+	ps.connectionsGauge, err = meter.Int64ObservableGauge(
+		"db_connections",
+		metric.WithDescription("Current number of database pool connections by state (in_use, idle)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create database connections gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			stats := ps.db.Stats()
+			observer.ObserveInt64(ps.connectionsGauge, int64(stats.InUse), metric.WithAttributes(attribute.String("state", "in_use")))
+			observer.ObserveInt64(ps.connectionsGauge, int64(stats.Idle), metric.WithAttributes(attribute.String("state", "idle")))
+			return nil
+		},
+		ps.connectionsGauge,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register database connections callback: %w", err)
+	}
+	return nil
+}
+
+// observe records a query's latency and, unless it just found no row, its
+// failure
+func (ps *postgresStore) observe(ctx context.Context, operation string, start time.Time, err error) {
+	attrs := metric.WithAttributes(attribute.String("operation", operation))
+	ps.queryDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ps.queryErrors.Add(ctx, 1, attrs)
+	}
+}
+
+// exec runs a prepared statement that returns no rows
+func (ps *postgresStore) exec(ctx context.Context, operation string, args ...interface{}) error {
+	start := time.Now()
+	_, err := ps.statements[operation].ExecContext(ctx, args...)
+	ps.observe(ctx, operation, start, err)
+	if err != nil {
+		return fmt.Errorf("postgres %s: %w", operation, err)
+	}
+	return nil
+}
+
+// queryRow runs a prepared statement returning at most one row and scans
+// it into dest, reporting whether there was one
+func (ps *postgresStore) queryRow(ctx context.Context, operation string, args []interface{}, dest ...interface{}) (bool, error) {
+	start := time.Now()
+	err := ps.statements[operation].QueryRowContext(ctx, args...).Scan(dest...)
+	ps.observe(ctx, operation, start, err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("postgres %s: %w", operation, err)
+	}
+	return true, nil
+}
+
+// query runs a prepared statement and calls scan for each row
+func (ps *postgresStore) query(ctx context.Context, operation string, scan func(rows *sql.Rows) error) error {
+	start := time.Now()
+	err := ps.scanRows(ctx, operation, scan)
+	ps.observe(ctx, operation, start, err)
+	return err
+}
+
+func (ps *postgresStore) scanRows(ctx context.Context, operation string, scan func(rows *sql.Rows) error) error {
+	rows, err := ps.statements[operation].QueryContext(ctx)
+	if err != nil {
+		return fmt.Errorf("postgres %s: %w", operation, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("postgres %s: %w", operation, err)
+	}
+	return nil
+}
+
+func (ps *postgresStore) closeStatements() {
+	for _, statement := range ps.statements {
+		statement.Close()
+	}
+}
+
+// Close closes the prepared statements and the connection pool
+func (ps *postgresStore) Close() error {
+	ps.closeStatements()
+	return ps.db.Close()
+}
+
+// postgresCartStore stores carts in the carts table, the checkout lock
+// included so every instance sees it
+type postgresCartStore struct {
+	*postgresStore
+}
+
+// postgresCart builds a cart from its stored columns
+func postgresCart(userID string, items []byte, lockedUntil sql.NullTime, updatedAt time.Time) (*Cart, error) {
+	cart := &Cart{UserID: userID, Items: []CartItem{}, lockedUntil: lockedUntil.Time, updatedAt: updatedAt}
+	if err := json.Unmarshal(items, &cart.Items); err != nil {
+		return nil, fmt.Errorf("failed to decode cart %s: %w", userID, err)
+	}
+	if cart.Items == nil {
+		cart.Items = []CartItem{}
+	}
+	return cart, nil
+}
+
+func (s *postgresCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	var items []byte
+	var lockedUntil sql.NullTime
+	var updatedAt time.Time
+	found, err := s.queryRow(ctx, "cart.get", []interface{}{userID}, &items, &lockedUntil, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w for user %s", ErrCartNotFound, userID)
+	}
+	return postgresCart(userID, items, lockedUntil, updatedAt)
+}
+
+func (s *postgresCartStore) Put(ctx context.Context, cart *Cart) error {
+	items, err := json.Marshal(cart.Items)
+	if err != nil {
+		return fmt.Errorf("failed to encode cart %s: %w", cart.UserID, err)
+	}
+	lockedUntil := sql.NullTime{Time: cart.lockedUntil, Valid: !cart.lockedUntil.IsZero()}
+	return s.exec(ctx, "cart.put", cart.UserID, string(items), lockedUntil, cart.updatedAt)
+}
+
+func (s *postgresCartStore) Delete(ctx context.Context, userID string) error {
+	return s.exec(ctx, "cart.delete", userID)
+}
+
+func (s *postgresCartStore) List(ctx context.Context) ([]*Cart, error) {
+	var carts []*Cart
+	err := s.query(ctx, "cart.list", func(rows *sql.Rows) error {
+		var userID string
+		var items []byte
+		var lockedUntil sql.NullTime
+		var updatedAt time.Time
+		if err := rows.Scan(&userID, &items, &lockedUntil, &updatedAt); err != nil {
+			return fmt.Errorf("postgres cart.list: %w", err)
+		}
+		cart, err := postgresCart(userID, items, lockedUntil, updatedAt)
+		if err != nil {
+			return err
+		}
+		carts = append(carts, cart)
+		return nil
+	})
+	return carts, err
+}
+
+// postgresProfileStore stores profiles as JSON in the profiles table
+type postgresProfileStore struct {
+	*postgresStore
+}
+
+func (s *postgresProfileStore) Get(ctx context.Context, userID string) (*Profile, error) {
+	var body []byte
+	found, err := s.queryRow(ctx, "profile.get", []interface{}{userID}, &body)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w for user %s", ErrProfileNotFound, userID)
+	}
+	var profile Profile
+	if err := json.Unmarshal(body, &profile); err != nil {
+		return nil, fmt.Errorf("failed to decode profile %s: %w", userID, err)
+	}
+	return &profile, nil
+}
+
+func (s *postgresProfileStore) Put(ctx context.Context, profile *Profile) error {
+	body, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile %s: %w", profile.UserID, err)
+	}
+	return s.exec(ctx, "profile.put", profile.UserID, string(body))
+}
+
+func (s *postgresProfileStore) Delete(ctx context.Context, userID string) error {
+	return s.exec(ctx, "profile.delete", userID)
+}
+
+func (s *postgresProfileStore) List(ctx context.Context) ([]*Profile, error) {
+	var profiles []*Profile
+	err := s.query(ctx, "profile.list", func(rows *sql.Rows) error {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			return fmt.Errorf("postgres profile.list: %w", err)
+		}
+		var profile Profile
+		if err := json.Unmarshal(body, &profile); err != nil {
+			return fmt.Errorf("failed to decode profile: %w", err)
+		}
+		profiles = append(profiles, &profile)
+		return nil
+	})
+	return profiles, err
+}
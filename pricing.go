@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PricingRule is a config-defined price adjustment. All conditions that are
+// set must hold for the rule to apply to a cart line.
+type PricingRule struct {
+	Name string `json:"name"`
+
+	// Cart-level conditions
+	StartHour   *int     `json:"start_hour,omitempty"` // local hour window [start, end)
+	EndHour     *int     `json:"end_hour,omitempty"`
+	Weekdays    []string `json:"weekdays,omitempty"` // e.g. ["sat", "sun"]
+	MinSubtotal float64  `json:"min_subtotal,omitempty"`
+
+	// Line-level conditions
+	ItemIDs     []string `json:"item_ids,omitempty"`
+	MinQuantity int      `json:"min_quantity,omitempty"`
+
+	// Adjustment applied to matching lines
+	PercentOff float64 `json:"percent_off,omitempty"`
+	AmountOff  float64 `json:"amount_off,omitempty"` // per unit
+}
+
+// validate checks a rule for obviously invalid values
+func (pr PricingRule) validate() error {
+	switch {
+	case pr.Name == "":
+		return errors.New("pricing rule name is required")
+	case pr.PercentOff < 0 || pr.PercentOff > 100:
+		return fmt.Errorf("pricing rule %s: percent_off must be between 0 and 100", pr.Name)
+	case pr.AmountOff < 0:
+		return fmt.Errorf("pricing rule %s: amount_off must not be negative", pr.Name)
+	case pr.PercentOff == 0 && pr.AmountOff == 0:
+		return fmt.Errorf("pricing rule %s: no adjustment configured", pr.Name)
+	case (pr.StartHour == nil) != (pr.EndHour == nil):
+		return fmt.Errorf("pricing rule %s: start_hour and end_hour must be set together", pr.Name)
+	case pr.StartHour != nil && (*pr.StartHour < 0 || *pr.StartHour > 23 || *pr.EndHour < 0 || *pr.EndHour > 24):
+		return fmt.Errorf("pricing rule %s: hours must be within 0-24", pr.Name)
+	}
+	for _, day := range pr.Weekdays {
+		if _, ok := weekdayNames[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("pricing rule %s: unknown weekday %q", pr.Name, day)
+		}
+	}
+	return nil
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParsePricingRules parses a JSON array of pricing rules
+func ParsePricingRules(spec string) ([]PricingRule, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var rules []PricingRule
+	if err := json.Unmarshal([]byte(spec), &rules); err != nil {
+		return nil, fmt.Errorf("invalid pricing rules JSON: %w", err)
+	}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// TotalsLine is the priced view of a single cart line
+type TotalsLine struct {
+	ItemID       string   `json:"item_id"`
+	Quantity     int      `json:"quantity"`
+	UnitPrice    float64  `json:"unit_price"`
+	Subtotal     float64  `json:"subtotal"`
+	Discount     float64  `json:"discount"`
+	Total        float64  `json:"total"`
+	AppliedRules []string `json:"applied_rules,omitempty"`
+}
+
+// CartTotals is the priced view of a cart
+type CartTotals struct {
+	UserID   string       `json:"user_id"`
+	Lines    []TotalsLine `json:"lines"`
+	Subtotal float64      `json:"subtotal"`
+	Discount float64      `json:"discount"`
+	Total    float64      `json:"total"` // including shipping
+
+	Shipping *ShippingEstimate `json:"shipping,omitempty"`
+}
+
+// PricingEngine evaluates pricing rules while computing cart totals
+type PricingEngine struct {
+	rules    []PricingRule
+	calendar *ReportingCalendar
+	tracer   trace.Tracer
+
+	// OpenTelemetry Metrics
+	applicationCounter metric.Int64Counter // Counter: rule applications per rule
+}
+
+// NewPricingEngine creates an engine evaluating rules in the local time of
+// each tenant's reporting timezone
+func NewPricingEngine(rules []PricingRule, calendar *ReportingCalendar) (*PricingEngine, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	engine := &PricingEngine{
+		rules:    rules,
+		calendar: calendar,
+		tracer:   otel.Tracer("shopping-cart-service"),
+	}
+
+	var err error
+	engine.applicationCounter, err = meter.Int64Counter(
+		"pricing_rule_applications_total",
+		metric.WithDescription("Total number of cart lines a pricing rule was applied to"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pricing rule counter: %w", err)
+	}
+
+	return engine, nil
+}
+
+// roundCents rounds a monetary amount to two decimal places
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// cartConditionsHold checks the cart-level conditions of a rule at local, the
+// time in the zone the rule's hours and weekdays refer to
+func (pe *PricingEngine) cartConditionsHold(rule PricingRule, local time.Time, subtotal float64) bool {
+	if rule.StartHour != nil {
+		hour := local.Hour()
+		start, end := *rule.StartHour, *rule.EndHour
+		inWindow := hour >= start && hour < end
+		if start > end {
+			// Window wraps midnight, e.g. 22-2
+			inWindow = hour >= start || hour < end
+		}
+		if !inWindow {
+			return false
+		}
+	}
+
+	if len(rule.Weekdays) > 0 {
+		matched := false
+		for _, day := range rule.Weekdays {
+			if weekdayNames[strings.ToLower(day)] == local.Weekday() {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return subtotal >= rule.MinSubtotal
+}
+
+// lineConditionsHold checks the line-level conditions of a rule
+func lineConditionsHold(rule PricingRule, item CartItem) bool {
+	if item.Quantity < rule.MinQuantity {
+		return false
+	}
+	if len(rule.ItemIDs) == 0 {
+		return true
+	}
+	for _, id := range rule.ItemIDs {
+		if id == item.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Price computes totals for a cart, applying every matching rule in order
+func (pe *PricingEngine) Price(ctx context.Context, cart *Cart) *CartTotals {
+	ctx, span := pe.tracer.Start(ctx, "pricing.evaluate_rules",
+		trace.WithAttributes(attribute.Int("pricing.rules_configured", len(pe.rules))),
+	)
+	defer span.End()
+
+	totals := &CartTotals{UserID: cart.UserID, Lines: make([]TotalsLine, 0, len(cart.Items))}
+	for _, item := range cart.Items {
+		totals.Subtotal += float64(item.Quantity) * item.Price
+	}
+	totals.Subtotal = roundCents(totals.Subtotal)
+
+	local := time.Now().In(pe.calendar.Location(tenantID(ctx)))
+	active := make([]PricingRule, 0, len(pe.rules))
+	for _, rule := range pe.rules {
+		if pe.cartConditionsHold(rule, local, totals.Subtotal) {
+			active = append(active, rule)
+		}
+	}
+
+	applications := 0
+	for _, item := range cart.Items {
+		line := TotalsLine{
+			ItemID:    item.ID,
+			Quantity:  item.Quantity,
+			UnitPrice: item.Price,
+			Subtotal:  roundCents(float64(item.Quantity) * item.Price),
+		}
+
+		remaining := line.Subtotal
+		for _, rule := range active {
+			if !lineConditionsHold(rule, item) || remaining <= 0 {
+				continue
+			}
+
+			discount := remaining*rule.PercentOff/100 + rule.AmountOff*float64(item.Quantity)
+			discount = math.Min(roundCents(discount), remaining)
+			remaining = roundCents(remaining - discount)
+
+			line.Discount = roundCents(line.Discount + discount)
+			line.AppliedRules = append(line.AppliedRules, rule.Name)
+			applications++
+
+			pe.applicationCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("rule", rule.Name)))
+		}
+
+		line.Total = remaining
+		totals.Discount = roundCents(totals.Discount + line.Discount)
+		totals.Lines = append(totals.Lines, line)
+	}
+	totals.Total = roundCents(totals.Subtotal - totals.Discount)
+
+	span.SetAttributes(
+		attribute.Int("pricing.rules_active", len(active)),
+		attribute.Int("pricing.rule_applications", applications),
+		attribute.Float64("pricing.discount", totals.Discount),
+	)
+
+	return totals
+}
+
+// CalculateTotals prices a user's current cart, shipping to the default
+// destination in their profile
+func (cs *CartService) CalculateTotals(ctx context.Context, userID string) (*CartTotals, error) {
+	cart, err := cs.GetCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	_, region, err := cs.shippingDestination(ctx, userID, "")
+	if err != nil {
+		return nil, err
+	}
+	return cs.priceCart(ctx, cart, region)
+}
+
+func (ms *MetricsServer) handleCartTotals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+		return
+	}
+	setRequestUser(r.Context(), userID)
+
+	totals, err := ms.service.CalculateTotals(r.Context(), userID)
+	if err != nil {
+		ms.writeServiceError(w, r, err, userID)
+		return
+	}
+
+	writeJSON(w, r, totals)
+}
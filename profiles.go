@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSavedAddresses bounds the address book of a single profile
+const maxSavedAddresses = 10
+
+// Errors returned by profile operations
+var (
+	ErrProfileNotFound  = errors.New("profile not found")
+	ErrAddressNotFound  = errors.New("address not found")
+	ErrTooManyAddresses = errors.New("too many saved addresses")
+	ErrInvalidProfile   = errors.New("invalid profile")
+)
+
+// Address is a saved shipping address
+type Address struct {
+	ID         string `json:"id"`
+	Label      string `json:"label,omitempty"`
+	Recipient  string `json:"recipient"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2
+}
+
+// Profile holds a customer's display name, regional defaults and saved
+// addresses. Region and currency are preferences: the region picks shipping
+// tiers when no address is given, the currency is reported to clients but
+// prices are not converted.
+type Profile struct {
+	UserID           string    `json:"user_id"`
+	DisplayName      string    `json:"display_name"`
+	Region           string    `json:"region,omitempty"`   // ISO 3166-1 alpha-2
+	Currency         string    `json:"currency,omitempty"` // ISO 4217
+	Addresses        []Address `json:"addresses"`
+	DefaultAddressID string    `json:"default_address_id,omitempty"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// clone returns a copy of the profile that shares no slices with it
+func (p *Profile) clone() *Profile {
+	profileCopy := *p
+	profileCopy.Addresses = append([]Address(nil), p.Addresses...)
+	return &profileCopy
+}
+
+// address returns the saved address with the given ID
+func (p *Profile) address(addressID string) (*Address, bool) {
+	for i := range p.Addresses {
+		if p.Addresses[i].ID == addressID {
+			return &p.Addresses[i], true
+		}
+	}
+	return nil, false
+}
+
+// validRegion reports whether code looks like an ISO 3166-1 alpha-2 code
+func validRegion(code string) bool {
+	return len(code) == 2 && isUpperASCII(code)
+}
+
+// validCurrency reports whether code looks like an ISO 4217 code
+func validCurrency(code string) bool {
+	return len(code) == 3 && isUpperASCII(code)
+}
+
+func isUpperASCII(s string) bool {
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ProfileStore persists customer profiles. Implementations return copies so
+// callers may modify results freely.
+type ProfileStore interface {
+	Get(ctx context.Context, userID string) (*Profile, error)
+	Put(ctx context.Context, profile *Profile) error
+	Delete(ctx context.Context, userID string) error
+	List(ctx context.Context) ([]*Profile, error)
+}
+
+// memoryProfileStore keeps profiles in process memory
+type memoryProfileStore struct {
+	profiles map[string]*Profile
+	mutex    sync.RWMutex
+}
+
+// newMemoryProfileStore creates an empty in-memory profile store
+func newMemoryProfileStore() *memoryProfileStore {
+	return &memoryProfileStore{profiles: make(map[string]*Profile)}
+}
+
+func (s *memoryProfileStore) Get(_ context.Context, userID string) (*Profile, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	profile, exists := s.profiles[userID]
+	if !exists {
+		return nil, fmt.Errorf("%w for user %s", ErrProfileNotFound, userID)
+	}
+	return profile.clone(), nil
+}
+
+func (s *memoryProfileStore) Put(_ context.Context, profile *Profile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.profiles[profile.UserID] = profile.clone()
+	return nil
+}
+
+func (s *memoryProfileStore) Delete(_ context.Context, userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.profiles, userID)
+	return nil
+}
+
+func (s *memoryProfileStore) List(_ context.Context) ([]*Profile, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	profiles := make([]*Profile, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		profiles = append(profiles, profile.clone())
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].UserID < profiles[j].UserID
+	})
+	return profiles, nil
+}
+
+// customerProfiles serializes read-modify-write updates to a ProfileStore
+type customerProfiles struct {
+	store ProfileStore
+	mutex sync.Mutex
+}
+
+// newCustomerProfiles creates a profile directory backed by store
+func newCustomerProfiles(store ProfileStore) *customerProfiles {
+	return &customerProfiles{store: store}
+}
+
+// update applies fn to the user's profile, creating an empty profile first
+// when create is set, and stores the result
+func (cp *customerProfiles) update(ctx context.Context, userID string, create bool, fn func(*Profile) error) (*Profile, error) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	profile, err := cp.store.Get(ctx, userID)
+	if errors.Is(err, ErrProfileNotFound) && create {
+		profile, err = &Profile{UserID: userID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fn(profile); err != nil {
+		return nil, err
+	}
+	profile.UpdatedAt = time.Now().UTC()
+	if err := cp.store.Put(ctx, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ProfileUpdate holds the editable profile fields
+type ProfileUpdate struct {
+	DisplayName string `json:"display_name"`
+	Region      string `json:"region"`
+	Currency    string `json:"currency"`
+}
+
+// GetProfile returns a user's profile
+func (cs *CartService) GetProfile(ctx context.Context, userID string) (*Profile, error) {
+	return cs.profiles.store.Get(ctx, userID)
+}
+
+// SaveProfile creates or updates a user's display name and regional
+// defaults. Saved addresses are kept.
+func (cs *CartService) SaveProfile(ctx context.Context, userID string, update ProfileUpdate) (*Profile, error) {
+	region := strings.ToUpper(strings.TrimSpace(update.Region))
+	if region != "" && !validRegion(region) {
+		return nil, fmt.Errorf("%w: region %q", ErrInvalidProfile, update.Region)
+	}
+	currency := strings.ToUpper(strings.TrimSpace(update.Currency))
+	if currency != "" && !validCurrency(currency) {
+		return nil, fmt.Errorf("%w: currency %q", ErrInvalidProfile, update.Currency)
+	}
+
+	return cs.profiles.update(ctx, userID, true, func(profile *Profile) error {
+		profile.DisplayName = strings.TrimSpace(update.DisplayName)
+		profile.Region = region
+		profile.Currency = currency
+		return nil
+	})
+}
+
+// AddAddress validates an address and saves its normalized form to a user's
+// profile, creating the profile if needed. The first address, or one saved
+// with makeDefault, becomes the default shipping address.
+func (cs *CartService) AddAddress(ctx context.Context, userID string, address Address, makeDefault bool) (*Address, error) {
+	address, err := cs.addressValidation.Validate(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	address.ID = "addr_" + newRequestID()[:16]
+
+	_, err = cs.profiles.update(ctx, userID, true, func(profile *Profile) error {
+		if len(profile.Addresses) >= maxSavedAddresses {
+			return fmt.Errorf("%w: limit is %d", ErrTooManyAddresses, maxSavedAddresses)
+		}
+		profile.Addresses = append(profile.Addresses, address)
+		if makeDefault || profile.DefaultAddressID == "" {
+			profile.DefaultAddressID = address.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// RemoveAddress deletes a saved address. Removing the default address
+// promotes the oldest remaining one.
+func (cs *CartService) RemoveAddress(ctx context.Context, userID, addressID string) error {
+	_, err := cs.profiles.update(ctx, userID, false, func(profile *Profile) error {
+		kept := profile.Addresses[:0]
+		for _, address := range profile.Addresses {
+			if address.ID != addressID {
+				kept = append(kept, address)
+			}
+		}
+		if len(kept) == len(profile.Addresses) {
+			return fmt.Errorf("%w: %s", ErrAddressNotFound, addressID)
+		}
+		profile.Addresses = kept
+
+		if profile.DefaultAddressID == addressID {
+			profile.DefaultAddressID = ""
+			if len(kept) > 0 {
+				profile.DefaultAddressID = kept[0].ID
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrProfileNotFound) {
+		return fmt.Errorf("%w: %s", ErrAddressNotFound, addressID)
+	}
+	return err
+}
+
+// shippingDestination resolves where a user's order ships: the named saved
+// address, else the profile's default address. The region is the address
+// country, falling back to the profile region. Users without a profile ship
+// to an unknown destination at the default tiers.
+func (cs *CartService) shippingDestination(ctx context.Context, userID, addressID string) (*Address, string, error) {
+	profile, err := cs.profiles.store.Get(ctx, userID)
+	if errors.Is(err, ErrProfileNotFound) {
+		if addressID != "" {
+			return nil, "", fmt.Errorf("%w: %s", ErrAddressNotFound, addressID)
+		}
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if addressID == "" {
+		addressID = profile.DefaultAddressID
+	}
+	if addressID == "" {
+		return nil, profile.Region, nil
+	}
+
+	address, found := profile.address(addressID)
+	if !found {
+		return nil, "", fmt.Errorf("%w: %s", ErrAddressNotFound, addressID)
+	}
+	return address, address.Country, nil
+}
+
+func (ms *MetricsServer) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+			return
+		}
+		setRequestUser(r.Context(), userID)
+
+		profile, err := ms.service.GetProfile(r.Context(), userID)
+		if err != nil {
+			ms.writeServiceError(w, r, err, userID)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	case http.MethodPut:
+		var req struct {
+			UserID string `json:"user_id"`
+			ProfileUpdate
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		setRequestUser(r.Context(), req.UserID)
+
+		if req.UserID == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+			return
+		}
+
+		profile, err := ms.service.SaveProfile(r.Context(), req.UserID, req.ProfileUpdate)
+		switch {
+		case errors.Is(err, ErrInvalidProfile):
+			ms.rejectInvalidRequest(w, r, constraintViolation("profile", msgInvalidFieldValue))
+			return
+		case err != nil:
+			ms.writeServiceError(w, r, err, req.UserID)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
+
+func (ms *MetricsServer) handleProfileAddresses(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			UserID  string  `json:"user_id"`
+			Address Address `json:"address"`
+			Default bool    `json:"default"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		setRequestUser(r.Context(), req.UserID)
+
+		if req.UserID == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+			return
+		}
+
+		address, err := ms.service.AddAddress(r.Context(), req.UserID, req.Address, req.Default)
+		var invalid *AddressValidationError
+		switch {
+		case errors.As(err, &invalid):
+			ms.rejectInvalidRequest(w, r, constraintViolation("address."+invalid.Field, msgInvalidFieldValue))
+			return
+		case err != nil:
+			ms.writeServiceError(w, r, err, maxSavedAddresses)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(address)
+
+	case http.MethodDelete:
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+			return
+		}
+		setRequestUser(r.Context(), userID)
+
+		addressID := r.URL.Query().Get("address_id")
+		if addressID == "" {
+			writeError(w, r, http.StatusBadRequest, msgMissingParameter, "address_id")
+			return
+		}
+
+		err := ms.service.RemoveAddress(r.Context(), userID, addressID)
+		if err != nil {
+			ms.writeServiceError(w, r, err, addressID)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Sampling of the mutex and block profiles, which are off by default: one
+// in mutexProfileFraction contention events, and a blocking event per
+// blockProfileRate nanoseconds spent blocked
+const (
+	mutexProfileFraction = 5
+	blockProfileRate     = int(time.Millisecond)
+)
+
+// Results of a profile push
+const (
+	profilePushed  = "success"
+	profileFailed  = "failure"
+	profileSkipped = "skipped" // the CPU profiler was busy, e.g. with /debug/pprof/profile
+)
+
+// ContinuousProfiler takes pprof profiles every interval and pushes them
+// to a Pyroscope-compatible server's /ingest API, labeled with the service
+// version and the configured labels, so CPU and memory regressions can be
+// tracked across deploys next to the traces.
+type ContinuousProfiler struct {
+	cfg      config.ProfilingConfig
+	endpoint string
+	labels   string // "{service_version=1.0.0,...}", appended to profile names
+	client   *http.Client
+
+	// OpenTelemetry Metrics
+	pushCounter metric.Int64Counter // Counter: profile pushes by type and result
+}
+
+// NewContinuousProfiler creates the profiler for cfg. It returns nil when
+// no endpoint is configured, disabling profiling.
+func NewContinuousProfiler(cfg config.ProfilingConfig) (*ContinuousProfiler, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+
+	labels := []string{"service_version=" + serviceVersion}
+	for name, value := range cfg.Labels {
+		labels = append(labels, name+"="+profileLabelValue(value))
+	}
+	sort.Strings(labels[1:])
+
+	pushCounter, err := otel.Meter("shopping-cart-service").Int64Counter(
+		"profiles_pushed_total",
+		metric.WithDescription("Total number of continuous profiling pushes by profile type and result (success, failure, skipped)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create profile push counter: %w", err)
+	}
+
+	return &ContinuousProfiler{
+		cfg:         cfg,
+		endpoint:    strings.TrimSuffix(cfg.Endpoint, "/"),
+		labels:      "{" + strings.Join(labels, ",") + "}",
+		client:      &http.Client{Timeout: 10 * time.Second, Transport: outboundPools.transport("profiling")},
+		pushCounter: pushCounter,
+	}, nil
+}
+
+// profileLabelValue replaces the characters that delimit labels in profile
+// names
+func profileLabelValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '=', '{', '}':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// Run profiles until ctx is done. The CPU profile runs through each
+// interval; the others are snapshots taken at its end.
+func (p *ContinuousProfiler) Run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	if p.enabled(config.ProfileMutex) {
+		runtime.SetMutexProfileFraction(mutexProfileFraction)
+	}
+	if p.enabled(config.ProfileBlock) {
+		runtime.SetBlockProfileRate(blockProfileRate)
+	}
+	slog.Info("Continuous profiling started", "endpoint", p.endpoint, "interval", p.cfg.Interval.String(), "types", p.cfg.Types)
+
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		from := time.Now()
+		var cpu *bytes.Buffer
+		if p.enabled(config.ProfileCPU) {
+			cpu = new(bytes.Buffer)
+			if err := pprof.StartCPUProfile(cpu); err != nil {
+				slog.DebugContext(ctx, "CPU profile skipped", "error", err)
+				p.record(ctx, config.ProfileCPU, profileSkipped)
+				cpu = nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if cpu != nil {
+				pprof.StopCPUProfile()
+			}
+			return
+		}
+
+		until := time.Now()
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			p.push(ctx, config.ProfileCPU, cpu.Bytes(), from, until)
+		}
+		for _, profile := range p.cfg.Types {
+			if profile == config.ProfileCPU {
+				continue
+			}
+			var snapshot bytes.Buffer
+			if err := pprof.Lookup(profile).WriteTo(&snapshot, 0); err != nil {
+				slog.WarnContext(ctx, "Failed to take profile", "type", profile, "error", err)
+				p.record(ctx, profile, profileFailed)
+				continue
+			}
+			p.push(ctx, profile, snapshot.Bytes(), from, until)
+		}
+	}
+}
+
+// enabled reports whether the profile type is taken
+func (p *ContinuousProfiler) enabled(profile string) bool {
+	for _, enabled := range p.cfg.Types {
+		if enabled == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// push uploads one profile covering from to until, logging failures; a
+// lost profile leaves a gap but doesn't stop profiling
+func (p *ContinuousProfiler) push(ctx context.Context, profile string, data []byte, from, until time.Time) {
+	if err := p.upload(ctx, profile, data, from, until); err != nil {
+		slog.WarnContext(ctx, "Failed to push profile", "type", profile, "error", err)
+		p.record(ctx, profile, profileFailed)
+		return
+	}
+	p.record(ctx, profile, profilePushed)
+}
+
+// upload sends a profile to the /ingest API as a multipart pprof upload,
+// named <service>.<type>{labels}
+func (p *ContinuousProfiler) upload(ctx context.Context, profile string, data []byte, from, until time.Time) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"name":       {serviceName + "." + profile + p.labels},
+		"from":       {strconv.FormatInt(from.Unix(), 10)},
+		"until":      {strconv.FormatInt(until.Unix(), 10)},
+		"spyName":    {"gospy"},
+		"sampleRate": {"100"}, // the Go CPU profiler's rate, in Hz
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/ingest?"+query.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	for name, value := range p.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("profiling server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// record counts a profile push by result
+func (p *ContinuousProfiler) record(ctx context.Context, profile, result string) {
+	p.pushCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("type", profile),
+		attribute.String("result", result),
+	))
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+	"shopping-cart-service/events"
+)
+
+// Recommendation list sizes
+const (
+	defaultRecommendations = 5
+	maxRecommendations     = 50
+)
+
+// AnalyticsTotals is cart and order activity in one namespace
+type AnalyticsTotals struct {
+	Namespace      string    `json:"namespace,omitempty"`
+	ProductViews   int       `json:"product_views"` // reported by clients
+	CartsOpened    int       `json:"carts_opened"`  // reported by clients
+	UnitsAdded     int       `json:"units_added"`
+	UnitsRemoved   int       `json:"units_removed"`
+	CartsExpired   int       `json:"carts_expired"`
+	ExpiredValue   float64   `json:"expired_value"` // left in expired carts
+	Orders         int       `json:"orders"`
+	Revenue        float64   `json:"revenue"`         // order totals including shipping
+	ConversionRate float64   `json:"conversion_rate"` // orders over orders and expired carts
+	LastEventAt    time.Time `json:"last_event_at"`
+}
+
+// eventAnalytics is the analytics projection: running totals of the event
+// stream per namespace
+type eventAnalytics struct {
+	totals map[string]*AnalyticsTotals // by namespace
+	mutex  sync.RWMutex
+}
+
+func newEventAnalytics() *eventAnalytics {
+	return &eventAnalytics{totals: make(map[string]*AnalyticsTotals)}
+}
+
+// apply is the analytics consumer's handler
+func (ea *eventAnalytics) apply(_ context.Context, envelope *events.Envelope) error {
+	ea.mutex.Lock()
+	defer ea.mutex.Unlock()
+
+	totals, ok := ea.totals[envelope.Namespace]
+	if !ok {
+		totals = &AnalyticsTotals{Namespace: envelope.Namespace}
+		ea.totals[envelope.Namespace] = totals
+	}
+
+	switch envelope.Type {
+	case events.TypeProductViewed:
+		totals.ProductViews++
+	case events.TypeCartOpened:
+		totals.CartsOpened++
+	case events.TypeCartItemAdded:
+		var event events.CartItemAdded
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		totals.UnitsAdded += event.Quantity
+	case events.TypeCartItemRemoved:
+		var event events.CartItemRemoved
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		totals.UnitsRemoved += event.Quantity
+	case events.TypeCartExpired:
+		var event events.CartExpired
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		totals.CartsExpired++
+		totals.ExpiredValue += event.Value
+	case events.TypeOrderPlaced:
+		var event events.OrderPlaced
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		totals.Orders++
+		totals.Revenue += event.Total
+	}
+
+	if closed := totals.Orders + totals.CartsExpired; closed > 0 {
+		totals.ConversionRate = float64(totals.Orders) / float64(closed)
+	}
+	if envelope.OccurredAt.After(totals.LastEventAt) {
+		totals.LastEventAt = envelope.OccurredAt
+	}
+	return nil
+}
+
+// snapshot returns the totals of every namespace, by name
+func (ea *eventAnalytics) snapshot() []AnalyticsTotals {
+	ea.mutex.RLock()
+	defer ea.mutex.RUnlock()
+
+	snapshot := make([]AnalyticsTotals, 0, len(ea.totals))
+	for _, totals := range ea.totals {
+		snapshot = append(snapshot, *totals)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Namespace < snapshot[j].Namespace })
+	return snapshot
+}
+
+func (ea *eventAnalytics) fresh() projection { return newEventAnalytics() }
+
+// diff lists the totals that differ from rebuilt's, by namespace
+func (ea *eventAnalytics) diff(rebuilt projection) []string {
+	live := make(map[string]AnalyticsTotals)
+	for _, totals := range ea.snapshot() {
+		live[totals.Namespace] = totals
+	}
+	replayed := make(map[string]AnalyticsTotals)
+	for _, totals := range rebuilt.(*eventAnalytics).snapshot() {
+		replayed[totals.Namespace] = totals
+	}
+
+	var differences []string
+	for _, namespace := range unionKeys(live, replayed) {
+		a, b := live[namespace], replayed[namespace]
+		field := func(name string, liveValue, rebuiltValue interface{}) {
+			if liveValue != rebuiltValue {
+				differences = append(differences, fmt.Sprintf("namespace %s %s: live %v, rebuilt %v", namespaceLabel(namespace), name, liveValue, rebuiltValue))
+			}
+		}
+		field("product_views", a.ProductViews, b.ProductViews)
+		field("carts_opened", a.CartsOpened, b.CartsOpened)
+		field("units_added", a.UnitsAdded, b.UnitsAdded)
+		field("units_removed", a.UnitsRemoved, b.UnitsRemoved)
+		field("carts_expired", a.CartsExpired, b.CartsExpired)
+		field("expired_value", a.ExpiredValue, b.ExpiredValue)
+		field("orders", a.Orders, b.Orders)
+		field("revenue", a.Revenue, b.Revenue)
+	}
+	return differences
+}
+
+func (ea *eventAnalytics) replace(rebuilt projection) {
+	totals := rebuilt.(*eventAnalytics).totals
+
+	ea.mutex.Lock()
+	defer ea.mutex.Unlock()
+	ea.totals = totals
+}
+
+// Recommendation is a product often in the same carts as another
+type Recommendation struct {
+	ProductID string  `json:"product_id"`
+	Name      string  `json:"name"`
+	Price     float64 `json:"price"`
+	Score     int     `json:"score"` // carts the two products were in together
+}
+
+// recommender is the recommendations projection: how often each pair of
+// products has been in a cart together, per namespace
+type recommender struct {
+	carts map[string]map[string]int            // namespace and user -> product -> units
+	pairs map[string]map[string]map[string]int // namespace -> product -> other product -> carts
+	mutex sync.RWMutex
+}
+
+func newRecommender() *recommender {
+	return &recommender{
+		carts: make(map[string]map[string]int),
+		pairs: make(map[string]map[string]map[string]int),
+	}
+}
+
+// apply is the recommendations consumer's handler. A product first
+// entering a cart pairs with every product already in it.
+func (rc *recommender) apply(_ context.Context, envelope *events.Envelope) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	switch envelope.Type {
+	case events.TypeCartItemAdded:
+		var event events.CartItemAdded
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		key := envelope.Namespace + "\x00" + event.UserID
+		cart := rc.carts[key]
+		if cart == nil {
+			cart = make(map[string]int)
+			rc.carts[key] = cart
+		}
+		if cart[event.ItemID] == 0 {
+			for other := range cart {
+				rc.pair(envelope.Namespace, event.ItemID, other)
+				rc.pair(envelope.Namespace, other, event.ItemID)
+			}
+		}
+		cart[event.ItemID] += event.Quantity
+	case events.TypeCartItemRemoved:
+		var event events.CartItemRemoved
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		key := envelope.Namespace + "\x00" + event.UserID
+		if cart := rc.carts[key]; cart != nil {
+			cart[event.ItemID] -= event.Quantity
+			if cart[event.ItemID] <= 0 {
+				delete(cart, event.ItemID)
+			}
+		}
+	case events.TypeCartExpired:
+		var event events.CartExpired
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		delete(rc.carts, envelope.Namespace+"\x00"+event.UserID)
+	case events.TypeOrderPlaced:
+		// A partial checkout leaves lines in the cart; they pair again
+		// only if added again
+		var event events.OrderPlaced
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		delete(rc.carts, envelope.Namespace+"\x00"+event.UserID)
+	}
+	return nil
+}
+
+// pair counts other in a cart with product. Callers must hold rc.mutex.
+func (rc *recommender) pair(namespace, product, other string) {
+	products := rc.pairs[namespace]
+	if products == nil {
+		products = make(map[string]map[string]int)
+		rc.pairs[namespace] = products
+	}
+	if products[product] == nil {
+		products[product] = make(map[string]int)
+	}
+	products[product][other]++
+}
+
+func (rc *recommender) fresh() projection { return newRecommender() }
+
+// diff lists the product pair counts and open carts that differ from
+// rebuilt's
+func (rc *recommender) diff(rebuilt projection) []string {
+	other := rebuilt.(*recommender)
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+
+	var differences []string
+	for _, namespace := range unionKeys(rc.pairs, other.pairs) {
+		live, replayed := rc.pairs[namespace], other.pairs[namespace]
+		for _, product := range unionKeys(live, replayed) {
+			for _, paired := range unionKeys(live[product], replayed[product]) {
+				if a, b := live[product][paired], replayed[product][paired]; a != b {
+					differences = append(differences, fmt.Sprintf("namespace %s pair %s+%s: live %d, rebuilt %d", namespaceLabel(namespace), product, paired, a, b))
+				}
+			}
+		}
+	}
+	for _, key := range unionKeys(rc.carts, other.carts) {
+		namespace, user, _ := strings.Cut(key, "\x00")
+		for _, product := range unionKeys(rc.carts[key], other.carts[key]) {
+			if a, b := rc.carts[key][product], other.carts[key][product]; a != b {
+				differences = append(differences, fmt.Sprintf("namespace %s cart %s %s: live %d units, rebuilt %d", namespaceLabel(namespace), user, product, a, b))
+			}
+		}
+	}
+	return differences
+}
+
+func (rc *recommender) replace(rebuilt projection) {
+	other := rebuilt.(*recommender)
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.carts, rc.pairs = other.carts, other.pairs
+}
+
+// unionKeys returns the keys of a and b, sorted
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// namespaceLabel names namespace in messages, the default one included
+func namespaceLabel(namespace string) string {
+	if namespace == "" {
+		return config.DefaultNamespace
+	}
+	return namespace
+}
+
+// recommend returns up to limit products most often in carts with product,
+// most frequent first, leaving out ones no longer in catalog
+func (rc *recommender) recommend(namespace, product string, limit int, catalog *Catalog) []Recommendation {
+	rc.mutex.RLock()
+	scores := rc.pairs[namespace][product]
+	others := make([]string, 0, len(scores))
+	for other := range scores {
+		others = append(others, other)
+	}
+	sort.Slice(others, func(i, j int) bool {
+		if scores[others[i]] != scores[others[j]] {
+			return scores[others[i]] > scores[others[j]]
+		}
+		return others[i] < others[j]
+	})
+	ranked := make([]Recommendation, 0, len(others))
+	for _, other := range others {
+		ranked = append(ranked, Recommendation{ProductID: other, Score: scores[other]})
+	}
+	rc.mutex.RUnlock()
+
+	recommendations := []Recommendation{}
+	for _, recommendation := range ranked {
+		if len(recommendations) == limit {
+			break
+		}
+		found, err := catalog.Get(recommendation.ProductID)
+		if err != nil {
+			continue
+		}
+		recommendation.Name, recommendation.Price = found.Name, found.Price
+		recommendations = append(recommendations, recommendation)
+	}
+	return recommendations
+}
+
+// notifyFromEvents is the notifications consumer's handler: it confirms
+// placed orders and tells users their idle cart expired. A failed delivery
+// is returned so the consumer retries it.
+func (cs *CartService) notifyFromEvents(ctx context.Context, envelope *events.Envelope) error {
+	notification := Notification{CreatedAt: envelope.OccurredAt}
+
+	switch envelope.Type {
+	case events.TypeOrderPlaced:
+		var event events.OrderPlaced
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		notification.Type, notification.UserID = notificationOrderPlaced, event.UserID
+		notification.Message = fmt.Sprintf("Order %s of %d items for %.2f was placed", event.OrderID, event.ItemCount, event.Total)
+	case events.TypeCartExpired:
+		var event events.CartExpired
+		if err := envelope.Unmarshal(&event); err != nil {
+			return err
+		}
+		notification.Type, notification.UserID = notificationCartExpired, event.UserID
+		notification.Message = fmt.Sprintf("Your cart of %d items expired after being left idle", event.ItemCount)
+	default:
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cs.notifications.timeout)
+	defer cancel()
+	return cs.notifications.Deliver(ctx, notification)
+}
+
+// handleAnalytics serves GET /admin/analytics, the analytics projection
+func (ms *MetricsServer) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespaces": ms.service.analytics.snapshot(),
+	})
+}
+
+// handleRecommendations serves GET /catalog/recommendations?id=..., the
+// products most often in carts with the given one
+func (ms *MetricsServer) handleRecommendations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	productID := r.URL.Query().Get("id")
+	if productID == "" {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "id")
+		return
+	}
+	limit := defaultRecommendations
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxRecommendations {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "limit")
+			return
+		}
+		limit = parsed
+	}
+
+	ctx := r.Context()
+	catalog := ms.service.catalogFor(ctx)
+	if _, err := catalog.Get(productID); err != nil {
+		writeError(w, r, http.StatusNotFound, msgProductNotFound, productID)
+		return
+	}
+	namespace := ""
+	if ns := namespaceFrom(ctx); ns != nil {
+		namespace = ns.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"product_id":      productID,
+		"recommendations": ms.service.recommendations.recommend(namespace, productID, limit, catalog),
+	})
+}
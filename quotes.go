@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// defaultQuoteTTL is how long quoted totals are honored at checkout
+const defaultQuoteTTL = 15 * time.Minute
+
+// Errors returned when redeeming quote tokens
+var (
+	ErrInvalidQuote  = errors.New("invalid quote token")
+	ErrQuoteExpired  = errors.New("quote expired")
+	ErrQuoteMismatch = errors.New("cart changed since quote")
+)
+
+// quotePayload is the signed content of a quote token
+type quotePayload struct {
+	UserID      string      `json:"u"`
+	Key         string      `json:"k"` // storage key of the cart, tying the quote to its tenant and namespace
+	ExpiresAt   int64       `json:"e"`
+	Fingerprint string      `json:"f"`
+	Totals      *CartTotals `json:"t"`
+}
+
+// PriceQuoter issues signed quote tokens that hold cart totals for a limited
+// time. Like share links they are self-contained, so honoring a quote needs
+// no server-side state.
+type PriceQuoter struct {
+	secret []byte
+	ttl    time.Duration
+
+	// OpenTelemetry Metrics
+	quoteCounter metric.Int64Counter // Counter: quotes by result
+}
+
+// NewPriceQuoter creates a quoter signing with secret whose quotes are valid
+// for ttl
+func NewPriceQuoter(secret string, ttl time.Duration) (*PriceQuoter, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	key, err := tokenSecret(secret, "QUOTE_SECRET")
+	if err != nil {
+		return nil, err
+	}
+
+	quoter := &PriceQuoter{secret: key, ttl: ttl}
+
+	quoter.quoteCounter, err = meter.Int64Counter(
+		"price_quotes_total",
+		metric.WithDescription("Total number of price quotes by result (issued, honored, expired, mismatch, invalid)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create price quote counter: %w", err)
+	}
+
+	return quoter, nil
+}
+
+// cartFingerprint identifies the quoted lines so a quote cannot be applied
+// to a cart whose contents changed
+func cartFingerprint(items []CartItem) string {
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, fmt.Sprintf("%s:%d:%.2f", item.ID, item.Quantity, item.Price))
+	}
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "|")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Issue signs totals for the given cart lines
+func (pq *PriceQuoter) Issue(ctx context.Context, userID string, items []CartItem, totals *CartTotals) (string, time.Time, error) {
+	expiresAt := time.Now().Add(pq.ttl).UTC().Truncate(time.Second)
+
+	body, err := json.Marshal(quotePayload{
+		UserID:      userID,
+		Key:         storageKey(ctx, userID),
+		ExpiresAt:   expiresAt.Unix(),
+		Fingerprint: cartFingerprint(items),
+		Totals:      totals,
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to encode quote: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(body)
+	pq.record(ctx, "issued")
+	return payload + "." + signToken(pq.secret, payload), expiresAt, nil
+}
+
+// Redeem verifies a quote token for the given user and cart lines and
+// returns the quoted totals
+func (pq *PriceQuoter) Redeem(ctx context.Context, userID string, items []CartItem, token string) (*CartTotals, error) {
+	totals, err := pq.verify(ctx, userID, items, token)
+	switch {
+	case errors.Is(err, ErrQuoteExpired):
+		pq.record(ctx, "expired")
+	case errors.Is(err, ErrQuoteMismatch):
+		pq.record(ctx, "mismatch")
+	case err != nil:
+		pq.record(ctx, "invalid")
+	}
+	return totals, err
+}
+
+// verify checks the token signature, owner, expiry and cart fingerprint.
+// Quotes issued in another tenant or namespace than ctx's are invalid.
+func (pq *PriceQuoter) verify(ctx context.Context, userID string, items []CartItem, token string) (*CartTotals, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signToken(pq.secret, payload))) {
+		return nil, ErrInvalidQuote
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidQuote
+	}
+	var quote quotePayload
+	if err := json.Unmarshal(body, &quote); err != nil || quote.Totals == nil {
+		return nil, ErrInvalidQuote
+	}
+
+	if quote.UserID != userID || quote.Key != storageKey(ctx, userID) {
+		return nil, ErrInvalidQuote
+	}
+	if time.Now().After(time.Unix(quote.ExpiresAt, 0)) {
+		return nil, ErrQuoteExpired
+	}
+	if quote.Fingerprint != cartFingerprint(items) {
+		return nil, ErrQuoteMismatch
+	}
+	return quote.Totals, nil
+}
+
+// record counts a quote outcome
+func (pq *PriceQuoter) record(ctx context.Context, result string) {
+	pq.quoteCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+// Quote prices the selected lines of a user's cart, shipping to the given
+// saved address (the profile default when empty), and signs the totals
+func (cs *CartService) Quote(ctx context.Context, userID string, itemIDs []string, addressID string) (*CartTotals, string, time.Time, error) {
+	cart, err := cs.GetCart(ctx, userID)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	selected, _, err := selectLines(cart.Items, itemIDs)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	_, region, err := cs.shippingDestination(ctx, userID, addressID)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	totals, err := cs.priceCart(ctx, &Cart{UserID: userID, Items: selected}, region)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	token, expiresAt, err := cs.quotes.Issue(ctx, userID, selected, totals)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	return totals, token, expiresAt, nil
+}
+
+// writeQuoteError maps quote redemption failures to responses
+func writeQuoteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrQuoteExpired):
+		writeError(w, r, http.StatusGone, msgQuoteExpired)
+	case errors.Is(err, ErrQuoteMismatch):
+		writeError(w, r, http.StatusConflict, msgQuoteMismatch)
+	default:
+		writeError(w, r, http.StatusForbidden, msgInvalidQuote)
+	}
+}
+
+func (ms *MetricsServer) handleQuote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    string   `json:"user_id"`
+		ItemIDs   []string `json:"item_ids"`
+		AddressID string   `json:"address_id"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+
+	totals, token, expiresAt, err := ms.service.Quote(r.Context(), req.UserID, req.ItemIDs, req.AddressID)
+	switch {
+	case errors.Is(err, ErrItemNotFound):
+		ms.rejectInvalidRequest(w, r, constraintViolation("item_ids", msgInvalidFieldValue))
+		return
+	case errors.Is(err, ErrAddressNotFound):
+		ms.rejectInvalidRequest(w, r, constraintViolation("address_id", msgInvalidFieldValue))
+		return
+	case err != nil:
+		ms.writeServiceError(w, r, err, req.UserID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"totals":      totals,
+		"quote_token": token,
+		"expires_at":  expiresAt,
+	})
+}
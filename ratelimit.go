@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled are dropped
+const rateLimitSweepInterval = time.Minute
+
+// maxRateLimitBuckets bounds the buckets kept at once, so a flood of new
+// subjects between sweeps can't grow memory without limit. Past it an
+// arbitrary other bucket is forgotten.
+const maxRateLimitBuckets = 100000
+
+// tokenBucket is one subject's allowance under one rule
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter throttles requests per caller with token buckets. Requests
+// count against their authenticated subject, else the client IP; the user
+// a request names is the client's say-so, so it isn't trusted to pick the
+// bucket.
+type RateLimiter struct {
+	rules     []config.RateLimitConfig // longest prefix first
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+
+	// OpenTelemetry Metrics
+	limitedCounter metric.Int64Counter // Counter: requests rejected with 429
+}
+
+// NewRateLimiter creates a limiter enforcing rules. Without rules every
+// request passes.
+func NewRateLimiter(rules []config.RateLimitConfig) (*RateLimiter, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	sorted := make([]config.RateLimitConfig, len(rules))
+	copy(sorted, rules)
+	// Longest prefix first so the most specific rule wins
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+
+	rl := &RateLimiter{
+		rules:     sorted,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+
+	var err error
+	rl.limitedCounter, err = meter.Int64Counter(
+		"rate_limited_requests_total",
+		metric.WithDescription("Total number of requests rejected by the rate limiter by endpoint, rule and key type"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rate limited requests counter: %w", err)
+	}
+
+	return rl, nil
+}
+
+// wrap is the rate limit middleware. Allowed responses carry the
+// RateLimit-Limit and RateLimit-Remaining headers; rejected ones get 429
+// with Retry-After.
+func (rl *RateLimiter) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := rl.ruleFor(r.URL.Path)
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		subject, keyType := rateLimitSubject(r)
+		remaining, wait := rl.take(rule, subject, time.Now())
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rule.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		if remaining == 0 && wait > 0 {
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		if remaining < 0 {
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			rl.limitedCounter.Add(r.Context(), 1, metric.WithAttributes(
+				attribute.String("endpoint", endpointOf(r)),
+				attribute.String("rule", rule.Prefix),
+				attribute.String("key_type", keyType),
+			))
+			writeError(w, r, http.StatusTooManyRequests, msgRateLimited)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// ruleFor returns the rule with the longest prefix of path
+func (rl *RateLimiter) ruleFor(path string) (config.RateLimitConfig, bool) {
+	if rl == nil {
+		return config.RateLimitConfig{}, false
+	}
+	for _, rule := range rl.rules {
+		if strings.HasPrefix(path, rule.Prefix) {
+			return rule, true
+		}
+	}
+	return config.RateLimitConfig{}, false
+}
+
+// take spends a token from subject's bucket under rule. It returns the
+// tokens left, or -1 when none was available, and how long until the next
+// token. Buckets start full.
+func (rl *RateLimiter) take(rule config.RateLimitConfig, subject string, now time.Time) (int, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		rl.sweepLocked(now)
+	}
+
+	key := rule.Prefix + "\x00" + subject
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		if len(rl.buckets) >= maxRateLimitBuckets {
+			for evicted := range rl.buckets {
+				delete(rl.buckets, evicted)
+				break
+			}
+		}
+		bucket = &tokenBucket{tokens: float64(rule.Burst), updated: now}
+		rl.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rule.Rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return -1, time.Duration((1 - bucket.tokens) / rule.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	wait := time.Duration(0)
+	if bucket.tokens < 1 {
+		wait = time.Duration((1 - bucket.tokens) / rule.Rate * float64(time.Second))
+	}
+	return int(bucket.tokens), wait
+}
+
+// peek returns what take would report for subject's bucket under rule,
+// without spending a token
+func (rl *RateLimiter) peek(rule config.RateLimitConfig, subject string, now time.Time) (int, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	tokens := float64(rule.Burst)
+	if bucket, exists := rl.buckets[rule.Prefix+"\x00"+subject]; exists {
+		tokens = math.Min(tokens, bucket.tokens+now.Sub(bucket.updated).Seconds()*rule.Rate)
+	}
+	if tokens < 1 {
+		return 0, time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+	}
+	return int(tokens), 0
+}
+
+// limits returns the rules, longest prefix first
+func (rl *RateLimiter) limits() []config.RateLimitConfig {
+	if rl == nil {
+		return nil
+	}
+	return rl.rules
+}
+
+// sweepLocked drops buckets idle long enough to have refilled, which
+// behave the same as new ones. Callers must hold rl.mutex.
+func (rl *RateLimiter) sweepLocked(now time.Time) {
+	rl.lastSweep = now
+	for key, bucket := range rl.buckets {
+		prefix, _, _ := strings.Cut(key, "\x00")
+		rule, _ := rl.ruleFor(prefix)
+		if rule.Prefix == prefix && bucket.tokens+now.Sub(bucket.updated).Seconds()*rule.Rate >= float64(rule.Burst) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// rateLimitSubject returns who a request counts against: the user its
+// credentials authenticate, else the client IP. Credentials acting for any
+// user count against the IP too.
+func rateLimitSubject(r *http.Request) (string, string) {
+	if subject, ok := authSubjectFrom(r.Context()); ok && subject != config.AnySubject {
+		return "user:" + subject, "user"
+	}
+	if addr, ok := clientIP(r); ok {
+		return "ip:" + addr.String(), "ip"
+	}
+	return "ip:" + r.RemoteAddr, "ip"
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Retry delays for startup dependencies that fail to load
+const (
+	readinessInitialBackoff = time.Second
+	readinessMaxBackoff     = 30 * time.Second
+)
+
+// startupDependency is data the instance needs before it can serve traffic
+type startupDependency struct {
+	name     string
+	load     func(ctx context.Context) error
+	ready    bool
+	attempts int
+	lastErr  error
+	warmup   bool // runs once every other dependency has loaded
+}
+
+// Readiness tracks the startup dependencies, such as the catalog, that
+// must load before the instance takes traffic. Until they all have,
+// /ready reports 503 and the cart and catalog routes are rejected, so a
+// half-initialized instance never serves.
+type Readiness struct {
+	dependencies []*startupDependency
+	mutex        sync.Mutex
+
+	// OpenTelemetry Metrics
+	readyGauge      metric.Int64ObservableGauge // Gauge: 1 once each dependency has loaded
+	attemptsCounter metric.Int64Counter         // Counter: load attempts by result
+}
+
+// newReadiness creates a readiness tracker with no dependencies, which is
+// ready immediately
+func newReadiness() (*Readiness, error) {
+	meter := otel.Meter("shopping-cart-service")
+	rd := &Readiness{}
+
+	var err error
+	rd.readyGauge, err = meter.Int64ObservableGauge(
+		"startup_dependency_ready",
+		metric.WithDescription("Whether each startup dependency has loaded (1) or not yet (0)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create startup dependency gauge: %w", err)
+	}
+
+	rd.attemptsCounter, err = meter.Int64Counter(
+		"startup_load_attempts_total",
+		metric.WithDescription("Total number of startup dependency load attempts by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create startup load attempts counter: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			rd.mutex.Lock()
+			defer rd.mutex.Unlock()
+			for _, dep := range rd.dependencies {
+				value := int64(0)
+				if dep.ready {
+					value = 1
+				}
+				observer.ObserveInt64(rd.readyGauge, value, metric.WithAttributes(
+					attribute.String("dependency", dep.name),
+				))
+			}
+			return nil
+		},
+		rd.readyGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register startup dependency callback: %w", err)
+	}
+
+	return rd, nil
+}
+
+// Require adds a dependency that load fetches. It must be called before
+// Run; embedders use it for their own seed data.
+func (rd *Readiness) Require(name string, load func(ctx context.Context) error) {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+	rd.dependencies = append(rd.dependencies, &startupDependency{name: name, load: load})
+}
+
+// RequireWarmup adds a step that warm runs once every dependency has
+// loaded, e.g. to prime caches with the data they loaded. The instance
+// isn't ready until it has succeeded. Like Require, it must be called
+// before Run.
+func (rd *Readiness) RequireWarmup(name string, warm func(ctx context.Context) error) {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+	rd.dependencies = append(rd.dependencies, &startupDependency{name: name, load: warm, warmup: true})
+}
+
+// Run loads every dependency concurrently, retrying failures with
+// exponential backoff, then runs the warmups in turn, until all have
+// succeeded or ctx is cancelled
+func (rd *Readiness) Run(ctx context.Context) {
+	rd.mutex.Lock()
+	dependencies := append([]*startupDependency(nil), rd.dependencies...)
+	rd.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	var warmups []*startupDependency
+	for _, dep := range dependencies {
+		if dep.warmup {
+			warmups = append(warmups, dep)
+			continue
+		}
+		wg.Add(1)
+		go func(dep *startupDependency) {
+			defer wg.Done()
+			rd.loadWithRetry(ctx, dep)
+		}(dep)
+	}
+	wg.Wait()
+
+	for _, dep := range warmups {
+		if ctx.Err() != nil {
+			return
+		}
+		rd.loadWithRetry(ctx, dep)
+	}
+
+	if rd.Ready() {
+		slog.InfoContext(ctx, "Instance ready", "dependencies", len(dependencies))
+	}
+}
+
+// loadWithRetry loads dep until it succeeds or ctx is cancelled
+func (rd *Readiness) loadWithRetry(ctx context.Context, dep *startupDependency) {
+	backoff := readinessInitialBackoff
+	for {
+		err := dep.load(ctx)
+
+		rd.mutex.Lock()
+		dep.attempts++
+		dep.lastErr = err
+		dep.ready = err == nil
+		attempts := dep.attempts
+		rd.mutex.Unlock()
+
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		rd.attemptsCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("dependency", dep.name),
+			attribute.String("result", result),
+		))
+		if err == nil {
+			slog.InfoContext(ctx, "Startup dependency loaded", "dependency", dep.name, "attempts", attempts)
+			return
+		}
+
+		// Jitter keeps restarted replicas from retrying in lockstep
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		slog.WarnContext(ctx, "Startup dependency failed to load, retrying",
+			"dependency", dep.name, "attempts", attempts, "retry_in", delay.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, readinessMaxBackoff)
+	}
+}
+
+// Ready reports whether every dependency has loaded
+func (rd *Readiness) Ready() bool {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+	for _, dep := range rd.dependencies {
+		if !dep.ready {
+			return false
+		}
+	}
+	return true
+}
+
+// dependencyStatus is one dependency in the /ready response
+type dependencyStatus struct {
+	Ready     bool   `json:"ready"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// status returns each dependency's load state
+func (rd *Readiness) status() map[string]dependencyStatus {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+	statuses := make(map[string]dependencyStatus, len(rd.dependencies))
+	for _, dep := range rd.dependencies {
+		status := dependencyStatus{Ready: dep.ready, Attempts: dep.attempts}
+		if dep.lastErr != nil {
+			status.LastError = dep.lastErr.Error()
+		}
+		statuses[dep.name] = status
+	}
+	return statuses
+}
+
+// gate rejects requests with 503 until the instance is ready, except the
+// warmup's own
+func (rd *Readiness) gate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rd.Ready() && !warmupRequest(r.Context()) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, msgNotReady)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// readinessGated reports whether requests to pattern wait for readiness.
+// Probes, metrics, the API docs and the admin API answer from the start.
+func readinessGated(pattern string) bool {
+	return pattern != "/health" && pattern != "/ready" && pattern != "/metrics" && !apiDocsRoute(pattern) && !strings.HasPrefix(pattern, "/admin/")
+}
+
+// handleReady is the readiness probe: 200 once every startup dependency
+// has loaded, 503 with each dependency's state until then
+func (ms *MetricsServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	state := "ready"
+	if !ms.service.readiness.Ready() {
+		status = http.StatusServiceUnavailable
+		state = "starting"
+		w.Header().Set("Retry-After", "1")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       state,
+		"dependencies": ms.service.readiness.status(),
+	})
+}
+
+// Readiness returns the service's startup dependency tracker
+func (cs *CartService) Readiness() *Readiness {
+	return cs.readiness
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"shopping-cart-service/events"
+)
+
+// Rebuild states
+const (
+	rebuildIdle      = "idle"
+	rebuildQueued    = "queued"
+	rebuildRunning   = "running"
+	rebuildCompleted = "completed"
+	rebuildCancelled = "cancelled"
+)
+
+// maxRebuildDifferences bounds the differences a rebuild reports
+const maxRebuildDifferences = 100
+
+var (
+	errConsumerNotFound  = errors.New("consumer not found")
+	errNotAProjection    = errors.New("consumer is not a projection")
+	errRebuildInProgress = errors.New("rebuild already in progress")
+)
+
+// projection is consumer state that can be rebuilt by replaying the event
+// log into an empty copy
+type projection interface {
+	apply(ctx context.Context, envelope *events.Envelope) error
+
+	// fresh returns an empty projection of the same kind
+	fresh() projection
+
+	// diff describes how rebuilt, a fresh projection of the same kind,
+	// differs from this one
+	diff(rebuilt projection) []string
+
+	// replace swaps this projection's state for rebuilt's
+	replace(rebuilt projection)
+}
+
+// RebuildStatus reports the progress and outcome of a projection rebuild
+type RebuildStatus struct {
+	Projection string `json:"projection"`
+	State      string `json:"state"` // idle, queued, running, completed or cancelled
+	DryRun     bool   `json:"dry_run"`
+	Force      bool   `json:"force"`
+
+	FromOffset int64   `json:"from_offset"` // oldest event in the log
+	ToOffset   int64   `json:"to_offset"`   // the live consumer's offset when the replay started
+	Replayed   int64   `json:"replayed"`
+	Failed     int64   `json:"failed"`   // events that failed to decode or apply
+	Progress   float64 `json:"progress"` // 0 to 1
+
+	// Truncated is set when events before from_offset have left the log,
+	// so the rebuilt state misses them; it then only replaces the live
+	// state when forced
+	Truncated bool `json:"truncated"`
+
+	Consistent      *bool    `json:"consistent,omitempty"` // rebuilt state equals the live state
+	Differences     []string `json:"differences,omitempty"`
+	DifferenceCount int      `json:"difference_count"`
+	Replaced        bool     `json:"replaced"`
+
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// done reports whether the rebuild has finished
+func (rs *RebuildStatus) done() bool {
+	return rs.State == rebuildCompleted || rs.State == rebuildCancelled
+}
+
+// Rebuild queues a rebuild of the named projection: its consumer replays
+// the log from the oldest kept event into an empty projection, compares it
+// with the live state and, unless dryRun, replaces the live state. A log
+// that no longer holds every event replaces it only when force is set.
+func (ec *EventConsumers) Rebuild(name string, dryRun, force bool) (RebuildStatus, error) {
+	consumer := ec.consumer(name)
+	if consumer == nil {
+		return RebuildStatus{}, errConsumerNotFound
+	}
+	if consumer.projection == nil {
+		return RebuildStatus{}, errNotAProjection
+	}
+
+	ec.mutex.Lock()
+	if consumer.rebuild != nil && !consumer.rebuild.done() {
+		ec.mutex.Unlock()
+		return RebuildStatus{}, errRebuildInProgress
+	}
+	consumer.rebuild = &RebuildStatus{Projection: name, State: rebuildQueued, DryRun: dryRun, Force: force}
+	status := *consumer.rebuild
+	ec.mutex.Unlock()
+
+	select {
+	case consumer.wake <- struct{}{}:
+	default:
+	}
+	return status, nil
+}
+
+// RebuildStatus returns the named projection's latest rebuild
+func (ec *EventConsumers) RebuildStatus(name string) (RebuildStatus, error) {
+	consumer := ec.consumer(name)
+	if consumer == nil {
+		return RebuildStatus{}, errConsumerNotFound
+	}
+	if consumer.projection == nil {
+		return RebuildStatus{}, errNotAProjection
+	}
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	if consumer.rebuild == nil {
+		return RebuildStatus{Projection: name, State: rebuildIdle}, nil
+	}
+	return *consumer.rebuild, nil
+}
+
+func (ec *EventConsumers) rebuildQueued(consumer *eventConsumer) bool {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	return consumer.rebuild != nil && consumer.rebuild.State == rebuildQueued
+}
+
+// updateRebuild changes the consumer's rebuild status under ec.mutex
+func (ec *EventConsumers) updateRebuild(consumer *eventConsumer, update func(status *RebuildStatus)) RebuildStatus {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	update(consumer.rebuild)
+	return *consumer.rebuild
+}
+
+// replay runs the consumer's queued rebuild up to its committed offset. It
+// runs on the consumer's goroutine, so live processing waits meanwhile and
+// both states stand at the same offset when compared. Failed events are
+// counted, not retried. It returns false when ctx is cancelled first.
+func (ec *EventConsumers) replay(ctx context.Context, consumer *eventConsumer) bool {
+	from, to := ec.publisher.log.oldest(), ec.committed(consumer)
+	if from > to {
+		from = to
+	}
+	started := time.Now().UTC()
+	status := ec.updateRebuild(consumer, func(status *RebuildStatus) {
+		status.State, status.FromOffset, status.ToOffset = rebuildRunning, from, to
+		status.Truncated = from > 0
+		status.StartedAt = &started
+	})
+	slog.InfoContext(ctx, "Rebuilding projection", "projection", consumer.name, "from", from, "to", to, "dry_run", status.DryRun)
+
+	rebuilt := consumer.projection.fresh()
+	codec := ec.publisher.codec.Load()
+	var replayed, failed int64
+	for offset := from; offset < to; {
+		records, _ := ec.publisher.log.read(offset, consumerBatchSize)
+		if len(records) > 0 && records[0].offset > offset {
+			// The log dropped events while the replay was behind
+			ec.updateRebuild(consumer, func(status *RebuildStatus) { status.Truncated = true })
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, record := range records {
+			if record.offset >= to {
+				break
+			}
+			if ctx.Err() != nil {
+				finished := time.Now().UTC()
+				ec.updateRebuild(consumer, func(status *RebuildStatus) {
+					status.State, status.FinishedAt = rebuildCancelled, &finished
+				})
+				return false
+			}
+
+			envelope, err := codec.Decode(ctx, record.message)
+			if err == nil {
+				err = invoke(ctx, rebuilt.apply, envelope)
+			}
+			if err != nil {
+				failed++
+			}
+			replayed++
+			offset = record.offset + 1
+		}
+
+		progress := float64(offset-from) / float64(to-from)
+		ec.updateRebuild(consumer, func(status *RebuildStatus) {
+			status.Replayed, status.Failed, status.Progress = replayed, failed, progress
+		})
+	}
+
+	differences := consumer.projection.diff(rebuilt)
+	consistent := len(differences) == 0
+	status = ec.updateRebuild(consumer, func(status *RebuildStatus) {
+		status.Replayed, status.Failed, status.Progress = replayed, failed, 1
+	})
+	replaced := !status.DryRun && (!status.Truncated || status.Force)
+	if replaced {
+		consumer.projection.replace(rebuilt)
+	}
+
+	finished := time.Now().UTC()
+	ec.updateRebuild(consumer, func(status *RebuildStatus) {
+		status.Consistent, status.DifferenceCount = &consistent, len(differences)
+		status.Differences = differences
+		if len(differences) > maxRebuildDifferences {
+			status.Differences = differences[:maxRebuildDifferences]
+		}
+		status.Replaced = replaced
+		status.State, status.FinishedAt = rebuildCompleted, &finished
+	})
+
+	slog.InfoContext(ctx, "Rebuilt projection", "projection", consumer.name, "replayed", replayed, "failed", failed,
+		"consistent", consistent, "differences", len(differences), "replaced", replaced, "duration", finished.Sub(started).String())
+	return true
+}
+
+// handleRebuild serves /admin/consumers/{name}/rebuild: POST starts a
+// rebuild of the named projection, ?dry_run=true only comparing it with the
+// live state and ?force=true replacing the live state even from a
+// truncated log; GET reports the latest rebuild's progress
+func (ms *MetricsServer) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var status RebuildStatus
+	var err error
+	code := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		status, err = ms.service.consumers.RebuildStatus(name)
+	case http.MethodPost:
+		query := r.URL.Query()
+		status, err = ms.service.consumers.Rebuild(name, query.Get("dry_run") == "true", query.Get("force") == "true")
+		code = http.StatusAccepted
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errConsumerNotFound):
+		writeError(w, r, http.StatusNotFound, msgConsumerNotFound, name)
+		return
+	case errors.Is(err, errNotAProjection):
+		writeError(w, r, http.StatusConflict, msgNotAProjection, name)
+		return
+	case errors.Is(err, errRebuildInProgress):
+		writeError(w, r, http.StatusConflict, msgRebuildInProgress, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// runRebuild starts a projection rebuild on a running instance and reports
+// its progress until it finishes
+func runRebuild(ctx context.Context, args []string) error {
+	flags, baseURL, token, timeout := adminCommandFlags("rebuild")
+	dryRun := flags.Bool("dry-run", false, "only compare the rebuilt projection with the live one")
+	force := flags.Bool("force", false, "replace the live projection even when the log no longer holds every event")
+	interval := flags.Duration("interval", time.Second, "progress polling interval")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: rebuild [flags] <projection>, e.g. analytics, recommendations or funnel")
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", *interval)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	url := strings.TrimSuffix(*baseURL, "/") + "/admin/consumers/" + flags.Arg(0) + "/rebuild"
+	status, err := fetchRebuildStatus(ctx, client, *token, http.MethodPost, fmt.Sprintf("%s?dry_run=%t&force=%t", url, *dryRun, *force))
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for !status.done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if status, err = fetchRebuildStatus(ctx, client, *token, http.MethodGet, url); err != nil {
+			return err
+		}
+		if status.State == rebuildRunning {
+			fmt.Printf("%s: %d/%d events replayed (%.0f%%)\n", status.Projection, status.Replayed, status.ToOffset-status.FromOffset, status.Progress*100)
+		}
+	}
+
+	renderRebuild(os.Stdout, status)
+	if status.State == rebuildCancelled {
+		return errors.New("rebuild cancelled by shutdown")
+	}
+	return nil
+}
+
+// fetchRebuildStatus sends one rebuild request and decodes the status
+func fetchRebuildStatus(ctx context.Context, client *http.Client, adminToken, method, url string) (*RebuildStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(message)))
+	}
+	var status RebuildStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode rebuild status: %w", err)
+	}
+	return &status, nil
+}
+
+// renderRebuild writes a finished rebuild's outcome
+func renderRebuild(w io.Writer, status *RebuildStatus) {
+	fmt.Fprintf(w, "%s: replayed %d events (offsets %d-%d), %d failed\n", status.Projection, status.Replayed, status.FromOffset, status.ToOffset, status.Failed)
+	if status.Truncated {
+		fmt.Fprintln(w, "The log no longer holds the oldest events; the rebuilt state misses them")
+	}
+	switch {
+	case status.Consistent == nil:
+	case *status.Consistent:
+		fmt.Fprintln(w, "Consistent with the live state")
+	default:
+		fmt.Fprintf(w, "%d differences from the live state:\n", status.DifferenceCount)
+		for _, difference := range status.Differences {
+			fmt.Fprintf(w, "  %s\n", difference)
+		}
+		if hidden := status.DifferenceCount - len(status.Differences); hidden > 0 {
+			fmt.Fprintf(w, "  ... and %d more\n", hidden)
+		}
+	}
+	switch {
+	case status.Replaced:
+		fmt.Fprintln(w, "Replaced the live state")
+	case status.DryRun:
+		fmt.Fprintln(w, "Dry run: the live state is unchanged")
+	case status.State == rebuildCompleted:
+		fmt.Fprintln(w, "Live state kept (rerun with --force to replace it anyway)")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxRecordedBody caps each recorded request and response body
+const maxRecordedBody = 64 << 10
+
+// recordingsFile is the JSON lines file recordings are appended to when a
+// recording directory is configured
+const recordingsFile = "recordings.jsonl"
+
+// redacted replaces recorded secrets
+const redacted = "[REDACTED]"
+
+// redactedHeaders are always masked, whatever their value
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"Proxy-Authorization": true,
+}
+
+// RecordedExchange is one captured request and its response
+type RecordedExchange struct {
+	RequestID  string    `json:"request_id"`
+	Time       time.Time `json:"time"`
+	UserID     string    `json:"user_id,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+
+	Method        string      `json:"method"`
+	URL           string      `json:"url"` // path and query
+	RequestHeader http.Header `json:"request_header"`
+	RequestBody   string      `json:"request_body,omitempty"`
+
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+}
+
+// RecordingSettings select which requests are recorded. Recording is off
+// when SampleRate is 0 and UserID is empty.
+type RecordingSettings struct {
+	SampleRate float64 `json:"sample_rate"`       // fraction of all requests
+	UserID     string  `json:"user_id,omitempty"` // every request for this user
+}
+
+// active reports whether any request may be recorded
+func (s RecordingSettings) active() bool {
+	return s.SampleRate > 0 || s.UserID != ""
+}
+
+// RequestRecorder keeps the most recent recorded exchanges in memory and,
+// with a directory configured, appends them to a size-capped file so they
+// survive restarts and can be copied off for replay
+type RequestRecorder struct {
+	mutex     sync.Mutex
+	settings  RecordingSettings
+	exchanges []RecordedExchange // ring buffer of up to maxEntries
+	next      int
+	full      bool
+
+	maxEntries   int
+	path         string // empty keeps recordings in memory only
+	maxFileBytes int64
+
+	// OpenTelemetry Metrics
+	recordedCounter metric.Int64Counter // Counter: recorded exchanges
+}
+
+// NewRequestRecorder creates a recorder with the initial settings in cfg
+func NewRequestRecorder(cfg config.RecordingConfig) (*RequestRecorder, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	rr := &RequestRecorder{
+		settings:     RecordingSettings{SampleRate: cfg.SampleRate, UserID: cfg.UserID},
+		exchanges:    make([]RecordedExchange, cfg.MaxEntries),
+		maxEntries:   cfg.MaxEntries,
+		maxFileBytes: cfg.MaxFileBytes,
+	}
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create recording directory: %w", err)
+		}
+		rr.path = filepath.Join(cfg.Dir, recordingsFile)
+	}
+
+	var err error
+	rr.recordedCounter, err = meter.Int64Counter(
+		"recorded_requests_total",
+		metric.WithDescription("Total number of request/response pairs captured by the request recorder"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recorded requests counter: %w", err)
+	}
+
+	return rr, nil
+}
+
+// Settings returns the current selection
+func (rr *RequestRecorder) Settings() RecordingSettings {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	return rr.settings
+}
+
+// SetSettings replaces the selection
+func (rr *RequestRecorder) SetSettings(settings RecordingSettings) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	rr.settings = settings
+}
+
+// Exchanges returns the recorded exchanges in memory, oldest first
+func (rr *RequestRecorder) Exchanges() []RecordedExchange {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if !rr.full {
+		return append([]RecordedExchange(nil), rr.exchanges[:rr.next]...)
+	}
+	out := make([]RecordedExchange, 0, rr.maxEntries)
+	out = append(out, rr.exchanges[rr.next:]...)
+	return append(out, rr.exchanges[:rr.next]...)
+}
+
+// Clear drops the recordings in memory and on disk
+func (rr *RequestRecorder) Clear() error {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.exchanges = make([]RecordedExchange, rr.maxEntries)
+	rr.next, rr.full = 0, false
+	if rr.path == "" {
+		return nil
+	}
+	if err := os.Remove(rr.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// add stores a recorded exchange
+func (rr *RequestRecorder) add(ctx context.Context, exchange RecordedExchange) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.exchanges[rr.next] = exchange
+	rr.next = (rr.next + 1) % rr.maxEntries
+	if rr.next == 0 {
+		rr.full = true
+	}
+
+	result := "memory"
+	if rr.path != "" {
+		result = "disk"
+		if err := rr.appendFile(exchange); err != nil {
+			result = "disk_error"
+		}
+	}
+	rr.recordedCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("storage", result)))
+}
+
+// appendFile writes exchange to the recordings file, starting a new file
+// once it reaches the size cap and keeping the previous one as .1
+func (rr *RequestRecorder) appendFile(exchange RecordedExchange) error {
+	if info, err := os.Stat(rr.path); err == nil && info.Size() >= rr.maxFileBytes {
+		if err := os.Rename(rr.path, rr.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(rr.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(exchange)
+}
+
+// recordingWriter captures the response alongside writing it
+type recordingWriter struct {
+	*responseWriter
+	body bytes.Buffer
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if room := maxRecordedBody - rw.body.Len(); room > 0 {
+		rw.body.Write(b[:min(len(b), room)])
+	}
+	return rw.responseWriter.Write(b)
+}
+
+// capture reports whether the request might be recorded and, if so, buffers
+// its body so the handler still reads it. Requests for a recorded user are
+// only known after the handler runs, so all are buffered while a user is
+// selected. Admin traffic is never recorded.
+func (rr *RequestRecorder) capture(r *http.Request) (RecordingSettings, []byte, bool) {
+	settings := rr.Settings()
+	if !settings.active() || strings.HasPrefix(r.URL.Path, "/admin/") {
+		return settings, nil, false
+	}
+	if settings.UserID == "" && rand.Float64() >= settings.SampleRate {
+		return settings, nil, false
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, _ = io.ReadAll(io.LimitReader(r.Body, maxRecordedBody))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	}
+	return settings, body, true
+}
+
+// finish records the exchange if it matches settings
+func (rr *RequestRecorder) finish(ctx context.Context, settings RecordingSettings, r *http.Request, body []byte, rw *recordingWriter, start time.Time) {
+	info := requestInfoFrom(ctx)
+	userID := ""
+	if info != nil {
+		userID = info.UserID
+	}
+
+	// With a user selected, others are still sampled at the sample rate
+	if settings.UserID != "" && userID != settings.UserID && rand.Float64() >= settings.SampleRate {
+		return
+	}
+
+	exchange := RecordedExchange{
+		Time:           start.UTC(),
+		UserID:         userID,
+		DurationMS:     float64(time.Since(start).Microseconds()) / 1000,
+		Method:         r.Method,
+		URL:            r.URL.RequestURI(),
+		RequestHeader:  redactHeader(r.Header),
+		RequestBody:    redactBody(body, r.Header.Get("Content-Type")),
+		Status:         rw.statusCode,
+		ResponseHeader: redactHeader(rw.Header()),
+	}
+	if info != nil {
+		exchange.RequestID = info.ID
+	}
+	if rw.Header().Get("Content-Encoding") == "" {
+		exchange.ResponseBody = redactBody(rw.body.Bytes(), rw.Header().Get("Content-Type"))
+	}
+	rr.add(ctx, exchange)
+}
+
+// redactHeader copies header, masking credentials
+func redactHeader(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for name, values := range header {
+		if redactedHeaders[name] || sensitiveName(name) {
+			out[name] = []string{redacted}
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// sensitiveName reports whether a header or field name suggests a secret
+func sensitiveName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, marker := range sensitiveConfigMarkers {
+		if marker != "HEADERS" && strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactBody masks secret-looking fields in JSON bodies, such as quote and
+// share tokens. Other bodies are kept as they are.
+func redactBody(body []byte, contentType string) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if !strings.HasPrefix(contentType, "application/json") && !json.Valid(body) {
+		return string(body)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(body)
+	}
+	masked, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return string(body)
+	}
+	return string(masked)
+}
+
+// redactValue masks sensitive keys at any depth
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if sensitiveName(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+// readRecordings parses recordings in the JSON lines export format
+func readRecordings(r io.Reader) ([]RecordedExchange, error) {
+	var exchanges []RecordedExchange
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 4*maxRecordedBody)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var exchange RecordedExchange
+		if err := json.Unmarshal(text, &exchange); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges, scanner.Err()
+}
+
+func (ms *MetricsServer) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// JSON lines, the format the replay command reads
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+recordingsFile+`"`)
+		encoder := json.NewEncoder(w)
+		for _, exchange := range ms.recorder.Exchanges() {
+			encoder.Encode(exchange)
+		}
+	case http.MethodDelete:
+		if err := ms.recorder.Clear(); err != nil {
+			writeError(w, r, http.StatusInternalServerError, msgInternalError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
+
+// handleRecordingSettings reports (GET) or changes (PUT) which requests
+// are recorded
+func (ms *MetricsServer) handleRecordingSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var settings RecordingSettings
+		if err := decodeJSONBody(r, &settings); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		if settings.SampleRate < 0 || settings.SampleRate > 1 {
+			ms.rejectInvalidRequest(w, r, constraintViolation("sample_rate", msgInvalidFieldValue))
+			return
+		}
+		ms.recorder.SetSettings(settings)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	settings := ms.recorder.Settings()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sample_rate": settings.SampleRate,
+		"user_id":     settings.UserID,
+		"active":      settings.active(),
+		"recorded":    len(ms.recorder.Exchanges()),
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// headerTracker notes whether the response has started
+type headerTracker struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (ht *headerTracker) WriteHeader(code int) {
+	ht.wroteHeader = true
+	ht.ResponseWriter.WriteHeader(code)
+}
+
+func (ht *headerTracker) Write(b []byte) (int, error) {
+	ht.wroteHeader = true
+	return ht.ResponseWriter.Write(b)
+}
+
+func (ht *headerTracker) Unwrap() http.ResponseWriter {
+	return ht.ResponseWriter
+}
+
+// withRecovery turns a handler panic into a 500 with a JSON error body,
+// logging the stack and counting it in http_panics_total, so the request
+// is measured and answered instead of the connection being dropped. A
+// panic after the response has started can only abort it, and is still
+// logged and counted. handle applies it to every route, whatever its
+// pipeline, just outside the handler.
+func (ms *MetricsServer) withRecovery(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tracker := &headerTracker{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate aborts are net/http's to handle
+				panic(recovered)
+			}
+
+			ctx := r.Context()
+			endpoint := endpointOf(r)
+			err := fmt.Errorf("handler panicked: %v", recovered)
+			slog.ErrorContext(ctx, "Handler panicked", "endpoint", endpoint, "method", r.Method, "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			ms.service.panicCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("endpoint", endpoint)))
+
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(err, trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, err.Error())
+
+			if tracker.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		}()
+		handler(tracker, r)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisKeyPrefix namespaces the service's keys in a shared Redis
+const defaultRedisKeyPrefix = "shopping-cart:"
+
+// redisStore stores JSON documents under prefixed keys
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// newRedisStore connects to the Redis server at url
+// (redis://[:password@]host:port/db) with the pool settings and verifies
+// the connection
+func newRedisStore(ctx context.Context, url string, pool config.RedisPoolConfig) (*redisStore, error) {
+	if url == "" {
+		return nil, fmt.Errorf("REDIS_URL is required when CART_STORE=%s", storeRedis)
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+
+	prefix := os.Getenv("REDIS_KEY_PREFIX")
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+
+	if pool.PoolSize > 0 {
+		opts.PoolSize = pool.PoolSize
+	}
+	if pool.MinIdleConns > 0 {
+		opts.MinIdleConns = pool.MinIdleConns
+	}
+	if pool.PoolTimeout > 0 {
+		opts.PoolTimeout = pool.PoolTimeout
+	}
+	if pool.ConnMaxIdleTime > 0 {
+		opts.ConnMaxIdleTime = pool.ConnMaxIdleTime
+	}
+	if pool.DialTimeout > 0 {
+		opts.DialTimeout = pool.DialTimeout
+	}
+	opts.Dialer = outboundPools.instrumentDial("redis", redis.NewDialer(opts))
+
+	client := redis.NewClient(opts)
+	// Commands find no idle connection on a pool miss, then dial or wait
+	outboundPools.register("redis", func() poolStats {
+		stats := client.PoolStats()
+		return poolStats{
+			inUse:    int64(stats.TotalConns) - int64(stats.IdleConns),
+			idle:     int64(stats.IdleConns),
+			max:      int64(client.Options().PoolSize),
+			waits:    int64(stats.Misses),
+			timeouts: int64(stats.Timeouts),
+		}
+	})
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	return &redisStore{client: client, prefix: prefix}, nil
+}
+
+// Close closes the Redis connection pool
+func (rs *redisStore) Close() error {
+	return rs.client.Close()
+}
+
+// get decodes the document at key into v, reporting whether it exists
+func (rs *redisStore) get(ctx context.Context, key string, v interface{}) (bool, error) {
+	body, err := rs.client.Get(ctx, rs.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("redis get %s: %w", key, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// put stores v as JSON at key
+func (rs *redisStore) put(ctx context.Context, key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+	if err := rs.client.Set(ctx, rs.prefix+key, body, 0).Err(); err != nil {
+		return fmt.Errorf("redis set %s: %w", key, err)
+	}
+	return nil
+}
+
+// del removes key
+func (rs *redisStore) del(ctx context.Context, key string) error {
+	if err := rs.client.Del(ctx, rs.prefix+key).Err(); err != nil {
+		return fmt.Errorf("redis del %s: %w", key, err)
+	}
+	return nil
+}
+
+// scan calls fn with every document whose key starts with kind, fetching
+// them in batches as SCAN returns them
+func (rs *redisStore) scan(ctx context.Context, kind string, fn func(body []byte) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := rs.client.Scan(ctx, cursor, rs.prefix+kind+"*", 500).Result()
+		if err != nil {
+			return fmt.Errorf("redis scan %s: %w", kind, err)
+		}
+
+		if len(keys) > 0 {
+			values, err := rs.client.MGet(ctx, keys...).Result()
+			if err != nil {
+				return fmt.Errorf("redis mget %s: %w", kind, err)
+			}
+			for _, value := range values {
+				// Keys deleted between SCAN and MGET come back as nil
+				body, ok := value.(string)
+				if !ok {
+					continue
+				}
+				if err := fn([]byte(body)); err != nil {
+					return err
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// lock takes the lock at key for ttl with SET NX PX, reporting whether it
+// was free. token identifies the holder when unlocking.
+func (rs *redisStore) lock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	taken, err := rs.client.SetNX(ctx, rs.prefix+key, token, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis set nx %s: %w", key, err)
+	}
+	return taken, nil
+}
+
+// unlockScript deletes KEYS[1] only while it still holds the token ARGV[1],
+// so a holder whose lock lapsed can't release the next holder's
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// unlock releases the lock at key if token still holds it
+func (rs *redisStore) unlock(ctx context.Context, key, token string) error {
+	if err := unlockScript.Run(ctx, rs.client, []string{rs.prefix + key}, token).Err(); err != nil {
+		return fmt.Errorf("redis unlock %s: %w", key, err)
+	}
+	return nil
+}
+
+// cartRecord is the stored form of a cart, including its checkout lock so
+// every instance sees it, and the revision that writes check against
+type cartRecord struct {
+	UserID      string     `json:"user_id"`
+	Items       []CartItem `json:"items"`
+	LockedUntil time.Time  `json:"locked_until"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Revision    int64      `json:"revision"`
+}
+
+// newCartRecord returns the stored form of cart
+func newCartRecord(cart *Cart) cartRecord {
+	return cartRecord{
+		UserID:      cart.UserID,
+		Items:       cart.Items,
+		LockedUntil: cart.lockedUntil,
+		UpdatedAt:   cart.updatedAt,
+		Revision:    cart.revision,
+	}
+}
+
+func (r cartRecord) cart() *Cart {
+	return &Cart{UserID: r.UserID, Items: r.Items, lockedUntil: r.LockedUntil, updatedAt: r.UpdatedAt, revision: r.Revision}
+}
+
+// putCartScript stores the cart ARGV[2] at KEYS[1] only if the stored
+// cart is still at revision ARGV[1], 0 for one that doesn't exist (or was
+// stored before carts had revisions). It returns 0 when another write got
+// there first.
+var putCartScript = redis.NewScript(`
+local stored = redis.call('GET', KEYS[1])
+local revision = 0
+if stored then
+	revision = tonumber(cjson.decode(stored).revision) or 0
+end
+if revision ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// redisCartStore stores carts under <prefix>cart:<user_id>. Instances
+// share the carts, so a write only lands if the cart is still at the
+// revision it was read at; otherwise it fails with ErrCartConflict rather
+// than overwrite another instance's change.
+type redisCartStore struct {
+	*redisStore
+}
+
+func (s *redisCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	var record cartRecord
+	found, err := s.get(ctx, "cart:"+userID, &record)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w for user %s", ErrCartNotFound, userID)
+	}
+	if record.Items == nil {
+		record.Items = []CartItem{}
+	}
+	return record.cart(), nil
+}
+
+func (s *redisCartStore) Put(ctx context.Context, cart *Cart) error {
+	key := "cart:" + cart.UserID
+	record := newCartRecord(cart)
+	record.Revision++
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+
+	stored, err := putCartScript.Run(ctx, s.client, []string{s.prefix + key}, cart.revision, body).Int()
+	if err != nil {
+		return fmt.Errorf("redis set %s: %w", key, err)
+	}
+	if stored == 0 {
+		return fmt.Errorf("%w: %s", ErrCartConflict, cart.UserID)
+	}
+	cart.revision = record.Revision
+	return nil
+}
+
+func (s *redisCartStore) Delete(ctx context.Context, userID string) error {
+	return s.del(ctx, "cart:"+userID)
+}
+
+func (s *redisCartStore) List(ctx context.Context) ([]*Cart, error) {
+	var carts []*Cart
+	err := s.scan(ctx, "cart:", func(body []byte) error {
+		var record cartRecord
+		if err := json.Unmarshal(body, &record); err != nil {
+			return fmt.Errorf("failed to decode cart: %w", err)
+		}
+		carts = append(carts, record.cart())
+		return nil
+	})
+	return carts, err
+}
+
+// redisProfileStore stores profiles under <prefix>profile:<user_id>
+type redisProfileStore struct {
+	*redisStore
+}
+
+func (s *redisProfileStore) Get(ctx context.Context, userID string) (*Profile, error) {
+	var profile Profile
+	found, err := s.get(ctx, "profile:"+userID, &profile)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w for user %s", ErrProfileNotFound, userID)
+	}
+	return &profile, nil
+}
+
+func (s *redisProfileStore) Put(ctx context.Context, profile *Profile) error {
+	return s.put(ctx, "profile:"+profile.UserID, profile)
+}
+
+func (s *redisProfileStore) Delete(ctx context.Context, userID string) error {
+	return s.del(ctx, "profile:"+userID)
+}
+
+func (s *redisProfileStore) List(ctx context.Context) ([]*Profile, error) {
+	var profiles []*Profile
+	err := s.scan(ctx, "profile:", func(body []byte) error {
+		var profile Profile
+		if err := json.Unmarshal(body, &profile); err != nil {
+			return fmt.Errorf("failed to decode profile: %w", err)
+		}
+		profiles = append(profiles, &profile)
+		return nil
+	})
+	return profiles, err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// replaySkippedHeaders are set by the transport or identify the original
+// request, so they aren't copied onto replayed requests
+var replaySkippedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Connection":        true,
+	"Accept-Encoding":   true,
+	"X-Request-Id":      true,
+	"Traceparent":       true,
+	"Tracestate":        true,
+	"Transfer-Encoding": true,
+}
+
+// runReplay re-sends recorded requests to an instance, typically a local
+// one, and reports where its responses differ from the recorded ones
+func runReplay(ctx context.Context, args []string) error {
+	flags, baseURL, timeout := commandFlags("replay")
+	file := flags.String("file", "", "recordings file to replay (default: download from --from)")
+	from := recordingsFromFlag(flags)
+	adminToken := adminTokenFlag(flags)
+	requestID := flags.String("request-id", "", "replay only this recorded request")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	exchanges, err := loadRecordings(ctx, client, *file, *from, *adminToken)
+	if err != nil {
+		return err
+	}
+	if *requestID != "" {
+		var matched []RecordedExchange
+		for _, exchange := range exchanges {
+			if exchange.RequestID == *requestID {
+				matched = append(matched, exchange)
+			}
+		}
+		exchanges = matched
+	}
+	if len(exchanges) == 0 {
+		return errors.New("no recordings to replay")
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "REQUEST\tMETHOD\tURL\tRECORDED\tREPLAYED\tRESULT")
+	differing := 0
+	for _, exchange := range exchanges {
+		status, body, err := replayExchange(ctx, client, *baseURL, exchange)
+		result := "match"
+		switch {
+		case err != nil:
+			result = err.Error()
+		case status != exchange.Status:
+			result = "status differs"
+		case !sameBody(body, exchange.ResponseBody):
+			result = "body differs"
+		}
+		if result != "match" {
+			differing++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%s\n", exchange.RequestID, exchange.Method, exchange.URL, exchange.Status, status, result)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d replayed, %d differ\n", len(exchanges), differing)
+	return nil
+}
+
+// recordingsFromFlag registers the ops port recordings are downloaded from
+func recordingsFromFlag(flags *flag.FlagSet) *string {
+	return flags.String("from", firstSet(os.Getenv("CART_SERVICE_OPS_URL"), defaultOpsURL), "ops port of the instance to download recordings from (CART_SERVICE_OPS_URL)")
+}
+
+// loadRecordings reads the recordings file, or downloads the recordings
+// from the ops port at source when no file is given
+func loadRecordings(ctx context.Context, client *http.Client, file, source, adminToken string) ([]RecordedExchange, error) {
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readRecordings(f)
+	}
+
+	url := strings.TrimSuffix(source, "/") + "/admin/recordings"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return readRecordings(resp.Body)
+}
+
+// replayExchange sends the recorded request to baseURL and returns the
+// response status and body. Redacted headers are left out, so requests
+// that needed credentials fail unless the target doesn't check them.
+func replayExchange(ctx context.Context, client *http.Client, baseURL string, exchange RecordedExchange) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, exchange.Method, strings.TrimSuffix(baseURL, "/")+exchange.URL, strings.NewReader(exchange.RequestBody))
+	if err != nil {
+		return 0, "", err
+	}
+	for name, values := range exchange.RequestHeader {
+		if replaySkippedHeaders[http.CanonicalHeaderKey(name)] || (len(values) == 1 && values[0] == redacted) {
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Replay-Of", exchange.RequestID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRecordedBody))
+	if err != nil {
+		return resp.StatusCode, "", err
+	}
+	return resp.StatusCode, redactBody(body, resp.Header.Get("Content-Type")), nil
+}
+
+// sameBody compares response bodies, ignoring JSON formatting
+func sameBody(replayed, recorded string) bool {
+	if replayed == recorded {
+		return true
+	}
+	var a, b bytes.Buffer
+	if json.Compact(&a, []byte(replayed)) != nil || json.Compact(&b, []byte(recorded)) != nil {
+		return strings.TrimSpace(replayed) == strings.TrimSpace(recorded)
+	}
+	return a.String() == b.String()
+}
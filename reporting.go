@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReportingCalendar computes reporting period boundaries in each tenant's
+// local time zone. Boundaries are derived from calendar dates rather than
+// fixed 24h offsets, so days spanning a DST transition are 23 or 25 hours
+// long as expected.
+type ReportingCalendar struct {
+	defaultLocation *time.Location
+	tenantLocations map[string]*time.Location
+}
+
+// NewReportingCalendar creates a calendar using defaultZone for tenants
+// without an explicit zone. Zone names are IANA identifiers.
+func NewReportingCalendar(defaultZone string, tenantZones map[string]string) (*ReportingCalendar, error) {
+	if defaultZone == "" {
+		defaultZone = "UTC"
+	}
+
+	defaultLocation, err := time.LoadLocation(defaultZone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default reporting timezone: %w", err)
+	}
+
+	calendar := &ReportingCalendar{
+		defaultLocation: defaultLocation,
+		tenantLocations: make(map[string]*time.Location),
+	}
+
+	for tenant, zone := range tenantZones {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load reporting timezone for tenant %s: %w", tenant, err)
+		}
+		calendar.tenantLocations[tenant] = location
+	}
+
+	return calendar, nil
+}
+
+// ParseTenantTimezones parses "tenant=Zone" pairs separated by commas,
+// e.g. "acme=America/New_York,globex=Europe/Berlin"
+func ParseTenantTimezones(spec string) (map[string]string, error) {
+	zones := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, zone, found := strings.Cut(entry, "=")
+		tenant = strings.TrimSpace(tenant)
+		zone = strings.TrimSpace(zone)
+		if !found || tenant == "" || zone == "" {
+			return nil, fmt.Errorf("invalid tenant timezone %q", entry)
+		}
+		zones[tenant] = zone
+	}
+	return zones, nil
+}
+
+// Location returns the reporting time zone for a tenant
+func (rc *ReportingCalendar) Location(tenant string) *time.Location {
+	if location, ok := rc.tenantLocations[tenant]; ok {
+		return location
+	}
+	return rc.defaultLocation
+}
+
+// DayBounds returns the [start, end) interval of the local calendar day
+// containing t for the tenant
+func (rc *ReportingCalendar) DayBounds(tenant string, t time.Time) (time.Time, time.Time) {
+	location := rc.Location(tenant)
+	local := t.In(location)
+
+	start := startOfDay(local.Year(), local.Month(), local.Day(), location)
+	end := startOfDay(local.Year(), local.Month(), local.Day()+1, location)
+	return start, end
+}
+
+// startOfDay returns the first instant of a local calendar day. In zones
+// whose clocks jump over midnight, by however much, the day starts when
+// the jump lands; when clocks turn back over midnight, the day starts at
+// the first one. It works from the zone periods time.Date lands in rather than
+// probing in steps, so odd offsets such as +05:45 come out exact.
+func startOfDay(year int, month time.Month, day int, location *time.Location) time.Time {
+	date := time.Date(year, month, day, 12, 0, 0, 0, location)
+	t := time.Date(year, month, day, 0, 0, 0, 0, location)
+	if !sameDate(t, date) {
+		// A skipped midnight normalized back into the previous day; the
+		// day starts where that zone period ends
+		_, t = t.ZoneBounds()
+	}
+
+	for {
+		// Within one zone period the offset is fixed, so midnight is the
+		// time of day back from t; the period may start later than that,
+		// or an earlier one may already have been on this date
+		start, _ := t.ZoneBounds()
+		midnight := t.Add(-sinceMidnight(t))
+		if start.IsZero() {
+			return midnight
+		}
+		before := start.Add(-time.Nanosecond)
+		if sameDate(before, date) {
+			t = before
+			continue
+		}
+		if midnight.Before(start) {
+			return start
+		}
+		return midnight
+	}
+}
+
+// sameDate reports whether t and u fall on the same date in t's location
+func sameDate(t, u time.Time) bool {
+	ty, tm, td := t.Date()
+	uy, um, ud := u.In(t.Location()).Date()
+	return ty == uy && tm == um && td == ud
+}
+
+// sinceMidnight returns how long after 00:00 on its clock t is
+func sinceMidnight(t time.Time) time.Duration {
+	hour, minute, second := t.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute +
+		time.Duration(second)*time.Second + time.Duration(t.Nanosecond())
+}
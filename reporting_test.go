@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDayBoundsAcrossTransitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		zone      string
+		at        string // an instant during the day, RFC 3339
+		wantStart string
+		wantHours float64
+	}{
+		{"plain day", "America/New_York", "2024-03-09T12:00:00-05:00", "2024-03-09T00:00:00-05:00", 24},
+		{"spring forward", "America/New_York", "2024-03-10T12:00:00-04:00", "2024-03-10T00:00:00-05:00", 23},
+		{"fall back", "America/New_York", "2024-11-03T12:00:00-05:00", "2024-11-03T00:00:00-04:00", 25},
+		{"spring forward over midnight", "America/Santiago", "2024-09-08T12:00:00-03:00", "2024-09-08T01:00:00-03:00", 23},
+		{"day before falling back over midnight", "America/Santiago", "2024-04-06T12:00:00-03:00", "2024-04-06T00:00:00-03:00", 25},
+		{"fall back over midnight", "America/Santiago", "2024-04-07T12:00:00-04:00", "2024-04-07T00:00:00-04:00", 24},
+		{"spring forward at midnight", "America/Havana", "2024-03-10T12:00:00-04:00", "2024-03-10T01:00:00-04:00", 23},
+		{"quarter-hour jump over midnight", "Asia/Kathmandu", "1986-01-01T12:00:00+05:45", "1986-01-01T00:15:00+05:45", 23.75},
+		{"three-quarter-hour jump over midnight", "America/Guyana", "1975-08-01T12:00:00-03:00", "1975-08-01T00:45:00-03:00", 23.25},
+		{"clocks turned back over midnight", "Antarctica/Casey", "2010-03-05T12:00:00+08:00", "2010-03-05T00:00:00+11:00", 27},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calendar, err := NewReportingCalendar("UTC", map[string]string{"acme": tt.zone})
+			if err != nil {
+				t.Fatalf("NewReportingCalendar: %v", err)
+			}
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantStart, err := time.Parse(time.RFC3339, tt.wantStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start, end := calendar.DayBounds("acme", at)
+			if !start.Equal(wantStart) {
+				t.Errorf("start = %s, want %s", start, wantStart)
+			}
+			if hours := end.Sub(start).Hours(); hours != tt.wantHours {
+				t.Errorf("day is %vh long, want %vh", hours, tt.wantHours)
+			}
+		})
+	}
+}
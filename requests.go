@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestInfo carries per-request details that handlers fill in as they
+// learn them (e.g. the user ID from a JSON body)
+type requestInfo struct {
+	ID           string
+	UserID       string
+	ErrorMessage string     // English error message, for triage buffers
+	Client       clientInfo // client family and version from request headers
+	Synthetic    string     // synthetic traffic source, empty for user traffic
+	Region       *geoRegion // client region, nil when GeoIP is disabled
+	ClientIP     netip.Addr // originating client address, resolved by TrustedProxies
+
+	Timings *serverTimings // phase durations for Server-Timing, nil when disabled
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo stores info in the context
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the request info stored in ctx, if any
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setRequestUser records the user a request acts on
+func setRequestUser(ctx context.Context, userID string) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.UserID = userID
+	}
+}
+
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 128
+
+// validRequestID reports whether a client-supplied request ID is safe to
+// echo and log: 1 to 128 letters, digits, '-', '_', '.' or ':'
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID identifies every request, whatever its route's pipeline:
+// it keeps a valid X-Request-ID from the client or generates one, echoes it
+// on the response and stores it in the request context, where logs, error
+// bodies, the request lookup and outgoing calls pick it up
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{ID: r.Header.Get("X-Request-ID"), Client: parseClient(r)}
+		info.Synthetic = parseSyntheticSource(r, info.Client)
+		if !validRequestID(info.ID) {
+			info.ID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", info.ID)
+		next.ServeHTTP(w, r.WithContext(withRequestInfo(r.Context(), info)))
+	})
+}
+
+// requestIDTransport forwards the request ID of the request being served on
+// outgoing calls, so webhook and validator logs can be joined with ours
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (rt *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := requestInfoFrom(req.Context())
+	if info == nil || req.Header.Get("X-Request-ID") != "" {
+		return rt.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Request-ID", info.ID)
+	return rt.next.RoundTrip(req)
+}
+
+// newRequestID generates a random 128-bit request identifier
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// RequestRecord summarizes a completed request for support lookups
+type RequestRecord struct {
+	RequestID  string    `json:"request_id"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	UserID     string    `json:"user_id,omitempty"`
+	Method     string    `json:"method"`
+	Endpoint   string    `json:"endpoint"`
+	StatusCode int       `json:"status_code"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// requestLog is a bounded ring buffer of recent requests indexed by ID
+type requestLog struct {
+	records []RequestRecord
+	index   map[string]int
+	next    int
+	mutex   sync.RWMutex
+}
+
+// newRequestLog creates a ring buffer holding up to capacity records
+func newRequestLog(capacity int) *requestLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &requestLog{
+		records: make([]RequestRecord, capacity),
+		index:   make(map[string]int, capacity),
+	}
+}
+
+// Add stores a record, evicting the oldest one when full
+func (rl *requestLog) Add(record RequestRecord) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// Client-supplied request IDs can repeat, so the index may already
+	// point at a newer record with the evicted one's ID
+	if evicted := rl.records[rl.next].RequestID; evicted != "" && rl.index[evicted] == rl.next {
+		delete(rl.index, evicted)
+	}
+
+	rl.records[rl.next] = record
+	rl.index[record.RequestID] = rl.next
+	rl.next = (rl.next + 1) % len(rl.records)
+}
+
+// Get looks up a record by request ID
+func (rl *requestLog) Get(requestID string) (RequestRecord, bool) {
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+
+	slot, exists := rl.index[requestID]
+	if !exists {
+		return RequestRecord{}, false
+	}
+	return rl.records[slot], true
+}
+
+// recordCompletedRequest adds a finished request to the lookup buffer
+func (cs *CartService) recordCompletedRequest(ctx context.Context, r *http.Request, start time.Time, duration time.Duration, statusCode int) {
+	info := requestInfoFrom(ctx)
+	if info == nil {
+		return
+	}
+
+	record := RequestRecord{
+		RequestID:  info.ID,
+		UserID:     info.UserID,
+		Method:     r.Method,
+		Endpoint:   r.URL.Path,
+		StatusCode: statusCode,
+		StartedAt:  start.UTC(),
+		DurationMS: float64(duration.Microseconds()) / 1000,
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.TraceID = spanContext.TraceID().String()
+	}
+
+	cs.requests.Add(record)
+}
+
+func (ms *MetricsServer) handleLookupRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	requestID := strings.TrimPrefix(r.URL.Path, "/admin/requests/")
+	if requestID == "" || strings.Contains(requestID, "/") {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "requestID")
+		return
+	}
+
+	record, found := ms.service.requests.Get(requestID)
+	if !found {
+		writeError(w, r, http.StatusNotFound, msgRequestNotFound, requestID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
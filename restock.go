@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// stockSubscriptions tracks users waiting for products to come back in stock
+type stockSubscriptions struct {
+	// product ID -> user ID -> quantity the user wants
+	waiting map[string]map[string]int
+	mutex   sync.Mutex
+
+	// OpenTelemetry Metrics
+	subscriptionCounter metric.Int64Counter         // Counter: subscriptions created
+	pendingGauge        metric.Int64ObservableGauge // Gauge: pending subscriptions per product
+}
+
+// newStockSubscriptions creates an empty subscription store
+func newStockSubscriptions() (*stockSubscriptions, error) {
+	meter := otel.Meter("shopping-cart-service")
+	subs := &stockSubscriptions{waiting: make(map[string]map[string]int)}
+
+	var err error
+	subs.subscriptionCounter, err = meter.Int64Counter(
+		"back_in_stock_subscriptions_total",
+		metric.WithDescription("Total number of back-in-stock subscriptions created"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create subscription counter: %w", err)
+	}
+
+	subs.pendingGauge, err = meter.Int64ObservableGauge(
+		"back_in_stock_subscriptions_pending",
+		metric.WithDescription("Current number of pending back-in-stock subscriptions per product"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pending subscriptions gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(ctx context.Context, observer metric.Observer) error {
+			subs.mutex.Lock()
+			defer subs.mutex.Unlock()
+			for productID, users := range subs.waiting {
+				observer.ObserveInt64(subs.pendingGauge, int64(len(users)),
+					metric.WithAttributes(attribute.String("product_id", productID)))
+			}
+			return nil
+		},
+		subs.pendingGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register subscriptions callback: %w", err)
+	}
+
+	return subs, nil
+}
+
+// Subscribe registers userID for a notification once quantity units of
+// productID are available. Re-subscribing replaces the wanted quantity.
+func (ss *stockSubscriptions) Subscribe(ctx context.Context, productID, userID string, quantity int) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	users, exists := ss.waiting[productID]
+	if !exists {
+		users = make(map[string]int)
+		ss.waiting[productID] = users
+	}
+	users[userID] = quantity
+
+	ss.subscriptionCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("product_id", productID)))
+}
+
+// takeSatisfied removes and returns the subscribers of a product whose
+// wanted quantity is covered by stock
+func (ss *stockSubscriptions) takeSatisfied(productID string, stock int) []string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	var satisfied []string
+	for userID, quantity := range ss.waiting[productID] {
+		if quantity <= stock {
+			satisfied = append(satisfied, userID)
+			delete(ss.waiting[productID], userID)
+		}
+	}
+	if len(ss.waiting[productID]) == 0 {
+		delete(ss.waiting, productID)
+	}
+	return satisfied
+}
+
+// Restock adds stock to a product and notifies subscribers whose wanted
+// quantity is now available. It returns the updated product and the number
+// of notifications dispatched.
+func (cs *CartService) Restock(ctx context.Context, productID string, quantity int) (Product, int, error) {
+	product, err := cs.catalogFor(ctx).Restock(productID, quantity)
+	if err != nil {
+		return Product{}, 0, err
+	}
+
+	subscribers := cs.stockSubscriptions.takeSatisfied(productID, product.Stock)
+	for _, userID := range subscribers {
+		cs.notifications.Dispatch(Notification{
+			Type:      notificationBackInStock,
+			UserID:    userID,
+			ProductID: productID,
+			Message:   fmt.Sprintf("%s is back in stock", product.Name),
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+
+	return product, len(subscribers), nil
+}
+
+func (ms *MetricsServer) handleStockSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    string `json:"user_id"`
+		ProductID string `json:"product_id"`
+		Quantity  int    `json:"quantity"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	switch {
+	case req.UserID == "":
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	case req.ProductID == "":
+		ms.rejectInvalidRequest(w, r, constraintViolation("product_id", msgMissingFields))
+		return
+	case req.Quantity < 0:
+		ms.rejectInvalidRequest(w, r, constraintViolation("quantity", msgInvalidFieldValue))
+		return
+	}
+
+	if _, err := ms.service.catalogFor(r.Context()).Get(req.ProductID); err != nil {
+		writeError(w, r, http.StatusNotFound, msgProductNotFound, req.ProductID)
+		return
+	}
+
+	ms.service.stockSubscriptions.Subscribe(r.Context(), req.ProductID, req.UserID, req.Quantity)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "subscribed",
+		"product_id": req.ProductID,
+		"quantity":   req.Quantity,
+	})
+}
+
+func (ms *MetricsServer) handleRestock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ProductID string `json:"product_id"`
+		Quantity  int    `json:"quantity"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+
+	if req.ProductID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("product_id", msgMissingFields))
+		return
+	}
+	if req.Quantity <= 0 {
+		ms.rejectInvalidRequest(w, r, constraintViolation("quantity", msgInvalidFieldValue))
+		return
+	}
+
+	product, notified, err := ms.service.Restock(r.Context(), req.ProductID, req.Quantity)
+	if err != nil {
+		ms.writeServiceError(w, r, err, req.ProductID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"product":  product,
+		"notified": notified,
+	})
+}
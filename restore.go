@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	// ErrRestoreUnavailable is returned when the cart store keeps no
+	// write-ahead log history to restore from
+	ErrRestoreUnavailable = errors.New("point-in-time restore requires a write-ahead log")
+	// ErrRestoreOutOfRange is returned for times the retained history
+	// doesn't cover
+	ErrRestoreOutOfRange = errors.New("restore point outside the retained history")
+	// ErrNoStagedRestore is returned when promoting or inspecting without
+	// a staged restore
+	ErrNoStagedRestore = errors.New("no restore staged")
+)
+
+// maxRestoreChanges caps the carts listed in a restore plan; the summary
+// counts all of them
+const maxRestoreChanges = 1000
+
+// Ways promoting a restore changes a live cart
+const (
+	restoreCreate = "create" // existed then, gone now
+	restoreUpdate = "update" // items differ
+	restoreDelete = "delete" // created since
+)
+
+// CartChange is how promoting a restore changes one live cart
+type CartChange struct {
+	UserID   string     `json:"user_id"`
+	Action   string     `json:"action"`
+	Live     []CartItem `json:"live,omitempty"`
+	Restored []CartItem `json:"restored,omitempty"`
+}
+
+// RestoreSummary counts the carts a restore changes and leaves alone
+type RestoreSummary struct {
+	Create    int `json:"create"`
+	Update    int `json:"update"`
+	Delete    int `json:"delete"`
+	Unchanged int `json:"unchanged"`
+}
+
+// RestorePlan compares the carts as they were at a point in time with the
+// live ones
+type RestorePlan struct {
+	At         time.Time      `json:"at"`
+	UserPrefix string         `json:"user_prefix,omitempty"`
+	Snapshot   time.Time      `json:"snapshot"`         // history snapshot the state was rebuilt from
+	Replayed   int            `json:"replayed_entries"` // logged changes applied on top of it
+	StagedAt   *time.Time     `json:"staged_at,omitempty"`
+	Summary    RestoreSummary `json:"summary"`
+	Changes    []CartChange   `json:"changes"`
+	Truncated  bool           `json:"truncated,omitempty"` // more changes than listed
+}
+
+// stagedRestore is a rebuilt past state held apart from the live carts
+// until it is promoted or discarded
+type stagedRestore struct {
+	at         time.Time
+	userPrefix string
+	snapshot   time.Time
+	replayed   int
+	stagedAt   time.Time
+	carts      map[string]*Cart // the restored carts matching userPrefix
+}
+
+// diff lists, in user ID order, how the live carts matching the prefix
+// differ from the staged ones
+func (sr *stagedRestore) diff(live []*Cart) (changes []CartChange, unchanged int) {
+	seen := make(map[string]bool, len(sr.carts))
+	for _, cart := range live {
+		if !strings.HasPrefix(cart.UserID, sr.userPrefix) {
+			continue
+		}
+		seen[cart.UserID] = true
+		restored, existed := sr.carts[cart.UserID]
+		switch {
+		case !existed:
+			changes = append(changes, CartChange{UserID: cart.UserID, Action: restoreDelete, Live: cart.Items})
+		case !slices.Equal(cart.Items, restored.Items):
+			changes = append(changes, CartChange{UserID: cart.UserID, Action: restoreUpdate, Live: cart.Items, Restored: restored.Items})
+		default:
+			unchanged++
+		}
+	}
+	for userID, restored := range sr.carts {
+		if !seen[userID] {
+			changes = append(changes, CartChange{UserID: userID, Action: restoreCreate, Restored: restored.Items})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].UserID < changes[j].UserID })
+	return changes, unchanged
+}
+
+// plan describes changes, listing at most maxRestoreChanges of them
+func (sr *stagedRestore) plan(changes []CartChange, unchanged int) *RestorePlan {
+	plan := &RestorePlan{
+		At:         sr.at,
+		UserPrefix: sr.userPrefix,
+		Snapshot:   sr.snapshot,
+		Replayed:   sr.replayed,
+		Summary:    RestoreSummary{Unchanged: unchanged},
+		Changes:    []CartChange{},
+	}
+	if !sr.stagedAt.IsZero() {
+		stagedAt := sr.stagedAt
+		plan.StagedAt = &stagedAt
+	}
+	for _, change := range changes {
+		switch change.Action {
+		case restoreCreate:
+			plan.Summary.Create++
+		case restoreUpdate:
+			plan.Summary.Update++
+		case restoreDelete:
+			plan.Summary.Delete++
+		}
+	}
+	if len(changes) > maxRestoreChanges {
+		changes = changes[:maxRestoreChanges]
+		plan.Truncated = true
+	}
+	plan.Changes = append(plan.Changes, changes...)
+	return plan
+}
+
+// cartRestorer rebuilds cart state at a past time from the write-ahead
+// log history into a staging namespace, which can be compared with the
+// live carts and then promoted to replace them. Only one restore is staged
+// at a time.
+type cartRestorer struct {
+	wal    *walCartStore // nil when the store keeps no history
+	staged *stagedRestore
+	mutex  sync.Mutex
+
+	// OpenTelemetry Metrics
+	operationCounter metric.Int64Counter // Counter: restore operations by action and result
+}
+
+// newCartRestorer creates a restorer reading the history of wal, which
+// may be nil
+func newCartRestorer(wal *walCartStore) (*cartRestorer, error) {
+	meter := otel.Meter("shopping-cart-service")
+	cr := &cartRestorer{wal: wal}
+
+	var err error
+	cr.operationCounter, err = meter.Int64Counter(
+		"cart_restores_total",
+		metric.WithDescription("Total number of point-in-time restore operations by action and result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart restores counter: %w", err)
+	}
+
+	return cr, nil
+}
+
+func (cr *cartRestorer) count(ctx context.Context, action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	cr.operationCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("action", action),
+		attribute.String("result", result),
+	))
+}
+
+// PlanRestore rebuilds the carts of users with userPrefix as they were at
+// and diffs them against the live carts. With stage the rebuilt carts
+// replace any staged restore, ready to be promoted; otherwise it is a dry
+// run and nothing is kept.
+func (cs *CartService) PlanRestore(ctx context.Context, at time.Time, userPrefix string, stage bool) (plan *RestorePlan, err error) {
+	action := "dry_run"
+	if stage {
+		action = "stage"
+	}
+	defer func() { cs.restorer.count(ctx, action, err) }()
+
+	if cs.restorer.wal == nil {
+		return nil, ErrRestoreUnavailable
+	}
+	// The history holds every namespace's carts under their storage keys,
+	// so restores compare against the unscoped store
+	ctx = unscoped(ctx)
+	state, snapshot, replayed, err := cs.restorer.wal.stateAt(at)
+	if err != nil {
+		return nil, err
+	}
+
+	restored, _ := state.List(ctx)
+	staged := &stagedRestore{at: at, userPrefix: userPrefix, snapshot: snapshot, replayed: replayed, carts: make(map[string]*Cart)}
+	for _, cart := range restored {
+		if strings.HasPrefix(cart.UserID, userPrefix) {
+			staged.carts[cart.UserID] = cart
+		}
+	}
+
+	live, err := cs.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stage {
+		staged.stagedAt = time.Now().UTC()
+		cs.restorer.mutex.Lock()
+		cs.restorer.staged = staged
+		cs.restorer.mutex.Unlock()
+	}
+	return staged.plan(staged.diff(live)), nil
+}
+
+// StagedRestore diffs the staged restore against the live carts as they
+// are now
+func (cs *CartService) StagedRestore(ctx context.Context) (*RestorePlan, error) {
+	cs.restorer.mutex.Lock()
+	staged := cs.restorer.staged
+	cs.restorer.mutex.Unlock()
+	if staged == nil {
+		return nil, ErrNoStagedRestore
+	}
+
+	live, err := cs.store.List(unscoped(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return staged.plan(staged.diff(live)), nil
+}
+
+// PromoteRestore makes the live carts match the staged restore: carts that
+// existed then are put back as they were and carts created since are
+// deleted, through the store so the changes are logged like any other.
+// The returned plan lists the changes made. The staging namespace is
+// cleared once every change is applied.
+func (cs *CartService) PromoteRestore(ctx context.Context) (plan *RestorePlan, err error) {
+	defer func() { cs.restorer.count(ctx, "promote", err) }()
+
+	// Holding the restorer lock keeps the staged restore from being
+	// replaced, or promoted twice, meanwhile
+	cs.restorer.mutex.Lock()
+	defer cs.restorer.mutex.Unlock()
+	staged := cs.restorer.staged
+	if staged == nil {
+		return nil, ErrNoStagedRestore
+	}
+
+	live, err := cs.store.List(unscoped(ctx))
+	if err != nil {
+		return nil, err
+	}
+	changes, unchanged := staged.diff(live)
+	for i, change := range changes {
+		if err := cs.applyRestoreChange(unscoped(ctx), staged, change); err != nil {
+			return nil, fmt.Errorf("failed to restore cart for user %s after %d of %d changes: %w", change.UserID, i, len(changes), err)
+		}
+	}
+
+	cs.restorer.staged = nil
+	return staged.plan(changes, unchanged), nil
+}
+
+// applyRestoreChange puts back or deletes one live cart
+func (cs *CartService) applyRestoreChange(ctx context.Context, staged *stagedRestore, change CartChange) error {
+	defer cs.cartLocks.lock(change.UserID)()
+	if change.Action == restoreDelete {
+		return cs.store.Delete(ctx, change.UserID)
+	}
+	return cs.store.Put(ctx, staged.carts[change.UserID])
+}
+
+// DiscardRestore drops the staged restore
+func (cs *CartService) DiscardRestore(ctx context.Context) (err error) {
+	defer func() { cs.restorer.count(ctx, "discard", err) }()
+
+	cs.restorer.mutex.Lock()
+	defer cs.restorer.mutex.Unlock()
+	if cs.restorer.staged == nil {
+		return ErrNoStagedRestore
+	}
+	cs.restorer.staged = nil
+	return nil
+}
+
+// writeRestoreError answers with the status for a restore failure
+func (ms *MetricsServer) writeRestoreError(w http.ResponseWriter, r *http.Request, at time.Time, err error) {
+	ms.writeServiceError(w, r, err, at.Format(time.RFC3339))
+}
+
+// handleRestore rebuilds the carts as they were at a point in time. POST
+// {"at": RFC 3339, "user_prefix": "...", "dry_run": true} returns the diff
+// against the live carts; without dry_run the rebuilt carts are also
+// staged for /admin/restore/promote. GET diffs the staged restore against
+// the live carts now and DELETE discards it.
+func (ms *MetricsServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	var plan *RestorePlan
+	var err error
+	var at time.Time
+
+	switch r.Method {
+	case http.MethodGet:
+		plan, err = ms.service.StagedRestore(r.Context())
+	case http.MethodPost:
+		var req struct {
+			At         time.Time `json:"at"`
+			UserPrefix string    `json:"user_prefix"`
+			DryRun     bool      `json:"dry_run"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		if req.At.IsZero() {
+			ms.rejectInvalidRequest(w, r, constraintViolation("at", msgMissingFields))
+			return
+		}
+		if req.At.After(time.Now()) {
+			ms.rejectInvalidRequest(w, r, constraintViolation("at", msgInvalidFieldValue))
+			return
+		}
+		at = req.At
+		plan, err = ms.service.PlanRestore(r.Context(), req.At, req.UserPrefix, !req.DryRun)
+	case http.MethodDelete:
+		if err := ms.service.DiscardRestore(r.Context()); err != nil {
+			ms.writeRestoreError(w, r, at, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+		return
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		ms.writeRestoreError(w, r, at, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// handleRestorePromote replaces the live carts with the staged restore and
+// returns the changes made
+func (ms *MetricsServer) handleRestorePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	plan, err := ms.service.PromoteRestore(r.Context())
+	if err != nil {
+		ms.writeRestoreError(w, r, time.Time{}, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Promoted point-in-time restore", "at", plan.At, "user_prefix", plan.UserPrefix,
+		"created", plan.Summary.Create, "updated", plan.Summary.Update, "deleted", plan.Summary.Delete)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// runRestore drives a point-in-time restore on a running instance. With
+// --at it prints how restoring to that time would change the live carts,
+// staging the result with --stage; --promote applies the staged restore
+// and --discard drops it. Without either it shows the staged restore.
+func runRestore(ctx context.Context, args []string) error {
+	flags, baseURL, token, timeout := adminCommandFlags("restore")
+	atValue := flags.String("at", "", "time to restore to, RFC 3339")
+	userPrefix := flags.String("user-prefix", "", "only restore carts of users with this prefix")
+	stage := flags.Bool("stage", false, "stage the restore for --promote instead of a dry run")
+	promote := flags.Bool("promote", false, "replace the live carts with the staged restore")
+	discard := flags.Bool("discard", false, "drop the staged restore")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	method, path, body := http.MethodGet, "/admin/restore", ""
+	switch {
+	case *promote && *discard:
+		return errors.New("--promote and --discard are exclusive")
+	case *promote:
+		method, path = http.MethodPost, "/admin/restore/promote"
+	case *discard:
+		method = http.MethodDelete
+	case *atValue != "":
+		at, err := time.Parse(time.RFC3339, *atValue)
+		if err != nil {
+			return fmt.Errorf("invalid --at %q: %w", *atValue, err)
+		}
+		request, _ := json.Marshal(map[string]interface{}{"at": at, "user_prefix": *userPrefix, "dry_run": !*stage})
+		method, body = http.MethodPost, string(request)
+	}
+
+	url := strings.TrimSuffix(*baseURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if *discard {
+		fmt.Println("Discarded the staged restore")
+		return nil
+	}
+
+	var plan RestorePlan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return fmt.Errorf("failed to decode restore plan: %w", err)
+	}
+	switch {
+	case *promote:
+		fmt.Printf("Restored carts to %s\n", plan.At.Format(time.RFC3339))
+	case plan.StagedAt != nil:
+		fmt.Printf("Staged restore to %s (promote with --promote)\n", plan.At.Format(time.RFC3339))
+	default:
+		fmt.Printf("Dry run of a restore to %s\n", plan.At.Format(time.RFC3339))
+	}
+	renderRestorePlan(os.Stdout, &plan)
+	return nil
+}
+
+// renderRestorePlan writes the plan's source, summary and changes
+func renderRestorePlan(w io.Writer, plan *RestorePlan) {
+	fmt.Fprintf(w, "From snapshot %s + %d logged changes", plan.Snapshot.Format(time.RFC3339), plan.Replayed)
+	if plan.UserPrefix != "" {
+		fmt.Fprintf(w, ", users %s*", plan.UserPrefix)
+	}
+	fmt.Fprintf(w, "\n%d create, %d update, %d delete, %d unchanged\n\n",
+		plan.Summary.Create, plan.Summary.Update, plan.Summary.Delete, plan.Summary.Unchanged)
+	if len(plan.Changes) == 0 {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "USER\tACTION\tLIVE\tRESTORED")
+	for _, change := range plan.Changes {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", change.UserID, change.Action, formatItems(change.Live), formatItems(change.Restored))
+	}
+	table.Flush()
+	if plan.Truncated {
+		fmt.Fprintf(w, "\nOnly the first %d changes are listed\n", len(plan.Changes))
+	}
+}
+
+// formatItems lists cart lines as id×quantity
+func formatItems(items []CartItem) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	lines := make([]string, len(items))
+	for i, item := range items {
+		lines[i] = fmt.Sprintf("%s×%d", item.ID, item.Quantity)
+	}
+	return strings.Join(lines, ", ")
+}
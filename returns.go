@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RMAState is the state of a return merchandise authorization
+type RMAState string
+
+// RMA states. Requested returns are approved or rejected by an admin;
+// approved returns are restocked on receipt, and received ones refunded.
+const (
+	RMARequested RMAState = "requested"
+	RMAApproved  RMAState = "approved"
+	RMARejected  RMAState = "rejected"
+	RMAReceived  RMAState = "received"
+	RMARefunded  RMAState = "refunded"
+)
+
+// rmaTransitions maps admin actions to the state changes they allow
+var rmaTransitions = map[string]map[RMAState]RMAState{
+	"approve": {RMARequested: RMAApproved},
+	"reject":  {RMARequested: RMARejected},
+	"receive": {RMAApproved: RMAReceived},
+	"refund":  {RMAReceived: RMARefunded},
+}
+
+// Notification type sent when a refund is issued
+const notificationRefundIssued = "refund_issued"
+
+// Errors returned by the returns workflow
+var (
+	ErrReturnNotFound    = errors.New("return not found")
+	ErrInvalidReturn     = errors.New("invalid return request")
+	ErrInvalidTransition = errors.New("invalid return state transition")
+)
+
+// ReturnLine is a quantity of one order line being returned
+type ReturnLine struct {
+	ItemID   string  `json:"item_id"`
+	Quantity int     `json:"quantity"`
+	Refund   float64 `json:"refund"`
+}
+
+// RMAEvent records one state change of a return
+type RMAEvent struct {
+	From RMAState  `json:"from,omitempty"`
+	To   RMAState  `json:"to"`
+	At   time.Time `json:"at"`
+	Note string    `json:"note,omitempty"`
+}
+
+// RMA is a return merchandise authorization for lines of an order
+type RMA struct {
+	ID          string       `json:"id"`
+	UserID      string       `json:"user_id"`
+	OrderID     string       `json:"order_id"`
+	Reason      string       `json:"reason,omitempty"`
+	Lines       []ReturnLine `json:"lines"`
+	RefundTotal float64      `json:"refund_total"`
+	State       RMAState     `json:"state"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Events      []RMAEvent   `json:"events"`
+}
+
+// snapshot returns a deep copy safe to use outside the desk's lock
+func (rma *RMA) snapshot() RMA {
+	copied := *rma
+	copied.Lines = append([]ReturnLine(nil), rma.Lines...)
+	copied.Events = append([]RMAEvent(nil), rma.Events...)
+	return copied
+}
+
+// returnsDesk stores returns and records their state changes
+type returnsDesk struct {
+	returns map[string]*RMA
+	mutex   sync.Mutex
+
+	// OpenTelemetry Metrics
+	transitionCounter metric.Int64Counter     // Counter: state transitions
+	stateDuration     metric.Float64Histogram // Histogram: time spent in each state
+}
+
+// newReturnsDesk creates an empty returns desk
+func newReturnsDesk() (*returnsDesk, error) {
+	meter := otel.Meter("shopping-cart-service")
+	desk := &returnsDesk{returns: make(map[string]*RMA)}
+
+	var err error
+	desk.transitionCounter, err = meter.Int64Counter(
+		"rma_transitions_total",
+		metric.WithDescription("Total number of return state transitions by from and to state"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create RMA transition counter: %w", err)
+	}
+
+	desk.stateDuration, err = meter.Float64Histogram(
+		"rma_state_duration_seconds",
+		metric.WithDescription("Time returns spend in each state before moving on"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(60, 300, 900, 3600, 14400, 86400, 259200, 604800),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create RMA state duration histogram: %w", err)
+	}
+
+	return desk, nil
+}
+
+// transition moves a return to a new state, recording the time spent in the
+// previous one. Guarded by rd.mutex.
+func (rd *returnsDesk) transition(ctx context.Context, rma *RMA, to RMAState, note string) {
+	now := time.Now().UTC()
+	from := rma.State
+
+	rd.stateDuration.Record(ctx, now.Sub(rma.UpdatedAt).Seconds(),
+		metric.WithAttributes(attribute.String("state", string(from))))
+	rd.transitionCounter.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.String("from", string(from)),
+			attribute.String("to", string(to)),
+		),
+	)
+	trace.SpanFromContext(ctx).AddEvent("rma.transition", trace.WithAttributes(
+		attribute.String("rma.id", rma.ID),
+		attribute.String("rma.from", string(from)),
+		attribute.String("rma.to", string(to)),
+	))
+
+	rma.State = to
+	rma.UpdatedAt = now
+	rma.Events = append(rma.Events, RMAEvent{From: from, To: to, At: now, Note: note})
+}
+
+// returnedQuantities sums quantities per item already under return for an
+// order, excluding rejected returns. Guarded by rd.mutex.
+func (rd *returnsDesk) returnedQuantities(orderID string) map[string]int {
+	returned := make(map[string]int)
+	for _, rma := range rd.returns {
+		if rma.OrderID != orderID || rma.State == RMARejected {
+			continue
+		}
+		for _, line := range rma.Lines {
+			returned[line.ItemID] += line.Quantity
+		}
+	}
+	return returned
+}
+
+// RequestReturn opens a return for lines of one of the user's orders. Each
+// line's refund is its share of the order line total after discounts.
+func (cs *CartService) RequestReturn(ctx context.Context, userID, orderID, reason string, lines []ReturnLine) (*RMA, error) {
+	order, err := cs.orders.Get(userID, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%w: no lines", ErrInvalidReturn)
+	}
+
+	ordered := make(map[string]TotalsLine, len(order.Totals.Lines))
+	for _, line := range order.Totals.Lines {
+		ordered[line.ItemID] = line
+	}
+
+	cs.returns.mutex.Lock()
+	defer cs.returns.mutex.Unlock()
+
+	returned := cs.returns.returnedQuantities(orderID)
+	now := time.Now().UTC()
+	rma := &RMA{
+		ID:        "rma_" + newRequestID()[:16],
+		UserID:    userID,
+		OrderID:   orderID,
+		Reason:    reason,
+		State:     RMARequested,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Events:    []RMAEvent{{To: RMARequested, At: now}},
+	}
+	for _, line := range lines {
+		orderLine, exists := ordered[line.ItemID]
+		returned[line.ItemID] += line.Quantity
+		if !exists || line.Quantity <= 0 || returned[line.ItemID] > orderLine.Quantity {
+			return nil, fmt.Errorf("%w: item %s", ErrInvalidReturn, line.ItemID)
+		}
+
+		line.Refund = roundCents(orderLine.Total / float64(orderLine.Quantity) * float64(line.Quantity))
+		rma.RefundTotal = roundCents(rma.RefundTotal + line.Refund)
+		rma.Lines = append(rma.Lines, line)
+	}
+
+	cs.returns.returns[rma.ID] = rma
+	cs.returns.transitionCounter.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.String("from", ""),
+			attribute.String("to", string(RMARequested)),
+		),
+	)
+
+	snapshot := rma.snapshot()
+	return &snapshot, nil
+}
+
+// TransitionReturn applies an admin action (approve, reject, receive or
+// refund) to a return. Receiving restocks the returned items; refunding
+// sends the refund notification.
+func (cs *CartService) TransitionReturn(ctx context.Context, rmaID, action, note string) (*RMA, error) {
+	cs.returns.mutex.Lock()
+	defer cs.returns.mutex.Unlock()
+
+	rma, exists := cs.returns.returns[rmaID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrReturnNotFound, rmaID)
+	}
+	to, allowed := rmaTransitions[action][rma.State]
+	if !allowed {
+		return nil, fmt.Errorf("%w: cannot %s a %s return", ErrInvalidTransition, action, rma.State)
+	}
+
+	if to == RMAReceived {
+		for _, line := range rma.Lines {
+			// Items outside the catalog are not stock-tracked
+			if _, _, err := cs.Restock(ctx, line.ItemID, line.Quantity); err != nil && !errors.Is(err, ErrProductNotFound) {
+				return nil, fmt.Errorf("failed to restock %s: %w", line.ItemID, err)
+			}
+		}
+	}
+
+	cs.returns.transition(ctx, rma, to, note)
+
+	if to == RMARefunded {
+		cs.notifications.Dispatch(Notification{
+			Type:      notificationRefundIssued,
+			UserID:    rma.UserID,
+			Message:   fmt.Sprintf("Refund of %.2f issued for return %s", rma.RefundTotal, rma.ID),
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+
+	snapshot := rma.snapshot()
+	return &snapshot, nil
+}
+
+// ListReturns returns a user's returns, newest first
+func (cs *CartService) ListReturns(userID string) []RMA {
+	cs.returns.mutex.Lock()
+	defer cs.returns.mutex.Unlock()
+
+	var returns []RMA
+	for _, rma := range cs.returns.returns {
+		if rma.UserID == userID {
+			returns = append(returns, rma.snapshot())
+		}
+	}
+	sort.Slice(returns, func(i, j int) bool {
+		return returns[i].CreatedAt.After(returns[j].CreatedAt)
+	})
+	return returns
+}
+
+func (ms *MetricsServer) handleReturns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+			return
+		}
+		setRequestUser(r.Context(), userID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"returns": ms.service.ListReturns(userID),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			UserID  string       `json:"user_id"`
+			OrderID string       `json:"order_id"`
+			Reason  string       `json:"reason"`
+			Lines   []ReturnLine `json:"lines"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		setRequestUser(r.Context(), req.UserID)
+
+		if req.UserID == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+			return
+		}
+		if req.OrderID == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("order_id", msgMissingFields))
+			return
+		}
+
+		rma, err := ms.service.RequestReturn(r.Context(), req.UserID, req.OrderID, req.Reason, req.Lines)
+		switch {
+		case errors.Is(err, ErrInvalidReturn):
+			ms.rejectInvalidRequest(w, r, constraintViolation("lines", msgInvalidFieldValue))
+			return
+		case err != nil:
+			ms.writeServiceError(w, r, err, req.OrderID)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rma)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
+
+func (ms *MetricsServer) handleReturnTransition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RMAID  string `json:"rma_id"`
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+
+	if req.RMAID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("rma_id", msgMissingFields))
+		return
+	}
+	if _, known := rmaTransitions[req.Action]; !known {
+		ms.rejectInvalidRequest(w, r, constraintViolation("action", msgInvalidFieldValue))
+		return
+	}
+
+	rma, err := ms.service.TransitionReturn(r.Context(), req.RMAID, req.Action, req.Note)
+	switch {
+	case errors.Is(err, ErrInvalidTransition):
+		writeError(w, r, http.StatusConflict, msgInvalidTransition, req.Action)
+		return
+	case err != nil:
+		ms.writeServiceError(w, r, err, req.RMAID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rma)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RiskDecision is the outcome of a checkout risk evaluation
+type RiskDecision string
+
+// Risk decisions in increasing order of severity
+const (
+	RiskAllow  RiskDecision = "allow"
+	RiskFlag   RiskDecision = "flag"
+	RiskDelay  RiskDecision = "delay"
+	RiskReject RiskDecision = "reject"
+)
+
+var riskSeverity = map[RiskDecision]int{RiskAllow: 0, RiskFlag: 1, RiskDelay: 2, RiskReject: 3}
+
+// Velocity signals evaluated by the built-in checker
+const (
+	riskSignalCheckoutVelocity = "checkouts_per_hour"
+	riskSignalValueSpike       = "value_spike"
+	riskSignalSharedIP         = "users_per_ip"
+)
+
+// CheckoutAttempt describes a checkout being evaluated for risk
+type CheckoutAttempt struct {
+	UserID   string
+	ClientIP string
+	Total    float64
+	At       time.Time
+}
+
+// RiskAssessment is a risk decision with the signals that triggered it
+type RiskAssessment struct {
+	Decision RiskDecision `json:"decision"`
+	Signals  []string     `json:"signals,omitempty"`
+}
+
+// escalate raises the assessment to decision if it is more severe
+func (ra *RiskAssessment) escalate(signal string, decision RiskDecision) {
+	ra.Signals = append(ra.Signals, signal)
+	if riskSeverity[decision] > riskSeverity[ra.Decision] {
+		ra.Decision = decision
+	}
+}
+
+// RiskChecker evaluates checkout attempts. Implementations must be safe for
+// concurrent use; the built-in one is a velocity checker.
+type RiskChecker interface {
+	Evaluate(ctx context.Context, attempt CheckoutAttempt) RiskAssessment
+}
+
+// riskRule is a threshold on one velocity signal and the decision taken
+// when it is exceeded
+type riskRule struct {
+	threshold float64
+	decision  RiskDecision
+}
+
+// RiskRules holds the thresholds of the velocity checker keyed by signal
+type RiskRules map[string]riskRule
+
+// defaultRiskRules is used when RISK_RULES is not set
+const defaultRiskRules = "checkouts_per_hour=5:delay,value_spike=5:flag,users_per_ip=10:reject"
+
+// ParseRiskRules parses "signal=threshold:decision,..." where signal is one
+// of checkouts_per_hour, value_spike (multiple of the user's average order)
+// or users_per_ip
+func ParseRiskRules(spec string) (RiskRules, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = defaultRiskRules
+	}
+
+	rules := make(RiskRules)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		signal, rest, found := strings.Cut(entry, "=")
+		thresholdValue, decisionValue, hasDecision := strings.Cut(rest, ":")
+		if !found || !hasDecision {
+			return nil, fmt.Errorf("invalid risk rule %q: expected signal=threshold:decision", entry)
+		}
+		switch signal {
+		case riskSignalCheckoutVelocity, riskSignalValueSpike, riskSignalSharedIP:
+		default:
+			return nil, fmt.Errorf("unknown risk signal %q", signal)
+		}
+		threshold, err := strconv.ParseFloat(thresholdValue, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid threshold in risk rule %q", entry)
+		}
+		decision := RiskDecision(decisionValue)
+		if _, ok := riskSeverity[decision]; !ok || decision == RiskAllow {
+			return nil, fmt.Errorf("invalid decision in risk rule %q", entry)
+		}
+
+		rules[signal] = riskRule{threshold: threshold, decision: decision}
+	}
+	return rules, nil
+}
+
+// velocityRiskChecker tracks recent checkouts per user and per client IP
+// over a sliding window
+type velocityRiskChecker struct {
+	rules  RiskRules
+	window time.Duration
+
+	checkouts map[string][]time.Time          // user -> recent checkout times
+	values    map[string][]float64            // user -> recent checkout totals
+	ipUsers   map[string]map[string]time.Time // IP -> user -> last seen
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// maxRiskValueHistory bounds the totals kept per user for spike detection
+const maxRiskValueHistory = 20
+
+// riskSweepInterval is how often users and IPs with no checkout left in
+// the window are dropped
+const riskSweepInterval = time.Minute
+
+// maxRiskTracked bounds the users, and separately the IPs, tracked at once,
+// so a flood of new ones within the window can't grow memory without
+// limit. Past it an arbitrary other one is forgotten.
+const maxRiskTracked = 100000
+
+// newVelocityRiskChecker creates a checker evaluating rules over window
+func newVelocityRiskChecker(rules RiskRules, window time.Duration) *velocityRiskChecker {
+	return &velocityRiskChecker{
+		rules:     rules,
+		window:    window,
+		checkouts: make(map[string][]time.Time),
+		values:    make(map[string][]float64),
+		ipUsers:   make(map[string]map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Evaluate checks the attempt against each configured signal and records it
+// for future evaluations
+func (vc *velocityRiskChecker) Evaluate(ctx context.Context, attempt CheckoutAttempt) RiskAssessment {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	assessment := RiskAssessment{Decision: RiskAllow}
+	cutoff := attempt.At.Add(-vc.window)
+	if attempt.At.Sub(vc.lastSweep) >= riskSweepInterval {
+		vc.sweepLocked(attempt.At, cutoff)
+	}
+
+	// Checkouts per user within the window
+	if _, exists := vc.checkouts[attempt.UserID]; !exists && len(vc.checkouts) >= maxRiskTracked {
+		for userID := range vc.checkouts {
+			delete(vc.checkouts, userID)
+			delete(vc.values, userID)
+			break
+		}
+	}
+	recent := vc.checkouts[attempt.UserID][:0]
+	for _, at := range vc.checkouts[attempt.UserID] {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, attempt.At)
+	vc.checkouts[attempt.UserID] = recent
+	if rule, ok := vc.rules[riskSignalCheckoutVelocity]; ok && float64(len(recent)) > rule.threshold {
+		assessment.escalate(riskSignalCheckoutVelocity, rule.decision)
+	}
+
+	// Cart value compared with the user's average checkout
+	history := vc.values[attempt.UserID]
+	if rule, ok := vc.rules[riskSignalValueSpike]; ok && len(history) > 0 {
+		sum := 0.0
+		for _, value := range history {
+			sum += value
+		}
+		if average := sum / float64(len(history)); average > 0 && attempt.Total > average*rule.threshold {
+			assessment.escalate(riskSignalValueSpike, rule.decision)
+		}
+	}
+	history = append(history, attempt.Total)
+	if len(history) > maxRiskValueHistory {
+		history = history[len(history)-maxRiskValueHistory:]
+	}
+	vc.values[attempt.UserID] = history
+
+	// Distinct users checking out from one IP within the window
+	if attempt.ClientIP != "" {
+		users, exists := vc.ipUsers[attempt.ClientIP]
+		if !exists {
+			if len(vc.ipUsers) >= maxRiskTracked {
+				for ip := range vc.ipUsers {
+					delete(vc.ipUsers, ip)
+					break
+				}
+			}
+			users = make(map[string]time.Time)
+			vc.ipUsers[attempt.ClientIP] = users
+		}
+		for userID, lastSeen := range users {
+			if !lastSeen.After(cutoff) {
+				delete(users, userID)
+			}
+		}
+		users[attempt.UserID] = attempt.At
+		if rule, ok := vc.rules[riskSignalSharedIP]; ok && float64(len(users)) > rule.threshold {
+			assessment.escalate(riskSignalSharedIP, rule.decision)
+		}
+	}
+
+	return assessment
+}
+
+// sweepLocked drops the users and IPs with no checkout after cutoff,
+// including the totals of those users: the maps would otherwise keep one
+// key for every user and IP ever seen. Callers must hold vc.mutex.
+func (vc *velocityRiskChecker) sweepLocked(now, cutoff time.Time) {
+	vc.lastSweep = now
+	for userID, times := range vc.checkouts {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(vc.checkouts, userID)
+			delete(vc.values, userID)
+		}
+	}
+	for ip, users := range vc.ipUsers {
+		for userID, lastSeen := range users {
+			if !lastSeen.After(cutoff) {
+				delete(users, userID)
+			}
+		}
+		if len(users) == 0 {
+			delete(vc.ipUsers, ip)
+		}
+	}
+}
+
+// CheckoutQuota is how many more checkouts a user may place before the
+// velocity rule triggers
+type CheckoutQuota struct {
+	Limit     int           // checkouts allowed per window
+	Remaining int           // left in the current window
+	Window    time.Duration // the sliding window
+	Reset     time.Duration // until the oldest counted checkout leaves the window
+	Decision  RiskDecision  // taken once the limit is exceeded
+}
+
+// checkoutQuotaReporter is implemented by checkers that can report a user's
+// checkout quota
+type checkoutQuotaReporter interface {
+	checkoutQuota(userID string, now time.Time) (CheckoutQuota, bool)
+}
+
+// checkoutQuota reports userID's checkouts left under the checkouts per
+// hour rule, if one is configured
+func (vc *velocityRiskChecker) checkoutQuota(userID string, now time.Time) (CheckoutQuota, bool) {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	rule, ok := vc.rules[riskSignalCheckoutVelocity]
+	if !ok {
+		return CheckoutQuota{}, false
+	}
+
+	quota := CheckoutQuota{Limit: int(rule.threshold), Window: vc.window, Decision: rule.decision}
+	cutoff := now.Add(-vc.window)
+	counted := 0
+	for _, at := range vc.checkouts[userID] {
+		if !at.After(cutoff) {
+			continue
+		}
+		if counted == 0 {
+			quota.Reset = at.Sub(cutoff)
+		}
+		counted++
+	}
+	quota.Remaining = max(quota.Limit-counted, 0)
+	return quota, true
+}
+
+// RiskGate runs a RiskChecker for checkouts, applying delays and recording
+// each decision as a span and metrics
+type RiskGate struct {
+	checker RiskChecker
+	delay   time.Duration
+	tracer  trace.Tracer
+
+	// OpenTelemetry Metrics
+	decisionCounter metric.Int64Counter // Counter: decisions by outcome
+	signalCounter   metric.Int64Counter // Counter: triggered signals
+}
+
+// NewRiskGate creates a gate around checker, holding delayed checkouts for
+// delay before they proceed
+func NewRiskGate(checker RiskChecker, delay time.Duration) (*RiskGate, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	gate := &RiskGate{
+		checker: checker,
+		delay:   delay,
+		tracer:  otel.Tracer("shopping-cart-service"),
+	}
+
+	var err error
+	gate.decisionCounter, err = meter.Int64Counter(
+		"checkout_risk_decisions_total",
+		metric.WithDescription("Total number of checkout risk decisions by decision"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create risk decision counter: %w", err)
+	}
+
+	gate.signalCounter, err = meter.Int64Counter(
+		"checkout_risk_signals_total",
+		metric.WithDescription("Total number of triggered checkout risk signals by signal"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create risk signal counter: %w", err)
+	}
+
+	return gate, nil
+}
+
+// Assess evaluates a checkout attempt. Delayed attempts return once the
+// delay has elapsed or ctx is done.
+func (rg *RiskGate) Assess(ctx context.Context, attempt CheckoutAttempt) RiskAssessment {
+	ctx, span := rg.tracer.Start(ctx, "checkout.risk_check")
+	defer span.End()
+
+	assessment := rg.checker.Evaluate(ctx, attempt)
+
+	span.SetAttributes(
+		attribute.String("risk.decision", string(assessment.Decision)),
+		attribute.StringSlice("risk.signals", assessment.Signals),
+	)
+	rg.decisionCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("decision", string(assessment.Decision))))
+	for _, signal := range assessment.Signals {
+		rg.signalCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("signal", signal)))
+	}
+
+	if assessment.Decision == RiskDelay && rg.delay > 0 {
+		timer := time.NewTimer(rg.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return assessment
+}
+
+// CheckoutQuota reports userID's checkout quota when the checker tracks one
+func (rg *RiskGate) CheckoutQuota(userID string, now time.Time) (CheckoutQuota, bool) {
+	reporter, ok := rg.checker.(checkoutQuotaReporter)
+	if !ok {
+		return CheckoutQuota{}, false
+	}
+	return reporter.checkoutQuota(userID, now)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// routeMetricSwitches turns request metrics off for configured routes,
+// counting each measurement it suppresses so the suppression stays visible
+type routeMetricSwitches struct {
+	rules map[string][]routeMetricRule // route pattern -> rules
+
+	// OpenTelemetry Metrics
+	droppedCounter metric.Int64Counter // Counter: suppressed measurements by metric and endpoint
+}
+
+// routeMetricRule is a validated config.RouteMetricsConfig
+type routeMetricRule struct {
+	client   string          // client family, empty for any
+	disabled map[string]bool // nil for every request metric
+}
+
+func newRouteMetricSwitches(routes []config.RouteMetricsConfig) (*routeMetricSwitches, error) {
+	meter := otel.Meter("shopping-cart-service")
+	switches := &routeMetricSwitches{rules: make(map[string][]routeMetricRule)}
+	for _, route := range routes {
+		rule := routeMetricRule{client: route.Client}
+		if route.Disable[0] != config.AllRequestMetrics {
+			rule.disabled = make(map[string]bool)
+			for _, name := range route.Disable {
+				rule.disabled[name] = true
+			}
+		}
+		switches.rules[route.Route] = append(switches.rules[route.Route], rule)
+	}
+
+	var err error
+	switches.droppedCounter, err = meter.Int64Counter(
+		"http_metric_measurements_dropped_total",
+		metric.WithDescription("Total number of request metric measurements not recorded because the route's metric is disabled, by metric and endpoint"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dropped measurements counter: %w", err)
+	}
+
+	return switches, nil
+}
+
+// enabled reports whether the request metric name is recorded for the
+// request in ctx to endpoint, counting the measurement as dropped if not
+func (s *routeMetricSwitches) enabled(ctx context.Context, endpoint, name string) bool {
+	if s == nil {
+		return true
+	}
+	rules := s.rules[endpoint]
+	if len(rules) == 0 {
+		return true
+	}
+
+	var client string
+	if info := requestInfoFrom(ctx); info != nil {
+		client = info.Client.Family
+	}
+	for _, rule := range rules {
+		if rule.client != "" && rule.client != client {
+			continue
+		}
+		if rule.disabled == nil || rule.disabled[name] {
+			s.droppedCounter.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("metric", name),
+				attribute.String("endpoint", endpoint),
+			))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// apiVersion prefixes the versioned REST routes
+const apiVersion = "v1"
+
+// deprecated marks responses of a flat route replaced by successor, a
+// /v1 route template, with the Deprecation and Link-Template headers, and
+// counts its use so the alias can be removed once clients have moved
+func (ms *MetricsServer) deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link-Template", "<"+successor+`>; rel="successor-version"`)
+		ms.service.deprecatedRouteCounter.Add(r.Context(), 1, metric.WithAttributes(
+			attribute.String("endpoint", endpointOf(r)),
+		))
+		handler(w, r)
+	}
+}
+
+// handleV1Cart serves GET /v1/carts/{userID}, the user's cart, and DELETE,
+// emptying it or, with ?delete=true, deleting it
+func (ms *MetricsServer) handleV1Cart(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	setRequestUser(r.Context(), userID)
+
+	switch r.Method {
+	case http.MethodGet:
+		ms.writeCart(w, r, userID)
+	case http.MethodDelete:
+		deleteCart := false
+		if value := r.URL.Query().Get("delete"); value != "" {
+			var err error
+			if deleteCart, err = strconv.ParseBool(value); err != nil {
+				writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "delete")
+				return
+			}
+		}
+		if err := ms.service.ClearCart(r.Context(), userID, deleteCart); err != nil {
+			ms.writeServiceError(w, r, err, userID)
+			return
+		}
+		writeJSON(w, r, map[string]string{"status": "success"})
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
+
+// handleV1CartItems serves POST /v1/carts/{userID}/items, adding the item
+// in the body. Retries with the same Idempotency-Key add it once.
+func (ms *MetricsServer) handleV1CartItems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	userID := r.PathValue("userID")
+	setRequestUser(r.Context(), userID)
+
+	var item CartItem
+	if err := decodeJSONBody(r, &item); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	if err := validateCartItem(item); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	ms.addItem(w, r, userID, item)
+}
+
+// handleV1CartItem serves PATCH /v1/carts/{userID}/items/{itemID}, setting
+// the quantity in the body (0 or less removes the item), and DELETE,
+// removing the item
+func (ms *MetricsServer) handleV1CartItem(w http.ResponseWriter, r *http.Request) {
+	userID, itemID := r.PathValue("userID"), r.PathValue("itemID")
+	setRequestUser(r.Context(), userID)
+
+	switch r.Method {
+	case http.MethodPatch:
+		var req struct {
+			Quantity *int `json:"quantity"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		if req.Quantity == nil {
+			ms.rejectInvalidRequest(w, r, constraintViolation("quantity", msgMissingFields))
+			return
+		}
+		ms.setQuantity(w, r, userID, itemID, *req.Quantity)
+	case http.MethodDelete:
+		ms.removeItem(w, r, userID, itemID)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
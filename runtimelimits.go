@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// cgroupRoot is where the container's cgroup is mounted, as seen from
+// inside its cgroup namespace
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Where a runtime limit came from
+const (
+	limitSourceEnv     = "env"     // GOMAXPROCS or GOMEMLIMIT
+	limitSourceCgroup  = "cgroup"  // derived from the container's limits
+	limitSourceDefault = "default" // the Go runtime's own
+)
+
+// runtimeLimits are the container's cgroup limits and the Go runtime
+// settings derived from them
+type runtimeLimits struct {
+	cpuQuota    float64 // cores; 0 when unlimited or undetected
+	memoryLimit int64   // bytes; 0 when unlimited or undetected
+
+	maxProcs       int
+	maxProcsSource string
+	memLimit       int64 // GOMEMLIMIT bytes; 0 when unset
+	memLimitSource string
+}
+
+// applyRuntimeLimits sizes GOMAXPROCS and GOMEMLIMIT to the container's
+// cgroup limits, so a container granted 2 CPUs on a 64 core node doesn't
+// run 64 Ps into CPU throttling, and the garbage collector works harder
+// before the container is OOM killed rather than after. Variables set
+// explicitly in the environment are left alone.
+func applyRuntimeLimits(cfg config.RuntimeConfig) *runtimeLimits {
+	limits := &runtimeLimits{maxProcsSource: limitSourceDefault, memLimitSource: limitSourceDefault}
+	limits.cpuQuota, limits.memoryLimit = readCgroupLimits(cgroupRoot)
+
+	switch {
+	case os.Getenv("GOMAXPROCS") != "":
+		limits.maxProcsSource = limitSourceEnv
+	case cfg.AutoMaxProcs && limits.cpuQuota > 0:
+		runtime.GOMAXPROCS(max(int(math.Floor(limits.cpuQuota)), 1))
+		limits.maxProcsSource = limitSourceCgroup
+	}
+	limits.maxProcs = runtime.GOMAXPROCS(0)
+
+	switch {
+	case os.Getenv("GOMEMLIMIT") != "":
+		limits.memLimitSource = limitSourceEnv
+	case cfg.MemoryLimitRatio > 0 && limits.memoryLimit > 0:
+		debug.SetMemoryLimit(int64(float64(limits.memoryLimit) * cfg.MemoryLimitRatio))
+		limits.memLimitSource = limitSourceCgroup
+	}
+	if memLimit := debug.SetMemoryLimit(-1); memLimit != math.MaxInt64 {
+		limits.memLimit = memLimit
+	}
+
+	slog.Info("Runtime limits",
+		"cpu_quota", limits.cpuQuota,
+		"memory_limit", limits.memoryLimit,
+		"gomaxprocs", limits.maxProcs,
+		"gomaxprocs_source", limits.maxProcsSource,
+		"gomemlimit", limits.memLimit,
+		"gomemlimit_source", limits.memLimitSource,
+	)
+	return limits
+}
+
+// registerMetrics exports the limits as gauges
+func (rl *runtimeLimits) registerMetrics() error {
+	meter := otel.Meter("shopping-cart-service")
+
+	cpuQuota, err := meter.Float64ObservableGauge(
+		"runtime_cpu_quota",
+		metric.WithDescription("CPU quota of the container in cores; 0 when unlimited"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create runtime CPU quota gauge: %w", err)
+	}
+	memoryLimit, err := meter.Int64ObservableGauge(
+		"runtime_memory_limit_bytes",
+		metric.WithDescription("Memory limit of the container; 0 when unlimited"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create runtime memory limit gauge: %w", err)
+	}
+	maxProcs, err := meter.Int64ObservableGauge(
+		"runtime_gomaxprocs",
+		metric.WithDescription("GOMAXPROCS by source (env, cgroup, default)"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create GOMAXPROCS gauge: %w", err)
+	}
+	memLimit, err := meter.Int64ObservableGauge(
+		"runtime_gomemlimit_bytes",
+		metric.WithDescription("GOMEMLIMIT by source (env, cgroup, default); 0 when unset"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create GOMEMLIMIT gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			observer.ObserveFloat64(cpuQuota, rl.cpuQuota)
+			observer.ObserveInt64(memoryLimit, rl.memoryLimit)
+			observer.ObserveInt64(maxProcs, int64(rl.maxProcs), metric.WithAttributes(attribute.String("source", rl.maxProcsSource)))
+			observer.ObserveInt64(memLimit, rl.memLimit, metric.WithAttributes(attribute.String("source", rl.memLimitSource)))
+			return nil
+		},
+		cpuQuota, memoryLimit, maxProcs, memLimit,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register runtime limits callback: %w", err)
+	}
+	return nil
+}
+
+// readCgroupLimits reads the CPU quota, in cores, and the memory limit, in
+// bytes, of the cgroup mounted at root, v2 or v1. Either is 0 when
+// unlimited or unreadable, e.g. outside a container.
+func readCgroupLimits(root string) (cpuQuota float64, memoryLimit int64) {
+	// cgroup v2: "<quota> <period>" or "max <period>", and bytes or "max"
+	if fields, err := readCgroupFile(filepath.Join(root, "cpu.max")); err == nil {
+		if len(fields) == 2 {
+			cpuQuota = cgroupQuota(fields[0], fields[1])
+		}
+		if fields, err := readCgroupFile(filepath.Join(root, "memory.max")); err == nil && len(fields) == 1 {
+			memoryLimit = cgroupBytes(fields[0])
+		}
+		return cpuQuota, memoryLimit
+	}
+
+	// cgroup v1: the quota is -1 when unlimited, the memory limit close to
+	// the maximum int64
+	quota, quotaErr := readCgroupFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	period, periodErr := readCgroupFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if quotaErr == nil && periodErr == nil && len(quota) == 1 && len(period) == 1 {
+		cpuQuota = cgroupQuota(quota[0], period[0])
+	}
+	if fields, err := readCgroupFile(filepath.Join(root, "memory", "memory.limit_in_bytes")); err == nil && len(fields) == 1 {
+		memoryLimit = cgroupBytes(fields[0])
+	}
+	return cpuQuota, memoryLimit
+}
+
+// readCgroupFile reads the whitespace separated fields of a cgroup file
+func readCgroupFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, errors.New("empty cgroup file")
+	}
+	return fields, nil
+}
+
+// cgroupQuota divides a CPU quota by its period, 0 when unlimited
+func cgroupQuota(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// cgroupBytes parses a memory limit, 0 when unlimited. cgroup v1 reports
+// no limit as the maximum int64 rounded down to a page.
+func cgroupBytes(value string) int64 {
+	bytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || bytes <= 0 || bytes >= math.MaxInt64/2 {
+		return 0
+	}
+	return bytes
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxJobHistory bounds the run history kept per job
+const maxJobHistory = 20
+
+// CronSchedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week)
+type CronSchedule struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+
+	anyDay     bool
+	anyWeekday bool
+	location   *time.Location
+}
+
+// ParseCronSchedule parses a standard five-field cron expression evaluated
+// in location. Fields support "*", lists, ranges and steps ("*/15", "1-5").
+func ParseCronSchedule(spec string, location *time.Location) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+
+	schedule := &CronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+		location:   location,
+	}
+
+	parsers := []struct {
+		field    string
+		min, max int
+		set      func(int)
+	}{
+		{fields[0], 0, 59, func(v int) { schedule.minutes[v] = true }},
+		{fields[1], 0, 23, func(v int) { schedule.hours[v] = true }},
+		{fields[2], 1, 31, func(v int) { schedule.days[v] = true }},
+		{fields[3], 1, 12, func(v int) { schedule.months[v] = true }},
+		{fields[4], 0, 7, func(v int) { schedule.weekdays[v%7] = true }}, // 7 is Sunday too
+	}
+	for _, p := range parsers {
+		if err := parseCronField(p.field, p.min, p.max, p.set); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", spec, err)
+		}
+	}
+
+	return schedule, nil
+}
+
+// parseCronField expands one cron field into the values it matches
+func parseCronField(field string, min, max int, set func(int)) error {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step = parsed
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			lowValue, highValue, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(lowValue); err != nil {
+				return fmt.Errorf("invalid value in %q", part)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highValue); err != nil {
+					return fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			set(v)
+		}
+	}
+	return nil
+}
+
+// matchesDay applies cron's day semantics: when both day-of-month and
+// day-of-week are restricted, either may match
+func (cs *CronSchedule) matchesDay(t time.Time) bool {
+	dayMatch := cs.days[t.Day()]
+	weekdayMatch := cs.weekdays[int(t.Weekday())]
+	switch {
+	case cs.anyDay && cs.anyWeekday:
+		return true
+	case cs.anyDay:
+		return weekdayMatch
+	case cs.anyWeekday:
+		return dayMatch
+	default:
+		return dayMatch || weekdayMatch
+	}
+}
+
+// Next returns the first matching minute strictly after after, or the zero
+// time if none exists within five years
+func (cs *CronSchedule) Next(after time.Time) time.Time {
+	t := after.In(cs.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !cs.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, cs.location)
+			continue
+		}
+		if !cs.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, cs.location)
+			continue
+		}
+		if !cs.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, cs.location)
+			continue
+		}
+		if !cs.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// JobRun records the outcome of a single job execution
+type JobRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS float64   `json:"duration_ms"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// JobStatus is a read-only view of a scheduled job
+type JobStatus struct {
+	Name                string   `json:"name"`
+	Kind                string   `json:"kind"`
+	Schedule            string   `json:"schedule"`
+	NextRun             string   `json:"next_run,omitempty"`
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	History             []JobRun `json:"history"`
+}
+
+// scheduledJob is a job registered with the scheduler
+type scheduledJob struct {
+	name     string
+	kind     string
+	spec     string
+	schedule *CronSchedule
+	run      func(ctx context.Context) error
+
+	nextRun             time.Time
+	running             bool
+	consecutiveFailures int
+	history             []JobRun
+}
+
+// JobScheduler runs registered jobs on cron schedules. It is the shared
+// scheduler for background work such as recurring cart templates.
+type JobScheduler struct {
+	jobs  map[string]*scheduledJob
+	mutex sync.Mutex
+
+	// OpenTelemetry Metrics
+	runCounter     metric.Int64Counter         // Counter: job runs by kind and status
+	runDuration    metric.Float64Histogram     // Histogram: job run duration
+	failingJobs    metric.Int64ObservableGauge // Gauge: jobs whose last run failed
+	registeredJobs metric.Int64ObservableGauge // Gauge: registered jobs
+}
+
+// NewJobScheduler creates an empty scheduler
+func NewJobScheduler(durationBuckets []float64) (*JobScheduler, error) {
+	meter := otel.Meter("shopping-cart-service")
+	scheduler := &JobScheduler{jobs: make(map[string]*scheduledJob)}
+
+	var err error
+	scheduler.runCounter, err = meter.Int64Counter(
+		"scheduled_job_runs_total",
+		metric.WithDescription("Total number of scheduled job runs by kind and status"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job run counter: %w", err)
+	}
+
+	scheduler.runDuration, err = meter.Float64Histogram(
+		"scheduled_job_duration_seconds",
+		metric.WithDescription("Scheduled job run duration in seconds"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(durationBuckets...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job duration histogram: %w", err)
+	}
+
+	scheduler.failingJobs, err = meter.Int64ObservableGauge(
+		"scheduled_jobs_failing",
+		metric.WithDescription("Number of scheduled jobs whose most recent run failed"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create failing jobs gauge: %w", err)
+	}
+
+	scheduler.registeredJobs, err = meter.Int64ObservableGauge(
+		"scheduled_jobs_registered",
+		metric.WithDescription("Number of registered scheduled jobs"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create registered jobs gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(scheduler.observe, scheduler.failingJobs, scheduler.registeredJobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register scheduler callback: %w", err)
+	}
+
+	return scheduler, nil
+}
+
+// observe reports scheduler gauges by job kind
+func (js *JobScheduler) observe(ctx context.Context, observer metric.Observer) error {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	failing := make(map[string]int64)
+	registered := make(map[string]int64)
+	for _, job := range js.jobs {
+		registered[job.kind]++
+		if job.consecutiveFailures > 0 {
+			failing[job.kind]++
+		}
+	}
+	for kind, count := range registered {
+		attrs := metric.WithAttributes(attribute.String("kind", kind))
+		observer.ObserveInt64(js.registeredJobs, count, attrs)
+		observer.ObserveInt64(js.failingJobs, failing[kind], attrs)
+	}
+	return nil
+}
+
+// Schedule registers (or replaces) a named job
+func (js *JobScheduler) Schedule(name, kind string, schedule *CronSchedule, spec string, run func(ctx context.Context) error) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	js.jobs[name] = &scheduledJob{
+		name:     name,
+		kind:     kind,
+		spec:     spec,
+		schedule: schedule,
+		run:      run,
+		nextRun:  schedule.Next(time.Now()),
+	}
+}
+
+// Unschedule removes a job
+func (js *JobScheduler) Unschedule(name string) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	delete(js.jobs, name)
+}
+
+// Status returns a snapshot of a job
+func (js *JobScheduler) Status(name string) (JobStatus, bool) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	job, exists := js.jobs[name]
+	if !exists {
+		return JobStatus{}, false
+	}
+
+	status := JobStatus{
+		Name:                job.name,
+		Kind:                job.kind,
+		Schedule:            job.spec,
+		ConsecutiveFailures: job.consecutiveFailures,
+		History:             make([]JobRun, len(job.history)),
+	}
+	if !job.nextRun.IsZero() {
+		status.NextRun = job.nextRun.UTC().Format(time.RFC3339)
+	}
+	copy(status.History, job.history)
+	return status, true
+}
+
+// Run checks for due jobs every interval until ctx is cancelled
+func (js *JobScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			js.runDue(ctx, now)
+		}
+	}
+}
+
+// runDue starts every job whose next run time has passed
+func (js *JobScheduler) runDue(ctx context.Context, now time.Time) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	for _, job := range js.jobs {
+		if job.running || job.nextRun.IsZero() || now.Before(job.nextRun) {
+			continue
+		}
+		job.running = true
+		job.nextRun = job.schedule.Next(now)
+		go js.execute(ctx, job)
+	}
+}
+
+// execute runs a job and records its outcome
+func (js *JobScheduler) execute(ctx context.Context, job *scheduledJob) {
+	start := time.Now()
+	err := job.run(ctx)
+	duration := time.Since(start)
+
+	run := JobRun{
+		StartedAt:  start.UTC(),
+		DurationMS: float64(duration.Microseconds()) / 1000,
+		Status:     "success",
+	}
+	if err != nil {
+		run.Status = "failure"
+		run.Error = sanitizeErrorMessage(err.Error())
+		slog.ErrorContext(ctx, "Scheduled job failed", "job", job.name, "error", err)
+	}
+
+	attrs := metric.WithAttributes(
+		attribute.String("kind", job.kind),
+		attribute.String("status", run.Status),
+	)
+	js.runCounter.Add(ctx, 1, attrs)
+	js.runDuration.Record(ctx, duration.Seconds(), attrs)
+
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+
+	job.running = false
+	if err != nil {
+		job.consecutiveFailures++
+	} else {
+		job.consecutiveFailures = 0
+	}
+	job.history = append(job.history, run)
+	if len(job.history) > maxJobHistory {
+		job.history = job.history[len(job.history)-maxJobHistory:]
+	}
+}
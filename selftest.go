@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"shopping-cart-service/cartclient"
+	"shopping-cart-service/config"
+)
+
+// selfTestTimeout bounds each self-test step
+const selfTestTimeout = 10 * time.Second
+
+// selfTestStep is one check of the self-test
+type selfTestStep struct {
+	name string
+	run  func(ctx context.Context) (detail string, err error)
+	flow bool // part of the cart flow, skipped once an earlier step failed
+}
+
+// selfTest holds the state shared by the self-test steps
+type selfTest struct {
+	cfg     *config.Config
+	service *CartService
+	baseURL string
+	opsURL  string // probes and metrics, baseURL unless they have their own port
+	http    *http.Client
+	client  *cartclient.Client
+	userID  string
+	product cartclient.Product
+}
+
+// runSelfTest serves the HTTP API on a loopback port, drives a scripted
+// cart flow through it, checks metrics exposition and exporter
+// connectivity, and prints a report. It returns an error when any step
+// fails, so a deployment can gate on the exit status. The server and
+// service are shut down either way.
+func runSelfTest(ctx context.Context, cfg *config.Config, server *MetricsServer, service *CartService) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	go server.server.Serve(listener)
+	opsURL := "http://" + listener.Addr().String()
+	if server.ops != nil {
+		opsListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		go server.ops.Serve(opsListener)
+		opsURL = "http://" + opsListener.Addr().String()
+	}
+
+	st := &selfTest{
+		cfg:     cfg,
+		service: service,
+		baseURL: "http://" + listener.Addr().String(),
+		opsURL:  opsURL,
+		http:    &http.Client{Timeout: selfTestTimeout},
+		userID:  fmt.Sprintf("self-test-%d", time.Now().UnixNano()),
+	}
+	st.client = cartclient.New(st.baseURL,
+		cartclient.WithHTTPClient(st.http),
+		cartclient.WithAPIKey(cfg.Simulation.APIKey),
+		cartclient.WithSyntheticSource(syntheticSelfTest),
+	)
+
+	steps := []selfTestStep{
+		{"health", st.checkHealth, true},
+		{"ready", st.waitReady, true},
+		{"catalog", st.pickProduct, true},
+		{"add item", st.addItem, true},
+		{"get cart", st.getCart, true},
+		{"remove item", st.removeItem, true},
+		{"checkout", st.checkout, true},
+		{"metrics exposition", st.checkMetrics, false},
+		{"exporters", st.flushExporters, false},
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STEP\tRESULT\tDURATION\tDETAIL")
+	failed := 0
+	for _, step := range steps {
+		result, detail := "ok", ""
+		start := time.Now()
+		var err error
+		if failed > 0 && step.flow {
+			result, detail = "skipped", "an earlier step failed"
+		} else {
+			stepCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+			detail, err = step.run(stepCtx)
+			cancel()
+		}
+		if err != nil {
+			result, detail = "FAIL", err.Error()
+			failed++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", step.name, result, time.Since(start).Round(time.Millisecond), detail)
+	}
+	table.Flush()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	var errs []error
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d steps failed", failed, len(steps)))
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to stop server: %w", err))
+	}
+	if err := service.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush service: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// checkHealth expects /health to report the instance up
+func (st *selfTest) checkHealth(ctx context.Context) (string, error) {
+	status, _, err := st.get(ctx, "/health")
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("status %d", status)
+	}
+	return "", nil
+}
+
+// waitReady polls /ready until the startup dependencies have loaded
+func (st *selfTest) waitReady(ctx context.Context) (string, error) {
+	for {
+		status, body, err := st.get(ctx, "/ready")
+		if err == nil && status == http.StatusOK {
+			return "", nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("status %d: %s", status, strings.TrimSpace(body))
+			}
+			return "", err
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// pickProduct chooses an in-stock catalog product for the cart steps
+func (st *selfTest) pickProduct(ctx context.Context) (string, error) {
+	products, err := st.client.ListProducts(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, product := range products {
+		if product.Stock > 0 {
+			st.product = product
+			return product.ID, nil
+		}
+	}
+	return "", fmt.Errorf("none of %d products in stock", len(products))
+}
+
+func (st *selfTest) addItem(ctx context.Context) (string, error) {
+	item := cartclient.Item{ID: st.product.ID, Name: st.product.Name, Price: st.product.Price, Quantity: 1}
+	return st.userID, st.client.AddItem(ctx, st.userID, item)
+}
+
+func (st *selfTest) getCart(ctx context.Context) (string, error) {
+	cart, err := st.client.GetCart(ctx, st.userID)
+	if err != nil {
+		return "", err
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ID != st.product.ID {
+		return "", fmt.Errorf("cart has %d items, want only %s", len(cart.Items), st.product.ID)
+	}
+	return "", nil
+}
+
+func (st *selfTest) removeItem(ctx context.Context) (string, error) {
+	if err := st.client.RemoveItem(ctx, st.userID, st.product.ID); err != nil {
+		return "", err
+	}
+	cart, err := st.client.GetCart(ctx, st.userID)
+	if err != nil && !cartclient.IsNotFound(err) {
+		return "", err
+	}
+	if cart != nil && len(cart.Items) > 0 {
+		return "", fmt.Errorf("cart still has %d items", len(cart.Items))
+	}
+	return "", nil
+}
+
+// checkout places an order for a fresh cart with the product
+func (st *selfTest) checkout(ctx context.Context) (string, error) {
+	if _, err := st.addItem(ctx); err != nil {
+		return "", err
+	}
+	order, err := st.client.Checkout(ctx, st.userID)
+	if err != nil {
+		return "", err
+	}
+	return order.ID, nil
+}
+
+// checkMetrics expects the request metrics of the steps above on /metrics
+// when the Prometheus exporter is enabled
+func (st *selfTest) checkMetrics(ctx context.Context) (string, error) {
+	exporters := st.cfg.Telemetry.Metrics.Exporters
+	if len(exporters) > 0 && !slices.Contains(exporters, config.ExporterPrometheus) {
+		return "prometheus exporter disabled", nil
+	}
+
+	status, body, err := st.get(ctx, "/metrics")
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("status %d", status)
+	}
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds"} {
+		if !strings.Contains(body, name) {
+			return "", fmt.Errorf("%s not exposed", name)
+		}
+	}
+	return "", nil
+}
+
+// flushExporters pushes the collected metrics and spans, which fails when
+// a configured OTLP endpoint can't be reached
+func (st *selfTest) flushExporters(ctx context.Context) (string, error) {
+	if err := st.service.meterProvider.ForceFlush(ctx); err != nil {
+		return "", fmt.Errorf("metrics: %w", err)
+	}
+	if err := st.service.tracerProvider.ForceFlush(ctx); err != nil {
+		return "", fmt.Errorf("traces: %w", err)
+	}
+	endpoint := st.cfg.Telemetry.OTLPEndpoint
+	if !otlpEnabled("METRICS", st.cfg.Telemetry.MetricsEndpoint()) && !otlpEnabled("TRACES", endpoint) {
+		return "no OTLP endpoint configured", nil
+	}
+	return "flushed", nil
+}
+
+// get fetches path from the self-test server's operational endpoints
+func (st *selfTest) get(ctx context.Context, path string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, st.opsURL+path, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := st.http.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// serverTimings accumulates the phase durations of one request
+type serverTimings struct {
+	mutex     sync.Mutex
+	start     time.Time
+	durations map[string]time.Duration
+}
+
+func newServerTimings() *serverTimings {
+	return &serverTimings{start: time.Now(), durations: make(map[string]time.Duration)}
+}
+
+func (t *serverTimings) add(phase string, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.durations[phase] += d
+}
+
+// header renders the phases measured so far plus the total time, e.g.
+// "auth;dur=0.12, store;dur=1.5, total;dur=2.03"
+func (t *serverTimings) header() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var entries []string
+	for _, phase := range requestPhases {
+		if d, ok := t.durations[phase]; ok {
+			entries = append(entries, serverTimingEntry(phase, d))
+		}
+	}
+	entries = append(entries, serverTimingEntry("total", time.Since(t.start)))
+	return strings.Join(entries, ", ")
+}
+
+func serverTimingEntry(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.2f", name, float64(d.Microseconds())/1000)
+}
+
+// serverTimingProcessor feeds the durations of ended phase spans to the
+// Server-Timing of the request they were started in. Only recorded spans
+// are seen, so requests the sampler drops report just their total.
+type serverTimingProcessor struct {
+	pending sync.Map // span ID -> *serverTimings
+}
+
+func (p *serverTimingProcessor) OnStart(parent context.Context, span sdktrace.ReadWriteSpan) {
+	info := requestInfoFrom(parent)
+	if info == nil || info.Timings == nil {
+		return
+	}
+	for _, attr := range span.Attributes() {
+		if attr.Key == phaseKey {
+			p.pending.Store(span.SpanContext().SpanID(), info.Timings)
+			return
+		}
+	}
+}
+
+func (p *serverTimingProcessor) OnEnd(span sdktrace.ReadOnlySpan) {
+	timings, ok := p.pending.LoadAndDelete(span.SpanContext().SpanID())
+	if !ok {
+		return
+	}
+	for _, attr := range span.Attributes() {
+		if attr.Key == phaseKey {
+			timings.(*serverTimings).add(attr.Value.AsString(), span.EndTime().Sub(span.StartTime()))
+			return
+		}
+	}
+}
+
+func (p *serverTimingProcessor) Shutdown(context.Context) error   { return nil }
+func (p *serverTimingProcessor) ForceFlush(context.Context) error { return nil }
+
+// withServerTiming adds a Server-Timing header to the response, written
+// with the phases that finished before the response headers were sent
+func withServerTiming(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r.Context())
+		if info == nil {
+			handler(w, r)
+			return
+		}
+		info.Timings = newServerTimings()
+		handler(&serverTimingWriter{ResponseWriter: w, timings: info.Timings}, r)
+	}
+}
+
+// serverTimingWriter sets the Server-Timing header as the response headers
+// are sent
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timings     *serverTimings
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timings.header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// event streams
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeJSON encodes v as the response body, timing the encoding as the
+// serialization phase. The body is encoded before anything is written, so
+// the phase makes it into Server-Timing.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	_, span := startPhaseSpan(r.Context(), phaseSerialization, "encode", "response.encode")
+	body, err := json.Marshal(v)
+	endSpan(span, err)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
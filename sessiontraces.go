@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sessionHeader carries the client's session ID, e.g. a cookie value the
+// frontend forwards
+const sessionHeader = "X-Session-ID"
+
+// Why a session trace ended, the reason label of session_traces_total
+const (
+	sessionEndIdle     = "idle"
+	sessionEndShutdown = "shutdown"
+)
+
+// SessionTracer stitches the requests of each client session into one
+// trace: a root span per session, ended once the session goes idle, with a
+// child span per request linked to the request's own trace. Request traces
+// keep their client-propagated parents, so distributed traces still join up.
+type SessionTracer struct {
+	enabled     bool
+	idleTimeout time.Duration
+	maxSessions int
+	tracer      trace.Tracer
+
+	mutex    sync.Mutex
+	sessions map[string]*traceSession
+
+	// OpenTelemetry Metrics
+	endedCounter metric.Int64Counter         // Counter: session traces ended by reason
+	activeGauge  metric.Int64ObservableGauge // Gauge: sessions with an open root span
+}
+
+// traceSession is an open session and its root span
+type traceSession struct {
+	ctx      context.Context // carries the root span, the parent of request spans
+	root     trace.Span
+	userID   string
+	requests int
+	errors   int // requests answered with a 5xx
+	lastSeen time.Time
+}
+
+// NewSessionTracer creates a session tracer for cfg. When cfg is disabled
+// requests are traced as usual.
+func NewSessionTracer(cfg config.SessionTracesConfig) (*SessionTracer, error) {
+	meter := otel.Meter("shopping-cart-service")
+	st := &SessionTracer{
+		enabled:     cfg.Enabled,
+		idleTimeout: cfg.IdleTimeout,
+		maxSessions: cfg.MaxSessions,
+		tracer:      otel.Tracer("shopping-cart-service"),
+		sessions:    make(map[string]*traceSession),
+	}
+
+	var err error
+	st.endedCounter, err = meter.Int64Counter(
+		"session_traces_total",
+		metric.WithDescription("Total number of session traces ended by reason"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session traces counter: %w", err)
+	}
+
+	st.activeGauge, err = meter.Int64ObservableGauge(
+		"session_traces_active",
+		metric.WithDescription("Current number of sessions with an open root span"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create active session traces gauge: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			st.mutex.Lock()
+			defer st.mutex.Unlock()
+			observer.ObserveInt64(st.activeGauge, int64(len(st.sessions)))
+			return nil
+		},
+		st.activeGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register active session traces callback: %w", err)
+	}
+
+	return st, nil
+}
+
+// wrap traces a request carrying a session ID as a span of its session's
+// trace. Requests without one, or past the session limit, pass untouched.
+func (st *SessionTracer) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.Header.Get(sessionHeader)
+		if st == nil || !st.enabled || !validRequestID(sessionID) {
+			handler(w, r)
+			return
+		}
+		session, ok := st.join(sessionID, time.Now())
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		// The request's span names the session so it can be searched by;
+		// the session's span links back to the request's whole trace
+		requestSpan := trace.SpanFromContext(r.Context())
+		requestSpan.SetAttributes(attribute.String("session.id", sessionID))
+		opts := []trace.SpanStartOption{trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", endpointOf(r)),
+		)}
+		if link := requestSpan.SpanContext(); link.IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+		}
+		_, span := st.tracer.Start(session.ctx, r.Method+" "+endpointOf(r), opts...)
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(wrapped, r)
+
+		var userID string
+		if info := requestInfoFrom(r.Context()); info != nil {
+			userID = info.UserID
+			span.SetAttributes(attribute.String("request.id", info.ID))
+		}
+		span.SetAttributes(attribute.Int("http.status_code", wrapped.statusCode))
+		if wrapped.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(wrapped.statusCode))
+		}
+		span.End()
+		st.leave(sessionID, userID, wrapped.statusCode, time.Now())
+	}
+}
+
+// join returns the open session sessionID, starting its root span at now
+// when it has none. It reports false when the session limit is reached.
+func (st *SessionTracer) join(sessionID string, now time.Time) (*traceSession, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if session, ok := st.sessions[sessionID]; ok {
+		session.requests++
+		session.lastSeen = now
+		return session, true
+	}
+	if len(st.sessions) >= st.maxSessions {
+		return nil, false
+	}
+
+	ctx, root := st.tracer.Start(context.Background(), "session",
+		trace.WithNewRoot(),
+		trace.WithTimestamp(now),
+		trace.WithAttributes(attribute.String("session.id", sessionID)),
+	)
+	session := &traceSession{ctx: ctx, root: root, requests: 1, lastSeen: now}
+	st.sessions[sessionID] = session
+	return session, true
+}
+
+// leave records a finished request of sessionID, naming the session's user
+// after the first request that identifies one
+func (st *SessionTracer) leave(sessionID, userID string, statusCode int, now time.Time) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	session, ok := st.sessions[sessionID]
+	if !ok {
+		return
+	}
+	if session.userID == "" && userID != "" {
+		session.userID = userID
+		session.root.SetAttributes(attribute.String("enduser.id", userID))
+	}
+	if statusCode >= http.StatusInternalServerError {
+		session.errors++
+	}
+	session.lastSeen = now
+}
+
+// Run ends the sessions idle for longer than the idle timeout until ctx is
+// cancelled. It returns immediately when session tracing is disabled.
+func (st *SessionTracer) Run(ctx context.Context) {
+	if st == nil || !st.enabled {
+		return
+	}
+
+	ticker := time.NewTicker(max(st.idleTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ended := st.endIdle(ctx, time.Now()); ended > 0 {
+				slog.DebugContext(ctx, "Ended idle session traces", "sessions", ended)
+			}
+		}
+	}
+}
+
+// endIdle ends the sessions idle for longer than the idle timeout at now
+// and returns how many it ended
+func (st *SessionTracer) endIdle(ctx context.Context, now time.Time) int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	ended := 0
+	for sessionID, session := range st.sessions {
+		if now.Sub(session.lastSeen) > st.idleTimeout {
+			st.end(ctx, sessionID, session, sessionEndIdle, session.lastSeen)
+			ended++
+		}
+	}
+	return ended
+}
+
+// Close ends every open session, so their root spans are exported before
+// the tracer provider shuts down
+func (st *SessionTracer) Close(ctx context.Context) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	for sessionID, session := range st.sessions {
+		st.end(ctx, sessionID, session, sessionEndShutdown, now)
+	}
+}
+
+// end ends a session's root span at the given time; the caller holds the
+// mutex
+func (st *SessionTracer) end(ctx context.Context, sessionID string, session *traceSession, reason string, at time.Time) {
+	session.root.SetAttributes(
+		attribute.Int("session.requests", session.requests),
+		attribute.Int("session.errors", session.errors),
+		attribute.String("session.end_reason", reason),
+	)
+	session.root.End(trace.WithTimestamp(at))
+	delete(st.sessions, sessionID)
+	st.endedCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+}
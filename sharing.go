@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Share link lifetime bounds
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+)
+
+// Errors returned when resolving share tokens
+var (
+	ErrInvalidShareToken = errors.New("invalid share token")
+	ErrShareTokenExpired = errors.New("share token expired")
+)
+
+// CartSharer issues and verifies signed, expiring cart share tokens. Tokens
+// are self-contained (owner, its storage key and expiry are signed with
+// HMAC-SHA256), so no server-side state is needed to resolve them. The
+// storage key ties a token to the tenant and namespace it was issued in.
+type CartSharer struct {
+	secret []byte
+
+	// OpenTelemetry Metrics
+	usageCounter metric.Int64Counter // Counter: share actions by result
+}
+
+// tokenSecret returns the HMAC key for signed tokens. When secret is empty a
+// random key is generated, which invalidates issued tokens on restart.
+func tokenSecret(secret, envName string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate %s: %w", envName, err)
+	}
+	slog.Warn("Signing secret not set; signed tokens will not survive restarts", "variable", envName)
+	return key, nil
+}
+
+// signToken computes an HMAC-SHA256 token signature over payload
+func signToken(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewCartSharer creates a sharer signing with secret. When secret is empty a
+// random one is generated, which invalidates links on restart.
+func NewCartSharer(secret string) (*CartSharer, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	key, err := tokenSecret(secret, "SHARE_SECRET")
+	if err != nil {
+		return nil, err
+	}
+
+	sharer := &CartSharer{secret: key}
+
+	sharer.usageCounter, err = meter.Int64Counter(
+		"cart_shares_total",
+		metric.WithDescription("Total number of cart share link actions by action and result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cart share counter: %w", err)
+	}
+
+	return sharer, nil
+}
+
+// sign computes the token signature over the payload
+func (s *CartSharer) sign(payload string) string {
+	return signToken(s.secret, payload)
+}
+
+// Issue creates a share token for ownerID's cart in the tenant and namespace
+// of ctx, valid until expiresAt
+func (s *CartSharer) Issue(ctx context.Context, ownerID string, expiresAt time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(ownerID)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(storageKey(ctx, ownerID))) + "." +
+		strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + s.sign(payload)
+}
+
+// Resolve verifies a token and returns the cart owner it grants access to.
+// Tokens issued in another tenant or namespace than ctx's are invalid.
+func (s *CartSharer) Resolve(ctx context.Context, token string) (string, error) {
+	lastDot := strings.LastIndex(token, ".")
+	if lastDot < 0 {
+		return "", ErrInvalidShareToken
+	}
+	payload, signature := token[:lastDot], token[lastDot+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return "", ErrInvalidShareToken
+	}
+
+	fields := strings.Split(payload, ".")
+	if len(fields) != 3 {
+		return "", ErrInvalidShareToken
+	}
+	encodedOwner, encodedKey, expiryValue := fields[0], fields[1], fields[2]
+	owner, err := base64.RawURLEncoding.DecodeString(encodedOwner)
+	if err != nil {
+		return "", ErrInvalidShareToken
+	}
+	key, err := base64.RawURLEncoding.DecodeString(encodedKey)
+	if err != nil || string(key) != storageKey(ctx, string(owner)) {
+		return "", ErrInvalidShareToken
+	}
+	expiry, err := strconv.ParseInt(expiryValue, 10, 64)
+	if err != nil {
+		return "", ErrInvalidShareToken
+	}
+	if time.Now().After(time.Unix(expiry, 0)) {
+		return "", ErrShareTokenExpired
+	}
+
+	return string(owner), nil
+}
+
+// recordUsage counts a share action and its outcome
+func (s *CartSharer) recordUsage(ctx context.Context, action string, err error) {
+	result := "success"
+	switch {
+	case errors.Is(err, ErrShareTokenExpired):
+		result = "expired"
+	case errors.Is(err, ErrInvalidShareToken):
+		result = "invalid"
+	case err != nil:
+		result = "failure"
+	}
+	s.usageCounter.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.String("action", action),
+			attribute.String("result", result),
+		),
+	)
+}
+
+// CloneCart copies every item from the owner's cart into the target user's
+// cart, merging quantities of items already present
+func (cs *CartService) CloneCart(ctx context.Context, ownerID, targetID string) (*Cart, error) {
+	source, err := cs.GetCart(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range source.Items {
+		if err := cs.AddToCart(ctx, targetID, item); err != nil {
+			return nil, err
+		}
+	}
+	return cs.GetCart(ctx, targetID)
+}
+
+// writeShareTokenError maps token resolution failures to responses
+func writeShareTokenError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrShareTokenExpired) {
+		writeError(w, r, http.StatusGone, msgShareTokenExpired)
+		return
+	}
+	writeError(w, r, http.StatusForbidden, msgInvalidShareToken)
+}
+
+func (ms *MetricsServer) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID     string `json:"user_id"`
+		TTLSeconds int    `json:"ttl_seconds"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if req.TTLSeconds == 0 {
+		ttl = defaultShareTTL
+	}
+	if ttl <= 0 || ttl > maxShareTTL {
+		ms.rejectInvalidRequest(w, r, constraintViolation("ttl_seconds", msgInvalidFieldValue))
+		return
+	}
+
+	if _, err := ms.service.GetCart(r.Context(), req.UserID); err != nil {
+		ms.service.shares.recordUsage(r.Context(), "create", err)
+		ms.writeServiceError(w, r, err, req.UserID)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	token := ms.service.shares.Issue(r.Context(), req.UserID, expiresAt)
+	ms.service.shares.recordUsage(r.Context(), "create", nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": expiresAt,
+		"path":       "/cart/shared?token=" + token,
+	})
+}
+
+func (ms *MetricsServer) handleViewShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeError(w, r, http.StatusBadRequest, msgMissingParameter, "token")
+		return
+	}
+
+	ownerID, err := ms.service.shares.Resolve(r.Context(), token)
+	if err != nil {
+		ms.service.shares.recordUsage(r.Context(), "view", err)
+		writeShareTokenError(w, r, err)
+		return
+	}
+
+	cart, err := ms.service.GetCart(r.Context(), ownerID)
+	ms.service.shares.recordUsage(r.Context(), "view", err)
+	if err != nil {
+		ms.writeServiceError(w, r, err, ownerID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"read_only": true,
+		"cart":      cart,
+	})
+}
+
+func (ms *MetricsServer) handleCloneShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token  string `json:"token"`
+		UserID string `json:"user_id"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		ms.rejectInvalidRequest(w, r, err)
+		return
+	}
+	setRequestUser(r.Context(), req.UserID)
+
+	if req.Token == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("token", msgMissingFields))
+		return
+	}
+	if req.UserID == "" {
+		ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+		return
+	}
+
+	ownerID, err := ms.service.shares.Resolve(r.Context(), req.Token)
+	if err != nil {
+		ms.service.shares.recordUsage(r.Context(), "clone", err)
+		writeShareTokenError(w, r, err)
+		return
+	}
+
+	cart, err := ms.service.CloneCart(r.Context(), ownerID, req.UserID)
+	ms.service.shares.recordUsage(r.Context(), "clone", err)
+	if err != nil {
+		ms.writeServiceError(w, r, err, ownerID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Supported units, normalized to kilograms and centimetres
+var (
+	weightUnits = map[string]float64{"kg": 1, "g": 0.001, "lb": 0.45359237, "oz": 0.028349523125}
+	lengthUnits = map[string]float64{"cm": 1, "mm": 0.1, "m": 100, "in": 2.54}
+)
+
+// volumetricDivisor converts cm³ to volumetric kilograms, as used by most
+// parcel carriers
+const volumetricDivisor = 5000
+
+// Dimensions are the package dimensions of a single unit of a product
+type Dimensions struct {
+	Length float64 `json:"length"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Unit   string  `json:"unit"`
+}
+
+// validateUnits checks that a product's weight and dimensions use known,
+// consistent units
+func (p Product) validateUnits() error {
+	if p.Weight < 0 {
+		return fmt.Errorf("product %s: weight must not be negative", p.ID)
+	}
+	if p.Weight > 0 {
+		if _, ok := weightUnits[p.WeightUnit]; !ok {
+			return fmt.Errorf("product %s: unknown weight unit %q", p.ID, p.WeightUnit)
+		}
+	}
+	if d := p.Dimensions; d != nil {
+		if _, ok := lengthUnits[d.Unit]; !ok {
+			return fmt.Errorf("product %s: unknown dimension unit %q", p.ID, d.Unit)
+		}
+		if d.Length <= 0 || d.Width <= 0 || d.Height <= 0 {
+			return fmt.Errorf("product %s: dimensions must be positive", p.ID)
+		}
+	}
+	return nil
+}
+
+// weightKG returns the weight of one unit in kilograms
+func (p Product) weightKG() float64 {
+	return p.Weight * weightUnits[p.WeightUnit]
+}
+
+// volumeCM3 returns the package volume of one unit in cubic centimetres
+func (p Product) volumeCM3() float64 {
+	d := p.Dimensions
+	if d == nil {
+		return 0
+	}
+	factor := lengthUnits[d.Unit]
+	return d.Length * factor * d.Width * factor * d.Height * factor
+}
+
+// ShippingTier charges Cost for shipments up to MaxWeightKG. The last tier
+// may be open-ended (MaxWeightKG of +Inf).
+type ShippingTier struct {
+	MaxWeightKG float64 `json:"max_weight_kg"`
+	Cost        float64 `json:"cost"`
+}
+
+// defaultShippingTiers is used when SHIPPING_TIERS is not set
+const defaultShippingTiers = "1=4.99,5=9.99,20=19.99,*=39.99"
+
+// ParseShippingTiers parses "max_kg=cost,..." where "*" marks an open-ended
+// final tier
+func ParseShippingTiers(spec string) ([]ShippingTier, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = defaultShippingTiers
+	}
+
+	var tiers []ShippingTier
+	for _, entry := range strings.Split(spec, ",") {
+		maxValue, costValue, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid shipping tier %q: expected max_kg=cost", entry)
+		}
+
+		tier := ShippingTier{MaxWeightKG: math.Inf(1)}
+		if maxValue != "*" {
+			maxWeight, err := strconv.ParseFloat(maxValue, 64)
+			if err != nil || maxWeight <= 0 {
+				return nil, fmt.Errorf("invalid weight in shipping tier %q", entry)
+			}
+			tier.MaxWeightKG = maxWeight
+		}
+		cost, err := strconv.ParseFloat(costValue, 64)
+		if err != nil || cost < 0 {
+			return nil, fmt.Errorf("invalid cost in shipping tier %q", entry)
+		}
+		tier.Cost = cost
+		tiers = append(tiers, tier)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MaxWeightKG < tiers[j].MaxWeightKG
+	})
+	return tiers, nil
+}
+
+// ParseRegionShippingTiers parses per-destination tier overrides of the form
+// "US:1=5.99,*=29.99;CA:2=12.50,*=49.99", keyed by ISO country code
+func ParseRegionShippingTiers(spec string) (map[string][]ShippingTier, error) {
+	regions := make(map[string][]ShippingTier)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		region, tierSpec, found := strings.Cut(entry, ":")
+		region = strings.ToUpper(strings.TrimSpace(region))
+		if !found || !validRegion(region) || strings.TrimSpace(tierSpec) == "" {
+			return nil, fmt.Errorf("invalid regional shipping tiers %q: expected COUNTRY:max_kg=cost,...", entry)
+		}
+
+		tiers, err := ParseShippingTiers(tierSpec)
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %w", region, err)
+		}
+		regions[region] = tiers
+	}
+	return regions, nil
+}
+
+// ErrNoShippingTier is returned when a shipment exceeds every tier
+var ErrNoShippingTier = errors.New("no shipping tier for shipment weight")
+
+// ShippingEstimate is the shipping cost of a cart
+type ShippingEstimate struct {
+	ActualWeightKG     float64 `json:"actual_weight_kg"`
+	VolumetricWeightKG float64 `json:"volumetric_weight_kg"`
+	BillableWeightKG   float64 `json:"billable_weight_kg"`
+	Cost               float64 `json:"cost"`
+
+	// Region is the destination country when the tiers were chosen for
+	// a customer's address or profile region
+	Region string `json:"region,omitempty"`
+}
+
+// ShippingEstimator prices shipments by billable weight tier, optionally
+// with separate tiers per destination country
+type ShippingEstimator struct {
+	tiers       []ShippingTier
+	regionTiers map[string][]ShippingTier
+}
+
+// NewShippingEstimator creates an estimator for tiers sorted by weight.
+// regionTiers, which may be nil, override the tiers for destinations in
+// those countries.
+func NewShippingEstimator(tiers []ShippingTier, regionTiers map[string][]ShippingTier) *ShippingEstimator {
+	return &ShippingEstimator{tiers: tiers, regionTiers: regionTiers}
+}
+
+// Estimate prices a shipment of the given actual weight and package volume
+// to region, which may be empty when the destination is unknown. The
+// billable weight is the greater of actual and volumetric weight.
+func (se *ShippingEstimator) Estimate(region string, weightKG, volumeCM3 float64) (*ShippingEstimate, error) {
+	estimate := &ShippingEstimate{
+		ActualWeightKG:     math.Round(weightKG*1000) / 1000,
+		VolumetricWeightKG: math.Round(volumeCM3/volumetricDivisor*1000) / 1000,
+		Region:             region,
+	}
+	estimate.BillableWeightKG = math.Max(estimate.ActualWeightKG, estimate.VolumetricWeightKG)
+
+	tiers, regional := se.regionTiers[region]
+	if !regional {
+		tiers = se.tiers
+	}
+	for _, tier := range tiers {
+		if estimate.BillableWeightKG <= tier.MaxWeightKG {
+			estimate.Cost = tier.Cost
+			return estimate, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %.3fkg", ErrNoShippingTier, estimate.BillableWeightKG)
+}
+
+// priceCart computes cart totals including shipping to region. Items that
+// are not in the catalog have no known weight and ship free.
+func (cs *CartService) priceCart(ctx context.Context, cart *Cart, region string) (*CartTotals, error) {
+	totals := cs.pricing.Price(ctx, cart)
+	if cs.featuresFor(ctx).Enabled(featureCartRulePricing, cart.UserID) {
+		cs.cartRulesFor(ctx).applyDiscounts(ctx, cart, totals)
+	}
+	cs.extensions.adjustPrices(ctx, cart, totals)
+
+	weight, volume := 0.0, 0.0
+	for _, item := range cart.Items {
+		product, err := cs.catalogFor(ctx).Get(item.ID)
+		if err != nil {
+			continue
+		}
+		weight += product.weightKG() * float64(item.Quantity)
+		volume += product.volumeCM3() * float64(item.Quantity)
+	}
+	if weight == 0 && volume == 0 {
+		return totals, nil
+	}
+
+	estimate, err := cs.shipping.Estimate(region, weight, volume)
+	if err != nil {
+		return nil, err
+	}
+	totals.Shipping = estimate
+	totals.Total = roundCents(totals.Total + estimate.Cost)
+	return totals, nil
+}
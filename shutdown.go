@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// complete or ctx to expire, on the ops server too when there is one. Cart
+// event streams are ended first, and open session traces afterwards, before
+// the tracer provider flushes.
+func (ms *MetricsServer) Shutdown(ctx context.Context) error {
+	// Event streams never finish on their own
+	ms.service.changes.Close()
+	err := ms.server.Shutdown(ctx)
+	if ms.ops != nil {
+		err = errors.Join(err, ms.ops.Shutdown(ctx))
+	}
+	ms.sessions.Close(ctx)
+	return err
+}
+
+// Shutdown delivers the queued notifications, flushes telemetry and
+// releases the store. The meter provider is shut down before the store is
+// closed so its final collection can still read the cart gauges.
+func (cs *CartService) Shutdown(ctx context.Context) error {
+	var errs []error
+	if err := cs.notifications.Close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("notifications: %w", err))
+	}
+	if err := cs.meterProvider.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("meter provider: %w", err))
+	}
+	if err := cs.tracerProvider.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("tracer provider: %w", err))
+	}
+	if err := cs.dependencies.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cs.extensions.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cs.closeStore(); err != nil {
+		errs = append(errs, fmt.Errorf("store: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// flushTimeout bounds flushing the service once requests have drained. It
+// is separate from the drain timeout so a drain that runs out the clock
+// still leaves time to export the final telemetry.
+const flushTimeout = 5 * time.Second
+
+// serveUntilDone runs the HTTP server, and the gRPC server when not nil,
+// until one fails or ctx is cancelled, then drains in-flight requests
+// within timeout and flushes the service within flushTimeout
+func serveUntilDone(ctx context.Context, server *MetricsServer, grpcServer *GRPCServer, service *CartService, timeout time.Duration) error {
+	serveErr := make(chan error, 2)
+	go func() { serveErr <- server.Start() }()
+	if grpcServer != nil {
+		go func() { serveErr <- grpcServer.Start() }()
+	}
+
+	var failure error
+	select {
+	case err := <-serveErr:
+		if err == nil || errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		// Drain the other server before reporting the failure
+		failure = err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, draining requests", "timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := []error{failure}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+	}
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain RPCs: %w", err))
+		}
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancelFlush()
+	if err := service.Shutdown(flushCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush service: %w", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tolerances used when comparing locally computed values with SigNoz
+const (
+	selfCheckErrorRateTolerance = 0.05 // absolute difference
+	selfCheckLatencyTolerance   = 0.5  // relative difference
+)
+
+// SigNozClient queries the SigNoz query service for this service's own
+// telemetry. It is optional: the service runs normally without it.
+type SigNozClient struct {
+	baseURL     string
+	apiKey      string
+	serviceName string
+	client      *http.Client
+}
+
+// NewSigNozClient creates a client for the SigNoz query API at baseURL.
+// It returns nil when baseURL is empty, disabling the integration.
+func NewSigNozClient(baseURL, apiKey string) *SigNozClient {
+	if baseURL == "" {
+		return nil
+	}
+	return &SigNozClient{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		apiKey:      apiKey,
+		serviceName: "shopping-cart-service",
+		client:      &http.Client{Timeout: 5 * time.Second, Transport: outboundPools.transport("signoz")},
+	}
+}
+
+// queryRangeResponse is the subset of the query_range response we use
+type queryRangeResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Result []struct {
+			QueryName string `json:"queryName"`
+			Series    []struct {
+				Values []struct {
+					Timestamp int64  `json:"timestamp"`
+					Value     string `json:"value"`
+				} `json:"values"`
+			} `json:"series"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// QueryScalar evaluates a PromQL expression over the trailing minute and
+// returns the most recent value of the first series
+func (sc *SigNozClient) QueryScalar(ctx context.Context, promql string) (float64, error) {
+	end := time.Now()
+	start := end.Add(-time.Minute)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"start": start.UnixMilli(),
+		"end":   end.UnixMilli(),
+		"step":  60,
+		"compositeQuery": map[string]interface{}{
+			"queryType": "promql",
+			"panelType": "graph",
+			"promQueries": map[string]interface{}{
+				"A": map[string]interface{}{"query": promql, "disabled": false},
+			},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sc.baseURL+"/api/v3/query_range", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create query request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sc.apiKey != "" {
+		req.Header.Set("SIGNOZ-API-KEY", sc.apiKey)
+	}
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query signoz: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("signoz query returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+
+	var result queryRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to decode signoz response: %w", err)
+	}
+	if result.Status != "" && result.Status != "success" {
+		return 0, fmt.Errorf("signoz query failed: %s", result.Error)
+	}
+
+	for _, query := range result.Data.Result {
+		for _, series := range query.Series {
+			if len(series.Values) == 0 {
+				continue
+			}
+			value := series.Values[len(series.Values)-1].Value
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q in signoz response: %w", value, err)
+			}
+			return parsed, nil
+		}
+	}
+
+	return 0, errors.New("signoz query returned no data")
+}
+
+// selfCheckValues holds the telemetry values being compared
+type selfCheckValues struct {
+	ErrorRate  float64 `json:"error_rate"`
+	P99Seconds float64 `json:"p99_seconds"`
+}
+
+// remoteSelfCheck queries SigNoz for the values matching the local window
+func (sc *SigNozClient) remoteSelfCheck(ctx context.Context, window time.Duration) (selfCheckValues, error) {
+	rangeSelector := fmt.Sprintf("[%ds]", int(window.Seconds()))
+	selector := fmt.Sprintf(`{service_name="%s"}`, sc.serviceName)
+
+	errorRate, err := sc.QueryScalar(ctx, fmt.Sprintf(
+		"sum(rate(http_requests_errors_total%s%s)) / sum(rate(http_requests_total%s%s))",
+		selector, rangeSelector, selector, rangeSelector))
+	if err != nil {
+		return selfCheckValues{}, fmt.Errorf("error rate: %w", err)
+	}
+
+	p99, err := sc.QueryScalar(ctx, fmt.Sprintf(
+		"histogram_quantile(0.99, sum(rate(http_request_duration_seconds_bucket%s%s)) by (le))",
+		selector, rangeSelector))
+	if err != nil {
+		return selfCheckValues{}, fmt.Errorf("p99 latency: %w", err)
+	}
+
+	return selfCheckValues{ErrorRate: errorRate, P99Seconds: p99}, nil
+}
+
+func (ms *MetricsServer) handleSelfCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	snapshot := ms.service.window.Snapshot()
+	local := selfCheckValues{
+		ErrorRate:  snapshot.ErrorRate(),
+		P99Seconds: snapshot.Quantile(0.99),
+	}
+	if math.IsNaN(local.P99Seconds) {
+		local.P99Seconds = 0
+	}
+
+	response := map[string]interface{}{
+		"window_seconds": snapshot.Window.Seconds(),
+		"requests":       snapshot.Requests,
+		"local":          local,
+	}
+
+	if ms.signoz == nil {
+		response["status"] = "disabled"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	remote, err := ms.signoz.remoteSelfCheck(ctx, snapshot.Window)
+	if err != nil {
+		slog.WarnContext(ctx, "SigNoz self-check query failed", "error", err)
+		response["status"] = "unavailable"
+		response["error"] = "SigNoz query failed; see the service logs"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	diff := selfCheckValues{
+		ErrorRate:  remote.ErrorRate - local.ErrorRate,
+		P99Seconds: remote.P99Seconds - local.P99Seconds,
+	}
+
+	status := "ok"
+	if math.Abs(diff.ErrorRate) > selfCheckErrorRateTolerance {
+		status = "mismatch"
+	}
+	if local.P99Seconds > 0 && math.Abs(diff.P99Seconds)/local.P99Seconds > selfCheckLatencyTolerance {
+		status = "mismatch"
+	}
+
+	response["remote"] = remote
+	response["diff"] = diff
+	response["status"] = status
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
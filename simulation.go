@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"shopping-cart-service/cartclient"
+	"shopping-cart-service/config"
+	"shopping-cart-service/loadgen"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// newLoadGenerator creates the traffic generator for the simulation
+// settings. Its requests are traced, identify as synthetic simulator
+// traffic and honor server backoff signals so it doesn't hammer endpoints
+// that are throttling or failing.
+func newLoadGenerator(cfg *config.Config) (*loadgen.Generator, error) {
+	transport := otelhttp.NewTransport(&clientHeaderTransport{
+		next:      cartclient.NewBackoffTransport(outboundPools.transport("simulator")),
+		userAgent: simulatorUserAgent,
+		version:   simulatorVersion,
+		apiKey:    cfg.Simulation.APIKey,
+		synthetic: syntheticSimulator,
+	})
+
+	generator, err := loadgen.New(cfg.SimulationTarget(), transport, loadgen.Config{
+		Enabled:   cfg.Simulation.Enabled,
+		Profile:   cfg.Simulation.Profile,
+		TargetRPS: cfg.Simulation.TargetRPS,
+		Users:     cfg.Simulation.Users,
+		ErrorRate: cfg.Simulation.ErrorRate,
+		Seed:      cfg.Simulation.Seed,
+	}, cartclient.WithUserAgent(simulatorUserAgent, simulatorVersion))
+	if err != nil {
+		return nil, err
+	}
+	generator.SetOpsURL(cfg.SimulationOpsTarget(), cfg.Server.AdminToken)
+	return generator, nil
+}
+
+// handleLoadGenerator reports (GET) or changes (PUT) the built-in traffic
+// generator. A PUT body is a partial loadgen.Config applied over the
+// current one, so {"profile": "spike"} switches profiles and keeps the
+// rate, users and seed.
+func (ms *MetricsServer) handleLoadGenerator(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		config := ms.loadgen.Config()
+		if err := decodeJSONBody(r, &config); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+
+		if err := ms.loadgen.Reconfigure(config); err != nil {
+			var configErr *loadgen.ConfigError
+			if errors.As(err, &configErr) {
+				ms.rejectInvalidRequest(w, r, constraintViolation(configErr.Field, msgInvalidFieldValue))
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, msgInternalError)
+			return
+		}
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ms.loadgen.Status())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// snapshotCartStore is the in-memory store made durable by periodic
+// snapshots: every interval in which carts changed, all of them are written
+// to the snapshot file, and at startup they are loaded from it. It costs
+// nothing per mutation, unlike the write-ahead log, at the price of losing
+// the changes since the last snapshot in a crash. The file has the format
+// of the write-ahead log's snapshots, one JSON cart per line.
+type snapshotCartStore struct {
+	*memoryCartStore
+	path string
+
+	version   atomic.Int64 // bumped by every mutation
+	saved     int64        // version of the last snapshot
+	saveMutex sync.Mutex   // serializes snapshots and guards saved
+
+	lastSize    atomic.Int64 // bytes of the last snapshot
+	lastSuccess atomic.Int64 // unix time of the last snapshot, 0 before the first
+
+	stop chan struct{}
+	done chan struct{}
+
+	// OpenTelemetry Metrics
+	snapshotCounter  metric.Int64Counter     // Counter: snapshots by result
+	snapshotDuration metric.Float64Histogram // Histogram: time to write a snapshot
+}
+
+// openSnapshotCartStore loads the carts in the snapshot at path, if any,
+// and snapshots them every interval until Close
+func openSnapshotCartStore(path string, interval time.Duration) (*snapshotCartStore, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	s := &snapshotCartStore{
+		memoryCartStore: newMemoryCartStore(),
+		path:            path,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	var err error
+	s.snapshotCounter, err = meter.Int64Counter(
+		"store_snapshots_total",
+		metric.WithDescription("Total number of cart store snapshots written by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshots counter: %w", err)
+	}
+
+	s.snapshotDuration, err = meter.Float64Histogram(
+		"store_snapshot_duration_seconds",
+		metric.WithDescription("Time to encode and write a cart store snapshot"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot duration histogram: %w", err)
+	}
+
+	sizeGauge, err := meter.Int64ObservableGauge(
+		"store_snapshot_size_bytes",
+		metric.WithDescription("Size of the last cart store snapshot written"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot size gauge: %w", err)
+	}
+	lastSuccessGauge, err := meter.Int64ObservableGauge(
+		"store_snapshot_last_success_timestamp_seconds",
+		metric.WithDescription("Unix time of the last cart store snapshot written; 0 before the first"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot timestamp gauge: %w", err)
+	}
+	_, err = meter.RegisterCallback(
+		func(_ context.Context, observer metric.Observer) error {
+			observer.ObserveInt64(sizeGauge, s.lastSize.Load())
+			observer.ObserveInt64(lastSuccessGauge, s.lastSuccess.Load())
+			return nil
+		},
+		sizeGauge, lastSuccessGauge,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register snapshot metrics callback: %w", err)
+	}
+
+	if err := loadSnapshot(path, s.memoryCartStore); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		s.lastSize.Store(info.Size())
+		s.lastSuccess.Store(info.ModTime().Unix())
+	}
+	slog.Info("Restored carts from snapshot", "path", path, "carts", len(s.carts))
+
+	go s.runSnapshots(interval)
+	return s, nil
+}
+
+// Put and Delete bump the version once the change is applied, so a
+// snapshot that reads the new version also sees the change
+
+func (s *snapshotCartStore) Put(ctx context.Context, cart *Cart) error {
+	err := s.memoryCartStore.Put(ctx, cart)
+	s.version.Add(1)
+	return err
+}
+
+func (s *snapshotCartStore) Delete(ctx context.Context, userID string) error {
+	err := s.memoryCartStore.Delete(ctx, userID)
+	s.version.Add(1)
+	return err
+}
+
+// snapshot writes every cart to the snapshot file, replacing it atomically,
+// unless nothing changed since the last snapshot
+func (s *snapshotCartStore) snapshot(ctx context.Context) (err error) {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	// Mutations after this read are snapshotted next time, if not now
+	version := s.version.Load()
+	if version == s.saved {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		s.snapshotDuration.Record(ctx, time.Since(start).Seconds())
+		s.snapshotCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	}()
+
+	carts, _ := s.memoryCartStore.List(ctx)
+	var snapshot bytes.Buffer
+	encoder := json.NewEncoder(&snapshot)
+	for _, cart := range carts {
+		if err := encoder.Encode(newCartRecord(cart)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileSynced(s.path+".tmp", snapshot.Bytes()); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(s.path+".tmp", s.path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	syncDir(filepath.Dir(s.path))
+
+	s.saved = version
+	s.lastSize.Store(int64(snapshot.Len()))
+	s.lastSuccess.Store(time.Now().Unix())
+	return nil
+}
+
+// runSnapshots snapshots the carts every interval until Close
+func (s *snapshotCartStore) runSnapshots(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.snapshot(context.Background()); err != nil {
+				slog.Error("Cart store snapshot failed", "error", err)
+			}
+		}
+	}
+}
+
+// Close writes a last snapshot, so a graceful shutdown loses nothing
+func (s *snapshotCartStore) Close() error {
+	close(s.stop)
+	<-s.done
+
+	return s.snapshot(context.Background())
+}
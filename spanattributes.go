@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxSpanAttributeLength bounds enriched attribute values, so a large
+// header or body field can't bloat every span
+const maxSpanAttributeLength = 256
+
+// SpanEnricher copies configured request data, such as a tenant header or
+// a JSON body field, onto request spans, redacting it as configured
+type SpanEnricher struct {
+	rules []spanAttributeRule
+	json  bool // some rule reads the JSON body
+}
+
+// spanAttributeRule is a validated config.SpanAttributeConfig
+type spanAttributeRule struct {
+	source    string   // header, query or json
+	name      string   // header or query parameter name
+	path      []string // JSON body field path
+	attribute string
+	redact    string
+}
+
+// NewSpanEnricher creates an enricher for the validated mappings. Without
+// mappings requests pass untouched.
+func NewSpanEnricher(mappings []config.SpanAttributeConfig) *SpanEnricher {
+	se := &SpanEnricher{}
+	for _, mapping := range mappings {
+		source, name, _ := strings.Cut(mapping.Source, ":")
+		rule := spanAttributeRule{source: source, name: name, attribute: mapping.Attribute, redact: mapping.Redact}
+		if source == config.SpanSourceJSON {
+			rule.path = strings.Split(name, ".")
+			se.json = true
+		}
+		se.rules = append(se.rules, rule)
+	}
+	return se
+}
+
+// wrap is the enrich middleware
+func (se *SpanEnricher) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if se == nil || len(se.rules) == 0 {
+			handler(w, r)
+			return
+		}
+		span := trace.SpanFromContext(r.Context())
+		if !span.IsRecording() {
+			handler(w, r)
+			return
+		}
+
+		var body interface{}
+		if se.json {
+			body = peekJSONBody(r)
+		}
+		attributes := make([]attribute.KeyValue, 0, len(se.rules))
+		for _, rule := range se.rules {
+			if value, ok := rule.value(r, body); ok {
+				value = redactSpanValue(value, rule.redact)
+				if len(value) > maxSpanAttributeLength {
+					value = strings.ToValidUTF8(value[:maxSpanAttributeLength], "")
+				}
+				attributes = append(attributes, attribute.String(rule.attribute, value))
+			}
+		}
+		span.SetAttributes(attributes...)
+		handler(w, r)
+	}
+}
+
+// value returns the rule's value in the request, or false when the request
+// doesn't carry it
+func (rule spanAttributeRule) value(r *http.Request, body interface{}) (string, bool) {
+	var value string
+	switch rule.source {
+	case config.SpanSourceHeader:
+		value = r.Header.Get(rule.name)
+	case config.SpanSourceQuery:
+		value = r.URL.Query().Get(rule.name)
+	case config.SpanSourceJSON:
+		field, ok := jsonField(body, rule.path)
+		if !ok {
+			return "", false
+		}
+		value = field
+	}
+	return value, value != ""
+}
+
+// peekJSONBody decodes the start of a JSON request body, leaving the body
+// intact for the handler. It returns nil for other and malformed bodies.
+func peekJSONBody(r *http.Request) interface{} {
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxUserPeek))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+	if err != nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var body interface{}
+	if decoder.Decode(&body) != nil {
+		return nil
+	}
+	return body
+}
+
+// jsonField returns the scalar at path in a decoded JSON body, indexing
+// arrays by number
+func jsonField(body interface{}, path []string) (string, bool) {
+	for _, segment := range path {
+		switch node := body.(type) {
+		case map[string]interface{}:
+			body = node[segment]
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			body = node[index]
+		default:
+			return "", false
+		}
+	}
+	switch value := body.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// redactSpanValue applies a redaction to an attribute value
+func redactSpanValue(value, redact string) string {
+	switch redact {
+	case config.RedactHash:
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:8])
+	case config.RedactMask:
+		const kept = 4
+		runes := []rune(value)
+		if len(runes) <= kept {
+			return strings.Repeat("*", len(runes))
+		}
+		return strings.Repeat("*", len(runes)-kept) + string(runes[len(runes)-kept:])
+	}
+	return value
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxWindowEndpoints caps the endpoints tracked per second so unmatched
+// paths can't grow a bucket without bound; the rest count as "other"
+const maxWindowEndpoints = 100
+
+// windowBucket aggregates the requests completed within one second
+type windowBucket struct {
+	second    int64
+	requests  int64
+	errors    int64
+	latency   []int64 // counts per boundary, last entry is +Inf
+	endpoints map[string]*endpointCounts
+}
+
+// endpointCounts are the requests and errors seen for one endpoint
+type endpointCounts struct {
+	Requests int64
+	Errors   int64
+}
+
+// requestWindow keeps per-second request aggregates for a trailing window
+// so error rates and latency percentiles can be computed in-process
+type requestWindow struct {
+	size       time.Duration
+	boundaries []float64
+	buckets    []windowBucket
+	mutex      sync.Mutex
+}
+
+// windowSnapshot is a point-in-time aggregate over the whole window
+type windowSnapshot struct {
+	Window   time.Duration
+	Requests int64
+	Errors   int64
+	latency  []int64
+	bounds   []float64
+
+	endpoints map[string]*endpointCounts
+}
+
+// newRequestWindow creates a window covering size with one bucket per second
+func newRequestWindow(size time.Duration, boundaries []float64) *requestWindow {
+	seconds := int(size / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	window := &requestWindow{
+		size:       time.Duration(seconds) * time.Second,
+		boundaries: boundaries,
+		buckets:    make([]windowBucket, seconds),
+	}
+	for i := range window.buckets {
+		window.buckets[i].latency = make([]int64, len(boundaries)+1)
+	}
+	return window
+}
+
+// Record adds a completed request for endpoint to the current second's bucket
+func (rw *requestWindow) Record(endpoint string, duration time.Duration, statusCode int) {
+	now := time.Now().Unix()
+
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	bucket := &rw.buckets[now%int64(len(rw.buckets))]
+	if bucket.second != now {
+		// Bucket holds data from a previous lap of the ring; reset it
+		bucket.second = now
+		bucket.requests = 0
+		bucket.errors = 0
+		for i := range bucket.latency {
+			bucket.latency[i] = 0
+		}
+		bucket.endpoints = nil
+	}
+
+	if bucket.endpoints == nil {
+		bucket.endpoints = make(map[string]*endpointCounts)
+	}
+	counts, ok := bucket.endpoints[endpoint]
+	if !ok {
+		if len(bucket.endpoints) >= maxWindowEndpoints {
+			endpoint = "other"
+		}
+		if counts, ok = bucket.endpoints[endpoint]; !ok {
+			counts = &endpointCounts{}
+			bucket.endpoints[endpoint] = counts
+		}
+	}
+
+	bucket.requests++
+	counts.Requests++
+	if statusCode >= 400 {
+		bucket.errors++
+		counts.Errors++
+	}
+
+	seconds := duration.Seconds()
+	index := len(rw.boundaries)
+	for i, bound := range rw.boundaries {
+		if seconds <= bound {
+			index = i
+			break
+		}
+	}
+	bucket.latency[index]++
+}
+
+// Snapshot aggregates all buckets that fall inside the window
+func (rw *requestWindow) Snapshot() windowSnapshot {
+	oldest := time.Now().Unix() - int64(len(rw.buckets)) + 1
+
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	snapshot := windowSnapshot{
+		Window:    rw.size,
+		latency:   make([]int64, len(rw.boundaries)+1),
+		bounds:    rw.boundaries,
+		endpoints: make(map[string]*endpointCounts),
+	}
+	for _, bucket := range rw.buckets {
+		if bucket.second < oldest {
+			continue
+		}
+		snapshot.Requests += bucket.requests
+		snapshot.Errors += bucket.errors
+		for i, count := range bucket.latency {
+			snapshot.latency[i] += count
+		}
+		for endpoint, counts := range bucket.endpoints {
+			total, ok := snapshot.endpoints[endpoint]
+			if !ok {
+				total = &endpointCounts{}
+				snapshot.endpoints[endpoint] = total
+			}
+			total.Requests += counts.Requests
+			total.Errors += counts.Errors
+		}
+	}
+	return snapshot
+}
+
+// ErrorRate returns the fraction of requests in the window that failed
+func (ws windowSnapshot) ErrorRate() float64 {
+	if ws.Requests == 0 {
+		return 0
+	}
+	return float64(ws.Errors) / float64(ws.Requests)
+}
+
+// RequestsPerSecond returns the average request rate over the window
+func (ws windowSnapshot) RequestsPerSecond() float64 {
+	return float64(ws.Requests) / ws.Window.Seconds()
+}
+
+// Quantile estimates the q-quantile of request latency in seconds using the
+// same linear interpolation as PromQL's histogram_quantile, so local values
+// are directly comparable with those computed by the metrics backend
+func (ws windowSnapshot) Quantile(q float64) float64 {
+	var total int64
+	for _, count := range ws.latency {
+		total += count
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * float64(total)
+	var cumulative int64
+	for i, count := range ws.latency {
+		if float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+		if i == len(ws.bounds) {
+			// Falls in the +Inf bucket; report the highest finite bound
+			return ws.bounds[len(ws.bounds)-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = ws.bounds[i-1]
+		}
+		upper := ws.bounds[i]
+		if count == 0 {
+			return upper
+		}
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(count)
+	}
+
+	return ws.bounds[len(ws.bounds)-1]
+}
+
+// EndpointStats is an endpoint's share of the window
+type EndpointStats struct {
+	Endpoint          string  `json:"endpoint"`
+	Requests          int64   `json:"requests"`
+	Errors            int64   `json:"errors"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	ErrorRate         float64 `json:"error_rate"`
+}
+
+// TopEndpoints returns up to n endpoints by request count, busiest first
+func (ws windowSnapshot) TopEndpoints(n int) []EndpointStats {
+	stats := make([]EndpointStats, 0, len(ws.endpoints))
+	for endpoint, counts := range ws.endpoints {
+		entry := EndpointStats{
+			Endpoint:          endpoint,
+			Requests:          counts.Requests,
+			Errors:            counts.Errors,
+			RequestsPerSecond: float64(counts.Requests) / ws.Window.Seconds(),
+		}
+		if counts.Requests > 0 {
+			entry.ErrorRate = float64(counts.Errors) / float64(counts.Requests)
+		}
+		stats = append(stats, entry)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Endpoint < stats[j].Endpoint
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
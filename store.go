@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"shopping-cart-service/config"
+)
+
+// Storage backends selectable with CART_STORE
+const (
+	storeMemory   = "memory"
+	storeRedis    = "redis"
+	storePostgres = "postgres"
+)
+
+// ErrCartConflict is returned by stores shared between instances when a
+// cart changed between being read and written back
+var ErrCartConflict = errors.New("cart changed concurrently")
+
+// CartStore persists carts. Implementations return copies so callers may
+// modify results freely, and report missing carts with ErrCartNotFound.
+// Shared stores may refuse a Put with ErrCartConflict when the cart has
+// changed since it was read.
+type CartStore interface {
+	Get(ctx context.Context, userID string) (*Cart, error)
+	Put(ctx context.Context, cart *Cart) error
+	Delete(ctx context.Context, userID string) error
+	List(ctx context.Context) ([]*Cart, error)
+}
+
+// clone returns a copy of the cart that shares no slices with it
+func (c *Cart) clone() *Cart {
+	cartCopy := *c
+	cartCopy.Items = make([]CartItem, len(c.Items))
+	copy(cartCopy.Items, c.Items)
+	return &cartCopy
+}
+
+// tracedCartStore spans each call to the store it wraps, timing the store
+// phase as reads and writes
+type tracedCartStore struct {
+	CartStore
+}
+
+func (s tracedCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	ctx, span := startPhaseSpan(ctx, phaseStore, storeRead, "CartStore.Get")
+	cart, err := s.CartStore.Get(ctx, userID)
+	span.End() // a missing cart is an answer, not a failure
+	return cart, err
+}
+
+func (s tracedCartStore) Put(ctx context.Context, cart *Cart) error {
+	ctx, span := startPhaseSpan(ctx, phaseStore, storeWrite, "CartStore.Put")
+	err := s.CartStore.Put(ctx, cart)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedCartStore) Delete(ctx context.Context, userID string) error {
+	ctx, span := startPhaseSpan(ctx, phaseStore, storeWrite, "CartStore.Delete")
+	err := s.CartStore.Delete(ctx, userID)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedCartStore) List(ctx context.Context) ([]*Cart, error) {
+	ctx, span := startPhaseSpan(ctx, phaseStore, storeRead, "CartStore.List")
+	carts, err := s.CartStore.List(ctx)
+	endSpan(span, err)
+	return carts, err
+}
+
+// memoryCartStore keeps carts in process memory. It is the default store;
+// carts are lost on restart unless a write-ahead log is configured.
+type memoryCartStore struct {
+	carts map[string]*Cart
+	mutex sync.RWMutex
+}
+
+// newMemoryCartStore creates an empty in-memory cart store
+func newMemoryCartStore() *memoryCartStore {
+	return &memoryCartStore{carts: make(map[string]*Cart)}
+}
+
+func (s *memoryCartStore) Get(_ context.Context, userID string) (*Cart, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	cart, exists := s.carts[userID]
+	if !exists {
+		return nil, fmt.Errorf("%w for user %s", ErrCartNotFound, userID)
+	}
+	return cart.clone(), nil
+}
+
+func (s *memoryCartStore) Put(_ context.Context, cart *Cart) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.carts[cart.UserID] = cart.clone()
+	return nil
+}
+
+func (s *memoryCartStore) Delete(_ context.Context, userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.carts, userID)
+	return nil
+}
+
+func (s *memoryCartStore) List(_ context.Context) ([]*Cart, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	carts := make([]*Cart, 0, len(s.carts))
+	for _, cart := range s.carts {
+		carts = append(carts, cart.clone())
+	}
+	sort.Slice(carts, func(i, j int) bool {
+		return carts[i].UserID < carts[j].UserID
+	})
+	return carts, nil
+}
+
+// openStores opens the cart and profile stores for the configured backend.
+// The memory cart store is made durable when storage.WALDir or
+// storage.SnapshotPath is set. The
+// returned close function releases backend connections.
+func openStores(ctx context.Context, backend, redisURL string, storage config.StorageConfig, redisPool config.RedisPoolConfig) (CartStore, ProfileStore, func() error, error) {
+	switch backend {
+	case "", storeMemory:
+		if storage.WALDir != "" {
+			store, err := openWALCartStore(storage.WALDir, storage.CompactInterval, storage.WALRetention)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return store, newMemoryProfileStore(), store.Close, nil
+		}
+		if storage.SnapshotPath != "" {
+			store, err := openSnapshotCartStore(storage.SnapshotPath, storage.SnapshotInterval)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return store, newMemoryProfileStore(), store.Close, nil
+		}
+		return newMemoryCartStore(), newMemoryProfileStore(), func() error { return nil }, nil
+	case storeRedis:
+		client, err := newRedisStore(ctx, redisURL, redisPool)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &redisCartStore{client}, &redisProfileStore{client}, client.Close, nil
+	case storePostgres:
+		db, err := newPostgresStore(ctx, storage.Postgres)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &postgresCartStore{db}, &postgresProfileStore{db}, db.Close, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown CART_STORE %q: expected %s, %s or %s", backend, storeMemory, storeRedis, storePostgres)
+	}
+}
+
+// cartLocks serializes read-modify-write updates of a cart within this
+// instance. User IDs hash onto a fixed set of mutexes so updates to
+// different carts rarely contend and the set never grows.
+type cartLocks [64]sync.Mutex
+
+// lock acquires the update lock for userID and returns its release function
+func (cl *cartLocks) lock(userID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	mutex := &cl[h.Sum32()%uint32(len(cl))]
+	mutex.Lock()
+	return mutex.Unlock
+}
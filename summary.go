@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultSummaryEndpoints is how many endpoints /admin/summary lists
+const defaultSummaryEndpoints = 5
+
+// maxSummaryEndpoints bounds the top query parameter
+const maxSummaryEndpoints = 50
+
+// LatencySummary holds latency percentiles in seconds
+type LatencySummary struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// CartStats totals the active carts
+type CartStats struct {
+	Items        int     `json:"items"`         // units across all carts
+	Value        float64 `json:"value"`         // list-price value of those units
+	UpdatedToday int     `json:"updated_today"` // carts changed since the reporting day began
+	Abandoned    int     `json:"abandoned"`     // carts holding items, unchanged since before the previous reporting day began
+}
+
+// reportingDays are the starts of a tenant's current and previous
+// reporting days
+type reportingDays struct {
+	today, yesterday time.Time
+}
+
+// MetricsSummary is an at-a-glance view of service health, computed from
+// the in-process request window rather than the metrics backend
+type MetricsSummary struct {
+	GeneratedAt       time.Time       `json:"generated_at"`
+	WindowSeconds     float64         `json:"window_seconds"`
+	Requests          int64           `json:"requests"`
+	RequestsPerSecond float64         `json:"requests_per_second"`
+	ErrorRate         float64         `json:"error_rate"`
+	LatencySeconds    LatencySummary  `json:"latency_seconds"`
+	ActiveUsers       int             `json:"active_users"`
+	Carts             CartStats       `json:"carts"`
+	TopEndpoints      []EndpointStats `json:"top_endpoints"`
+}
+
+// Summary aggregates the request window and the active carts
+func (cs *CartService) Summary(ctx context.Context, topEndpoints int) (*MetricsSummary, error) {
+	carts, err := cs.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each cart's reporting days are its tenant's: the request's, or for
+	// the whole instance the one in the cart's storage key
+	now := time.Now()
+	days := make(map[string]reportingDays)
+	var stats CartStats
+	for _, cart := range carts {
+		tenant := tenantID(ctx)
+		if tenant == "" {
+			tenant = tenantOfKey(cart.UserID)
+		}
+		day, ok := days[tenant]
+		if !ok {
+			day.today, _ = cs.calendar.DayBounds(tenant, now)
+			day.yesterday, _ = cs.calendar.DayBounds(tenant, day.today.Add(-time.Nanosecond))
+			days[tenant] = day
+		}
+
+		if !cart.updatedAt.Before(day.today) {
+			stats.UpdatedToday++
+		}
+		if len(cart.Items) > 0 && !cart.updatedAt.IsZero() && cart.updatedAt.Before(day.yesterday) {
+			stats.Abandoned++
+		}
+		for _, item := range cart.Items {
+			stats.Items += item.Quantity
+			stats.Value += item.Price * float64(item.Quantity)
+		}
+	}
+
+	snapshot := cs.window.Snapshot()
+	return &MetricsSummary{
+		GeneratedAt:       now.UTC(),
+		WindowSeconds:     snapshot.Window.Seconds(),
+		Requests:          snapshot.Requests,
+		RequestsPerSecond: snapshot.RequestsPerSecond(),
+		ErrorRate:         snapshot.ErrorRate(),
+		LatencySeconds: LatencySummary{
+			P50: quantileOrZero(snapshot, 0.50),
+			P95: quantileOrZero(snapshot, 0.95),
+			P99: quantileOrZero(snapshot, 0.99),
+		},
+		ActiveUsers:  len(carts),
+		Carts:        stats,
+		TopEndpoints: snapshot.TopEndpoints(topEndpoints),
+	}, nil
+}
+
+// quantileOrZero reports 0 rather than NaN for an empty window, which JSON
+// can't encode
+func quantileOrZero(snapshot windowSnapshot, q float64) float64 {
+	value := snapshot.Quantile(q)
+	if math.IsNaN(value) {
+		return 0
+	}
+	return value
+}
+
+func (ms *MetricsServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	top := defaultSummaryEndpoints
+	if value := r.URL.Query().Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > maxSummaryEndpoints {
+			writeError(w, r, http.StatusBadRequest, msgInvalidParameter, "top")
+			return
+		}
+		top = parsed
+	}
+
+	summary, err := ms.service.Summary(r.Context(), top)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, msgInternalError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
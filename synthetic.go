@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// syntheticHeader names the source of synthetic traffic, such as the
+// traffic simulator or an external prober
+const syntheticHeader = "X-Synthetic-Source"
+
+// Traffic classes, the traffic attribute of request metrics. SLOs count
+// only user traffic.
+const (
+	trafficUser      = "user"
+	trafficSynthetic = "synthetic" // tagged by X-Synthetic-Source or sent by the simulator
+	trafficProbe     = "probe"     // health, readiness and metrics scrapes
+)
+
+// Synthetic traffic sources recognized in X-Synthetic-Source. Anything else
+// is reported as "other" so the source attribute stays low-cardinality.
+const (
+	syntheticSimulator = "simulator"
+	syntheticLoadTest  = "load-test"
+	syntheticProber    = "prober"
+	syntheticSelfTest  = "self-test"
+	syntheticWarmup    = "warmup"
+	syntheticOther     = "other"
+)
+
+var syntheticSources = map[string]bool{
+	syntheticSimulator: true,
+	syntheticLoadTest:  true,
+	syntheticProber:    true,
+	syntheticSelfTest:  true,
+	syntheticWarmup:    true,
+}
+
+// parseSyntheticSource returns the synthetic traffic source of a request,
+// empty for user traffic. Requests from the simulator count as synthetic
+// even without the header, so older simulator builds stay excluded.
+func parseSyntheticSource(r *http.Request, client clientInfo) string {
+	source := strings.ToLower(strings.TrimSpace(r.Header.Get(syntheticHeader)))
+	switch {
+	case syntheticSources[source]:
+		return source
+	case source != "":
+		return syntheticOther
+	case client.Family == clientSimulator:
+		return syntheticSimulator
+	}
+	return ""
+}
+
+// probeRoute reports whether a route serves probes and scrapes rather than
+// users
+func probeRoute(pattern string) bool {
+	return pattern == "/health" || pattern == "/ready" || pattern == "/metrics"
+}
+
+// trafficClass returns the traffic class of the request in ctx to endpoint
+func trafficClass(ctx context.Context, endpoint string) string {
+	if probeRoute(endpoint) {
+		return trafficProbe
+	}
+	if info := requestInfoFrom(ctx); info != nil && info.Synthetic != "" {
+		return trafficSynthetic
+	}
+	return trafficUser
+}
+
+// trafficAttributes returns the traffic attribute of request metrics
+func trafficAttributes(ctx context.Context, endpoint string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("traffic", trafficClass(ctx, endpoint))}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Schedule actions. Auto-checkout re-creates the template and then checks
+// out its lines.
+const (
+	scheduleActionRecreate     = "recreate"
+	scheduleActionAutoCheckout = "auto_checkout"
+)
+
+// ErrTemplateNotFound is returned for unknown templates or templates owned by
+// another user
+var ErrTemplateNotFound = errors.New("template not found")
+
+// CartTemplate is a saved snapshot of a cart that can be re-created later
+type CartTemplate struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name"`
+	Items     []CartItem `json:"items"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	owner string // storage key of the user's cart, scoping it to the tenant and namespace
+}
+
+// CartSchedule re-creates a template on a cron schedule, and with the
+// auto_checkout action checks it out
+type CartSchedule struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	TemplateID string    `json:"template_id"`
+	Cron       string    `json:"cron"`
+	Action     string    `json:"action"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// The schedule runs in the tenant and namespace it was created in
+	owner     string
+	tenant    *Tenant
+	namespace *Namespace
+}
+
+// templateStore keeps saved templates and their schedules
+type templateStore struct {
+	templates map[string]*CartTemplate
+	schedules map[string]*CartSchedule
+	mutex     sync.RWMutex
+}
+
+// newTemplateStore creates an empty template store
+func newTemplateStore() *templateStore {
+	return &templateStore{
+		templates: make(map[string]*CartTemplate),
+		schedules: make(map[string]*CartSchedule),
+	}
+}
+
+// SaveTemplate snapshots the user's current cart as a named template
+func (cs *CartService) SaveTemplate(ctx context.Context, userID, name string) (*CartTemplate, error) {
+	cart, err := cs.GetCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &CartTemplate{
+		ID:        "tpl_" + newRequestID()[:16],
+		UserID:    userID,
+		Name:      name,
+		Items:     append([]CartItem(nil), cart.Items...),
+		CreatedAt: time.Now().UTC(),
+		owner:     storageKey(ctx, userID),
+	}
+
+	cs.templates.mutex.Lock()
+	cs.templates.templates[template.ID] = template
+	cs.templates.mutex.Unlock()
+
+	return template, nil
+}
+
+// getTemplate returns a template owned by userID in the tenant and
+// namespace of ctx
+func (cs *CartService) getTemplate(ctx context.Context, userID, templateID string) (*CartTemplate, error) {
+	cs.templates.mutex.RLock()
+	defer cs.templates.mutex.RUnlock()
+
+	template, exists := cs.templates.templates[templateID]
+	if !exists || template.owner != storageKey(ctx, userID) {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, templateID)
+	}
+	return template, nil
+}
+
+// ListTemplates returns a user's templates ordered by creation time
+func (cs *CartService) ListTemplates(ctx context.Context, userID string) []CartTemplate {
+	cs.templates.mutex.RLock()
+	defer cs.templates.mutex.RUnlock()
+
+	owner := storageKey(ctx, userID)
+	var templates []CartTemplate
+	for _, template := range cs.templates.templates {
+		if template.owner == owner {
+			templates = append(templates, *template)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].CreatedAt.Before(templates[j].CreatedAt)
+	})
+	return templates
+}
+
+// RecreateFromTemplate adds a template's items back into the user's cart
+func (cs *CartService) RecreateFromTemplate(ctx context.Context, userID, templateID string) error {
+	template, err := cs.getTemplate(ctx, userID, templateID)
+	if err != nil {
+		return err
+	}
+	for _, item := range template.Items {
+		if err := cs.AddToCart(ctx, userID, item); err != nil {
+			return fmt.Errorf("failed to re-add item %s: %w", item.ID, err)
+		}
+	}
+	return nil
+}
+
+// ScheduleTemplate registers a recurring job for a template, run in the
+// tenant and namespace of ctx
+func (cs *CartService) ScheduleTemplate(ctx context.Context, userID, templateID, cronSpec, action string) (*CartSchedule, error) {
+	if _, err := cs.getTemplate(ctx, userID, templateID); err != nil {
+		return nil, err
+	}
+
+	schedule, err := ParseCronSchedule(cronSpec, cs.calendar.Location(tenantID(ctx)))
+	if err != nil {
+		return nil, err
+	}
+
+	cartSchedule := &CartSchedule{
+		ID:         "sch_" + newRequestID()[:16],
+		UserID:     userID,
+		TemplateID: templateID,
+		Cron:       cronSpec,
+		Action:     action,
+		CreatedAt:  time.Now().UTC(),
+		owner:      storageKey(ctx, userID),
+		tenant:     tenantFrom(ctx),
+		namespace:  namespaceFrom(ctx),
+	}
+
+	cs.templates.mutex.Lock()
+	cs.templates.schedules[cartSchedule.ID] = cartSchedule
+	cs.templates.mutex.Unlock()
+
+	cs.scheduler.Schedule(cartSchedule.ID, "cart_template_"+action, schedule, cronSpec, func(ctx context.Context) error {
+		ctx = withNamespace(withTenant(ctx, cartSchedule.tenant), cartSchedule.namespace)
+		return cs.runSchedule(ctx, cartSchedule)
+	})
+
+	return cartSchedule, nil
+}
+
+// runSchedule re-creates the schedule's template and, for auto-checkout,
+// checks out the template's lines, leaving anything else in the cart. ctx
+// is scoped to the schedule's tenant and namespace.
+func (cs *CartService) runSchedule(ctx context.Context, schedule *CartSchedule) error {
+	if err := cs.RecreateFromTemplate(ctx, schedule.UserID, schedule.TemplateID); err != nil {
+		return err
+	}
+	if schedule.Action != scheduleActionAutoCheckout {
+		return nil
+	}
+
+	template, err := cs.getTemplate(ctx, schedule.UserID, schedule.TemplateID)
+	if err != nil {
+		return err
+	}
+	itemIDs := make([]string, 0, len(template.Items))
+	for _, item := range template.Items {
+		itemIDs = append(itemIDs, item.ID)
+	}
+	if len(itemIDs) == 0 {
+		// No lines would check out the whole cart
+		return nil
+	}
+	order, err := cs.Checkout(ctx, schedule.UserID, CheckoutOptions{ItemIDs: itemIDs})
+	if err != nil {
+		return fmt.Errorf("failed to check out template %s: %w", schedule.TemplateID, err)
+	}
+	slog.InfoContext(ctx, "Scheduled checkout placed order", "schedule_id", schedule.ID, "user_id", schedule.UserID, "order_id", order.ID)
+	return nil
+}
+
+// ListSchedules returns a user's schedules together with their run history
+func (cs *CartService) ListSchedules(ctx context.Context, userID string) []map[string]interface{} {
+	owner := storageKey(ctx, userID)
+	cs.templates.mutex.RLock()
+	var schedules []CartSchedule
+	for _, schedule := range cs.templates.schedules {
+		if schedule.owner == owner {
+			schedules = append(schedules, *schedule)
+		}
+	}
+	cs.templates.mutex.RUnlock()
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+
+	views := make([]map[string]interface{}, 0, len(schedules))
+	for _, schedule := range schedules {
+		view := map[string]interface{}{"schedule": schedule}
+		if status, ok := cs.scheduler.Status(schedule.ID); ok {
+			view["status"] = status
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+func (ms *MetricsServer) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+			return
+		}
+		setRequestUser(r.Context(), userID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"templates": ms.service.ListTemplates(r.Context(), userID),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			UserID string `json:"user_id"`
+			Name   string `json:"name"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		setRequestUser(r.Context(), req.UserID)
+
+		if req.UserID == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+			return
+		}
+		if req.Name == "" {
+			ms.rejectInvalidRequest(w, r, constraintViolation("name", msgMissingFields))
+			return
+		}
+
+		template, err := ms.service.SaveTemplate(r.Context(), req.UserID, req.Name)
+		if err != nil {
+			ms.writeServiceError(w, r, err, req.UserID)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(template)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
+
+func (ms *MetricsServer) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeError(w, r, http.StatusBadRequest, msgMissingParameter, "user_id")
+			return
+		}
+		setRequestUser(r.Context(), userID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schedules": ms.service.ListSchedules(r.Context(), userID),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			UserID     string `json:"user_id"`
+			TemplateID string `json:"template_id"`
+			Cron       string `json:"cron"`
+			Action     string `json:"action"`
+		}
+		if err := decodeJSONBody(r, &req); err != nil {
+			ms.rejectInvalidRequest(w, r, err)
+			return
+		}
+		setRequestUser(r.Context(), req.UserID)
+
+		if req.Action == "" {
+			req.Action = scheduleActionRecreate
+		}
+		switch {
+		case req.UserID == "":
+			ms.rejectInvalidRequest(w, r, constraintViolation("user_id", msgMissingFields))
+			return
+		case req.TemplateID == "":
+			ms.rejectInvalidRequest(w, r, constraintViolation("template_id", msgMissingFields))
+			return
+		case req.Action != scheduleActionRecreate && req.Action != scheduleActionAutoCheckout:
+			ms.rejectInvalidRequest(w, r, constraintViolation("action", msgInvalidFieldValue))
+			return
+		}
+
+		schedule, err := ms.service.ScheduleTemplate(r.Context(), req.UserID, req.TemplateID, req.Cron, req.Action)
+		if errors.Is(err, ErrTemplateNotFound) {
+			writeError(w, r, http.StatusNotFound, msgTemplateNotFound, req.TemplateID)
+			return
+		}
+		if err != nil {
+			ms.rejectInvalidRequest(w, r, constraintViolation("cron", msgInvalidFieldValue))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(schedule)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"shopping-cart-service/config"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// tenantHeader names the tenant of a request; a /t/{tenant} path prefix
+// does the same and takes precedence
+const (
+	tenantHeader     = "X-Tenant-ID"
+	tenantPathPrefix = "/t/"
+)
+
+// tenantKeyPrefix starts the storage keys of tenants' carts,
+// "t:<tenant>:<user>", within their namespace's key
+const tenantKeyPrefix = "t:"
+
+// tenantOther is the tenant attribute of tenants not listed for metrics
+const tenantOther = "other"
+
+// Tenant is the customer a request is served for; each has its own carts
+type Tenant struct {
+	ID     string
+	metric string // tenant attribute value, the ID or "other"
+}
+
+// key returns the storage key of userID's cart of the tenant
+func (t *Tenant) key(userID string) string {
+	return tenantKeyPrefix + t.ID + ":" + userID
+}
+
+// userOf returns the user whose cart is stored under key, and whether the
+// key belongs to the tenant
+func (t *Tenant) userOf(key string) (string, bool) {
+	return strings.CutPrefix(key, tenantKeyPrefix+t.ID+":")
+}
+
+// Tenancy requires requests to name their tenant and scopes them to it
+type Tenancy struct {
+	metricTenants map[string]bool // tenants reported by name in metrics
+}
+
+// newTenancy creates the tenancy of cfg. It returns nil when tenancy is
+// disabled.
+func newTenancy(cfg config.TenancyConfig) *Tenancy {
+	if !cfg.Enabled {
+		return nil
+	}
+	tenancy := &Tenancy{metricTenants: make(map[string]bool, len(cfg.MetricTenants))}
+	for _, tenant := range cfg.MetricTenants {
+		tenancy.metricTenants[tenant] = true
+	}
+	return tenancy
+}
+
+// tenantOptional reports whether path may be requested without a tenant:
+// the probes, metrics, API docs and admin endpoints serve the instance
+func tenantOptional(path string) bool {
+	switch path {
+	case "/health", "/ready", "/metrics", "/openapi.json", "/docs":
+		return true
+	}
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// route serves each request for the tenant it names, stripping any
+// /t/{tenant} prefix so routing sees the usual path. Requests naming no
+// tenant are rejected with 400, except on the instance's own endpoints,
+// and so are malformed tenant IDs. With tenancy disabled requests pass
+// through unscoped.
+func (t *Tenancy) route(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(tenantHeader)
+		prefixed := false
+		if rest, found := strings.CutPrefix(r.URL.Path, tenantPathPrefix); found {
+			id, _, _ = strings.Cut(rest, "/")
+			prefixed = true
+		}
+
+		if id == "" {
+			if tenantOptional(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeError(w, r, http.StatusBadRequest, msgMissingTenant, tenantHeader)
+			return
+		}
+		if !config.ValidTenant(id) {
+			writeError(w, r, http.StatusBadRequest, msgInvalidTenant, id)
+			return
+		}
+
+		tenant := &Tenant{ID: id, metric: tenantOther}
+		if t.metricTenants[id] {
+			tenant.metric = id
+		}
+		r = r.Clone(withTenant(r.Context(), tenant))
+		if prefixed {
+			// Tenant IDs need no escaping, so the raw path has the same
+			// prefix
+			prefix := tenantPathPrefix + id
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+		}
+		w.Header().Set(tenantHeader, tenant.ID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type tenantContextKey struct{}
+
+// withTenant scopes ctx to tenant; nil leaves it unscoped
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantFrom returns the tenant ctx is scoped to, nil for background work,
+// requests to the instance's own endpoints and when tenancy is disabled
+func tenantFrom(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// tenantID returns the ID of the tenant ctx is scoped to, "" when it has none
+func tenantID(ctx context.Context) string {
+	if tenant := tenantFrom(ctx); tenant != nil {
+		return tenant.ID
+	}
+	return ""
+}
+
+// tenantOfKey returns the tenant whose cart is stored under key, a storage
+// key as unscoped calls list them, "" for carts stored without a tenant
+func tenantOfKey(key string) string {
+	if rest, found := strings.CutPrefix(key, namespaceKeyPrefix); found {
+		_, key, _ = strings.Cut(rest, ":")
+	}
+	rest, found := strings.CutPrefix(key, tenantKeyPrefix)
+	if !found {
+		return ""
+	}
+	id, _, _ := strings.Cut(rest, ":")
+	return id
+}
+
+// tenantAttributes returns the tenant attribute for the request in ctx. It
+// is omitted entirely for requests without a tenant.
+func tenantAttributes(ctx context.Context) []attribute.KeyValue {
+	tenant := tenantFrom(ctx)
+	if tenant == nil {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.String("tenant", tenant.metric)}
+}
+
+// storageKey returns the key userID's cart is stored under for the tenant
+// and namespace of ctx
+func storageKey(ctx context.Context, userID string) string {
+	key := userID
+	if tenant := tenantFrom(ctx); tenant != nil {
+		key = tenant.key(key)
+	}
+	if namespace := namespaceFrom(ctx); namespace != nil {
+		key = namespace.key(key)
+	}
+	return key
+}
+
+// tenantCartStore keeps each tenant's carts apart in the store it wraps,
+// within the namespace. Calls scoped to a tenant see only its carts, by
+// user ID; unscoped calls see every cart of the namespace by its key
+// within it.
+type tenantCartStore struct {
+	CartStore
+}
+
+func (s tenantCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	tenant := tenantFrom(ctx)
+	if tenant == nil {
+		return s.CartStore.Get(ctx, userID)
+	}
+	cart, err := s.CartStore.Get(ctx, tenant.key(userID))
+	if err != nil {
+		return nil, err
+	}
+	cart = cart.clone()
+	cart.UserID = userID
+	return cart, nil
+}
+
+func (s tenantCartStore) Put(ctx context.Context, cart *Cart) error {
+	tenant := tenantFrom(ctx)
+	if tenant == nil {
+		return s.CartStore.Put(ctx, cart)
+	}
+	stored := cart.clone()
+	stored.UserID = tenant.key(cart.UserID)
+	return s.CartStore.Put(ctx, stored)
+}
+
+func (s tenantCartStore) Delete(ctx context.Context, userID string) error {
+	tenant := tenantFrom(ctx)
+	if tenant == nil {
+		return s.CartStore.Delete(ctx, userID)
+	}
+	return s.CartStore.Delete(ctx, tenant.key(userID))
+}
+
+func (s tenantCartStore) List(ctx context.Context) ([]*Cart, error) {
+	carts, err := s.CartStore.List(ctx)
+	tenant := tenantFrom(ctx)
+	if err != nil || tenant == nil {
+		return carts, err
+	}
+
+	scoped := carts[:0]
+	for _, cart := range carts {
+		if userID, ok := tenant.userOf(cart.UserID); ok {
+			cart = cart.clone()
+			cart.UserID = userID
+			scoped = append(scoped, cart)
+		}
+	}
+	return scoped, nil
+}
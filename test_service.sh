@@ -6,6 +6,8 @@
 set -e
 
 BASE_URL="http://localhost:8080"
+OPS_URL="${OPS_URL:-http://localhost:9091}"      # /metrics, probes and /admin/
+ADMIN_TOKEN="${ADMIN_TOKEN:-}"                   # the service's ADMIN_TOKEN, for the /admin/ tests
 TEST_USER="test_user_$(date +%s)"
 
 # Colors for output
@@ -35,7 +37,7 @@ log_error() {
 # Check if service is running
 check_service() {
     log_info "Checking if service is running..."
-    if curl -s "$BASE_URL/health" > /dev/null; then
+    if curl -s "$OPS_URL/health" > /dev/null; then
         log_success "Service is running"
     else
         log_error "Service is not running. Please start the service first."
@@ -46,7 +48,7 @@ check_service() {
 # Test health endpoint
 test_health() {
     log_info "Testing health endpoint..."
-    response=$(curl -s "$BASE_URL/health")
+    response=$(curl -s "$OPS_URL/health")
     
     if echo "$response" | jq -e '.status == "healthy"' > /dev/null; then
         log_success "Health check passed"
@@ -120,6 +122,55 @@ test_add_another_item() {
     fi
 }
 
+# Test update item quantity
+test_update_quantity() {
+    log_info "Testing update item quantity..."
+    
+    response=$(curl -s -X PATCH "$BASE_URL/cart/item" \
+        -H "Content-Type: application/json" \
+        -d "{
+            \"user_id\": \"$TEST_USER\",
+            \"item_id\": \"widget_123\",
+            \"quantity\": 3
+        }")
+    
+    if echo "$response" | jq -e '.status == "success"' > /dev/null; then
+        log_success "Update item quantity passed"
+    else
+        log_error "Update item quantity failed"
+        echo "Response: $response"
+    fi
+}
+
+# Test that a retried add with the same Idempotency-Key is applied once
+test_idempotent_add() {
+    log_info "Testing idempotent add to cart..."
+    
+    key="test-$(date +%s)-$$"
+    for attempt in 1 2; do
+        curl -s -X POST "$BASE_URL/cart/add" \
+            -H "Content-Type: application/json" \
+            -H "Idempotency-Key: $key" \
+            -d "{
+                \"user_id\": \"$TEST_USER\",
+                \"item\": {
+                    \"id\": \"widget_789\",
+                    \"name\": \"Retried Widget\",
+                    \"price\": 9.99,
+                    \"quantity\": 1
+                }
+            }" > /dev/null
+    done
+    
+    response=$(curl -s "$BASE_URL/cart/get?user_id=$TEST_USER")
+    if echo "$response" | jq -e '[.items[] | select(.id == "widget_789")][0].quantity == 1' > /dev/null; then
+        log_success "Idempotent add passed"
+    else
+        log_error "Idempotent add failed"
+        echo "Response: $response"
+    fi
+}
+
 # Test remove item from cart
 test_remove_item() {
     log_info "Testing remove item from cart..."
@@ -139,6 +190,101 @@ test_remove_item() {
     fi
 }
 
+# Test the versioned REST routes and the deprecation headers of the flat ones
+test_v1_routes() {
+    log_info "Testing /v1 cart routes..."
+    
+    v1_user="${TEST_USER}_v1"
+    curl -s -X POST "$BASE_URL/v1/carts/$v1_user/items" \
+        -H "Content-Type: application/json" \
+        -d '{"id": "widget_v1", "name": "Versioned Widget", "price": 4.99, "quantity": 1}' > /dev/null
+    curl -s -X PATCH "$BASE_URL/v1/carts/$v1_user/items/widget_v1" \
+        -H "Content-Type: application/json" \
+        -d '{"quantity": 3}' > /dev/null
+    
+    response=$(curl -s "$BASE_URL/v1/carts/$v1_user")
+    if echo "$response" | jq -e '[.items[] | select(.id == "widget_v1")][0].quantity == 3' > /dev/null; then
+        log_success "/v1 add, update and get passed"
+    else
+        log_error "/v1 add, update and get failed"
+        echo "Response: $response"
+    fi
+    
+    response=$(curl -s -X DELETE "$BASE_URL/v1/carts/$v1_user/items/widget_v1")
+    if echo "$response" | jq -e '.status == "success"' > /dev/null; then
+        log_success "/v1 remove passed"
+    else
+        log_error "/v1 remove failed"
+        echo "Response: $response"
+    fi
+    
+    if curl -s -o /dev/null -D - "$BASE_URL/cart/get?user_id=$TEST_USER" | grep -qi '^Deprecation: true'; then
+        log_success "Flat routes marked deprecated"
+    else
+        log_error "Flat routes not marked deprecated"
+    fi
+}
+
+# Test limits introspection
+test_limits() {
+    log_info "Testing limits endpoint..."
+    
+    response=$(curl -s "$BASE_URL/v1/limits?user_id=$TEST_USER")
+    if echo "$response" | jq -e --arg subject "user:$TEST_USER" '.subject == $subject and (.rate_limits | type == "array") and .cart.max_idempotency_key_length > 0' > /dev/null; then
+        log_success "Limits reported"
+    else
+        log_error "Limits not reported"
+        echo "Response: $response"
+    fi
+}
+
+# Test the event consumers and the analytics projection
+test_event_consumers() {
+    log_info "Testing event consumers..."
+    
+    response=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$OPS_URL/admin/consumers")
+    if echo "$response" | jq -e '[.consumers[].name] | index("analytics") != null' > /dev/null; then
+        log_success "Event consumers listed"
+    else
+        log_error "Event consumers not listed"
+        echo "Response: $response"
+    fi
+    
+    response=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$OPS_URL/admin/analytics")
+    if echo "$response" | jq -e '[.namespaces[].units_added] | add > 0' > /dev/null; then
+        log_success "Analytics projected from cart events"
+    else
+        log_error "Analytics not projected"
+        echo "Response: $response"
+    fi
+}
+
+# Test namespace isolation (needs the service started with NAMESPACES=demo)
+test_namespaces() {
+    log_info "Testing namespaces..."
+    
+    status=$(curl -s -o /dev/null -w "%{http_code}" -H "X-Namespace: demo" "$OPS_URL/health")
+    if [ "$status" != "200" ]; then
+        log_warning "Namespace demo not configured, skipping namespace tests"
+        return
+    fi
+    
+    ns_user="${TEST_USER}_ns"
+    curl -s -X POST "$BASE_URL/ns/demo/v1/carts/$ns_user/items" \
+        -H "Content-Type: application/json" \
+        -d '{"id": "item1", "name": "Widget A", "price": 19.99, "quantity": 1}' > /dev/null
+    
+    demo=$(curl -s -o /dev/null -w "%{http_code}" -H "X-Namespace: demo" "$BASE_URL/v1/carts/$ns_user")
+    default=$(curl -s -o /dev/null -w "%{http_code}" "$BASE_URL/v1/carts/$ns_user")
+    if [ "$demo" = "200" ] && [ "$default" = "404" ]; then
+        log_success "Namespaced carts isolated"
+    else
+        log_error "Namespaced carts not isolated (demo: $demo, default: $default)"
+    fi
+    
+    curl -s -X DELETE "$BASE_URL/ns/demo/v1/carts/$ns_user/items/item1" > /dev/null
+}
+
 # Test error simulation
 test_error_simulation() {
     log_info "Testing error simulation..."
@@ -151,11 +297,35 @@ test_error_simulation() {
     log_success "Error simulation completed"
 }
 
+# Test fault injection
+test_fault_injection() {
+    log_info "Testing fault injection..."
+    
+    curl -s -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" "$OPS_URL/admin/faults" \
+        -H "Content-Type: application/json" \
+        -d '{"endpoint": "/catalog/recommendations", "error_rate": 1, "status_code": 503, "duration_seconds": 60}' > /dev/null
+    
+    status=$(curl -s -o /dev/null -w "%{http_code}" "$BASE_URL/catalog/recommendations?id=item1")
+    if [ "$status" = "503" ]; then
+        log_success "Injected fault returned 503"
+    else
+        log_error "Injected fault not applied (status: $status)"
+    fi
+    
+    curl -s -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" "$OPS_URL/admin/faults?endpoint=/catalog/recommendations" > /dev/null
+    status=$(curl -s -o /dev/null -w "%{http_code}" "$BASE_URL/catalog/recommendations?id=item1")
+    if [ "$status" = "200" ]; then
+        log_success "Fault removed"
+    else
+        log_error "Fault still applied after removal (status: $status)"
+    fi
+}
+
 # Test metrics endpoint
 test_metrics() {
     log_info "Testing metrics endpoint..."
     
-    metrics=$(curl -s "$BASE_URL/metrics")
+    metrics=$(curl -s "$OPS_URL/metrics")
     
     # Check for required metrics
     required_metrics=(
@@ -163,6 +333,9 @@ test_metrics() {
         "http_requests_errors_total"
         "http_request_duration_seconds"
         "cart_items_total"
+        "cart_value_total"
+        "cart_items_added_total"
+        "cart_size_items"
         "active_users_total"
     )
     
@@ -236,7 +409,7 @@ performance_test() {
     
     # Make 100 requests
     for i in {1..100}; do
-        curl -s "$BASE_URL/health" > /dev/null
+        curl -s "$OPS_URL/health" > /dev/null
     done
     
     end_time=$(date +%s%N)
@@ -264,7 +437,7 @@ validate_metrics_after_operations() {
     
     sleep 2 # Wait for metrics to be updated
     
-    metrics=$(curl -s "$BASE_URL/metrics")
+    metrics=$(curl -s "$OPS_URL/metrics")
     
     # Check request counts
     total_requests=$(echo "$metrics" | grep "http_requests_total" | grep -v "#" | wc -l)
@@ -311,7 +484,7 @@ validate_metrics_after_operations() {
 generate_metrics_report() {
     log_info "Generating detailed metrics report..."
     
-    metrics=$(curl -s "$BASE_URL/metrics")
+    metrics=$(curl -s "$OPS_URL/metrics")
     report_file="metrics_report_$(date +%Y%m%d_%H%M%S).txt"
     
     {
@@ -391,8 +564,15 @@ main() {
     test_add_cart
     test_get_cart
     test_add_another_item
+    test_update_quantity
+    test_idempotent_add
     test_remove_item
+    test_v1_routes
+    test_limits
+    test_event_consumers
+    test_namespaces
     test_error_simulation
+    test_fault_injection
     load_test
     performance_test
     test_metrics
@@ -416,8 +596,8 @@ main() {
     echo "✓ Load test completed"
     echo "✓ Error simulation working"
     echo ""
-    echo "View real-time metrics at: $BASE_URL/metrics"
-    echo "Service health status at: $BASE_URL/health"
+    echo "View real-time metrics at: $OPS_URL/metrics"
+    echo "Service health status at: $OPS_URL/health"
 }
 
 # Script execution
@@ -428,7 +608,8 @@ if [ "$1" == "--help" ] || [ "$1" == "-h" ]; then
     echo "including functional tests, load tests, and metrics validation."
     echo ""
     echo "Prerequisites:"
-    echo "  - Service running on localhost:8080"
+    echo "  - Service running on localhost:8080, with its ops port on localhost:9091"
+    echo "  - ADMIN_TOKEN set to the service's admin token"
     echo "  - curl and jq installed"
     echo ""
     echo "The script will:"
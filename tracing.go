@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otlpEnabled reports whether an OTLP endpoint is configured for signal
+// (TRACES or METRICS), either explicitly or through the standard
+// OTEL_EXPORTER_OTLP_* variables
+func otlpEnabled(signal, endpoint string) bool {
+	if os.Getenv("OTEL_"+signal+"_EXPORTER") == "none" {
+		return false
+	}
+	return endpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_"+signal+"_ENDPOINT") != ""
+}
+
+// otlpTarget splits a configured endpoint URL into the host:port the gRPC
+// exporters dial and whether it is plaintext. Bare host:port values keep
+// the exporter's TLS default.
+func otlpTarget(endpoint string) (host string, insecure bool) {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host, u.Scheme == "http"
+	}
+	return endpoint, false
+}
+
+// otlpTraceOptions returns the trace exporter options for an explicit
+// endpoint; without one the exporter reads OTEL_EXPORTER_OTLP_*
+func otlpTraceOptions(endpoint string) []otlptracegrpc.Option {
+	if endpoint == "" {
+		return nil
+	}
+	host, insecure := otlpTarget(endpoint)
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(host)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return opts
+}
+
+// newTracerProvider creates the service TracerProvider. Spans are batched to
+// an OTLP gRPC exporter when an endpoint is configured; the exporter dials
+// endpoint when given and otherwise reads its endpoint, headers and TLS
+// settings from the OTEL_EXPORTER_OTLP_* variables. The sampler honors
+// OTEL_TRACES_SAMPLER. Without an endpoint spans are still created so trace
+// IDs appear in request lookups and the error log.
+func newTracerProvider(ctx context.Context, res *resource.Resource, endpoint string) (*sdktrace.TracerProvider, error) {
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	if otlpEnabled("TRACES", endpoint) {
+		exporter, err := otlptracegrpc.New(ctx, otlpTraceOptions(endpoint)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+// withTracing wraps the mux with otelhttp server spans named after the
+// matched route pattern. Scrapes and health checks are not traced.
+func withTracing(mux *http.ServeMux) http.Handler {
+	return otelhttp.NewHandler(mux, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, pattern := mux.Handler(r)
+			if pattern == "" {
+				pattern = "unmatched"
+			}
+			return r.Method + " " + pattern
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/metrics" && r.URL.Path != "/health"
+		}),
+	)
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
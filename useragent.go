@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"shopping-cart-service/cartclient"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Client families recognized from User-Agent. Anything else is reported as
+// "other" so the attribute stays low-cardinality.
+const (
+	clientGoSDK     = "go-sdk"
+	clientSimulator = "simulator"
+	clientDemoUI    = "demo-ui"
+	clientBrowser   = "browser"
+	clientCurl      = "curl"
+	clientGoHTTP    = "go-http"
+	clientPython    = "python"
+	clientLoadTest  = "load-test"
+	clientBot       = "bot"
+	clientOther     = "other"
+	clientUnknown   = "unknown"
+)
+
+// Default identification for the built-in traffic simulator
+const (
+	simulatorUserAgent = "cart-simulator/1.0.0"
+	simulatorVersion   = "1.0.0"
+)
+
+// clientFamilyPrefixes maps lowercase User-Agent prefixes to families,
+// checked in order
+var clientFamilyPrefixes = []struct {
+	prefix string
+	family string
+}{
+	{"shopping-cart-go/", clientGoSDK},
+	{"cart-simulator/", clientSimulator},
+	{"cart-demo-ui/", clientDemoUI},
+	{"curl/", clientCurl},
+	{"go-http-client/", clientGoHTTP},
+	{"python-requests/", clientPython},
+	{"python-urllib/", clientPython},
+	{"k6/", clientLoadTest},
+	{"apachebench/", clientLoadTest},
+	{"wrk", clientLoadTest},
+	{"hey/", clientLoadTest},
+	{"mozilla/", clientBrowser},
+}
+
+// versionPattern extracts major.minor from a version string
+var versionPattern = regexp.MustCompile(`^v?(\d{1,3})\.(\d{1,3})`)
+
+// knownClientVersions are the major.minor versions of the SDK and the
+// simulator, the only client_version values reported. Any client can send
+// X-Client-Version, so other versions are "other" rather than new
+// attribute values.
+var knownClientVersions = map[string]bool{
+	majorMinor(cartclient.Version): true,
+	majorMinor(simulatorVersion):   true,
+}
+
+// majorMinor returns the major.minor of version, empty when it has none
+func majorMinor(version string) string {
+	match := versionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return ""
+	}
+	return match[1] + "." + match[2]
+}
+
+// clientInfo identifies the client that issued a request
+type clientInfo struct {
+	Family  string
+	Version string
+}
+
+// parseClient derives a bounded client family and major.minor version from
+// the User-Agent and X-Client-Version headers
+func parseClient(r *http.Request) clientInfo {
+	userAgent := strings.ToLower(strings.TrimSpace(r.UserAgent()))
+
+	info := clientInfo{Family: clientUnknown, Version: clientUnknown}
+	if userAgent != "" {
+		info.Family = clientOther
+		for _, candidate := range clientFamilyPrefixes {
+			if strings.HasPrefix(userAgent, candidate.prefix) {
+				info.Family = candidate.family
+				break
+			}
+		}
+		if info.Family == clientBrowser && (strings.Contains(userAgent, "bot") || strings.Contains(userAgent, "spider")) {
+			info.Family = clientBot
+		}
+	}
+
+	version := r.Header.Get("X-Client-Version")
+	if version == "" {
+		// Fall back to the product version in the User-Agent for our
+		// own clients, e.g. "shopping-cart-go/1.4.2"
+		switch info.Family {
+		case clientGoSDK, clientSimulator, clientDemoUI:
+			_, version, _ = strings.Cut(userAgent, "/")
+		}
+	}
+	if version != "" {
+		info.Version = clientOther
+		if known := majorMinor(version); knownClientVersions[known] {
+			info.Version = known
+		}
+	}
+
+	return info
+}
+
+// clientAttributes returns the client attributes for the request in ctx
+func clientAttributes(ctx context.Context) []attribute.KeyValue {
+	client := clientInfo{Family: clientUnknown, Version: clientUnknown}
+	if info := requestInfoFrom(ctx); info != nil && info.Client.Family != "" {
+		client = info.Client
+	}
+	return []attribute.KeyValue{
+		attribute.String("client_family", client.Family),
+		attribute.String("client_version", client.Version),
+	}
+}
+
+// annotateSpanWithClient stamps client attributes on the active span
+func annotateSpanWithClient(ctx context.Context) {
+	trace.SpanFromContext(ctx).SetAttributes(clientAttributes(ctx)...)
+}
+
+// clientHeaderTransport sets identification headers on outgoing requests
+type clientHeaderTransport struct {
+	next      http.RoundTripper
+	userAgent string
+	version   string
+	apiKey    string // sent in X-API-Key when set
+	synthetic string // sent in X-Synthetic-Source when set
+}
+
+// RoundTrip adds the User-Agent and X-Client-Version headers, and the API
+// key and synthetic source if any
+func (ct *clientHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", ct.userAgent)
+	}
+	if req.Header.Get("X-Client-Version") == "" {
+		req.Header.Set("X-Client-Version", ct.version)
+	}
+	if ct.apiKey != "" && req.Header.Get(apiKeyHeader) == "" {
+		req.Header.Set(apiKeyHeader, ct.apiKey)
+	}
+	if ct.synthetic != "" && req.Header.Get(syntheticHeader) == "" {
+		req.Header.Set(syntheticHeader, ct.synthetic)
+	}
+	return ct.next.RoundTrip(req)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Request decode failure reasons
+const (
+	decodeMalformedJSON       = "malformed_json"
+	decodeUnknownField        = "unknown_field"
+	decodeTypeMismatch        = "type_mismatch"
+	decodeConstraintViolation = "constraint_violation"
+)
+
+// unknownFieldLabel replaces client-supplied field names in metric
+// attributes so unknown fields can't blow up label cardinality
+const unknownFieldLabel = "_unknown"
+
+// requestDecodeError describes why a request body was rejected
+type requestDecodeError struct {
+	Reason     string
+	Field      string
+	MessageKey string
+	Err        error
+}
+
+func (e *requestDecodeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s on field %s: %v", e.Reason, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *requestDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// constraintViolation reports a field that decoded but failed validation
+func constraintViolation(field, messageKey string) *requestDecodeError {
+	return &requestDecodeError{
+		Reason:     decodeConstraintViolation,
+		Field:      field,
+		MessageKey: messageKey,
+		Err:        fmt.Errorf("invalid value for %s", field),
+	}
+}
+
+// decodeJSONBody strictly decodes a JSON request body into dst and
+// classifies any failure, then checks the user the body names against the
+// URL and the request's credentials
+func decodeJSONBody(r *http.Request, dst interface{}) error {
+	_, span := startPhaseSpan(r.Context(), phaseValidation, "decode", "request.decode")
+	defer span.End()
+
+	// The body is kept so the user it names can be checked
+	var body bytes.Buffer
+	decoder := json.NewDecoder(io.TeeReader(r.Body, &body))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dst)
+	if err == nil {
+		// Reject trailing data after the first JSON value
+		if decoder.More() {
+			return &requestDecodeError{Reason: decodeMalformedJSON, MessageKey: msgInvalidJSON, Err: errors.New("unexpected data after JSON body")}
+		}
+		return checkBodyUser(r, body.Bytes())
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		return &requestDecodeError{Reason: decodeTypeMismatch, Field: typeErr.Field, MessageKey: msgInvalidFieldType, Err: err}
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return &requestDecodeError{Reason: decodeMalformedJSON, MessageKey: msgInvalidJSON, Err: err}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &requestDecodeError{Reason: decodeUnknownField, Field: field, MessageKey: msgUnknownField, Err: err}
+	default:
+		return &requestDecodeError{Reason: decodeMalformedJSON, MessageKey: msgInvalidJSON, Err: err}
+	}
+}
+
+// validateCartItem checks the constraints on an item being added
+func validateCartItem(item CartItem) error {
+	switch {
+	case item.ID == "":
+		return constraintViolation("item.id", msgMissingFields)
+	case item.Quantity <= 0:
+		return constraintViolation("item.quantity", msgInvalidFieldValue)
+	case item.Price < 0:
+		return constraintViolation("item.price", msgInvalidFieldValue)
+	}
+	return nil
+}
+
+// recordDecodeFailure increments the decode failure counter
+func (cs *CartService) recordDecodeFailure(ctx context.Context, endpoint string, decodeErr *requestDecodeError) {
+	field := decodeErr.Field
+	if decodeErr.Reason == decodeUnknownField {
+		field = unknownFieldLabel
+	}
+
+	cs.decodeFailureCounter.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.String("endpoint", endpoint),
+			attribute.String("reason", decodeErr.Reason),
+			attribute.String("field", field),
+		),
+	)
+}
+
+// rejectInvalidRequest records a decode/validation failure and writes a
+// localized 400 response, or 403 for a body naming a user the credentials
+// can't act on
+func (ms *MetricsServer) rejectInvalidRequest(w http.ResponseWriter, r *http.Request, err error) {
+	var forbidden *forbiddenUserError
+	if errors.As(err, &forbidden) {
+		ms.auth.countFailure(r.Context(), authSubjectMismatch, endpointOf(r))
+		writeError(w, r, http.StatusForbidden, msgForbiddenUser, forbidden.UserID)
+		return
+	}
+
+	var decodeErr *requestDecodeError
+	if !errors.As(err, &decodeErr) {
+		writeError(w, r, http.StatusBadRequest, msgInvalidJSON)
+		return
+	}
+
+	ms.service.recordDecodeFailure(r.Context(), endpointOf(r), decodeErr)
+
+	// The envelope names the offending field even when the message doesn't
+	writeFieldError(w, r, http.StatusBadRequest, decodeErr.MessageKey, decodeErr.Field)
+}
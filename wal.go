@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Files in the WAL directory
+const (
+	walFileName      = "carts.wal"
+	snapshotFileName = "carts.snapshot"
+	historyDirName   = "history"
+)
+
+// historyTimeLayout names history files by compaction time. It is fixed
+// width so names sort in time order.
+const historyTimeLayout = "20060102T150405.000000000Z"
+
+// WAL operations
+const (
+	walPut    = "put"
+	walDelete = "delete"
+)
+
+// walEntry is one logged cart mutation
+type walEntry struct {
+	Op     string      `json:"op"`
+	At     time.Time   `json:"at"`
+	UserID string      `json:"user_id"`
+	Cart   *cartRecord `json:"cart,omitempty"` // for puts
+}
+
+// walCartStore is the in-memory store made durable: every mutation is
+// appended to a write-ahead log and fsynced before it is applied, and the
+// log is periodically compacted into a snapshot. At startup the snapshot
+// is loaded and the log replayed on top of it. Compacted logs and their
+// snapshots are kept in the history directory for the retention period,
+// so past states can be rebuilt (see stateAt).
+type walCartStore struct {
+	*memoryCartStore
+	dir       string
+	retention time.Duration
+
+	file         *os.File   // the open log
+	pending      int        // entries logged since the last compaction
+	logMutex     sync.Mutex // orders log appends with the in-memory updates
+	historyMutex sync.Mutex // keeps compaction from changing history while it is read
+
+	stop chan struct{}
+	done chan struct{}
+
+	// OpenTelemetry Metrics
+	appendCounter     metric.Int64Counter     // Counter: logged mutations
+	compactionCounter metric.Int64Counter     // Counter: compactions by result
+	appendLatency     metric.Float64Histogram // Histogram: append and fsync time
+}
+
+// openWALCartStore restores the carts logged in dir, creating it if needed,
+// and compacts the log every compactInterval until Close. History older
+// than retention is pruned.
+func openWALCartStore(dir string, compactInterval, retention time.Duration) (*walCartStore, error) {
+	meter := otel.Meter("shopping-cart-service")
+
+	if err := os.MkdirAll(filepath.Join(dir, historyDirName), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+
+	s := &walCartStore{
+		memoryCartStore: newMemoryCartStore(),
+		dir:             dir,
+		retention:       retention,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	var err error
+	s.appendCounter, err = meter.Int64Counter(
+		"store_wal_appends_total",
+		metric.WithDescription("Total number of cart mutations appended to the write-ahead log by operation"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL appends counter: %w", err)
+	}
+
+	s.compactionCounter, err = meter.Int64Counter(
+		"store_wal_compactions_total",
+		metric.WithDescription("Total number of write-ahead log compactions into a snapshot by result"),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL compactions counter: %w", err)
+	}
+
+	s.appendLatency, err = meter.Float64Histogram(
+		"store_wal_append_duration_seconds",
+		metric.WithDescription("Time to append and fsync a write-ahead log entry"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL append latency histogram: %w", err)
+	}
+
+	restored, replayed, err := s.restore()
+	if err != nil {
+		return nil, err
+	}
+	s.pending = replayed
+
+	s.file, err = os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	// Start from a fresh snapshot and log so a torn tail can't be appended to
+	if err := s.compact(context.Background()); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	slog.Info("Restored carts from write-ahead log", "dir", dir, "carts", restored, "replayed_entries", replayed)
+
+	go s.runCompaction(compactInterval)
+	return s, nil
+}
+
+func (s *walCartStore) Put(ctx context.Context, cart *Cart) error {
+	record := newCartRecord(cart)
+	return s.logged(ctx, walEntry{Op: walPut, UserID: cart.UserID, Cart: &record}, func() error {
+		return s.memoryCartStore.Put(ctx, cart)
+	})
+}
+
+func (s *walCartStore) Delete(ctx context.Context, userID string) error {
+	return s.logged(ctx, walEntry{Op: walDelete, UserID: userID}, func() error {
+		return s.memoryCartStore.Delete(ctx, userID)
+	})
+}
+
+// logged appends entry to the log and, once it is on disk, applies it
+func (s *walCartStore) logged(ctx context.Context, entry walEntry, apply func() error) error {
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+
+	start := time.Now()
+	entry.At = start.UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	s.appendLatency.Record(ctx, time.Since(start).Seconds())
+	s.appendCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", entry.Op)))
+	s.pending++
+
+	return apply()
+}
+
+// restore loads the snapshot and replays the log over it, returning the
+// carts restored and the log entries replayed
+func (s *walCartStore) restore() (int, int, error) {
+	if err := loadSnapshot(filepath.Join(s.dir, snapshotFileName), s.memoryCartStore); err != nil {
+		return 0, 0, err
+	}
+	replayed, torn, err := replayWAL(filepath.Join(s.dir, walFileName), func(entry walEntry) {
+		applyWALEntry(s.memoryCartStore, entry)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if torn {
+		// A crash mid-append leaves a partial last line; its mutation
+		// was never applied or acknowledged
+		slog.Warn("Discarding torn write-ahead log entry")
+	}
+	return len(s.carts), replayed, nil
+}
+
+// loadSnapshot puts every cart in the snapshot at path into carts. A
+// missing snapshot holds no carts.
+func loadSnapshot(path string, carts *memoryCartStore) error {
+	snapshot, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(snapshot))
+	for {
+		var record cartRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode snapshot %s: %w", filepath.Base(path), err)
+		}
+		carts.Put(context.Background(), record.cart())
+	}
+}
+
+// replayWAL passes each entry of the log at path to apply in order and
+// returns how many there were and whether the log ends in a partial line,
+// which is skipped. A missing log is empty.
+func replayWAL(path string, apply func(walEntry)) (int, bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer file.Close()
+
+	replayed := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return replayed, len(bytes.TrimSpace(line)) > 0, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read WAL: %w", err)
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return 0, false, fmt.Errorf("corrupt WAL entry %d in %s: %w", replayed+1, filepath.Base(path), err)
+		}
+		if (entry.Op != walPut || entry.Cart == nil) && entry.Op != walDelete {
+			return 0, false, fmt.Errorf("corrupt WAL entry %d in %s: unknown operation %q", replayed+1, filepath.Base(path), entry.Op)
+		}
+		apply(entry)
+		replayed++
+	}
+}
+
+// applyWALEntry makes the logged mutation in carts
+func applyWALEntry(carts *memoryCartStore, entry walEntry) {
+	if entry.Op == walDelete {
+		carts.Delete(context.Background(), entry.UserID)
+		return
+	}
+	carts.Put(context.Background(), entry.Cart.cart())
+}
+
+// compact writes every cart to a new snapshot and starts a new log,
+// moving the old one and a copy of the snapshot to the history. The
+// snapshot replaces the old one atomically; a crash before the log is
+// moved only replays entries the snapshot already contains.
+func (s *walCartStore) compact(ctx context.Context) (err error) {
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		s.compactionCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	}()
+
+	history := filepath.Join(s.dir, historyDirName)
+	if s.pending == 0 && s.hasHistorySnapshot() {
+		// Nothing changed since the last snapshot; drop any torn tail
+		if err := s.file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate WAL: %w", err)
+		}
+		return nil
+	}
+
+	now := time.Now().UTC()
+	carts, _ := s.memoryCartStore.List(ctx)
+	var snapshot bytes.Buffer
+	encoder := json.NewEncoder(&snapshot)
+	for _, cart := range carts {
+		if err := encoder.Encode(newCartRecord(cart)); err != nil {
+			return err
+		}
+	}
+
+	name := now.Format(historyTimeLayout)
+	if err := writeFileSynced(filepath.Join(history, name+".snapshot"), snapshot.Bytes()); err != nil {
+		return fmt.Errorf("failed to write history snapshot: %w", err)
+	}
+	path := filepath.Join(s.dir, snapshotFileName)
+	if err := writeFileSynced(path+".tmp", snapshot.Bytes()); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	syncDir(s.dir)
+
+	// The log's entries all predate the snapshot, so it moves to the
+	// history under the snapshot's name and a new one takes later entries
+	walPath := filepath.Join(s.dir, walFileName)
+	s.file.Close()
+	archiveErr := os.Rename(walPath, filepath.Join(history, name+".wal"))
+	s.file, err = os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %w", err)
+	}
+	if archiveErr != nil {
+		return fmt.Errorf("failed to archive WAL: %w", archiveErr)
+	}
+	syncDir(s.dir)
+	syncDir(history)
+	s.pending = 0
+
+	if err := s.pruneHistory(now.Add(-s.retention)); err != nil {
+		slog.WarnContext(ctx, "Failed to prune write-ahead log history", "error", err)
+	}
+	return nil
+}
+
+// historyFile is a snapshot or archived log in the history directory
+type historyFile struct {
+	name     string
+	at       time.Time // when it was compacted
+	snapshot bool      // a snapshot, else an archived log
+}
+
+// listHistory returns the history files in time order, snapshots before
+// the log archived with them. Callers must hold s.historyMutex.
+func (s *walCartStore) listHistory() ([]historyFile, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, historyDirName))
+	if err != nil {
+		return nil, err
+	}
+	var files []historyFile
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, snapshot := strings.CutSuffix(name, ".snapshot")
+		if !snapshot {
+			var archived bool
+			if stamp, archived = strings.CutSuffix(name, ".wal"); !archived {
+				continue
+			}
+		}
+		at, err := time.Parse(historyTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		files = append(files, historyFile{name: name, at: at, snapshot: snapshot})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].at.Equal(files[j].at) {
+			return files[i].at.Before(files[j].at)
+		}
+		return files[i].snapshot && !files[j].snapshot
+	})
+	return files, nil
+}
+
+// hasHistorySnapshot reports whether any snapshot has been archived.
+// Callers must hold s.historyMutex.
+func (s *walCartStore) hasHistorySnapshot() bool {
+	files, err := s.listHistory()
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		if file.snapshot {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneHistory deletes history from before horizon, keeping the newest
+// snapshot at or before it so every time since the horizon can still be
+// rebuilt. Callers must hold s.historyMutex.
+func (s *walCartStore) pruneHistory(horizon time.Time) error {
+	files, err := s.listHistory()
+	if err != nil {
+		return err
+	}
+	var keep *historyFile
+	for i, file := range files {
+		if file.snapshot && !file.at.After(horizon) {
+			keep = &files[i]
+		}
+	}
+	if keep == nil {
+		return nil
+	}
+	for _, file := range files {
+		// Older files, and the log archived with the kept snapshot, only
+		// hold changes the kept snapshot already contains
+		if file.at.Before(keep.at) || !file.snapshot && file.at.Equal(keep.at) {
+			if err := os.Remove(filepath.Join(s.dir, historyDirName, file.name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stateAt rebuilds the carts as they were at, from the newest history
+// snapshot at or before it and the logged mutations since. It returns the
+// carts, the snapshot's time and the entries replayed on top of it.
+func (s *walCartStore) stateAt(at time.Time) (*memoryCartStore, time.Time, int, error) {
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	files, err := s.listHistory()
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("failed to list WAL history: %w", err)
+	}
+	base := -1
+	for i, file := range files {
+		if file.snapshot && !file.at.After(at) {
+			base = i
+		}
+	}
+	if base < 0 {
+		for _, file := range files {
+			if file.snapshot {
+				return nil, time.Time{}, 0, fmt.Errorf("%w: history starts at %s", ErrRestoreOutOfRange, file.at.Format(time.RFC3339))
+			}
+		}
+		return nil, time.Time{}, 0, fmt.Errorf("%w: no history yet", ErrRestoreOutOfRange)
+	}
+
+	snapshotAt := files[base].at
+	carts := newMemoryCartStore()
+	if err := loadSnapshot(filepath.Join(s.dir, historyDirName, files[base].name), carts); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+
+	// Entries logged since the snapshot, up to at, are in the logs
+	// archived after it and then the open log
+	replayed := 0
+	apply := func(entry walEntry) {
+		if !entry.At.Before(snapshotAt) && !entry.At.After(at) {
+			applyWALEntry(carts, entry)
+			replayed++
+		}
+	}
+	var logs []string
+	covered := false // an archived log reaches past at
+	for _, file := range files[base+1:] {
+		if file.snapshot || !file.at.After(snapshotAt) {
+			continue
+		}
+		logs = append(logs, filepath.Join(s.dir, historyDirName, file.name))
+		if file.at.After(at) {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		logs = append(logs, filepath.Join(s.dir, walFileName))
+	}
+	for _, path := range logs {
+		// The open log may end in an entry being appended, which is
+		// after at anyway
+		if _, _, err := replayWAL(path, apply); err != nil {
+			return nil, time.Time{}, 0, err
+		}
+	}
+	return carts, snapshotAt, replayed, nil
+}
+
+// runCompaction compacts the log every interval while it has entries
+func (s *walCartStore) runCompaction(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.logMutex.Lock()
+			pending := s.pending
+			s.logMutex.Unlock()
+			if pending == 0 {
+				continue
+			}
+			if err := s.compact(context.Background()); err != nil {
+				slog.Error("Write-ahead log compaction failed", "error", err)
+			}
+		}
+	}
+}
+
+// Close compacts the log a last time, so the next start only loads the
+// snapshot, and closes it
+func (s *walCartStore) Close() error {
+	close(s.stop)
+	<-s.done
+
+	err := s.compact(context.Background())
+	return errors.Join(err, s.file.Close())
+}
+
+// syncDir fsyncs a directory so renames in it are durable
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// writeFileSynced writes data to path and fsyncs it
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
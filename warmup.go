@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"shopping-cart-service/config"
+)
+
+// warmupProducts is how many catalog products the warmup requests one by one
+const warmupProducts = 10
+
+// warmupKey marks the context of the warmup's requests, which pass the
+// readiness gate
+type warmupKey struct{}
+
+// warmupRequest reports whether ctx is a warmup request's
+func warmupRequest(ctx context.Context) bool {
+	return ctx.Value(warmupKey{}) != nil
+}
+
+// warmer readies an instance for traffic before it reports ready, so the
+// p99 of the first minutes after a deploy isn't spent on cold starts. It
+// reads the most recently changed carts through the store, filling its
+// caches and connection pools, then sends rounds of read-only requests
+// through the HTTP handler, setting up what is built on first use: metric
+// instruments, the OpenAPI document, pooled buffers and the Go heap.
+type warmer struct {
+	cfg     config.WarmupConfig
+	server  *MetricsServer
+	handler http.Handler
+	apiKey  string // sent as X-API-Key when set, for instances requiring auth
+}
+
+// newWarmer creates a warmer for server
+func newWarmer(cfg config.WarmupConfig, server *MetricsServer, apiKey string) *warmer {
+	return &warmer{cfg: cfg, server: server, handler: server.server.Handler, apiKey: apiKey}
+}
+
+// run warms the instance up until done or the warmup timeout. Warming up
+// is best effort: failures are logged and never hold readiness back.
+func (w *warmer) run(ctx context.Context) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+
+	carts, err := w.primeCarts(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Warmup failed to prime carts", "error", err)
+	}
+	requests := 0
+	for round := 0; round < w.cfg.Rounds && ctx.Err() == nil; round++ {
+		requests += w.exercise(ctx, round)
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.WarnContext(ctx, "Warmup timed out", "timeout", w.cfg.Timeout.String())
+	}
+	slog.InfoContext(ctx, "Warmup finished",
+		"carts", carts,
+		"requests", requests,
+		"duration", time.Since(start).String(),
+	)
+	return nil
+}
+
+// primeCarts reads the most recently changed carts into the store's caches
+// and returns how many were read. ctx is unscoped, so carts are read by
+// their storage keys, in every namespace.
+func (w *warmer) primeCarts(ctx context.Context) (int, error) {
+	if w.cfg.Carts == 0 {
+		return 0, nil
+	}
+	store := w.server.service.store
+	carts, err := store.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list carts: %w", err)
+	}
+	sort.Slice(carts, func(i, j int) bool { return carts[i].updatedAt.After(carts[j].updatedAt) })
+
+	primed := 0
+	for _, cart := range carts[:min(len(carts), w.cfg.Carts)] {
+		if _, err := store.Get(ctx, cart.UserID); err != nil && !errors.Is(err, ErrCartNotFound) {
+			return primed, err
+		}
+		primed++
+	}
+	return primed, nil
+}
+
+// exercise sends one round of warmup requests and returns how many were
+// sent. They only read, are tagged as synthetic warmup traffic so SLOs
+// leave them out, and ask for carts of warmup users, so no one's rate
+// limit is spent.
+func (w *warmer) exercise(ctx context.Context, round int) int {
+	paths := []string{
+		"/catalog/products",
+		fmt.Sprintf("/v1/carts/warmup-%d", round), // no such cart: the store miss and error paths
+		"/openapi.json",
+	}
+	products, _, _ := w.server.service.catalog.List("")
+	for _, product := range products[:min(len(products), warmupProducts)] {
+		paths = append(paths, "/catalog/product?id="+url.QueryEscape(product.ID))
+	}
+
+	sent := 0
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		req, err := http.NewRequestWithContext(context.WithValue(ctx, warmupKey{}, true), http.MethodGet, path, nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set(syntheticHeader, syntheticWarmup)
+		if w.apiKey != "" {
+			req.Header.Set(apiKeyHeader, w.apiKey)
+		}
+		w.handler.ServeHTTP(&warmupResponse{header: make(http.Header)}, req)
+		sent++
+	}
+	return sent
+}
+
+// warmupResponse discards the response to a warmup request
+type warmupResponse struct {
+	header http.Header
+}
+
+func (r *warmupResponse) Header() http.Header         { return r.header }
+func (r *warmupResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (r *warmupResponse) WriteHeader(int)             {}